@@ -6,6 +6,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/pem"
 	"hash/fnv"
 	"io"
@@ -121,6 +122,20 @@ func UniqueId() string {
 	return GetMd5String(base64.URLEncoding.EncodeToString(b))
 }
 
+// RandUint64 returns a nonzero random number from crypto/rand
+func RandUint64() uint64 {
+	b := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return uint64(mrand.Int63()) | 1
+		}
+		v := binary.LittleEndian.Uint64(b)
+		if v != 0 {
+			return v
+		}
+	}
+}
+
 func RandInt31n(n int) int32 {
 	ret := mrand.Int31n((int32)(n))
 	return int32(ret)
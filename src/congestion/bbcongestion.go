@@ -131,6 +131,11 @@ func (bb *BBCongestion) Update() {
 	}
 }
 
+// Window is the max bytes in flight, it is not locked, call it from the goroutine that calls Update
+func (bb *BBCongestion) Window() int {
+	return bb.maxfly
+}
+
 func (bb *BBCongestion) Info() string {
 	return fmt.Sprintf("status %v maxfly %v flyeddata %v lastratewin %v lastflyedwin %v", bb.status, bb.maxfly,
 		bb.flyeddata, bb.lastratewin, bb.lastflyedwin)
@@ -0,0 +1,730 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterWrapper("aead", func(inner Conn) Conn {
+		return &AeadConn{inner: inner}
+	}, false)
+}
+
+type AeadConfig struct {
+	Psk                string // 预共享密钥，双方都用它认证握手
+	PrivateKey         string // 服务端Ed25519私钥，hex，用GenerateAeadKey生成
+	PeerPublicKey      string // 客户端校验的服务端Ed25519公钥，hex
+	Cipher             string // chacha20-poly1305或aes-256-gcm，双方要一致
+	MaxRecordSize      int    // 可靠传输时每个加密记录的最大明文长度，加上16字节tag不能超过65535
+	MaxPacketSize      int    // 不可靠传输时最大包长度
+	ReplayWindow       int    // 不可靠传输时防重放窗口，包序号落后超过窗口的丢掉
+	HandshakeTimeoutMs int
+	HandshakeRetryMs   int // 不可靠传输时握手包重发间隔
+}
+
+func DefaultAeadConfig() *AeadConfig {
+	return &AeadConfig{
+		Cipher:             "chacha20-poly1305",
+		MaxRecordSize:      16 * 1024,
+		MaxPacketSize:      64 * 1024,
+		ReplayWindow:       1024,
+		HandshakeTimeoutMs: 10000,
+		HandshakeRetryMs:   500,
+	}
+}
+
+const (
+	aeadTypeHello    = 1
+	aeadTypeHelloRsp = 2
+	aeadTypeData     = 3
+
+	aeadMagic        = "AED1"
+	aeadHelloSize    = 1 + 4 + 32 + 32
+	aeadHelloRspSize = 1 + 4 + 32 + 32 + ed25519.SignatureSize
+	aeadPacketHead   = 1 + 8
+	aeadRecordHead   = 2
+
+	// the record length is a uint16 that counts the tag too, both ciphers have a 16 byte tag
+	aeadMaxRecordSize = 0xFFFF - chacha20poly1305.Overhead
+)
+
+// AeadConn runs an X25519 handshake authenticated by a psk or the Ed25519 key of the server, then seals every
+// record with its own nonce. Over reliable protos records are length prefixed and the nonce is implicit, over
+// packet protos every packet carries its sequence and a replay window drops old and duplicated packets.
+type AeadConn struct {
+	info      string
+	config    *AeadConfig
+	inner     Conn
+	conn      Conn
+	listener  Conn
+	reliable  bool
+	server    bool
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	sendseq   uint64
+	recvseq   uint64
+	sendlock  sync.Mutex
+	recvlock  sync.Mutex
+	readbuf   []byte
+	replay    *replayWindow
+	hello     []byte
+	hellorsp  []byte
+	hsonce    sync.Once
+	hserr     error
+	deadlinel sync.Mutex
+	readdl    time.Time
+	writedl   time.Time
+}
+
+func (c *AeadConn) Name() string {
+	return "aead+" + c.inner.Name()
+}
+
+func (c *AeadConn) Inner() Conn {
+	return c.inner
+}
+
+func (c *AeadConn) setReliable(reliable bool) {
+	c.reliable = reliable
+}
+
+func (c *AeadConn) Read(p []byte) (n int, err error) {
+	if c.conn != nil {
+		err := c.serverHandshake()
+		if err != nil {
+			return 0, err
+		}
+		if c.reliable {
+			return c.readRecord(p)
+		}
+		return c.readPacket(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *AeadConn) Write(p []byte) (n int, err error) {
+	if c.conn != nil {
+		err := c.serverHandshake()
+		if err != nil {
+			return 0, err
+		}
+		if c.reliable {
+			return c.writeRecord(p)
+		}
+		return c.writePacket(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *AeadConn) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	} else if c.listener != nil {
+		return c.listener.Close()
+	}
+	return c.inner.Close()
+}
+
+func (c *AeadConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		c.info = c.conn.LocalAddr().String() + "<--" + c.Name() + "-->" + c.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = c.Name() + "--" + c.listener.LocalAddr().String()
+	} else {
+		c.info = "empty aead conn"
+	}
+	return c.info
+}
+
+func (c *AeadConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.LocalAddr()
+	}
+	return nil
+}
+
+func (c *AeadConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *AeadConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		c.deadlinel.Lock()
+		c.readdl = t
+		c.writedl = t
+		c.deadlinel.Unlock()
+		return c.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *AeadConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		c.deadlinel.Lock()
+		c.readdl = t
+		c.deadlinel.Unlock()
+		return c.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *AeadConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		c.deadlinel.Lock()
+		c.writedl = t
+		c.deadlinel.Unlock()
+		return c.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *AeadConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *AeadConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	if c.config.Psk == "" && c.config.PeerPublicKey == "" {
+		return nil, errors.New("aead need psk or peer public key")
+	}
+	if c.config.MaxRecordSize <= 0 || c.config.MaxRecordSize > aeadMaxRecordSize {
+		return nil, errors.New("aead MaxRecordSize out of range")
+	}
+
+	inner, err := c.inner.DialContext(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &AeadConn{config: c.config, inner: inner, conn: inner, reliable: c.reliable}
+	err = u.clientHandshake(ctx)
+	if err != nil {
+		inner.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+func (c *AeadConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *AeadConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	if c.config.Psk == "" && c.config.PrivateKey == "" {
+		return nil, errors.New("aead need psk or private key")
+	}
+	if c.config.MaxRecordSize <= 0 || c.config.MaxRecordSize > aeadMaxRecordSize {
+		return nil, errors.New("aead MaxRecordSize out of range")
+	}
+
+	listener, err := c.inner.ListenContext(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AeadConn{config: c.config, inner: listener, listener: listener, reliable: c.reliable}, nil
+}
+
+func (c *AeadConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *AeadConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+
+	inner, err := c.listener.AcceptContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// handshake is done on the first Read/Write like TlsConn, so a slow client can not block Accept
+	return &AeadConn{config: c.config, inner: inner, conn: inner, reliable: c.reliable, server: true}, nil
+}
+
+func (c *AeadConn) clientHandshake(ctx context.Context) error {
+	priv, pub, err := newX25519Key()
+	if err != nil {
+		return err
+	}
+
+	hello := make([]byte, aeadHelloSize)
+	hello[0] = aeadTypeHello
+	copy(hello[1:], aeadMagic)
+	copy(hello[5:], pub)
+	if c.config.Psk != "" {
+		copy(hello[37:], aeadMac(c.config.Psk, hello[0:37]))
+	}
+
+	stop := c.handshakeDeadline(ctx)
+	rsp, err := c.exchangeHello(hello)
+	stop()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	if c.config.Psk != "" && !hmac.Equal(rsp[37:69], aeadMac(c.config.Psk, hello, rsp[0:37])) {
+		return errors.New("aead server psk mismatch")
+	}
+	if c.config.PeerPublicKey != "" {
+		peer, err := hex.DecodeString(c.config.PeerPublicKey)
+		if err != nil || len(peer) != ed25519.PublicKeySize {
+			return errors.New("aead bad peer public key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(peer), append(append([]byte{}, hello...), rsp[0:69]...), rsp[69:]) {
+			return errors.New("aead server signature mismatch")
+		}
+	}
+
+	return c.setKeys(priv, rsp[5:37], hello, rsp)
+}
+
+// exchangeHello sends the hello until the rsp comes, packet protos may lose either of them
+func (c *AeadConn) exchangeHello(hello []byte) ([]byte, error) {
+	if c.reliable {
+		_, err := c.conn.Write(hello)
+		if err != nil {
+			return nil, err
+		}
+		rsp := make([]byte, aeadHelloRspSize)
+		_, err = io.ReadFull(c.conn, rsp)
+		if err != nil {
+			return nil, err
+		}
+		if rsp[0] != aeadTypeHelloRsp || string(rsp[1:5]) != aeadMagic {
+			return nil, errors.New("aead bad hello rsp")
+		}
+		return rsp, nil
+	}
+
+	buf := make([]byte, c.config.MaxPacketSize)
+	begin := time.Now()
+	for time.Now().Sub(begin) < time.Millisecond*time.Duration(c.config.HandshakeTimeoutMs) {
+		_, err := c.conn.Write(hello)
+		if err != nil {
+			return nil, err
+		}
+		retry := time.Now().Add(time.Millisecond * time.Duration(c.config.HandshakeRetryMs))
+		for time.Now().Before(retry) {
+			c.conn.SetReadDeadline(retry)
+			n, err := c.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n == aeadHelloRspSize && buf[0] == aeadTypeHelloRsp && string(buf[1:5]) == aeadMagic {
+				return append([]byte{}, buf[0:n]...), nil
+			}
+		}
+	}
+	return nil, errors.New("aead handshake timeout")
+}
+
+func (c *AeadConn) serverHandshake() error {
+	if !c.server {
+		return nil
+	}
+	c.hsonce.Do(func() {
+		c.hserr = c.doServerHandshake()
+		if c.hserr != nil {
+			c.conn.Close()
+		}
+	})
+	return c.hserr
+}
+
+func (c *AeadConn) doServerHandshake() error {
+	stop := c.handshakeDeadline(context.Background())
+	defer stop()
+
+	hello := make([]byte, c.config.MaxPacketSize)
+	if c.reliable {
+		hello = hello[0:aeadHelloSize]
+		_, err := io.ReadFull(c.conn, hello)
+		if err != nil {
+			return err
+		}
+	} else {
+		for {
+			n, err := c.conn.Read(hello)
+			if err != nil {
+				return err
+			}
+			if n == aeadHelloSize {
+				hello = hello[0:n]
+				break
+			}
+		}
+	}
+	if hello[0] != aeadTypeHello || string(hello[1:5]) != aeadMagic {
+		return errors.New("aead bad hello")
+	}
+	if c.config.Psk != "" && !hmac.Equal(hello[37:69], aeadMac(c.config.Psk, hello[0:37])) {
+		return errors.New("aead client psk mismatch")
+	}
+
+	priv, pub, err := newX25519Key()
+	if err != nil {
+		return err
+	}
+
+	rsp := make([]byte, aeadHelloRspSize)
+	rsp[0] = aeadTypeHelloRsp
+	copy(rsp[1:], aeadMagic)
+	copy(rsp[5:], pub)
+	if c.config.Psk != "" {
+		copy(rsp[37:], aeadMac(c.config.Psk, hello, rsp[0:37]))
+	}
+	if c.config.PrivateKey != "" {
+		key, err := parseEd25519PrivateKey(c.config.PrivateKey)
+		if err != nil {
+			return err
+		}
+		copy(rsp[69:], ed25519.Sign(key, append(append([]byte{}, hello...), rsp[0:69]...)))
+	}
+
+	err = c.setKeys(priv, hello[5:37], hello, rsp)
+	if err != nil {
+		return err
+	}
+	c.hello = hello
+	c.hellorsp = rsp
+
+	_, err = c.conn.Write(rsp)
+	return err
+}
+
+// handshakeDeadline bounds the handshake, the returned func gives the user deadlines back
+func (c *AeadConn) handshakeDeadline(ctx context.Context) func() {
+	c.conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(c.config.HandshakeTimeoutMs)))
+	stop := watchContext(ctx, func() {
+		c.conn.SetDeadline(time.Now())
+	})
+	return func() {
+		stop()
+		c.deadlinel.Lock()
+		defer c.deadlinel.Unlock()
+		c.conn.SetReadDeadline(c.readdl)
+		c.conn.SetWriteDeadline(c.writedl)
+	}
+}
+
+func (c *AeadConn) setKeys(priv []byte, peer []byte, hello []byte, rsp []byte) error {
+	shared, err := curve25519.X25519(priv, peer)
+	if err != nil {
+		return err
+	}
+
+	var salt []byte
+	if c.config.Psk != "" {
+		sum := sha256.Sum256([]byte(c.config.Psk))
+		salt = sum[:]
+	}
+	transcript := sha256.Sum256(append(append([]byte{}, hello...), rsp...))
+	kdf := hkdf.New(sha256.New, shared, salt, append([]byte("aead conn "), transcript[:]...))
+
+	keys := make([]byte, 64)
+	_, err = io.ReadFull(kdf, keys)
+	if err != nil {
+		return err
+	}
+
+	c2s, err := newAead(c.config.Cipher, keys[0:32])
+	if err != nil {
+		return err
+	}
+	s2c, err := newAead(c.config.Cipher, keys[32:64])
+	if err != nil {
+		return err
+	}
+	if c.server {
+		c.send, c.recv = s2c, c2s
+	} else {
+		c.send, c.recv = c2s, s2c
+	}
+	if !c.reliable {
+		c.replay = newReplayWindow(c.config.ReplayWindow)
+	}
+	return nil
+}
+
+func (c *AeadConn) readRecord(p []byte) (int, error) {
+	c.recvlock.Lock()
+	defer c.recvlock.Unlock()
+
+	if len(c.readbuf) <= 0 {
+		head := make([]byte, aeadRecordHead)
+		_, err := io.ReadFull(c.conn, head)
+		if err != nil {
+			return 0, err
+		}
+		record := make([]byte, binary.BigEndian.Uint16(head))
+		_, err = io.ReadFull(c.conn, record)
+		if err != nil {
+			return 0, err
+		}
+		plain, err := c.recv.Open(record[:0], aeadNonce(c.recvseq), record, head)
+		if err != nil {
+			return 0, errors.New("aead record auth fail")
+		}
+		c.recvseq++
+		c.readbuf = plain
+	}
+
+	n := copy(p, c.readbuf)
+	c.readbuf = c.readbuf[n:]
+	return n, nil
+}
+
+func (c *AeadConn) writeRecord(p []byte) (int, error) {
+	c.sendlock.Lock()
+	defer c.sendlock.Unlock()
+
+	cur := 0
+	for cur < len(p) {
+		size := len(p) - cur
+		if size > c.config.MaxRecordSize {
+			size = c.config.MaxRecordSize
+		}
+		record := make([]byte, aeadRecordHead, aeadRecordHead+size+c.send.Overhead())
+		binary.BigEndian.PutUint16(record, uint16(size+c.send.Overhead()))
+		record = c.send.Seal(record, aeadNonce(c.sendseq), p[cur:cur+size], record[0:aeadRecordHead])
+		c.sendseq++
+		_, err := c.conn.Write(record)
+		if err != nil {
+			return cur, err
+		}
+		cur += size
+	}
+	return len(p), nil
+}
+
+func (c *AeadConn) readPacket(p []byte) (int, error) {
+	c.recvlock.Lock()
+	defer c.recvlock.Unlock()
+
+	buf := make([]byte, c.config.MaxPacketSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		packet := buf[0:n]
+
+		// the rsp was lost, the client sends the same hello again
+		if c.server && bytes.Equal(packet, c.hello) {
+			c.conn.Write(c.hellorsp)
+			continue
+		}
+		if n < aeadPacketHead+c.recv.Overhead() || packet[0] != aeadTypeData {
+			continue
+		}
+
+		seq := binary.BigEndian.Uint64(packet[1:aeadPacketHead])
+		if !c.replay.check(seq) {
+			continue
+		}
+		plain, err := c.recv.Open(packet[aeadPacketHead:aeadPacketHead], aeadNonce(seq), packet[aeadPacketHead:], packet[0:aeadPacketHead])
+		if err != nil {
+			continue
+		}
+		c.replay.accept(seq)
+
+		if len(plain) > len(p) {
+			return 0, errors.New("read buffer too small")
+		}
+		return copy(p, plain), nil
+	}
+}
+
+func (c *AeadConn) writePacket(p []byte) (int, error) {
+	c.sendlock.Lock()
+	seq := c.sendseq
+	c.sendseq++
+	c.sendlock.Unlock()
+
+	packet := make([]byte, aeadPacketHead, aeadPacketHead+len(p)+c.send.Overhead())
+	packet[0] = aeadTypeData
+	binary.BigEndian.PutUint64(packet[1:], seq)
+	packet = c.send.Seal(packet, aeadNonce(seq), p, packet[0:aeadPacketHead])
+	_, err := c.conn.Write(packet)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *AeadConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultAeadConfig()
+	}
+}
+
+func (c *AeadConn) SetConfig(config *AeadConfig) {
+	c.config = config
+}
+
+func (c *AeadConn) GetConfig() *AeadConfig {
+	c.checkConfig()
+	return c.config
+}
+
+// GenerateAeadKey makes an Ed25519 key pair for AeadConfig, the private key goes to the server
+func GenerateAeadKey() (string, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(pub), hex.EncodeToString(priv.Seed()), nil
+}
+
+func parseEd25519PrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(b), nil
+	}
+	if len(b) == ed25519.PrivateKeySize {
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, errors.New("aead bad private key")
+}
+
+func newX25519Key() ([]byte, []byte, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(rand.Reader, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+func newAead(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case "", "chacha20-poly1305":
+		return chacha20poly1305.New(key)
+	case "aes-256-gcm":
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, errors.New("aead unknown cipher " + name)
+}
+
+func aeadMac(psk string, data ...[]byte) []byte {
+	sum := sha256.Sum256([]byte(psk))
+	h := hmac.New(sha256.New, sum[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// each direction has its own key, so the nonce only needs the sequence
+func aeadNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+type replayWindow struct {
+	size   uint64
+	max    uint64
+	bits   []uint64
+	inited bool
+}
+
+func newReplayWindow(size int) *replayWindow {
+	if size < 64 {
+		size = 64
+	}
+	size = (size + 63) / 64 * 64
+	return &replayWindow{size: uint64(size), bits: make([]uint64, size/64)}
+}
+
+func (w *replayWindow) check(seq uint64) bool {
+	if !w.inited || seq > w.max {
+		return true
+	}
+	if w.max-seq >= w.size {
+		return false
+	}
+	i := seq % w.size
+	return w.bits[i/64]&(1<<(i%64)) == 0
+}
+
+// accept is called after the packet is authenticated, so forged sequences can not move the window
+func (w *replayWindow) accept(seq uint64) {
+	if !w.inited {
+		w.inited = true
+		w.max = seq
+	} else if seq > w.max {
+		if seq-w.max >= w.size {
+			for i := range w.bits {
+				w.bits[i] = 0
+			}
+		} else {
+			for s := w.max + 1; s <= seq; s++ {
+				i := s % w.size
+				w.bits[i/64] &^= 1 << (i % 64)
+			}
+		}
+		w.max = seq
+	}
+	i := seq % w.size
+	w.bits[i/64] |= 1 << (i % 64)
+}
@@ -0,0 +1,184 @@
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func testAeadEcho(t *testing.T, proto string, addr string, server *AeadConfig, client *AeadConfig, size int) error {
+	c, err := NewConn(proto)
+	if err != nil {
+		return err
+	}
+	c.(*AeadConn).SetConfig(server)
+
+	cc, err := c.Listen(addr)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer sonny.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := sonny.Read(buf)
+			if err != nil {
+				fmt.Println("sonny read", err)
+				return
+			}
+			sonny.Write(buf[0:n])
+		}
+	}()
+
+	d, _ := NewConn(proto)
+	d.(*AeadConn).SetConfig(client)
+	ccc, err := d.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	src := make([]byte, size)
+	for i := range src {
+		src[i] = byte(i * 7)
+	}
+	go ccc.Write(src)
+
+	dst := make([]byte, size)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error(proto + " data not match")
+	}
+	return nil
+}
+
+func Test0001AEAD(t *testing.T) {
+	server := DefaultAeadConfig()
+	server.Psk = "123456"
+	client := DefaultAeadConfig()
+	client.Psk = "123456"
+	err := testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 1024*1024)
+	if err != nil {
+		t.Error(err)
+	}
+
+	server.Cipher = "aes-256-gcm"
+	client.Cipher = "aes-256-gcm"
+	err = testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 100*1024)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the biggest record still fits the uint16 length with its tag
+	server.MaxRecordSize = aeadMaxRecordSize
+	client.MaxRecordSize = aeadMaxRecordSize
+	err = testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 1024*1024)
+	if err != nil {
+		t.Error(err)
+	}
+
+	server.MaxRecordSize = 64 * 1024
+	err = testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 1024)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("oversized record should fail")
+	}
+	server.MaxRecordSize = aeadMaxRecordSize
+	client.MaxRecordSize = 0
+	err = testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 1024)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("empty record should fail")
+	}
+	client.MaxRecordSize = aeadMaxRecordSize
+
+	client.Psk = "654321"
+	err = testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 1024)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("wrong psk should fail")
+	}
+}
+
+func Test0002AEAD(t *testing.T) {
+	pub, priv, err := GenerateAeadKey()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := DefaultAeadConfig()
+	server.PrivateKey = priv
+	client := DefaultAeadConfig()
+	client.PeerPublicKey = pub
+	err = testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 100*1024)
+	if err != nil {
+		t.Error(err)
+	}
+
+	other, _, _ := GenerateAeadKey()
+	client.PeerPublicKey = other
+	err = testAeadEcho(t, "aead+tcp", "127.0.0.1:58102", server, client, 1024)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("wrong server key should fail")
+	}
+
+	_, err = NewConn("aead+udp")
+	if err != nil {
+		t.Error(err)
+	}
+	c, _ := NewConn("aead+tcp")
+	_, err = c.Dial("127.0.0.1:58102")
+	fmt.Println(err)
+	if err == nil {
+		t.Error("aead without key should fail")
+	}
+}
+
+func Test0003AEAD(t *testing.T) {
+	server := DefaultAeadConfig()
+	server.Psk = "123456"
+	client := DefaultAeadConfig()
+	client.Psk = "123456"
+	err := testAeadEcho(t, "aead+udp", "127.0.0.1:58103", server, client, 1000)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = testAeadEcho(t, "aead+rudp", "127.0.0.1:58103", server, client, 256*1024)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test0004AEAD(t *testing.T) {
+	w := newReplayWindow(128)
+	for _, seq := range []uint64{5, 3, 200, 100, 199} {
+		if !w.check(seq) {
+			t.Error("new seq should pass", seq)
+		}
+		w.accept(seq)
+	}
+	for _, seq := range []uint64{5, 3, 200, 100, 199, 72, 0} {
+		if w.check(seq) {
+			t.Error("replayed or too old seq should fail", seq)
+		}
+	}
+	if !w.check(73) || !w.check(201) {
+		t.Error("seq in window should pass")
+	}
+}
@@ -1,70 +1,171 @@
 package conn
 
 import (
+	"context"
 	"errors"
-	"github.com/3t2ugg1e/go-engine/src/common"
-	"io"
+	"net"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type Conn interface {
-	io.ReadWriteCloser
+	net.Conn
 
 	Name() string
 
 	Info() string
 
 	Dial(dst string) (Conn, error)
+	DialContext(ctx context.Context, dst string) (Conn, error)
 
 	Listen(dst string) (Conn, error)
+	ListenContext(ctx context.Context, dst string) (Conn, error)
 	Accept() (Conn, error)
+	AcceptContext(ctx context.Context) (Conn, error)
+}
+
+type ConnFactory func() Conn
+
+// WrapperFactory layers a conn over another one, the inner conn is used to Dial/Listen/Accept
+type WrapperFactory func(inner Conn) Conn
+
+// WrapConn is implemented by conns returned from a WrapperFactory
+type WrapConn interface {
+	Inner() Conn
+}
+
+type connProto struct {
+	factory  ConnFactory
+	reliable bool
+}
+
+type connWrapper struct {
+	factory  WrapperFactory
+	reliable bool
+}
+
+var gProtos = make(map[string]*connProto)
+var gWrappers = make(map[string]*connWrapper)
+var gProtosLock sync.RWMutex
+
+func Register(name string, factory ConnFactory, reliable bool) {
+	gProtosLock.Lock()
+	defer gProtosLock.Unlock()
+	gProtos[strings.ToLower(name)] = &connProto{factory: factory, reliable: reliable}
+}
+
+// RegisterWrapper adds a wrapper usable as "name+proto", reliable means the inner proto must be reliable
+func RegisterWrapper(name string, factory WrapperFactory, reliable bool) {
+	gProtosLock.Lock()
+	defer gProtosLock.Unlock()
+	gWrappers[strings.ToLower(name)] = &connWrapper{factory: factory, reliable: reliable}
+}
+
+func checkProto(proto string) (bool, error) {
+	names := strings.Split(strings.ToLower(proto), "+")
+	base := names[len(names)-1]
+	p, ok := gProtos[base]
+	if !ok {
+		return false, errors.New("undefined proto " + base)
+	}
+	for i := len(names) - 2; i >= 0; i-- {
+		w, ok := gWrappers[names[i]]
+		if !ok {
+			return false, errors.New("undefined wrapper " + names[i])
+		}
+		if w.reliable && !p.reliable {
+			return false, errors.New("wrapper " + names[i] + " need reliable proto")
+		}
+	}
+	return p.reliable, nil
+}
+
+// reliableHook is implemented by wrappers that work differently over reliable and packet protos,
+// the Name of a conn is not always the registered proto, so NewConn tells them
+type reliableHook interface {
+	setReliable(reliable bool)
 }
 
 func NewConn(proto string) (Conn, error) {
-	proto = strings.ToLower(proto)
-	if proto == "tcp" {
-		return &TcpConn{}, nil
-	} else if proto == "udp" {
-		return &UdpConn{}, nil
-	} else if proto == "rudp" {
-		return &RudpConn{}, nil
-	} else if proto == "ricmp" {
-		return &RicmpConn{id: common.UniqueId()}, nil
-	} else if proto == "kcp" {
-		return &KcpConn{}, nil
-	} else if proto == "quic" {
-		return &QuicConn{}, nil
-	} else if proto == "rhttp" {
-		return &RhttpConn{}, nil
+	gProtosLock.RLock()
+	defer gProtosLock.RUnlock()
+	reliable, err := checkProto(proto)
+	if err != nil {
+		return nil, err
+	}
+	names := strings.Split(strings.ToLower(proto), "+")
+	c := gProtos[names[len(names)-1]].factory()
+	for i := len(names) - 2; i >= 0; i-- {
+		c = gWrappers[names[i]].factory(c)
+		if h, ok := c.(reliableHook); ok {
+			h.setReliable(reliable)
+		}
+	}
+	return c, nil
+}
+
+// Unwrap returns the innermost conn of a wrapped conn
+func Unwrap(c Conn) Conn {
+	for {
+		w, ok := c.(WrapConn)
+		if !ok {
+			return c
+		}
+		c = w.Inner()
 	}
-	return nil, errors.New("undefined proto " + proto)
 }
 
 func SupportReliableProtos() []string {
+	gProtosLock.RLock()
+	defer gProtosLock.RUnlock()
 	ret := make([]string, 0)
-	ret = append(ret, "tcp")
-	ret = append(ret, "rudp")
-	ret = append(ret, "ricmp")
-	ret = append(ret, "kcp")
-	ret = append(ret, "quic")
-	ret = append(ret, "rhttp")
+	for name, p := range gProtos {
+		if p.reliable {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
 	return ret
 }
 
 func SupportProtos() []string {
+	gProtosLock.RLock()
+	defer gProtosLock.RUnlock()
 	ret := make([]string, 0)
-	ret = append(ret, SupportReliableProtos()...)
-	ret = append(ret, "udp")
+	for name := range gProtos {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func SupportWrappers() []string {
+	gProtosLock.RLock()
+	defer gProtosLock.RUnlock()
+	ret := make([]string, 0)
+	for name := range gWrappers {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
 	return ret
 }
 
 func HasReliableProto(proto string) bool {
-	return common.HasString(SupportReliableProtos(), proto)
+	gProtosLock.RLock()
+	defer gProtosLock.RUnlock()
+	reliable, err := checkProto(proto)
+	return err == nil && reliable
 }
 
 func HasProto(proto string) bool {
-	return common.HasString(SupportProtos(), proto)
+	gProtosLock.RLock()
+	defer gProtosLock.RUnlock()
+	_, err := checkProto(proto)
+	return err == nil
 }
 
 var gControlOnConnSetup func(network, address string, c syscall.RawConn) error
@@ -72,3 +173,108 @@ var gControlOnConnSetup func(network, address string, c syscall.RawConn) error
 func RegisterDialerController(fn func(network, address string, c syscall.RawConn) error) {
 	gControlOnConnSetup = fn
 }
+
+// watchContext calls fn once ctx is done, until the returned stop func is called
+// stop waits for fn to finish, so callers can safely undo what fn did
+func watchContext(ctx context.Context, fn func()) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopch := make(chan int)
+	exitch := make(chan int)
+	go func() {
+		defer close(exitch)
+		select {
+		case <-ctx.Done():
+			fn()
+		case <-stopch:
+		}
+	}()
+	return func() {
+		close(stopch)
+		<-exitch
+	}
+}
+
+type connAddr struct {
+	network string
+	addr    string
+}
+
+func (a *connAddr) Network() string {
+	return a.network
+}
+
+func (a *connAddr) String() string {
+	return a.addr
+}
+
+// connDeadline keeps read/write deadlines for conns that are not backed by one socket
+type connDeadline struct {
+	read  int64
+	write int64
+}
+
+func deadlineNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func deadlineExpired(d int64) bool {
+	return d != 0 && time.Now().UnixNano() >= d
+}
+
+func (d *connDeadline) setDeadline(t time.Time) {
+	d.setReadDeadline(t)
+	d.setWriteDeadline(t)
+}
+
+func (d *connDeadline) setReadDeadline(t time.Time) {
+	atomic.StoreInt64(&d.read, deadlineNano(t))
+}
+
+func (d *connDeadline) setWriteDeadline(t time.Time) {
+	atomic.StoreInt64(&d.write, deadlineNano(t))
+}
+
+func (d *connDeadline) readExpired() bool {
+	return deadlineExpired(atomic.LoadInt64(&d.read))
+}
+
+func (d *connDeadline) writeExpired() bool {
+	return deadlineExpired(atomic.LoadInt64(&d.write))
+}
+
+type connListener struct {
+	conn   Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// AsListener wraps a listening Conn as net.Listener, so it can be served by http.Server and the like
+func AsListener(c Conn) net.Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connListener{conn: c, ctx: ctx, cancel: cancel}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, err := l.conn.AcceptContext(l.ctx)
+	if err != nil {
+		if l.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error {
+	l.cancel()
+	return l.conn.Close()
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,89 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test0001Register(t *testing.T) {
+	fmt.Println(SupportProtos())
+	fmt.Println(SupportReliableProtos())
+
+	if !HasReliableProto("RUDP") || HasReliableProto("udp") || !HasProto("udp") {
+		t.Error("builtin protos not registered")
+	}
+
+	Register("mytcp", func() Conn {
+		return &TcpConn{}
+	}, true)
+	defer func() {
+		gProtosLock.Lock()
+		delete(gProtos, "mytcp")
+		gProtosLock.Unlock()
+	}()
+
+	c, err := NewConn("MyTcp")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if c.Name() != "tcp" || !HasReliableProto("mytcp") {
+		t.Error("register fail")
+	}
+
+	_, err = NewConn("nothing")
+	if err == nil {
+		t.Error("undefined proto should fail")
+	}
+
+	// rhttp is named http, the wrapper still knows it is reliable
+	c, _ = NewConn("aead+rhttp")
+	if c.Name() != "aead+http" || !c.(*AeadConn).reliable {
+		t.Error("aead over rhttp should be reliable", c.Name())
+	}
+	c, _ = NewConn("aead+udp")
+	if c.(*AeadConn).reliable {
+		t.Error("aead over udp should not be reliable")
+	}
+}
+
+func Test0002DialContext(t *testing.T) {
+	for _, proto := range []string{"tcp", "rudp", "rhttp"} {
+		c, err := NewConn(proto)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		cc, err := c.Listen(":58087")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		begin := time.Now()
+		_, err = cc.AcceptContext(ctx)
+		cancel()
+		fmt.Println(proto, "AcceptContext", err, time.Now().Sub(begin))
+		if err != context.DeadlineExceeded {
+			t.Error("AcceptContext should be canceled")
+		}
+		cc.Close()
+	}
+
+	c, _ := NewConn("rudp")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Second)
+		cancel()
+	}()
+	begin := time.Now()
+	_, err := c.DialContext(ctx, "127.0.0.1:58087")
+	fmt.Println("rudp DialContext", err, time.Now().Sub(begin))
+	if err != context.Canceled {
+		t.Error("DialContext should be canceled")
+	}
+}
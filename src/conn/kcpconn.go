@@ -2,17 +2,72 @@ package conn
 
 import (
 	"context"
+	"crypto/sha1"
 	"errors"
 	"github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
+	"golang.org/x/crypto/pbkdf2"
 	"net"
+	"time"
 )
 
+func init() {
+	Register("kcp", func() Conn {
+		return &KcpConn{}
+	}, true)
+}
+
+type KcpConfig struct {
+	NoDelay              int    // kcp nodelay模式，0关1开
+	Interval             int    // kcp内部刷新间隔，毫秒
+	Resend               int    // 快速重传，跨越多少个ack就重传，0为关闭
+	NoCongestion         int    // 1为关闭拥塞控制
+	SndWnd               int    // 发送窗口，包数
+	RcvWnd               int    // 接收窗口，包数
+	Mtu                  int    // 最大包长
+	AckNoDelay           bool   // 收到包立即回ack
+	ReadBuffer           int    // socket读缓冲
+	WriteBuffer          int    // socket写缓冲
+	DataShards           int    // FEC数据分片数，0为不开启，两端需一致
+	ParityShards         int    // FEC校验分片数
+	Dscp                 int    // ip头的DSCP，0为不设置
+	Crypt                string // 包加密方式，none、aes、aes-128、aes-192、salsa20、sm4、twofish、3des、cast5、blowfish、tea、xtea、xor，两端需一致
+	Key                  string // 加密密钥，用pbkdf2派生
+	SmuxVersion          int    // smux协议版本，1或2，2有每个流的窗口
+	SmuxMaxReceiveBuffer int    // smux整个会话的接收缓冲
+	SmuxMaxStreamBuffer  int    // smux每个流的接收缓冲，版本2有效
+}
+
+func DefaultKcpConfig() *KcpConfig {
+	return &KcpConfig{
+		NoDelay:              0,
+		Interval:             100,
+		Resend:               1,
+		NoCongestion:         1,
+		SndWnd:               10000,
+		RcvWnd:               10000,
+		Mtu:                  500,
+		AckNoDelay:           false,
+		ReadBuffer:           16 * 1024 * 1024,
+		WriteBuffer:          16 * 1024 * 1024,
+		DataShards:           0,
+		ParityShards:         0,
+		Dscp:                 46,
+		Crypt:                "none",
+		Key:                  "",
+		SmuxVersion:          1,
+		SmuxMaxReceiveBuffer: 4 * 1024 * 1024,
+		SmuxMaxStreamBuffer:  64 * 1024,
+	}
+}
+
 type KcpConn struct {
+	config   *KcpConfig
 	session  *smux.Session
 	stream   *smux.Stream
 	listener *kcp.Listener
 	info     string
+	stat     connCounter
 }
 
 func (c *KcpConn) Name() string {
@@ -21,14 +76,22 @@ func (c *KcpConn) Name() string {
 
 func (c *KcpConn) Read(p []byte) (n int, err error) {
 	if c.stream != nil {
-		return c.stream.Read(p)
+		n, err = c.stream.Read(p)
+		if n > 0 {
+			c.stat.in(n)
+		}
+		return n, err
 	}
 	return 0, errors.New("empty conn")
 }
 
 func (c *KcpConn) Write(p []byte) (n int, err error) {
 	if c.stream != nil {
-		return c.stream.Write(p)
+		n, err = c.stream.Write(p)
+		if n > 0 {
+			c.stat.out(n)
+		}
+		return n, err
 	}
 	return 0, errors.New("empty conn")
 }
@@ -56,26 +119,101 @@ func (c *KcpConn) Info() string {
 	return c.info
 }
 
+func (c *KcpConn) LocalAddr() net.Addr {
+	if c.session != nil {
+		return c.session.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *KcpConn) RemoteAddr() net.Addr {
+	if c.session != nil {
+		return c.session.RemoteAddr()
+	}
+	return nil
+}
+
+// Stats only reports the bytes of this conn, kcp-go keeps packets, retransmits and fec in the process wide kcp.DefaultSnmp
+// and has no getter for the srtt or cwnd of a session, so all the other fields stay 0
+func (c *KcpConn) Stats() ConnStats {
+	s := c.stat.stats()
+	return ConnStats{BytesIn: s.BytesIn, BytesOut: s.BytesOut}
+}
+
+func (c *KcpConn) SetDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *KcpConn) SetReadDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetReadDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *KcpConn) SetWriteDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetWriteDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *KcpConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultKcpConfig()
+	}
+}
+
+func (c *KcpConn) SetConfig(config *KcpConfig) {
+	c.config = config
+}
+
+func (c *KcpConn) GetConfig() *KcpConfig {
+	c.checkConfig()
+	return c.config
+}
+
 func (c *KcpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *KcpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	block, err := c.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	smuxconfig, err := c.smuxConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	var lc net.ListenConfig
 	if gControlOnConnSetup != nil {
 		lc.Control = gControlOnConnSetup
 	}
 
 	laddr := &net.UDPAddr{}
-	pconn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	pconn, err := lc.ListenPacket(ctx, "udp", laddr.String())
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := kcp.NewConn(dst, nil, 0, 0, pconn.(*net.UDPConn))
+	conn, err := kcp.NewConn(dst, block, c.config.DataShards, c.config.ParityShards, pconn.(*net.UDPConn))
 	if err != nil {
 		return nil, err
 	}
 
 	c.setParam(conn)
 
-	session, err := smux.Client(conn, nil)
+	session, err := smux.Client(conn, smuxconfig)
 	if err != nil {
 		return nil, err
 	}
@@ -85,49 +223,162 @@ func (c *KcpConn) Dial(dst string) (Conn, error) {
 		return nil, err
 	}
 
-	return &KcpConn{session: session, stream: stream}, nil
+	if ctx.Err() != nil {
+		session.Close()
+		return nil, ctx.Err()
+	}
+
+	return &KcpConn{config: c.config, session: session, stream: stream}, nil
 }
 
 func (c *KcpConn) Listen(dst string) (Conn, error) {
-	listener, err := kcp.Listen(dst)
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *KcpConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	block, err := c.blockCrypt()
 	if err != nil {
 		return nil, err
 	}
 
-	listener.(*kcp.Listener).SetReadBuffer(4 * 1024 * 1024)
-	listener.(*kcp.Listener).SetWriteBuffer(4 * 1024 * 1024)
-	listener.(*kcp.Listener).SetDSCP(46)
+	addr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	pconn, err := lc.ListenPacket(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
 
-	return &KcpConn{listener: listener.(*kcp.Listener)}, nil
+	listener, err := kcp.ServeConn(block, c.config.DataShards, c.config.ParityShards, pconn)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+
+	listener.SetReadBuffer(c.config.ReadBuffer)
+	listener.SetWriteBuffer(c.config.WriteBuffer)
+	if c.config.Dscp > 0 {
+		listener.SetDSCP(c.config.Dscp)
+	}
+
+	return &KcpConn{config: c.config, listener: listener}, nil
 }
 
 func (c *KcpConn) Accept() (Conn, error) {
-	conn, err := c.listener.Accept()
+	return c.AcceptContext(context.Background())
+}
+
+func (c *KcpConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+
+	smuxconfig, err := c.smuxConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, func() {
+		c.listener.SetDeadline(time.Now())
+	})
+	conn, err := c.listener.AcceptKCP()
+	stop()
+	if ctx.Err() != nil {
+		c.listener.SetDeadline(time.Time{})
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	c.setParam(conn.(*kcp.UDPSession))
+	c.setParam(conn)
 
-	session, err := smux.Server(conn, nil)
+	session, err := smux.Server(conn, smuxconfig)
 	if err != nil {
 		return nil, err
 	}
 
+	stop = watchContext(ctx, func() {
+		session.SetDeadline(time.Now())
+	})
 	stream, err := session.AcceptStream()
+	stop()
+	if ctx.Err() != nil {
+		session.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &KcpConn{session: session, stream: stream}, nil
+	return &KcpConn{config: c.config, session: session, stream: stream}, nil
 }
 
 func (c *KcpConn) setParam(conn *kcp.UDPSession) {
 	conn.SetStreamMode(true)
-	conn.SetWindowSize(10000, 10000)
-	conn.SetReadBuffer(16 * 1024 * 1024)
-	conn.SetWriteBuffer(16 * 1024 * 1024)
-	conn.SetNoDelay(0, 100, 1, 1)
-	conn.SetMtu(500)
-	conn.SetACKNoDelay(false)
+	conn.SetWindowSize(c.config.SndWnd, c.config.RcvWnd)
+	conn.SetReadBuffer(c.config.ReadBuffer)
+	conn.SetWriteBuffer(c.config.WriteBuffer)
+	conn.SetNoDelay(c.config.NoDelay, c.config.Interval, c.config.Resend, c.config.NoCongestion)
+	conn.SetMtu(c.config.Mtu)
+	conn.SetACKNoDelay(c.config.AckNoDelay)
+	if c.config.Dscp > 0 {
+		conn.SetDSCP(c.config.Dscp)
+	}
+}
+
+func (c *KcpConn) smuxConfig() (*smux.Config, error) {
+	config := smux.DefaultConfig()
+	config.Version = c.config.SmuxVersion
+	config.MaxReceiveBuffer = c.config.SmuxMaxReceiveBuffer
+	config.MaxStreamBuffer = c.config.SmuxMaxStreamBuffer
+	err := smux.VerifyConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// blockCrypt returns nil for none, kcp-go then sends the packets as is
+func (c *KcpConn) blockCrypt() (kcp.BlockCrypt, error) {
+	key := pbkdf2.Key([]byte(c.config.Key), []byte("go-engine kcp"), 4096, 32, sha1.New)
+	switch c.config.Crypt {
+	case "", "none":
+		return nil, nil
+	case "aes":
+		return kcp.NewAESBlockCrypt(key)
+	case "aes-128":
+		return kcp.NewAESBlockCrypt(key[:16])
+	case "aes-192":
+		return kcp.NewAESBlockCrypt(key[:24])
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(key)
+	case "sm4":
+		return kcp.NewSM4BlockCrypt(key[:16])
+	case "twofish":
+		return kcp.NewTwofishBlockCrypt(key)
+	case "3des":
+		return kcp.NewTripleDESBlockCrypt(key[:24])
+	case "cast5":
+		return kcp.NewCast5BlockCrypt(key[:16])
+	case "blowfish":
+		return kcp.NewBlowfishBlockCrypt(key)
+	case "tea":
+		return kcp.NewTEABlockCrypt(key[:16])
+	case "xtea":
+		return kcp.NewXTEABlockCrypt(key[:16])
+	case "xor":
+		return kcp.NewSimpleXORBlockCrypt(key)
+	}
+	return nil, errors.New("unknown kcp crypt " + c.config.Crypt)
 }
@@ -1,8 +1,10 @@
 package conn
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"io"
 	"strconv"
 	"testing"
 	"time"
@@ -493,3 +495,116 @@ func Test0009KCP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func Test0010KCP(t *testing.T) {
+	c, _ := NewConn("kcp")
+	config := DefaultKcpConfig()
+	config.Crypt = "rot13"
+	c.(*KcpConn).SetConfig(config)
+	_, err := c.Listen("127.0.0.1:58116")
+	fmt.Println(err)
+	if err == nil {
+		t.Error("unknown crypt should fail")
+	}
+
+	config = DefaultKcpConfig()
+	config.Crypt = "salsa20"
+	config.Key = "123"
+	config.DataShards = 4
+	config.ParityShards = 2
+	config.SmuxVersion = 2
+	config.SmuxMaxStreamBuffer = 128 * 1024
+	c.(*KcpConn).SetConfig(config)
+	cc, err := c.Listen("127.0.0.1:58116")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		io.Copy(sonny, sonny)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58116")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+
+	src := make([]byte, 256*1024)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	go ccc.Write(src)
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+}
+
+func Test0011KCP(t *testing.T) {
+	c, _ := NewConn("kcp")
+	cc, err := c.Listen("127.0.0.1:58131")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			go io.Copy(sonny, sonny)
+		}
+	}()
+
+	busy, err := c.Dial("127.0.0.1:58131")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer busy.Close()
+	idle, err := c.Dial("127.0.0.1:58131")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer idle.Close()
+
+	src := make([]byte, 64*1024)
+	go busy.Write(src)
+	busy.SetReadDeadline(time.Now().Add(time.Second * 10))
+	_, err = io.ReadFull(busy, make([]byte, len(src)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the stats are per session, the idle one must not see the traffic of the busy one
+	bs, _ := GetStats(busy)
+	is, _ := GetStats(idle)
+	fmt.Printf("busy %+v\nidle %+v\n", bs, is)
+	if bs.BytesOut != int64(len(src)) || bs.BytesIn != int64(len(src)) || bs.PacketsIn != 0 || bs.PacketsOut != 0 {
+		t.Error("kcp busy stats wrong", bs)
+	}
+	if is.BytesOut != 0 || is.BytesIn != 0 || is.PacketsIn != 0 || is.PacketsOut != 0 || is.Retransmits != 0 {
+		t.Error("kcp idle stats should be empty", is)
+	}
+}
@@ -0,0 +1,224 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterWrapper("lossy", func(inner Conn) Conn {
+		return &LossyConn{Conn: inner, inner: inner}
+	}, false)
+}
+
+type LossyConfig struct {
+	Loss          float64 // 丢包率，0-1
+	DelayMs       int     // 固定延迟
+	JitterMs      int     // 延迟抖动，每个包在DelayMs上随机增加0-JitterMs
+	Reorder       float64 // 乱序率，选中的包再延迟ReorderMs，让后面的包先到
+	ReorderMs     int
+	Duplicate     float64 // 重复率
+	BandwidthKBps int     // 带宽上限，0为不限
+	QueueMs       int     // 超过带宽时最多排队多久，排不下的包丢掉
+	Seed          int64   // 随机种子，种子相同则丢包、重复、延迟的序列相同
+}
+
+func DefaultLossyConfig() *LossyConfig {
+	return &LossyConfig{
+		ReorderMs: 50,
+		QueueMs:   100,
+		Seed:      1,
+	}
+}
+
+// lossyHook is implemented by packet transports, they send every packet through the impairer
+type lossyHook interface {
+	setLossy(config *LossyConfig)
+}
+
+// LossyConn injects loss, latency, jitter, reordering, duplication and bandwidth caps into the packets of the inner conn,
+// only the sending side is impaired, so wrap both ends to impair both directions
+type LossyConn struct {
+	Conn
+	info   string
+	config *LossyConfig
+	inner  Conn
+}
+
+func (c *LossyConn) Name() string {
+	return "lossy+" + c.inner.Name()
+}
+
+func (c *LossyConn) Inner() Conn {
+	return c.inner
+}
+
+func (c *LossyConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	c.info = "lossy " + c.inner.Info()
+	return c.info
+}
+
+func (c *LossyConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *LossyConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	err := c.hook()
+	if err != nil {
+		return nil, err
+	}
+	inner, err := c.inner.DialContext(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	return &LossyConn{Conn: inner, config: c.config, inner: inner}, nil
+}
+
+func (c *LossyConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *LossyConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	err := c.hook()
+	if err != nil {
+		return nil, err
+	}
+	inner, err := c.inner.ListenContext(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	return &LossyConn{Conn: inner, config: c.config, inner: inner}, nil
+}
+
+func (c *LossyConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *LossyConn) AcceptContext(ctx context.Context) (Conn, error) {
+	inner, err := c.inner.AcceptContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &LossyConn{Conn: inner, config: c.config, inner: inner}, nil
+}
+
+func (c *LossyConn) hook() error {
+	c.checkConfig()
+	h, ok := c.inner.(lossyHook)
+	if !ok {
+		return errors.New("lossy need packet proto " + c.inner.Name())
+	}
+	h.setLossy(c.config)
+	return nil
+}
+
+func (c *LossyConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultLossyConfig()
+	}
+}
+
+func (c *LossyConn) SetConfig(config *LossyConfig) {
+	c.config = config
+}
+
+func (c *LossyConn) GetConfig() *LossyConfig {
+	c.checkConfig()
+	return c.config
+}
+
+// impairer decides the fate of each packet, one is shared by a dialer or by a listener and its sonnies
+type impairer struct {
+	config *LossyConfig
+	lock   sync.Mutex
+	rand   *rand.Rand
+	busy   time.Time
+
+	packets int64
+	dropped int64
+}
+
+func newImpairer(config *LossyConfig) *impairer {
+	if config == nil {
+		return nil
+	}
+	return &impairer{config: config, rand: rand.New(rand.NewSource(config.Seed))}
+}
+
+// plan returns the delay of each copy of a n bytes packet, empty means dropped
+// the random numbers drawn for a packet do not depend on time, so the same seed gives the same sequence
+func (i *impairer) plan(n int, now time.Time) []time.Duration {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.packets++
+	if i.config.Loss > 0 && i.rand.Float64() < i.config.Loss {
+		i.dropped++
+		return nil
+	}
+
+	copies := 1
+	if i.config.Duplicate > 0 && i.rand.Float64() < i.config.Duplicate {
+		copies = 2
+	}
+
+	ret := make([]time.Duration, copies)
+	for j := range ret {
+		ret[j] = time.Millisecond * time.Duration(i.config.DelayMs)
+		if i.config.JitterMs > 0 {
+			ret[j] += time.Duration(i.rand.Int63n(int64(time.Millisecond) * int64(i.config.JitterMs)))
+		}
+		if i.config.Reorder > 0 && i.rand.Float64() < i.config.Reorder {
+			ret[j] += time.Millisecond * time.Duration(i.config.ReorderMs)
+		}
+	}
+
+	if i.config.BandwidthKBps > 0 {
+		if i.busy.Before(now) {
+			i.busy = now
+		}
+		queue := i.busy.Sub(now)
+		if queue > time.Millisecond*time.Duration(i.config.QueueMs) {
+			i.dropped++
+			return nil
+		}
+		i.busy = i.busy.Add(time.Duration(n*copies) * time.Second / time.Duration(i.config.BandwidthKBps*1024))
+		for j := range ret {
+			ret[j] += queue
+		}
+	}
+
+	return ret
+}
+
+// count returns how many packets went through and how many of them were dropped, so tests measure the loss where it is made
+func (i *impairer) count() (int64, int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.packets, i.dropped
+}
+
+// send writes b through the impairer, a nil impairer writes it directly
+func (i *impairer) send(b []byte, write func([]byte) error) error {
+	if i == nil {
+		return write(b)
+	}
+	for _, d := range i.plan(len(b), time.Now()) {
+		if d <= 0 {
+			write(b)
+			continue
+		}
+		cb := make([]byte, len(b))
+		copy(cb, b)
+		time.AfterFunc(d, func() {
+			write(cb)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test0001LOSSY(t *testing.T) {
+	if !HasReliableProto("lossy+rudp") || HasReliableProto("lossy+udp") || !HasProto("tls+lossy+rudp") {
+		t.Error("lossy wrapper check fail")
+	}
+
+	c, _ := NewConn("lossy+tcp")
+	_, err := c.Dial("127.0.0.1:58091")
+	fmt.Println(err)
+	if err == nil {
+		t.Error("lossy over stream proto should fail")
+	}
+
+	config := &LossyConfig{Loss: 0.2, DelayMs: 10, JitterMs: 20, Reorder: 0.1, ReorderMs: 50, Duplicate: 0.1, Seed: 123}
+	a := newImpairer(config)
+	b := newImpairer(config)
+	now := time.Now()
+	lost := 0
+	dup := 0
+	for i := 0; i < 10000; i++ {
+		pa := a.plan(100, now)
+		pb := b.plan(100, now)
+		if fmt.Sprint(pa) != fmt.Sprint(pb) {
+			t.Error("same seed should give same plan", i, pa, pb)
+			return
+		}
+		if len(pa) == 0 {
+			lost++
+		} else if len(pa) > 1 {
+			dup++
+		}
+	}
+	fmt.Println("lost", lost, "dup", dup)
+	if lost < 1800 || lost > 2200 || dup < 600 || dup > 1000 {
+		t.Error("loss or duplicate rate not match", lost, dup)
+	}
+}
+
+func Test0002LOSSY(t *testing.T) {
+	c, err := NewConn("lossy+udp")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c.(*LossyConn).SetConfig(&LossyConfig{Loss: 0.3, Seed: 1})
+
+	l, _ := NewConn("udp")
+	cc, err := l.Listen(":58091")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	ccc, err := c.Dial("127.0.0.1:58091")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	recvch := make(chan int, 1)
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			recvch <- 0
+			return
+		}
+		recv := 0
+		buf := make([]byte, 100)
+		for {
+			sonny.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+			_, err := sonny.Read(buf)
+			if err != nil {
+				break
+			}
+			recv++
+		}
+		recvch <- recv
+	}()
+
+	for i := 0; i < 1000; i++ {
+		ccc.Write([]byte("hello"))
+		time.Sleep(time.Microsecond * 100)
+	}
+
+	// the receiver may drop more on its own when its channel is full, so the loss is measured at the wrapper
+	packets, dropped := ccc.(*LossyConn).Inner().(*UdpConn).impair.count()
+	recv := <-recvch
+	fmt.Println("packets", packets, "dropped", dropped, "recv", recv)
+	if packets != 1000 || dropped < 250 || dropped > 350 {
+		t.Error("loss rate not match", packets, dropped)
+	}
+	if recv <= 0 || recv > int(packets-dropped) {
+		t.Error("recv not match", recv)
+	}
+}
+
+func Test0003LOSSY(t *testing.T) {
+	c, err := NewConn("lossy+rudp")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c.(*LossyConn).SetConfig(&LossyConfig{Loss: 0.05, DelayMs: 10, JitterMs: 10, Reorder: 0.05, ReorderMs: 30,
+		Duplicate: 0.05, BandwidthKBps: 2048, QueueMs: 100, Seed: 1})
+
+	cc, err := c.Listen(":58091")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	src := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(src)
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done " + sonny.Info())
+		sonny.Write(src)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58091")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	begin := time.Now()
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 60))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cost := time.Now().Sub(begin)
+	speed := float64(len(dst)) / 1024 / cost.Seconds()
+	packets, dropped := cc.(*LossyConn).Inner().(*RudpConn).impair.count()
+	fmt.Println("recv", len(dst), "cost", cost, "speed KB/s", speed, "packets", packets, "dropped", dropped)
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+	if dropped <= 0 {
+		t.Error("nothing dropped")
+	}
+	// the link gives 2048KB/s, with 5% loss rudp should keep a good part of it
+	if speed < 100 {
+		t.Error("lossy rudp too slow", speed)
+	}
+}
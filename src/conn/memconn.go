@@ -0,0 +1,273 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/group"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	Register("mem", func() Conn {
+		return &MemConn{}
+	}, true)
+}
+
+type MemConfig struct {
+	AcceptChanLen int
+}
+
+func DefaultMemConfig() *MemConfig {
+	return &MemConfig{
+		AcceptChanLen: 128,
+	}
+}
+
+type MemConn struct {
+	info       string
+	config     *MemConfig
+	conn       net.Conn
+	localaddr  net.Addr
+	remoteaddr net.Addr
+	listener   *memConnListener
+}
+
+type memConnListener struct {
+	key    string
+	addr   net.Addr
+	wg     *group.Group
+	accept *common.Channel
+}
+
+var gMemListeners = make(map[string]*memConnListener)
+var gMemListenersLock sync.Mutex
+var gMemDialerId int64
+
+// memAddrKey makes ":80", "0.0.0.0:80", "127.0.0.1:80" and "localhost:80" the same address
+func memAddrKey(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "127.0.0.1" || host == "::" || host == "::1" || host == "localhost" {
+		return ":" + port
+	}
+	return addr
+}
+
+func (c *MemConn) Name() string {
+	return "mem"
+}
+
+func (c *MemConn) Read(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Read(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *MemConn) Write(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Write(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *MemConn) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	} else if c.listener != nil {
+		gMemListenersLock.Lock()
+		if gMemListeners[c.listener.key] == c.listener {
+			delete(gMemListeners, c.listener.key)
+		}
+		gMemListenersLock.Unlock()
+		c.listener.wg.Stop()
+		c.listener.wg.Wait()
+		for s := range c.listener.accept.Ch() {
+			if s != nil {
+				s.(*MemConn).Close()
+			}
+		}
+	}
+	return nil
+}
+
+func (c *MemConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		c.info = c.localaddr.String() + "<--mem-->" + c.remoteaddr.String()
+	} else if c.listener != nil {
+		c.info = "mem--" + c.listener.addr.String()
+	} else {
+		c.info = "empty mem conn"
+	}
+	return c.info
+}
+
+func (c *MemConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.localaddr
+	} else if c.listener != nil {
+		return c.listener.addr
+	}
+	return nil
+}
+
+func (c *MemConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.remoteaddr
+	}
+	return nil
+}
+
+func (c *MemConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *MemConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *MemConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *MemConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *MemConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	gMemListenersLock.Lock()
+	listener, ok := gMemListeners[memAddrKey(dst)]
+	gMemListenersLock.Unlock()
+	if !ok {
+		return nil, errors.New("connection refused " + dst)
+	}
+
+	id := atomic.AddInt64(&gMemDialerId, 1)
+	localaddr := &connAddr{network: "mem", addr: "dialer-" + strconv.FormatInt(id, 10)}
+
+	dialerconn, listenerconn := net.Pipe()
+	dialer := &MemConn{config: c.config, conn: dialerconn, localaddr: localaddr, remoteaddr: listener.addr}
+	sonny := &MemConn{config: c.config, conn: listenerconn, localaddr: listener.addr, remoteaddr: localaddr}
+
+	for !listener.wg.IsExit() {
+		if ctx.Err() != nil {
+			dialer.Close()
+			sonny.Close()
+			return nil, ctx.Err()
+		}
+		if listener.accept.WriteTimeout(sonny, 100) && !listener.wg.IsExit() {
+			return dialer, nil
+		}
+	}
+
+	dialer.Close()
+	sonny.Close()
+	return nil, errors.New("connection refused " + dst)
+}
+
+func (c *MemConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *MemConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	ch := common.NewChannel(c.config.AcceptChanLen)
+
+	wg := group.NewGroup("MemConn Listen"+" "+dst, nil, func() {
+		ch.Close()
+	})
+
+	key := memAddrKey(dst)
+	listener := &memConnListener{
+		key:    key,
+		addr:   &connAddr{network: "mem", addr: dst},
+		wg:     wg,
+		accept: ch,
+	}
+
+	gMemListenersLock.Lock()
+	defer gMemListenersLock.Unlock()
+	if _, ok := gMemListeners[key]; ok {
+		wg.Stop()
+		return nil, errors.New("address already in use " + dst)
+	}
+	gMemListeners[key] = listener
+
+	return &MemConn{config: c.config, listener: listener}, nil
+}
+
+func (c *MemConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *MemConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	for !c.listener.wg.IsExit() {
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s == nil {
+			break
+		}
+		return s.(*MemConn), nil
+	}
+	return nil, errors.New("listener close")
+}
+
+func (c *MemConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultMemConfig()
+	}
+}
+
+func (c *MemConn) SetConfig(config *MemConfig) {
+	c.config = config
+}
+
+func (c *MemConn) GetConfig() *MemConfig {
+	c.checkConfig()
+	return c.config
+}
@@ -0,0 +1,120 @@
+package conn
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test0001MEM(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewConn("mem")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = c.Dial("mem0001")
+	fmt.Println(err)
+	if err == nil {
+		t.Error("dial no listener should fail")
+	}
+
+	cc, err := c.Listen("mem0001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = c.Listen("mem0001")
+	fmt.Println(err)
+	if err == nil {
+		t.Error("listen twice should fail")
+	}
+
+	go func() {
+		for {
+			cc, err := cc.Accept()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Println("accept done " + cc.Info())
+			go func() {
+				defer cc.Close()
+				buf := make([]byte, 100)
+				for {
+					n, err := cc.Read(buf)
+					if err != nil {
+						return
+					}
+					cc.Write(buf[0:n])
+				}
+			}()
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		ccc, err := c.Dial("mem0001")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Println("dial done " + ccc.Info())
+		ccc.Write([]byte("hello" + strconv.Itoa(i)))
+		buf := make([]byte, 100)
+		n, err := ccc.Read(buf)
+		if err != nil || string(buf[0:n]) != "hello"+strconv.Itoa(i) {
+			t.Error("echo fail", err)
+		}
+		ccc.Close()
+	}
+
+	cc.Close()
+
+	_, err = c.Dial("mem0001")
+	if err == nil {
+		t.Error("dial closed listener should fail")
+	}
+}
+
+func Test0002MEM(t *testing.T) {
+	t.Parallel()
+
+	c, _ := NewConn("mem")
+	cc, err := c.Listen("127.0.0.1:58080")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Second)
+		cc.Close()
+	}()
+
+	ccc, err := c.Dial(":58080")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ccc.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = ccc.Read(make([]byte, 10))
+	fmt.Println(err)
+	if err == nil {
+		t.Error("read deadline not work")
+	}
+	ccc.SetReadDeadline(time.Time{})
+	_, err = ccc.Read(make([]byte, 10))
+	fmt.Println(err)
+	if err == nil {
+		t.Error("read closed conn should fail")
+	}
+}
@@ -0,0 +1,982 @@
+package conn
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/group"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	Register("multi", func() Conn {
+		return &MultiConn{}
+	}, true)
+}
+
+type MultiConfig struct {
+	Mode               string // stripe轮流使用所有通路，failover只用第一个可用的通路
+	MaxFrameSize       int
+	MaxUnackSize       int // 已发送未确认的数据上限，超过时Write阻塞
+	MaxUnackFrames     int // 已发送未确认的帧数上限，超过时Write阻塞，接收端的乱序窗口也按此和MaxUnackSize限制，两端需一致
+	MaxRecvBufferSize  int // 收到未读取的数据上限，超过时暂停从通路读取
+	AckIntervalMs      int // 确认和保活的间隔
+	PathTimeoutMs      int // 通路多久收不到数据认为断开
+	ReconnectMs        int // 断开的通路多久重连一次
+	SessionTimeoutMs   int // 所有通路都断开后多久关闭会话
+	HandshakeTimeoutMs int
+	CloseTimeoutMs     int
+	AcceptChanLen      int
+}
+
+func DefaultMultiConfig() *MultiConfig {
+	return &MultiConfig{
+		Mode:               "stripe",
+		MaxFrameSize:       16 * 1024,
+		MaxUnackSize:       1024 * 1024,
+		MaxUnackFrames:     1024,
+		MaxRecvBufferSize:  1024 * 1024,
+		AckIntervalMs:      100,
+		PathTimeoutMs:      10000,
+		ReconnectMs:        1000,
+		SessionTimeoutMs:   30000,
+		HandshakeTimeoutMs: 5000,
+		CloseTimeoutMs:     5000,
+		AcceptChanLen:      128,
+	}
+}
+
+const (
+	multiFrameData = 1
+	multiFrameAck  = 2
+	multiFrameFin  = 3
+
+	// type(1) seq(8) len(4)
+	multiHeaderLen = 13
+
+	multiHelloNew  = 0
+	multiHelloJoin = 1
+
+	multiIdLen  = 16
+	multiKeyLen = 16
+)
+
+var multiMagic = []byte("MLT1")
+
+type multiAddr struct {
+	proto string
+	addr  string
+}
+
+type multiFrame struct {
+	seq  uint64
+	data []byte
+}
+
+type multiPath struct {
+	conn      Conn
+	dead      int32
+	lastrecv  int64
+	writelock sync.Mutex
+}
+
+// multiSession carries one byte stream over several paths, every data frame has a seq and stays unacked until the peer acks it,
+// when a path dies the unacked frames are sent again over the others, the receiver drops duplicates and reorders by seq,
+// a path joins with an hmac of the session key over a nonce from the listener, the key goes in the clear on the path that
+// creates the session, so wrap the paths, e.g. tls+tcp, when someone may watch that path
+type multiSession struct {
+	id       string
+	key      []byte
+	config   *MultiConfig
+	wg       *group.Group
+	addrs    []multiAddr
+	lock     sync.Mutex
+	paths    []*multiPath
+	next     int
+	deadtime time.Time
+
+	sendseq   uint64
+	unack     *list.List
+	unacksize int
+
+	recvseq     uint64
+	recvbuf     map[uint64][]byte
+	recvbufsize int
+	readbuf     []byte
+	finrecv     bool
+	finseq      uint64
+}
+
+type multiConnListener struct {
+	addr      string
+	listeners []Conn
+	wg        *group.Group
+	accept    *common.Channel
+	sessions  map[string]*MultiConn
+	lock      sync.Mutex
+}
+
+type MultiConn struct {
+	info       string
+	config     *MultiConfig
+	session    *multiSession
+	listener   *multiConnListener
+	localaddr  net.Addr
+	remoteaddr net.Addr
+	isclose    bool
+	closelock  sync.Mutex
+	deadline   connDeadline
+}
+
+// parseMultiAddr parses "rudp://1.2.3.4:8888,tcp://1.2.3.4:8889", each path must be a reliable proto
+func parseMultiAddr(dst string) ([]multiAddr, error) {
+	var ret []multiAddr
+	for _, s := range strings.Split(dst, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "://")
+		if i <= 0 {
+			return nil, errors.New("multi addr need proto://addr " + s)
+		}
+		proto := strings.ToLower(s[0:i])
+		if proto == "multi" || !HasReliableProto(proto) {
+			return nil, errors.New("multi need reliable proto " + proto)
+		}
+		ret = append(ret, multiAddr{proto: proto, addr: s[i+3:]})
+	}
+	if len(ret) <= 0 {
+		return nil, errors.New("empty multi addr " + dst)
+	}
+	return ret, nil
+}
+
+func (c *MultiConn) Name() string {
+	return "multi"
+}
+
+func (c *MultiConn) Read(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	} else if c.session == nil {
+		return 0, errors.New("empty conn")
+	}
+
+	if len(p) <= 0 {
+		return 0, errors.New("read empty buffer")
+	}
+
+	s := c.session
+	for !c.isclose {
+		if c.deadline.readExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		s.lock.Lock()
+		if len(s.readbuf) > 0 {
+			size := copy(p, s.readbuf)
+			s.readbuf = s.readbuf[size:]
+			if len(s.readbuf) <= 0 {
+				s.readbuf = nil
+			}
+			s.lock.Unlock()
+			return size, nil
+		}
+		eof := s.finrecv && s.recvseq >= s.finseq
+		s.lock.Unlock()
+
+		if eof {
+			return 0, io.EOF
+		}
+		if s.wg.IsExit() {
+			return 0, errors.New("closed conn")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return 0, errors.New("read closed conn")
+}
+
+func (c *MultiConn) Write(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	} else if c.session == nil {
+		return 0, errors.New("empty conn")
+	}
+
+	if len(p) <= 0 {
+		return 0, errors.New("write empty data")
+	}
+
+	s := c.session
+	cur := 0
+	for cur < len(p) {
+		if c.isclose {
+			return cur, errors.New("write closed conn")
+		}
+		if s.wg.IsExit() {
+			return cur, errors.New("closed conn")
+		}
+		if c.deadline.writeExpired() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
+		size := len(p) - cur
+		if size > c.config.MaxFrameSize {
+			size = c.config.MaxFrameSize
+		}
+
+		f := s.push(p[cur : cur+size])
+		if f == nil {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		s.sendFrame(multiFrameData, f.seq, f.data)
+		cur += size
+	}
+
+	return cur, nil
+}
+
+func (c *MultiConn) Close() error {
+	c.checkConfig()
+
+	if c.isclose {
+		return nil
+	}
+
+	c.closelock.Lock()
+	defer c.closelock.Unlock()
+
+	if c.isclose {
+		return nil
+	}
+
+	if c.session != nil {
+		s := c.session
+		// give the unacked data a chance, then tell the peer no more data
+		start := time.Now()
+		for !s.wg.IsExit() && s.unackSize() > 0 && time.Now().Sub(start) < time.Millisecond*time.Duration(c.config.CloseTimeoutMs) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		s.lock.Lock()
+		seq := s.sendseq
+		s.lock.Unlock()
+		for _, p := range s.alivePaths() {
+			s.writePath(p, s.marshalFrame(multiFrameFin, seq, nil))
+		}
+		s.wg.Stop()
+		s.wg.Wait()
+	} else if c.listener != nil {
+		c.listener.wg.Stop()
+		c.listener.wg.Wait()
+	}
+	c.isclose = true
+
+	return nil
+}
+
+func (c *MultiConn) Info() string {
+	c.checkConfig()
+
+	if c.info != "" {
+		return c.info
+	}
+	if c.session != nil {
+		c.info = c.localaddr.String() + "<--multi-->" + c.remoteaddr.String()
+	} else if c.listener != nil {
+		c.info = "multi--" + c.listener.addr
+	} else {
+		c.info = "empty multi conn"
+	}
+	return c.info
+}
+
+func (c *MultiConn) LocalAddr() net.Addr {
+	if c.session != nil {
+		return c.localaddr
+	} else if c.listener != nil {
+		return &connAddr{network: "multi", addr: c.listener.addr}
+	}
+	return nil
+}
+
+func (c *MultiConn) RemoteAddr() net.Addr {
+	if c.session != nil {
+		return c.remoteaddr
+	}
+	return nil
+}
+
+func (c *MultiConn) SetDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setDeadline(t)
+	return nil
+}
+
+func (c *MultiConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setReadDeadline(t)
+	return nil
+}
+
+func (c *MultiConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setWriteDeadline(t)
+	return nil
+}
+
+func (c *MultiConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *MultiConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	addrs, err := parseMultiAddr(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newMultiSession(common.UniqueId()[0:multiIdLen], c.config)
+	s.key = make([]byte, multiKeyLen)
+	_, err = rand.Read(s.key)
+	if err != nil {
+		return nil, err
+	}
+	s.addrs = addrs
+	s.paths = make([]*multiPath, len(addrs))
+
+	// the first path creates the session on the listener, the others join it later
+	index := -1
+	var conn Conn
+	for i := range addrs {
+		conn, err = s.dialPath(ctx, addrs[i], multiHelloNew)
+		if err == nil {
+			index = i
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	if index < 0 {
+		return nil, err
+	}
+
+	s.wg = group.NewGroup("MultiConn Dial"+" "+dst, nil, func() {
+		s.closePaths()
+	})
+	s.addPath(index, conn)
+
+	s.wg.Go("MultiConn update"+" "+s.id, func() error {
+		return s.update()
+	})
+	s.wg.Go("MultiConn reconnect"+" "+s.id, func() error {
+		return s.reconnect()
+	})
+
+	return &MultiConn{config: c.config, session: s,
+		localaddr:  &connAddr{network: "multi", addr: s.id},
+		remoteaddr: &connAddr{network: "multi", addr: dst}}, nil
+}
+
+func (c *MultiConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *MultiConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	addrs, err := parseMultiAddr(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []Conn
+	for _, a := range addrs {
+		cc, err := NewConn(a.proto)
+		if err == nil {
+			cc, err = cc.ListenContext(ctx, a.addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, cc)
+	}
+
+	ch := common.NewChannel(c.config.AcceptChanLen)
+
+	wg := group.NewGroup("MultiConn Listen"+" "+dst, nil, func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		ch.Close()
+	})
+
+	listener := &multiConnListener{
+		addr:      dst,
+		listeners: listeners,
+		wg:        wg,
+		accept:    ch,
+		sessions:  make(map[string]*MultiConn),
+	}
+
+	u := &MultiConn{config: c.config, listener: listener}
+	for _, l := range listeners {
+		l := l
+		wg.Go("MultiConn loopAccept"+" "+l.Info(), func() error {
+			return u.loopAccept(l)
+		})
+	}
+
+	return u, nil
+}
+
+func (c *MultiConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *MultiConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	for !c.listener.wg.IsExit() {
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s == nil {
+			break
+		}
+		return s.(*MultiConn), nil
+	}
+	return nil, errors.New("listener close")
+}
+
+func (c *MultiConn) loopAccept(l Conn) error {
+	for !c.listener.wg.IsExit() {
+		conn, err := l.AcceptContext(c.listener.wg.Context())
+		if err != nil {
+			if !c.listener.wg.IsExit() {
+				time.Sleep(time.Millisecond * 100)
+			}
+			continue
+		}
+		c.listener.wg.Go("MultiConn accept"+" "+conn.Info(), func() error {
+			return c.accept(conn)
+		})
+	}
+	return nil
+}
+
+func (c *MultiConn) accept(conn Conn) error {
+	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(c.config.HandshakeTimeoutMs)))
+	hello := make([]byte, len(multiMagic)+multiIdLen+1)
+	_, err := io.ReadFull(conn, hello)
+	if err != nil || !bytes.Equal(hello[0:len(multiMagic)], multiMagic) {
+		conn.Close()
+		return nil
+	}
+	id := string(hello[len(multiMagic) : len(multiMagic)+multiIdLen])
+	flag := hello[len(hello)-1]
+
+	key := make([]byte, multiKeyLen)
+	nonce := make([]byte, multiKeyLen)
+	mac := make([]byte, multiKeyLen)
+	if flag == multiHelloNew {
+		_, err = io.ReadFull(conn, key)
+	} else {
+		// the nonce keeps a recorded join from being played again
+		_, err = rand.Read(nonce)
+		if err == nil {
+			_, err = conn.Write(nonce)
+		}
+		if err == nil {
+			_, err = io.ReadFull(conn, mac)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+
+	l := c.listener
+	l.lock.Lock()
+	u, ok := l.sessions[id]
+	isnew := false
+	if flag == multiHelloNew {
+		u = nil
+		if !ok && !l.wg.IsExit() {
+			u = c.newSonny(id, key)
+			l.sessions[id] = u
+			isnew = true
+		}
+	} else if ok && !hmac.Equal(mac, multiJoinMac(u.session.key, id, nonce)) {
+		//loggo.Debug("multi join mac fail %s %s", id, conn.Info())
+		u = nil
+	}
+	l.lock.Unlock()
+
+	if u == nil || u.session.wg.IsExit() {
+		conn.Write([]byte{1})
+		conn.Close()
+		return nil
+	}
+
+	_, err = conn.Write([]byte{0})
+	if err != nil {
+		conn.Close()
+		if isnew {
+			u.session.wg.Stop()
+		}
+		return nil
+	}
+	conn.SetDeadline(time.Time{})
+
+	u.session.addPath(-1, conn)
+	if isnew {
+		l.accept.Write(u)
+	}
+	return nil
+}
+
+func (c *MultiConn) newSonny(id string, key []byte) *MultiConn {
+	l := c.listener
+	s := newMultiSession(id, c.config)
+	s.key = key
+	s.wg = group.NewGroup("MultiConn ListenerSonny"+" "+id, l.wg, func() {
+		s.closePaths()
+		l.lock.Lock()
+		delete(l.sessions, id)
+		l.lock.Unlock()
+	})
+	s.wg.Go("MultiConn update"+" "+id, func() error {
+		return s.update()
+	})
+	return &MultiConn{config: c.config, session: s,
+		localaddr:  &connAddr{network: "multi", addr: l.addr},
+		remoteaddr: &connAddr{network: "multi", addr: id}}
+}
+
+func newMultiSession(id string, config *MultiConfig) *multiSession {
+	return &multiSession{
+		id:       id,
+		config:   config,
+		unack:    list.New(),
+		recvbuf:  make(map[uint64][]byte),
+		deadtime: time.Now(),
+	}
+}
+
+func (s *multiSession) dialPath(ctx context.Context, a multiAddr, flag byte) (Conn, error) {
+	c, err := NewConn(a.proto)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.DialContext(ctx, a.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(s.config.HandshakeTimeoutMs)))
+	hello := make([]byte, 0, len(multiMagic)+multiIdLen+1)
+	hello = append(hello, multiMagic...)
+	hello = append(hello, []byte(s.id)...)
+	hello = append(hello, flag)
+	if flag == multiHelloNew {
+		hello = append(hello, s.key...)
+	}
+	_, err = conn.Write(hello)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if flag == multiHelloJoin {
+		nonce := make([]byte, multiKeyLen)
+		_, err = io.ReadFull(conn, nonce)
+		if err == nil {
+			_, err = conn.Write(multiJoinMac(s.key, s.id, nonce))
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	rsp := make([]byte, 1)
+	_, err = io.ReadFull(conn, rsp)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if rsp[0] != 0 {
+		conn.Close()
+		return nil, errors.New("multi session rejected " + s.id)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// multiJoinMac signs a join of the session id with the nonce the listener sent
+func multiJoinMac(key []byte, id string, nonce []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(id))
+	h.Write(nonce)
+	return h.Sum(nil)[0:multiKeyLen]
+}
+
+// addPath puts a new path at index, or appends it if index < 0
+func (s *multiSession) addPath(index int, conn Conn) {
+	if s.wg.IsExit() {
+		conn.Close()
+		return
+	}
+
+	p := &multiPath{conn: conn, lastrecv: time.Now().UnixNano()}
+
+	s.lock.Lock()
+	if index >= 0 {
+		s.paths[index] = p
+	} else {
+		// the listener does not know the index of a joining path, drop the dead ones so a flapping client does not grow paths
+		paths := make([]*multiPath, 0, len(s.paths)+1)
+		for _, pp := range s.paths {
+			if atomic.LoadInt32(&pp.dead) == 0 {
+				paths = append(paths, pp)
+			}
+		}
+		s.paths = append(paths, p)
+	}
+	s.deadtime = time.Time{}
+	s.lock.Unlock()
+
+	s.wg.Go("MultiConn recvPath"+" "+conn.Info(), func() error {
+		return s.recvPath(p)
+	})
+
+	s.resend()
+}
+
+func (s *multiSession) pathDead(p *multiPath) {
+	if !atomic.CompareAndSwapInt32(&p.dead, 0, 1) {
+		return
+	}
+	p.conn.Close()
+
+	s.lock.Lock()
+	alive := false
+	for _, pp := range s.paths {
+		if pp != nil && atomic.LoadInt32(&pp.dead) == 0 {
+			alive = true
+		}
+	}
+	if !alive {
+		s.deadtime = time.Now()
+	}
+	s.lock.Unlock()
+
+	s.resend()
+}
+
+func (s *multiSession) closePaths() {
+	s.lock.Lock()
+	paths := make([]*multiPath, 0, len(s.paths))
+	for _, p := range s.paths {
+		if p != nil {
+			paths = append(paths, p)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, p := range paths {
+		atomic.StoreInt32(&p.dead, 1)
+		p.conn.Close()
+	}
+}
+
+func (s *multiSession) alivePaths() []*multiPath {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ret []*multiPath
+	for _, p := range s.paths {
+		if p != nil && atomic.LoadInt32(&p.dead) == 0 {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func (s *multiSession) pickPath() *multiPath {
+	paths := s.alivePaths()
+	if len(paths) <= 0 {
+		return nil
+	}
+	if s.config.Mode == "failover" {
+		return paths[0]
+	}
+	s.lock.Lock()
+	s.next++
+	index := s.next % len(paths)
+	s.lock.Unlock()
+	return paths[index]
+}
+
+func (s *multiSession) push(data []byte) *multiFrame {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.unacksize >= s.config.MaxUnackSize || s.unack.Len() >= s.config.MaxUnackFrames {
+		return nil
+	}
+	f := &multiFrame{seq: s.sendseq, data: make([]byte, len(data))}
+	copy(f.data, data)
+	s.sendseq++
+	s.unack.PushBack(f)
+	s.unacksize += len(data)
+	return f
+}
+
+func (s *multiSession) unackSize() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.unacksize
+}
+
+func (s *multiSession) resend() {
+	s.lock.Lock()
+	frames := make([]*multiFrame, 0, s.unack.Len())
+	for e := s.unack.Front(); e != nil; e = e.Next() {
+		frames = append(frames, e.Value.(*multiFrame))
+	}
+	s.lock.Unlock()
+
+	for _, f := range frames {
+		if !s.sendFrame(multiFrameData, f.seq, f.data) {
+			return
+		}
+	}
+}
+
+func (s *multiSession) marshalFrame(typ byte, seq uint64, data []byte) []byte {
+	b := make([]byte, multiHeaderLen+len(data))
+	b[0] = typ
+	binary.BigEndian.PutUint64(b[1:9], seq)
+	binary.BigEndian.PutUint32(b[9:13], uint32(len(data)))
+	copy(b[multiHeaderLen:], data)
+	return b
+}
+
+// sendFrame returns false if no path took the frame, unacked data is sent again when a path dies or joins
+func (s *multiSession) sendFrame(typ byte, seq uint64, data []byte) bool {
+	p := s.pickPath()
+	if p == nil {
+		return false
+	}
+	err := s.writePath(p, s.marshalFrame(typ, seq, data))
+	if err != nil {
+		s.pathDead(p)
+		return false
+	}
+	return true
+}
+
+func (s *multiSession) writePath(p *multiPath, b []byte) error {
+	p.writelock.Lock()
+	defer p.writelock.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(time.Millisecond * time.Duration(s.config.PathTimeoutMs)))
+	_, err := p.conn.Write(b)
+	return err
+}
+
+func (s *multiSession) recvBufferFull() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.readbuf) >= s.config.MaxRecvBufferSize
+}
+
+func (s *multiSession) recvPath(p *multiPath) error {
+	header := make([]byte, multiHeaderLen)
+	for !s.wg.IsExit() && atomic.LoadInt32(&p.dead) == 0 {
+		// stop reading while the app is slow, the path itself will slow down the peer
+		for s.recvBufferFull() && !s.wg.IsExit() {
+			atomic.StoreInt64(&p.lastrecv, time.Now().UnixNano())
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		_, err := io.ReadFull(p.conn, header)
+		if err != nil {
+			s.pathDead(p)
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(header[9:13]))
+		if size > s.config.MaxFrameSize {
+			s.pathDead(p)
+			return nil
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(p.conn, data)
+		if err != nil {
+			s.pathDead(p)
+			return nil
+		}
+		atomic.StoreInt64(&p.lastrecv, time.Now().UnixNano())
+
+		if !s.onFrame(header[0], binary.BigEndian.Uint64(header[1:9]), data) {
+			loggo.Error("MultiConn path send frame out of window %s", p.conn.Info())
+			s.pathDead(p)
+			return nil
+		}
+	}
+	return nil
+}
+
+// onFrame returns false when the peer sends past the window it may have unacked, the path is dropped then
+func (s *multiSession) onFrame(typ byte, seq uint64, data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch typ {
+	case multiFrameData:
+		if seq < s.recvseq {
+			return true
+		}
+		if _, ok := s.recvbuf[seq]; ok {
+			return true
+		}
+		// the sender pushes a frame while unacksize is under MaxUnackSize, so one more frame may go over it
+		if seq-s.recvseq >= uint64(s.config.MaxUnackFrames) ||
+			s.recvbufsize+len(data) > s.config.MaxUnackSize+s.config.MaxFrameSize {
+			return false
+		}
+		s.recvbuf[seq] = data
+		s.recvbufsize += len(data)
+		for {
+			d, ok := s.recvbuf[s.recvseq]
+			if !ok {
+				break
+			}
+			s.readbuf = append(s.readbuf, d...)
+			delete(s.recvbuf, s.recvseq)
+			s.recvbufsize -= len(d)
+			s.recvseq++
+		}
+	case multiFrameAck:
+		for e := s.unack.Front(); e != nil; {
+			f := e.Value.(*multiFrame)
+			if f.seq >= seq {
+				break
+			}
+			next := e.Next()
+			s.unack.Remove(e)
+			s.unacksize -= len(f.data)
+			e = next
+		}
+	case multiFrameFin:
+		s.finrecv = true
+		s.finseq = seq
+	}
+	return true
+}
+
+// update acks and keeps every path alive, and closes the session when no path is back in time
+func (s *multiSession) update() error {
+	for !s.wg.IsExit() {
+		select {
+		case <-s.wg.Done():
+			return nil
+		case <-time.After(time.Millisecond * time.Duration(s.config.AckIntervalMs)):
+		}
+
+		s.lock.Lock()
+		recvseq := s.recvseq
+		deadtime := s.deadtime
+		s.lock.Unlock()
+
+		now := time.Now()
+		for _, p := range s.alivePaths() {
+			if now.UnixNano()-atomic.LoadInt64(&p.lastrecv) > int64(time.Millisecond)*int64(s.config.PathTimeoutMs) {
+				s.pathDead(p)
+				continue
+			}
+			if s.writePath(p, s.marshalFrame(multiFrameAck, recvseq, nil)) != nil {
+				s.pathDead(p)
+			}
+		}
+
+		if !deadtime.IsZero() && now.Sub(deadtime) > time.Millisecond*time.Duration(s.config.SessionTimeoutMs) {
+			return errors.New("all path timeout")
+		}
+	}
+	return nil
+}
+
+// reconnect dials the dead paths of a dialer session again
+func (s *multiSession) reconnect() error {
+	for !s.wg.IsExit() {
+		for i := range s.addrs {
+			s.lock.Lock()
+			p := s.paths[i]
+			s.lock.Unlock()
+			if p != nil && atomic.LoadInt32(&p.dead) == 0 {
+				continue
+			}
+			conn, err := s.dialPath(s.wg.Context(), s.addrs[i], multiHelloJoin)
+			if err != nil {
+				continue
+			}
+			s.addPath(i, conn)
+		}
+
+		select {
+		case <-s.wg.Done():
+			return nil
+		case <-time.After(time.Millisecond * time.Duration(s.config.ReconnectMs)):
+		}
+	}
+	return nil
+}
+
+func (c *MultiConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultMultiConfig()
+	}
+}
+
+func (c *MultiConn) SetConfig(config *MultiConfig) {
+	c.config = config
+}
+
+func (c *MultiConn) GetConfig() *MultiConfig {
+	c.checkConfig()
+	return c.config
+}
@@ -0,0 +1,294 @@
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test0001MULTI(t *testing.T) {
+	for _, addr := range []string{"", "tcp:127.0.0.1:58092", "udp://127.0.0.1:58092", "multi://127.0.0.1:58092", "nothing://127.0.0.1:58092"} {
+		_, err := parseMultiAddr(addr)
+		fmt.Println(addr, err)
+		if err == nil {
+			t.Error("parse should fail", addr)
+		}
+	}
+
+	c, err := NewConn("multi")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	addr := "tcp://127.0.0.1:58092,rudp://127.0.0.1:58092"
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	src := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(src)
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done " + sonny.Info())
+		io.Copy(sonny, sonny)
+		sonny.Close()
+	}()
+
+	ccc, err := c.Dial(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println("dial done " + ccc.Info())
+
+	for i := 0; i < 50 && len(ccc.(*MultiConn).session.alivePaths()) < 2; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	go func() {
+		ccc.Write(src)
+	}()
+
+	begin := time.Now()
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println("echo", len(dst), "cost", time.Now().Sub(begin), "paths", len(ccc.(*MultiConn).session.alivePaths()))
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+	ccc.Close()
+}
+
+func Test0002MULTI(t *testing.T) {
+	c, _ := NewConn("multi")
+	c.(*MultiConn).GetConfig().ReconnectMs = 200
+
+	addr := "tcp://127.0.0.1:58093,rhttp://127.0.0.1:58094"
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	src := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(2)).Read(src)
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done " + sonny.Info())
+		for i := 0; i < len(src); i += 64 * 1024 {
+			_, err := sonny.Write(src[i : i+64*1024])
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		sonny.Close()
+	}()
+
+	ccc, err := c.Dial(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	s := ccc.(*MultiConn).session
+
+	for i := 0; i < 50 && len(s.alivePaths()) < 2; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+	fmt.Println("paths", len(s.alivePaths()))
+
+	// kill the tcp path in the middle of the stream
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		s.lock.Lock()
+		p := s.paths[0]
+		s.lock.Unlock()
+		fmt.Println("kill path " + p.conn.Info())
+		p.conn.Close()
+	}()
+
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+
+	_, err = ccc.Read(make([]byte, 10))
+	fmt.Println("read after fin", err)
+	if err != io.EOF {
+		t.Error("should be EOF", err)
+	}
+
+	s.lock.Lock()
+	p := s.paths[0]
+	s.lock.Unlock()
+	fmt.Println("path after reconnect " + p.conn.Info())
+}
+
+func Test0003MULTI(t *testing.T) {
+	config := DefaultMultiConfig()
+	s := newMultiSession("test", config)
+
+	// seq 0 is lost, the rest waits in the reorder window
+	for i := 1; i < config.MaxUnackFrames; i++ {
+		if !s.onFrame(multiFrameData, uint64(i), []byte{byte(i)}) {
+			t.Error("frame in window should be kept", i)
+			return
+		}
+	}
+	if s.onFrame(multiFrameData, uint64(config.MaxUnackFrames), []byte{0}) {
+		t.Error("frame out of window should fail")
+	}
+	if s.onFrame(multiFrameData, 1<<40, []byte{0}) {
+		t.Error("far frame should fail")
+	}
+	if len(s.recvbuf) != config.MaxUnackFrames-1 {
+		t.Error("recvbuf should not grow", len(s.recvbuf))
+	}
+
+	s.onFrame(multiFrameData, 0, []byte{0})
+	if s.recvseq != uint64(config.MaxUnackFrames) || len(s.recvbuf) != 0 || s.recvbufsize != 0 || len(s.readbuf) != config.MaxUnackFrames {
+		t.Error("reorder fail", s.recvseq, len(s.recvbuf), s.recvbufsize, len(s.readbuf))
+	}
+
+	// big frames are bound by bytes too
+	s = newMultiSession("test", config)
+	frame := make([]byte, config.MaxFrameSize)
+	n := 0
+	for i := 1; i < config.MaxUnackFrames; i++ {
+		if !s.onFrame(multiFrameData, uint64(i), frame) {
+			break
+		}
+		n++
+	}
+	fmt.Println("big frames kept", n, s.recvbufsize)
+	if s.recvbufsize > config.MaxUnackSize+config.MaxFrameSize || n != config.MaxUnackSize/config.MaxFrameSize+1 {
+		t.Error("recvbuf bytes not bound", n, s.recvbufsize)
+	}
+}
+
+func Test0004MULTI(t *testing.T) {
+	c, _ := NewConn("multi")
+	addr := "tcp://127.0.0.1:58134"
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	sonnych := make(chan *MultiConn, 1)
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sonnych <- sonny.(*MultiConn)
+	}()
+
+	ccc, err := c.Dial(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	s := ccc.(*MultiConn).session
+	sonny := <-sonnych
+
+	// join by hand, mac nil signs with the session key
+	join := func(flag byte, mac []byte) (Conn, byte) {
+		tc, _ := NewConn("tcp")
+		conn, err := tc.Dial("127.0.0.1:58134")
+		if err != nil {
+			t.Error(err)
+			return nil, 1
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		hello := append(append(append([]byte{}, multiMagic...), []byte(s.id)...), flag)
+		if flag == multiHelloNew {
+			hello = append(hello, make([]byte, multiKeyLen)...)
+		}
+		conn.Write(hello)
+		if flag == multiHelloJoin {
+			nonce := make([]byte, multiKeyLen)
+			io.ReadFull(conn, nonce)
+			if mac == nil {
+				mac = multiJoinMac(s.key, s.id, nonce)
+			}
+			conn.Write(mac)
+		}
+		rsp := make([]byte, 1)
+		_, err = io.ReadFull(conn, rsp)
+		if err != nil {
+			conn.Close()
+			return nil, 1
+		}
+		return conn, rsp[0]
+	}
+
+	if conn, rsp := join(multiHelloJoin, make([]byte, multiKeyLen)); rsp == 0 {
+		conn.Close()
+		t.Error("join without the key should fail")
+	}
+	if conn, rsp := join(multiHelloNew, nil); rsp == 0 {
+		conn.Close()
+		t.Error("new with a used id should fail")
+	}
+
+	// a flapping client joins again and again, the dead paths do not pile up
+	for i := 0; i < 20; i++ {
+		conn, rsp := join(multiHelloJoin, nil)
+		if rsp != 0 {
+			t.Error("join with the key should work")
+			return
+		}
+		conn.Close()
+		time.Sleep(time.Millisecond * 20)
+	}
+	sonny.session.lock.Lock()
+	n := len(sonny.session.paths)
+	sonny.session.lock.Unlock()
+	fmt.Println("sonny paths", n, len(sonny.session.alivePaths()))
+	if n > 3 {
+		t.Error("dead paths not pruned", n)
+	}
+
+	ccc.Write([]byte("multi"))
+	buf := make([]byte, 100)
+	sonny.SetReadDeadline(time.Now().Add(time.Second * 5))
+	rn, err := sonny.Read(buf)
+	if err != nil || string(buf[0:rn]) != "multi" {
+		t.Error("session broken after joins", err)
+	}
+}
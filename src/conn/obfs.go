@@ -0,0 +1,268 @@
+package conn
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3t2ugg1e/go-engine/src/frame"
+	"github.com/3t2ugg1e/go-engine/src/group"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/chacha20"
+)
+
+// ObfsConfig 包混淆配置，两端在CONN/CONNRSP中协商方案，握手总是用Key掩码，协商不成则之后明文
+type ObfsConfig struct {
+	Scheme   string // 支持的方案，按优先级逗号分隔，pad为掩码加填充和发送抖动，mask只掩码，空为不混淆
+	Key      string // 掩码密钥，两端需一致，不能为空
+	PadMin   int    // 随机填充的最小字节数
+	PadMax   int    // 随机填充的最大字节数
+	Sizes    []int  // 包长分布，填充到不小于原包的随机一档，为空时用PadMin到PadMax
+	JitterMs int    // pad方案下每个包的随机发送延迟上限
+}
+
+func DefaultObfsConfig() *ObfsConfig {
+	return &ObfsConfig{
+		Scheme:   "pad,mask",
+		Key:      "",
+		PadMin:   0,
+		PadMax:   128,
+		Sizes:    nil,
+		JitterMs: 0,
+	}
+}
+
+// checkObfs makes sure a config that masks has a key, an empty one would mask with a well known key
+func checkObfs(config *ObfsConfig) error {
+	if config == nil || config.Scheme == "" {
+		return nil
+	}
+	if config.Key == "" {
+		return errors.New("obfs need Key")
+	}
+	return nil
+}
+
+// obfsScheme returns what f is wrapped with, the CONN/CONNRSP handshake is always masked so the offered schemes do not give the protocol away
+func obfsScheme(fm *frame.FrameMgr, f *frame.Frame) string {
+	if f.Data != nil && (f.Data.Type == int32(frame.FrameData_CONN) || f.Data.Type == int32(frame.FrameData_CONNRSP)) {
+		return "mask"
+	}
+	return fm.GetObfs()
+}
+
+// nonce(12) | masked: len(2) crc32(4) frame | padding
+const obfsNonceLen = chacha20.NonceSize
+const obfsHeadLen = obfsNonceLen + 6
+
+// obfsJitterQueueLen bounds the packets waiting for their jitter, a send past it fails instead of piling up
+const obfsJitterQueueLen = 1024
+
+// obfsWriteTimeout is the write deadline of a delayed packet, the one the caller set may be gone by then
+const obfsWriteTimeout = time.Millisecond * 100
+
+type obfsDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+type obfsPacket struct {
+	b     []byte
+	at    time.Time
+	conn  obfsDeadliner
+	write func([]byte) error
+}
+
+// obfuscator wraps the marshalled frames, one is shared by a dialer or by a listener and its sonnies,
+// it only hides the frames from a passive look, crc32 is no mac and anyone with the key can forge or replay a packet
+type obfuscator struct {
+	config  *ObfsConfig
+	key     [32]byte
+	maxsize int
+	lock    sync.Mutex
+	rand    *rand.Rand
+	queue   chan *obfsPacket // 等抖动发送的包，JitterMs为0时为nil
+	last    time.Time        // 最后入队的包的发送时间，后面的包不早于它，保持包序
+	closed  int32
+}
+
+// newObfuscator returns nil when there is nothing to negotiate, maxsize limits the padded packet to what the peer can read
+func newObfuscator(config *ObfsConfig, maxsize int) *obfuscator {
+	if config == nil || config.Scheme == "" {
+		return nil
+	}
+	o := &obfuscator{config: config, key: sha256.Sum256([]byte(config.Key)), maxsize: maxsize,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if config.JitterMs > 0 {
+		o.queue = make(chan *obfsPacket, obfsJitterQueueLen)
+	}
+	return o
+}
+
+func (o *obfuscator) stream(nonce []byte) *chacha20.Cipher {
+	var n [chacha20.NonceSize]byte
+	copy(n[:], nonce)
+	c, _ := chacha20.NewUnauthenticatedCipher(o.key[:], n[:])
+	return c
+}
+
+func (o *obfuscator) padding(n int) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	pad := 0
+	if len(o.config.Sizes) > 0 {
+		var fit []int
+		for _, s := range o.config.Sizes {
+			if s >= n {
+				fit = append(fit, s)
+			}
+		}
+		if len(fit) > 0 {
+			pad = fit[o.rand.Intn(len(fit))] - n
+		}
+	} else if o.config.PadMax > o.config.PadMin {
+		pad = o.config.PadMin + o.rand.Intn(o.config.PadMax-o.config.PadMin+1)
+	} else {
+		pad = o.config.PadMin
+	}
+	if o.maxsize > 0 && n+pad > o.maxsize {
+		pad = o.maxsize - n
+	}
+	if pad < 0 {
+		pad = 0
+	}
+	return pad
+}
+
+// encode wraps b with the negotiated scheme, b is returned as is when there is none
+func (o *obfuscator) encode(scheme string, b []byte) []byte {
+	if o == nil || scheme == "" || len(b) > 0xFFFF {
+		return b
+	}
+
+	pad := 0
+	if scheme == "pad" {
+		pad = o.padding(obfsHeadLen + len(b))
+	}
+
+	ret := make([]byte, obfsHeadLen+len(b)+pad)
+	crand.Read(ret[0:obfsNonceLen])
+	o.lock.Lock()
+	o.rand.Read(ret[obfsHeadLen+len(b):])
+	o.lock.Unlock()
+
+	binary.BigEndian.PutUint16(ret[obfsNonceLen:], uint16(len(b)))
+	binary.BigEndian.PutUint32(ret[obfsNonceLen+2:], crc32.ChecksumIEEE(b))
+	copy(ret[obfsHeadLen:], b)
+
+	masked := ret[obfsNonceLen : obfsHeadLen+len(b)]
+	o.stream(ret[0:obfsNonceLen]).XORKeyStream(masked, masked)
+	return ret
+}
+
+// decode unwraps b, a packet that does not check out is returned as is with false
+func (o *obfuscator) decode(b []byte) ([]byte, bool) {
+	if o == nil || len(b) < obfsHeadLen {
+		return b, false
+	}
+
+	s := o.stream(b[0:obfsNonceLen])
+	var head [obfsHeadLen - obfsNonceLen]byte
+	s.XORKeyStream(head[:], b[obfsNonceLen:obfsHeadLen])
+	n := int(binary.BigEndian.Uint16(head[0:2]))
+	if n > len(b)-obfsHeadLen {
+		return b, false
+	}
+
+	ret := make([]byte, n)
+	s.XORKeyStream(ret, b[obfsHeadLen:obfsHeadLen+n])
+	if crc32.ChecksumIEEE(ret) != binary.BigEndian.Uint32(head[2:6]) {
+		return b, false
+	}
+	return ret, true
+}
+
+// unmarshal decodes b into f, a plain packet is taken before the negotiation or when there is no common scheme,
+// it is rejected once fm has negotiated one, fm is nil when the receiver is not known yet
+func (o *obfuscator) unmarshal(fm *frame.FrameMgr, b []byte, f *frame.Frame) error {
+	data, ok := o.decode(b)
+	if !ok && fm != nil && fm.GetObfs() != "" {
+		return errors.New("obfs packet not decode")
+	}
+	return proto.Unmarshal(data, f)
+}
+
+// send delays the packet by a random jitter under the pad scheme, b must not be reused by the caller,
+// the delayed packets keep their order and are written by loopJitter with a fresh deadline on conn
+func (o *obfuscator) send(scheme string, b []byte, conn obfsDeadliner, write func([]byte) error) error {
+	if o == nil || scheme != "pad" || o.queue == nil {
+		return write(b)
+	}
+	if atomic.LoadInt32(&o.closed) != 0 {
+		return errors.New("obfs closed")
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	at := time.Now().Add(time.Duration(o.rand.Int63n(int64(time.Millisecond) * int64(o.config.JitterMs))))
+	if at.Before(o.last) {
+		at = o.last
+	}
+	select {
+	case o.queue <- &obfsPacket{b: b, at: at, conn: conn, write: write}:
+		o.last = at
+		return nil
+	default:
+		return errors.New("obfs jitter queue full")
+	}
+}
+
+// loopJitter writes the delayed packets when their time comes, it runs in the group of the dialer or the listener,
+// the packets still queued when the group exits are dropped and later sends fail
+func (o *obfuscator) loopJitter(wg *group.Group) error {
+	if o == nil || o.queue == nil {
+		return nil
+	}
+	defer atomic.StoreInt32(&o.closed, 1)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		var p *obfsPacket
+		select {
+		case <-wg.Done():
+			return nil
+		case p = <-o.queue:
+		}
+
+		if d := time.Until(p.at); d > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(d)
+			select {
+			case <-wg.Done():
+				return nil
+			case <-timer.C:
+			}
+		}
+
+		if p.conn != nil {
+			p.conn.SetWriteDeadline(time.Now().Add(obfsWriteTimeout))
+		}
+		if err := p.write(p.b); err != nil {
+			loggo.Warn("obfs jitter write error %s", err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/frame"
+	"github.com/3t2ugg1e/go-engine/src/group"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test0001OBFS(t *testing.T) {
+	config := DefaultObfsConfig()
+	config.Key = "123456"
+	o := newObfuscator(config, 1024)
+
+	src := []byte("hello obfs frame")
+	for _, scheme := range []string{"pad", "mask"} {
+		b := o.encode(scheme, src)
+		if bytes.Contains(b, src) {
+			t.Error(scheme + " not masked")
+		}
+		if scheme == "mask" && len(b) != len(src)+obfsHeadLen {
+			t.Error("mask should not pad", len(b))
+		}
+		if d, ok := o.decode(b); !ok || !bytes.Equal(d, src) {
+			t.Error(scheme + " decode fail")
+		}
+	}
+
+	if !bytes.Equal(o.encode("", src), src) {
+		t.Error("no scheme should be plain")
+	}
+	if d, ok := o.decode(src); ok || !bytes.Equal(d, src) {
+		t.Error("plain packet should pass through")
+	}
+
+	other := DefaultObfsConfig()
+	other.Key = "654321"
+	b := o.encode("mask", src)
+	if _, ok := newObfuscator(other, 1024).decode(b); ok {
+		t.Error("wrong key should not decode")
+	}
+
+	if newObfuscator(nil, 1024) != nil || newObfuscator(&ObfsConfig{}, 1024) != nil {
+		t.Error("no scheme should have no obfuscator")
+	}
+}
+
+func Test0002OBFS(t *testing.T) {
+	config := DefaultObfsConfig()
+	config.Sizes = []int{100, 500, 1000}
+	o := newObfuscator(config, 800)
+
+	src := make([]byte, 200)
+	for i := 0; i < 100; i++ {
+		b := o.encode("pad", src)
+		if len(b) != 500 && len(b) != 800 {
+			t.Error("padded size not in sizes", len(b))
+		}
+		if d, ok := o.decode(b); !ok || !bytes.Equal(d, src) {
+			t.Error("decode fail")
+		}
+	}
+
+	config.Sizes = nil
+	config.PadMin = 10
+	config.PadMax = 20
+	for i := 0; i < 100; i++ {
+		n := len(o.encode("pad", src)) - len(src) - obfsHeadLen
+		if n < 10 || n > 20 {
+			t.Error("padding out of range", n)
+		}
+	}
+}
+
+func Test0003OBFS(t *testing.T) {
+	config := DefaultObfsConfig()
+	if checkObfs(config) == nil {
+		t.Error("obfs without key should fail")
+	}
+	config.Key = "123456"
+	if checkObfs(config) != nil || checkObfs(nil) != nil {
+		t.Error("check obfs fail")
+	}
+	o := newObfuscator(config, 1024)
+
+	// the handshake is masked even before there is a negotiated scheme
+	fm := frame.NewFrameMgr(1024, 100000, 1024*1024, 100, 400, 0, 0)
+	fm.SetObfs(config.Scheme)
+	fm.Connect()
+	fm.Update()
+	conn := fm.GetSendList().Front().Value.(*frame.Frame)
+	if obfsScheme(fm, conn) != "mask" {
+		t.Error("handshake should be masked")
+	}
+	data := &frame.Frame{Type: int32(frame.Frame_DATA), Data: &frame.FrameData{Type: int32(frame.FrameData_USER_DATA)}}
+	if obfsScheme(fm, data) != "" {
+		t.Error("data before negotiation should be plain")
+	}
+
+	mb, _ := proto.Marshal(data)
+	f := &frame.Frame{}
+	if o.unmarshal(fm, mb, f) != nil {
+		t.Error("plain packet before negotiation should pass")
+	}
+	if o.unmarshal(fm, o.encode("mask", mb), f) != nil {
+		t.Error("masked packet should pass")
+	}
+
+	// CONNRSP from the peer settles the scheme, plain packets are dropped from then on
+	rsp := &frame.Frame{Type: int32(frame.Frame_DATA), Id: 0, Data: &frame.FrameData{Type: int32(frame.FrameData_CONNRSP), Data: []byte("pad")}}
+	fm.OnRecvFrame(rsp)
+	fm.Update()
+	if fm.GetObfs() != "pad" {
+		t.Error("obfs should negotiate pad", fm.GetObfs())
+	}
+	if o.unmarshal(fm, mb, f) == nil {
+		t.Error("plain packet after negotiation should be dropped")
+	}
+	if o.unmarshal(fm, o.encode("pad", mb), f) != nil {
+		t.Error("padded packet should pass")
+	}
+}
+
+func Test0004OBFS(t *testing.T) {
+	config := DefaultObfsConfig()
+	config.Key = "123456"
+	config.JitterMs = 20
+	o := newObfuscator(config, 1024)
+
+	b := o.encode("mask", []byte("nonce"))
+	if bytes.Equal(b[0:obfsNonceLen], o.encode("mask", []byte("nonce"))[0:obfsNonceLen]) {
+		t.Error("nonce should not repeat")
+	}
+
+	wg := group.NewGroup("Test0004OBFS", nil, nil)
+	wg.Go("loopJitter", func() error {
+		return o.loopJitter(wg)
+	})
+
+	var lock sync.Mutex
+	var got []byte
+	write := func(b []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		got = append(got, b[0])
+		return errors.New("write error is logged")
+	}
+
+	// the jitter delays the packets but keeps their order
+	begin := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := o.send("pad", []byte{byte(i)}, nil, write); err != nil {
+			t.Error("send fail", err)
+		}
+	}
+	if o.send("mask", []byte{0xFF}, nil, func(b []byte) error { return errors.New("mask is not delayed") }) == nil {
+		t.Error("mask should write at once")
+	}
+	for time.Since(begin) < time.Second {
+		lock.Lock()
+		n := len(got)
+		lock.Unlock()
+		if n == 100 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	lock.Lock()
+	if len(got) != 100 {
+		t.Error("jitter lost packets", len(got))
+	}
+	for i := range got {
+		if got[i] != byte(i) {
+			t.Error("jitter reordered packets", got)
+			break
+		}
+	}
+	lock.Unlock()
+
+	// nothing is written once the group exits
+	o.send("pad", []byte{0xFE}, nil, write)
+	wg.Stop()
+	wg.Wait()
+	if o.send("pad", []byte{0xFD}, nil, write) == nil {
+		t.Error("send after close should fail")
+	}
+	time.Sleep(time.Millisecond * 50)
+	lock.Lock()
+	if len(got) > 101 {
+		t.Error("write after close", got[100:])
+	}
+	lock.Unlock()
+}
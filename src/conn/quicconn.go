@@ -6,19 +6,72 @@ import (
 	"errors"
 	"github.com/3t2ugg1e/go-engine/src/common"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
 	"github.com/xtaci/smux"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+func init() {
+	Register("quic", func() Conn {
+		return &QuicConn{}
+	}, true)
+}
+
+type QuicConfig struct {
+	CertFile           string   // 服务端证书，空则生成自签名证书
+	KeyFile            string   // 服务端私钥
+	CAFile             string   // 客户端校验服务端证书的CA，空则用系统根证书
+	ServerName         string   // 客户端校验证书用的域名，空则用地址中的host
+	Insecure           bool     // 客户端不校验服务端证书
+	Alpn               []string // ALPN，两端需有交集
+	Allow0RTT          bool     // 开启0-RTT，重连时握手完成前即可发数据，两端需都开启
+	Datagram           bool     // 开启datagram，用SendDatagram/ReceiveDatagram收发不可靠消息，两端需都开启
+	KeepAliveMs        int      // 保活包间隔，0为不发
+	IdleTimeoutMs      int      // 空闲超时
+	HandshakeTimeoutMs int      // 握手超时
+	MaxIncomingStreams int      // 对端最多可同时打开的流
+	StreamWindow       int      // 每个流的最大接收窗口
+	ConnWindow         int      // 整个连接的最大接收窗口
+	Smux               bool     // true为在一个quic流上跑smux，false为用原生quic流，两端需一致
+}
+
+func DefaultQuicConfig() *QuicConfig {
+	return &QuicConfig{
+		Alpn:               []string{"QuicConn"},
+		Allow0RTT:          false,
+		Datagram:           false,
+		KeepAliveMs:        10000,
+		IdleTimeoutMs:      30000,
+		HandshakeTimeoutMs: 5000,
+		MaxIncomingStreams: 1024,
+		StreamWindow:       6 * 1024 * 1024,
+		ConnWindow:         15 * 1024 * 1024,
+		Smux:               true,
+	}
+}
+
 type QuicConn struct {
-	qsession quic.Connection
-	session  *smux.Session
-	qsteam   quic.Stream
-	stream   *smux.Stream
-	listener quic.Listener
-	info     string
+	config    *QuicConfig
+	qsession  quic.Connection
+	pconn     net.PacketConn
+	session   *smux.Session
+	qsteam    quic.Stream
+	stream    streamIO
+	listener  quic.Listener
+	elistener quic.EarlyListener
+	info      string
+	tracer    *quicConnTracer
 }
 
+// a native stream is only seen by the peer once it carries data, so every stream starts with this byte
+const quicStreamHead = 0x51
+
+var gQuicSessionCache = tls.NewLRUClientSessionCache(64)
+
 func (c *QuicConn) Name() string {
 	return "quic"
 }
@@ -37,11 +90,24 @@ func (c *QuicConn) Write(p []byte) (n int, err error) {
 	return 0, errors.New("empty conn")
 }
 
+// Close closes the whole quic connection, and the udp socket of a dialer, not only the stream
 func (c *QuicConn) Close() error {
-	if c.stream != nil {
-		return c.stream.Close()
+	if c.qsession != nil {
+		if c.stream != nil {
+			c.stream.Close()
+		}
+		if c.session != nil {
+			c.session.Close()
+		}
+		err := c.qsession.CloseWithError(0, "")
+		if c.pconn != nil {
+			c.pconn.Close()
+		}
+		return err
 	} else if c.listener != nil {
 		return c.listener.Close()
+	} else if c.elistener != nil {
+		return c.elistener.Close()
 	}
 	return nil
 }
@@ -50,20 +116,89 @@ func (c *QuicConn) Info() string {
 	if c.info != "" {
 		return c.info
 	}
-	if c.session != nil {
+	if c.qsession != nil {
 		c.info = c.qsession.LocalAddr().String() + "<--quic-->" + c.qsession.RemoteAddr().String()
-	} else if c.listener != nil {
-		c.info = "kcp--" + c.listener.Addr().String()
+	} else if c.listener != nil || c.elistener != nil {
+		c.info = "quic--" + c.LocalAddr().String()
 	} else {
-		c.info = "empty kcp conn"
+		c.info = "empty quic conn"
 	}
 	return c.info
 }
 
+func (c *QuicConn) LocalAddr() net.Addr {
+	if c.qsession != nil {
+		return c.qsession.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	} else if c.elistener != nil {
+		return c.elistener.Addr()
+	}
+	return nil
+}
+
+func (c *QuicConn) RemoteAddr() net.Addr {
+	if c.qsession != nil {
+		return c.qsession.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *QuicConn) Stats() ConnStats {
+	if c.tracer == nil {
+		return ConnStats{}
+	}
+	ret := c.tracer.stat.stats()
+	ret.Cwnd = int(atomic.LoadInt64(&c.tracer.cwnd))
+	return ret
+}
+
+func (c *QuicConn) SetDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *QuicConn) SetReadDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetReadDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *QuicConn) SetWriteDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetWriteDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *QuicConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultQuicConfig()
+	}
+}
+
+func (c *QuicConn) SetConfig(config *QuicConfig) {
+	c.config = config
+}
+
+func (c *QuicConn) GetConfig() *QuicConfig {
+	c.checkConfig()
+	return c.config
+}
+
 func (c *QuicConn) Dial(dst string) (Conn, error) {
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"QuicConn"},
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *QuicConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	tlsConf, err := c.clientTlsConfig(dst)
+	if err != nil {
+		return nil, err
 	}
 
 	var lc net.ListenConfig
@@ -72,73 +207,429 @@ func (c *QuicConn) Dial(dst string) (Conn, error) {
 	}
 
 	laddr := &net.UDPAddr{}
-	pconn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	pconn, err := lc.ListenPacket(ctx, "udp", laddr.String())
 	if err != nil {
 		return nil, err
 	}
 
 	udpAddr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+
+	var session quic.Connection
+	if c.config.Allow0RTT {
+		session, err = quic.DialEarlyContext(ctx, pconn, udpAddr, dst, tlsConf, c.quicConfig())
+	} else {
+		session, err = quic.DialContext(ctx, pconn, udpAddr, dst, tlsConf, c.quicConfig())
+	}
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+
+	u := &QuicConn{config: c.config, qsession: session, pconn: pconn, tracer: gQuicTracer.get(session)}
+
+	if c.config.Smux {
+		stream, err := session.OpenStreamSync(ctx)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+
+		ss, err := smux.Client(stream, nil)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+
+		st, err := ss.OpenStream()
+		if err != nil {
+			ss.Close()
+			u.Close()
+			return nil, err
+		}
+		u.session = ss
+		u.qsteam = stream
+		u.stream = st
+	} else {
+		stream, err := quicOpenStream(ctx, session)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+		u.qsteam = stream
+		u.stream = stream
+	}
+
+	return u, nil
+}
+
+func (c *QuicConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *QuicConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	tlsConf, err := c.serverTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.config.Allow0RTT {
+		listener, err := quic.ListenAddrEarly(dst, tlsConf, c.quicConfig())
+		if err != nil {
+			return nil, err
+		}
+		return &QuicConn{config: c.config, elistener: listener}, nil
+	}
+
+	listener, err := quic.ListenAddr(dst, tlsConf, c.quicConfig())
 	if err != nil {
 		return nil, err
 	}
 
-	session, err := quic.Dial(pconn, udpAddr, dst, tlsConf, nil)
+	return &QuicConn{config: c.config, listener: listener}, nil
+}
+
+func (c *QuicConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *QuicConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	var session quic.Connection
+	var err error
+	if c.listener != nil {
+		session, err = c.listener.Accept(ctx)
+	} else if c.elistener != nil {
+		session, err = c.elistener.Accept(ctx)
+	} else {
+		return nil, errors.New("not listen")
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := session.OpenStreamSync(context.Background())
+	u := &QuicConn{config: c.config, qsession: session, tracer: gQuicTracer.get(session)}
+
+	if !c.config.Smux {
+		stream, err := quicAcceptStream(ctx, session)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+		u.qsteam = stream
+		u.stream = stream
+		return u, nil
+	}
+
+	stream, err := session.AcceptStream(ctx)
 	if err != nil {
+		u.Close()
 		return nil, err
 	}
 
-	ss, err := smux.Client(stream, nil)
+	ss, err := smux.Server(stream, nil)
 	if err != nil {
+		u.Close()
 		return nil, err
 	}
 
-	st, err := ss.OpenStream()
+	stop := watchContext(ctx, func() {
+		ss.SetDeadline(time.Now())
+	})
+	st, err := ss.AcceptStream()
+	stop()
+	if ctx.Err() != nil {
+		ss.Close()
+		u.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		ss.Close()
+		u.Close()
 		return nil, err
 	}
 
-	return &QuicConn{qsession: session, session: ss, qsteam: stream, stream: st}, nil
+	u.session = ss
+	u.qsteam = stream
+	u.stream = st
+	return u, nil
 }
 
-func (c *QuicConn) Listen(dst string) (Conn, error) {
-	config, err := common.GenerateTLSConfig("QuicConn")
+// OpenStream opens another stream to the peer, a smux one or a native quic one as Smux says
+func (c *QuicConn) OpenStream() (Conn, error) {
+	if c.qsession == nil {
+		return nil, errors.New("not a connected conn")
+	}
+	if c.session != nil {
+		st, err := c.session.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		return &StreamConn{parent: c, stream: st, id: int64(st.ID())}, nil
+	}
+	stream, err := quicOpenStream(context.Background(), c.qsession)
 	if err != nil {
 		return nil, err
 	}
+	return &StreamConn{parent: c, stream: stream, id: int64(stream.StreamID())}, nil
+}
+
+func (c *QuicConn) AcceptStream() (Conn, error) {
+	return c.AcceptStreamContext(context.Background())
+}
 
-	listener, err := quic.ListenAddr(dst, config, nil)
+func (c *QuicConn) AcceptStreamContext(ctx context.Context) (Conn, error) {
+	if c.qsession == nil {
+		return nil, errors.New("not a connected conn")
+	}
+	if c.session != nil {
+		stop := watchContext(ctx, func() {
+			c.session.SetDeadline(time.Now())
+		})
+		st, err := c.session.AcceptStream()
+		stop()
+		if ctx.Err() != nil {
+			c.session.SetDeadline(time.Time{})
+			if st != nil {
+				st.Close()
+			}
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &StreamConn{parent: c, stream: st, id: int64(st.ID())}, nil
+	}
+	stream, err := quicAcceptStream(ctx, c.qsession)
 	if err != nil {
 		return nil, err
 	}
+	return &StreamConn{parent: c, stream: stream, id: int64(stream.StreamID())}, nil
+}
 
-	return &QuicConn{listener: listener}, nil
+// SendDatagram sends b unreliably out of any stream, Datagram must be on at both sides
+func (c *QuicConn) SendDatagram(b []byte) error {
+	if c.qsession == nil {
+		return errors.New("empty conn")
+	}
+	return c.qsession.SendMessage(b)
 }
 
-func (c *QuicConn) Accept() (Conn, error) {
-	session, err := c.listener.Accept(context.Background())
+func (c *QuicConn) ReceiveDatagram() ([]byte, error) {
+	if c.qsession == nil {
+		return nil, errors.New("empty conn")
+	}
+	return c.qsession.ReceiveMessage()
+}
+
+func quicOpenStream(ctx context.Context, session quic.Connection) (quic.Stream, error) {
+	stream, err := session.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, err
 	}
+	_, err = stream.Write([]byte{quicStreamHead})
+	if err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
 
-	stream, err := session.AcceptStream(context.Background())
+func quicAcceptStream(ctx context.Context, session quic.Connection) (quic.Stream, error) {
+	stream, err := session.AcceptStream(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	ss, err := smux.Server(stream, nil)
+	stop := watchContext(ctx, func() {
+		stream.SetReadDeadline(time.Now())
+	})
+	head := make([]byte, 1)
+	_, err = io.ReadFull(stream, head)
+	stop()
+	if ctx.Err() != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
+	if head[0] != quicStreamHead {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, errors.New("quic stream head error")
+	}
+	return stream, nil
+}
 
-	st, err := ss.AcceptStream()
+func (c *QuicConn) quicConfig() *quic.Config {
+	return &quic.Config{
+		Tracer:                     gQuicTracer,
+		HandshakeIdleTimeout:       time.Duration(c.config.HandshakeTimeoutMs) * time.Millisecond,
+		MaxIdleTimeout:             time.Duration(c.config.IdleTimeoutMs) * time.Millisecond,
+		KeepAlivePeriod:            time.Duration(c.config.KeepAliveMs) * time.Millisecond,
+		MaxIncomingStreams:         int64(c.config.MaxIncomingStreams),
+		MaxStreamReceiveWindow:     uint64(c.config.StreamWindow),
+		MaxConnectionReceiveWindow: uint64(c.config.ConnWindow),
+		EnableDatagrams:            c.config.Datagram,
+	}
+}
+
+func (c *QuicConn) alpn() []string {
+	if len(c.config.Alpn) > 0 {
+		return c.config.Alpn
+	}
+	return []string{"QuicConn"}
+}
+
+func (c *QuicConn) clientTlsConfig(host string) (*tls.Config, error) {
+	config, err := clientTls(host, c.config.ServerName, c.config.CAFile, "", c.config.Insecure)
 	if err != nil {
 		return nil, err
 	}
+	config.NextProtos = c.alpn()
+	if c.config.Allow0RTT {
+		config.ClientSessionCache = gQuicSessionCache
+	}
+	return config, nil
+}
 
-	return &QuicConn{qsession: session, session: ss, qsteam: stream, stream: st}, nil
+func (c *QuicConn) serverTlsConfig() (*tls.Config, error) {
+	if c.config.CertFile == "" {
+		config, err := common.GenerateTLSConfig(c.alpn()[0])
+		if err != nil {
+			return nil, err
+		}
+		config.NextProtos = c.alpn()
+		return config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   c.alpn(),
+	}, nil
 }
+
+var gQuicTracer = &quicTracer{}
+
+// quicTracer collects the stats of every quic connection, they are found by the tracing id of the connection
+type quicTracer struct {
+	conns sync.Map
+}
+
+func (t *quicTracer) get(session quic.Connection) *quicConnTracer {
+	id, ok := session.Context().Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	v, ok := t.conns.Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*quicConnTracer)
+}
+
+func (t *quicTracer) TracerForConnection(ctx context.Context, p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	ct := &quicConnTracer{father: t, id: id}
+	t.conns.Store(id, ct)
+	return ct
+}
+
+func (t *quicTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+
+func (t *quicTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+type quicConnTracer struct {
+	father *quicTracer
+	id     uint64
+	stat   connCounter
+	cwnd   int64
+}
+
+func (t *quicConnTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+}
+
+func (t *quicConnTracer) NegotiatedVersion(chosen logging.VersionNumber, clientVersions, serverVersions []logging.VersionNumber) {
+}
+
+func (t *quicConnTracer) ClosedConnection(error) {}
+
+func (t *quicConnTracer) SentTransportParameters(*logging.TransportParameters) {}
+
+func (t *quicConnTracer) ReceivedTransportParameters(*logging.TransportParameters) {}
+
+func (t *quicConnTracer) RestoredTransportParameters(parameters *logging.TransportParameters) {}
+
+func (t *quicConnTracer) SentPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	t.stat.out(int(size))
+}
+
+func (t *quicConnTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {}
+
+func (t *quicConnTracer) ReceivedRetry(*logging.Header) {}
+
+func (t *quicConnTracer) ReceivedPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	t.stat.in(int(size))
+}
+
+func (t *quicConnTracer) BufferedPacket(logging.PacketType) {}
+
+func (t *quicConnTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+func (t *quicConnTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+	t.stat.setRtt(rttStats.SmoothedRTT())
+	atomic.StoreInt64(&t.cwnd, int64(cwnd))
+}
+
+func (t *quicConnTracer) AcknowledgedPacket(logging.EncryptionLevel, logging.PacketNumber) {}
+
+// lost packets are the ones quic sends again
+func (t *quicConnTracer) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+	t.stat.retransmit()
+}
+
+func (t *quicConnTracer) UpdatedCongestionState(logging.CongestionState) {}
+
+func (t *quicConnTracer) UpdatedPTOCount(value uint32) {}
+
+func (t *quicConnTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective) {}
+
+func (t *quicConnTracer) UpdatedKey(generation logging.KeyPhase, remote bool) {}
+
+func (t *quicConnTracer) DroppedEncryptionLevel(logging.EncryptionLevel) {}
+
+func (t *quicConnTracer) DroppedKey(generation logging.KeyPhase) {}
+
+func (t *quicConnTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {}
+
+func (t *quicConnTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel) {}
+
+func (t *quicConnTracer) LossTimerCanceled() {}
+
+// Close drops the tracer from the map, the QuicConn keeps its own pointer so stats stay readable
+func (t *quicConnTracer) Close() {
+	t.father.conns.Delete(t.id)
+}
+
+func (t *quicConnTracer) Debug(name, msg string) {}
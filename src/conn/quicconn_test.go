@@ -3,7 +3,9 @@ package conn
 import (
 	"fmt"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"io"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,6 +16,8 @@ func Test0001Quic(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	cc, err := c.Listen("localhost:58081")
 	if err != nil {
@@ -39,6 +43,8 @@ func Test0002Quic(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	go func() {
 		_, err := c.Dial("localhost:58081")
@@ -58,6 +64,8 @@ func Test0003Quic(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	cc, err := c.Listen("localhost:58081")
 	if err != nil {
@@ -99,6 +107,8 @@ func Test0004Quic(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	cc, err := c.Listen("localhost:58081")
 	if err != nil {
@@ -143,6 +153,8 @@ func Test0005Quic(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	cc, err := c.Listen("localhost:58081")
 	if err != nil {
@@ -206,6 +218,8 @@ func Test0005Quic1(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	cc, err := c.Listen("localhost:58081")
 	if err != nil {
@@ -269,6 +283,8 @@ func Test0006Quic(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	cc, err := c.Listen("localhost:58081")
 	if err != nil {
@@ -320,6 +336,8 @@ func Test0008Quic(t *testing.T) {
 		fmt.Println(err)
 		return
 	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
 
 	cc, err := c.Listen("localhost:58081")
 	if err != nil {
@@ -398,3 +416,78 @@ func Test0008Quic(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func Test0009Quic(t *testing.T) {
+	c, err := NewConn("quic")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// the listener uses a generated self-signed cert
+	c.(*QuicConn).GetConfig().Insecure = true
+	config := DefaultQuicConfig()
+	config.Smux = false
+	config.Datagram = true
+	config.Alpn = []string{"test", "QuicConn"}
+	config.Insecure = true
+	c.(*QuicConn).SetConfig(config)
+
+	cc, err := c.Listen("localhost:58112")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+	fmt.Println(cc.Info())
+	if !strings.HasPrefix(cc.Info(), "quic--") {
+		t.Error("listener info should be quic")
+	}
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		// the server talks first, the native stream must be accepted before any data
+		sonny.Write([]byte("hello"))
+		s, err := sonny.(StreamOpener).AcceptStream()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		io.Copy(s, s)
+	}()
+
+	ccc, err := c.Dial("localhost:58112")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+
+	buf := make([]byte, 5)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, err = io.ReadFull(ccc, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Error("main stream fail", err)
+		return
+	}
+
+	s, err := ccc.(StreamOpener).OpenStream()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s.Write([]byte("world"))
+	s.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, err = io.ReadFull(s, buf)
+	if err != nil || string(buf) != "world" {
+		t.Error("native stream fail", err)
+	}
+
+	err = ccc.(*QuicConn).SendDatagram([]byte("datagram"))
+	if err != nil {
+		t.Error(err)
+	}
+}
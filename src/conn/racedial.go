@@ -0,0 +1,204 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+type RaceConfig struct {
+	StaggerMs int                                     // 每个候选比前一个晚多久开始拨号，前一个失败时立即开始下一个
+	TimeoutMs int                                     // 整体拨号超时，0为只用ctx
+	Prepare   func(c Conn)                            // 拨号前设置每个候选conn，比如SetConfig
+	Probe     func(ctx context.Context, c Conn) error // 握手后的测速，通过的才算完成，nil为只比握手
+}
+
+func DefaultRaceConfig() *RaceConfig {
+	return &RaceConfig{
+		StaggerMs: 250,
+		TimeoutMs: 10000,
+	}
+}
+
+type raceResult struct {
+	index int
+	conn  Conn
+	err   error
+}
+
+// ParseRaceAddr parses "rudp://1.2.3.4:8888,tcp://1.2.3.4:8889" into the protos and addrs for RaceDial
+func ParseRaceAddr(dst string) ([]string, []string, error) {
+	var protos []string
+	var addrs []string
+	for _, s := range strings.Split(dst, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "://")
+		if i <= 0 {
+			return nil, nil, errors.New("race addr need proto://addr " + s)
+		}
+		protos = append(protos, strings.ToLower(s[0:i]))
+		addrs = append(addrs, s[i+3:])
+	}
+	if len(protos) <= 0 {
+		return nil, nil, errors.New("empty race addr " + dst)
+	}
+	return protos, addrs, nil
+}
+
+// RaceDial dials protos[i] to addrs[i] happy eyeballs style, a single addr is used for all protos
+// it returns the first conn done and its index, the others are closed
+func RaceDial(protos []string, addrs []string) (Conn, int, error) {
+	return RaceDialContext(context.Background(), nil, protos, addrs)
+}
+
+func RaceDialContext(ctx context.Context, config *RaceConfig, protos []string, addrs []string) (Conn, int, error) {
+	if config == nil {
+		config = DefaultRaceConfig()
+	}
+	if len(protos) <= 0 {
+		return nil, -1, errors.New("race dial no proto")
+	}
+	if len(addrs) != 1 && len(addrs) != len(protos) {
+		return nil, -1, errors.New("race dial addrs not match protos")
+	}
+
+	var cancel context.CancelFunc
+	if config.TimeoutMs > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.TimeoutMs)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	results := make(chan *raceResult, len(protos))
+	next := 0
+	running := 0
+	var stagger <-chan time.Time
+
+	start := func() {
+		index := next
+		next++
+		running++
+		addr := addrs[0]
+		if len(addrs) > 1 {
+			addr = addrs[index]
+		}
+		go func() {
+			c, err := raceDialOne(ctx, config, protos[index], addr)
+			results <- &raceResult{index: index, conn: c, err: err}
+		}()
+		stagger = nil
+		if next < len(protos) {
+			stagger = time.After(time.Duration(config.StaggerMs) * time.Millisecond)
+		}
+	}
+
+	// the losers still dialing are closed when they come back
+	closeLosers := func() {
+		n := running
+		go func() {
+			for i := 0; i < n; i++ {
+				r := <-results
+				if r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}()
+	}
+
+	start()
+
+	var lasterr error
+	for {
+		select {
+		case <-ctx.Done():
+			closeLosers()
+			if lasterr != nil {
+				return nil, -1, lasterr
+			}
+			return nil, -1, ctx.Err()
+		case <-stagger:
+			start()
+		case r := <-results:
+			running--
+			if r.err == nil {
+				cancel()
+				closeLosers()
+				//loggo.Debug("race dial win %v %v", r.index, r.conn.Info())
+				return r.conn, r.index, nil
+			}
+			loggo.Info("race dial fail %s %s", protos[r.index], r.err.Error())
+			lasterr = r.err
+			if next < len(protos) {
+				start()
+			} else if running <= 0 {
+				return nil, -1, lasterr
+			}
+		}
+	}
+}
+
+func raceDialOne(ctx context.Context, config *RaceConfig, proto string, addr string) (Conn, error) {
+	c, err := NewConn(proto)
+	if err != nil {
+		return nil, err
+	}
+	if config.Prepare != nil {
+		config.Prepare(c)
+	}
+	cc, err := c.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.Probe != nil {
+		err = config.Probe(ctx, cc)
+		if err != nil {
+			cc.Close()
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+// EchoProbe makes a RaceConfig.Probe that sends size random bytes and waits for the peer to echo them back
+func EchoProbe(size int) func(ctx context.Context, c Conn) error {
+	return func(ctx context.Context, c Conn) error {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		stop := watchContext(ctx, func() {
+			c.SetDeadline(time.Now())
+		})
+		defer stop()
+
+		errch := make(chan error, 1)
+		go func() {
+			_, err := c.Write(data)
+			errch <- err
+		}()
+		buf := make([]byte, size)
+		_, err := io.ReadFull(c, buf)
+		if werr := <-errch; err == nil {
+			err = werr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		c.SetDeadline(time.Time{})
+		if !bytes.Equal(buf, data) {
+			return errors.New("echo probe data diff")
+		}
+		return nil
+	}
+}
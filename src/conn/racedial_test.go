@@ -0,0 +1,161 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRaceEcho(t *testing.T, proto string, addr string, closed *int32) Conn {
+	c, err := NewConn(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer sonny.Close()
+				buf := make([]byte, 10240)
+				for {
+					n, err := sonny.Read(buf)
+					if err != nil {
+						if closed != nil {
+							atomic.AddInt32(closed, 1)
+						}
+						return
+					}
+					sonny.Write(buf[0:n])
+				}
+			}()
+		}
+	}()
+	return cc
+}
+
+func Test0001RACE(t *testing.T) {
+	tcp := testRaceEcho(t, "tcp", "127.0.0.1:58121", nil)
+	defer tcp.Close()
+	rudp := testRaceEcho(t, "rudp", "127.0.0.1:58122", nil)
+	defer rudp.Close()
+
+	config := DefaultRaceConfig()
+	config.StaggerMs = 100
+	begin := time.Now()
+	// nothing listens on 58123, so the first one fails and the next starts at once
+	c, index, err := RaceDialContext(context.Background(), config, []string{"tcp", "rudp", "tcp"},
+		[]string{"127.0.0.1:58123", "127.0.0.1:58122", "127.0.0.1:58121"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Println("race win", index, c.Name(), time.Now().Sub(begin))
+	if index == 0 {
+		t.Error("race win fail one")
+	}
+
+	c.Write([]byte("race"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[0:n]) != "race" {
+		t.Error("race echo fail", err)
+	}
+
+	_, _, err = RaceDial([]string{"tcp", "tcp"}, []string{"127.0.0.1:58123"})
+	fmt.Println(err)
+	if err == nil {
+		t.Error("race should fail")
+	}
+
+	_, _, err = RaceDial([]string{"tcp", "tcp"}, []string{"127.0.0.1:58121", "127.0.0.1:58122", "127.0.0.1:58123"})
+	if err == nil {
+		t.Error("race addrs should not match")
+	}
+}
+
+func Test0002RACE(t *testing.T) {
+	var closed int32
+	tcp := testRaceEcho(t, "tcp", "127.0.0.1:58124", &closed)
+	defer tcp.Close()
+
+	var probed int32
+	config := DefaultRaceConfig()
+	config.StaggerMs = 0
+	config.Prepare = func(c Conn) {
+		if strings.HasPrefix(c.Name(), "tcp") {
+			atomic.AddInt32(&probed, 1)
+		}
+	}
+	config.Probe = EchoProbe(64 * 1024)
+
+	c, index, err := RaceDialContext(context.Background(), config, []string{"tcp", "tcp", "tcp"}, []string{"127.0.0.1:58124"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("race win", index, c.Info())
+	if atomic.LoadInt32(&probed) != 3 {
+		t.Error("race prepare fail", probed)
+	}
+
+	c.Write([]byte("probe"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[0:n]) != "probe" {
+		t.Error("race probe echo fail", err)
+	}
+
+	// the losers that finished too are closed, only the winner is left
+	time.Sleep(time.Second)
+	if atomic.LoadInt32(&closed) != 2 {
+		t.Error("race losers not closed", closed)
+	}
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&closed) != 3 {
+		t.Error("race winner not closed", closed)
+	}
+}
+
+func Test0003RACE(t *testing.T) {
+	// the listener never echoes, so the probe holds until the timeout
+	c, _ := NewConn("tcp")
+	cc, err := c.Listen("127.0.0.1:58125")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			defer sonny.Close()
+		}
+	}()
+
+	config := DefaultRaceConfig()
+	config.TimeoutMs = 500
+	config.Probe = EchoProbe(1024)
+	begin := time.Now()
+	_, _, err = RaceDialContext(context.Background(), config, []string{"tcp", "tcp"}, []string{"127.0.0.1:58125"})
+	fmt.Println(err, time.Now().Sub(begin))
+	if err == nil {
+		t.Error("race should time out")
+	}
+	if time.Now().Sub(begin) > 3*time.Second {
+		t.Error("race time out too slow")
+	}
+}
@@ -0,0 +1,1122 @@
+package conn
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/congestion"
+	"github.com/3t2ugg1e/go-engine/src/frame"
+	"github.com/3t2ugg1e/go-engine/src/group"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	Register("rdns", func() Conn {
+		return &RdnsConn{}
+	}, true)
+}
+
+type RdnsConfig struct {
+	MaxPacketSize      int
+	DownCutSize        int // 服务端每个响应携带的帧大小，响应需小于递归服务器支持的udp包长
+	MaxId              int
+	BufferSize         int
+	MaxWin             int
+	ResendTimems       int
+	Compress           int
+	Stat               int
+	ConnectTimeoutMs   int
+	CloseTimeoutMs     int
+	CloseWaitTimeoutMs int
+	AcceptChanLen      int
+	Congestion         string
+	Domain             string // 隧道域名，服务端需是它的权威服务器，客户端上行帧大小由它的长度决定
+	Resolver           string // 客户端发查询的递归服务器，为空时直接发到dst
+	QueryType          string // 响应记录类型，TXT或NULL
+	PollIntervalMs     int    // 客户端空闲时轮询的间隔，服务端只能在响应里下发数据
+	MaxInflight        int    // 客户端同时在途的轮询数
+	QueryTimeoutMs     int    // 查询多久没有响应就不再算在途
+	SendQueueLen       int    // 服务端等待查询带走的帧数
+}
+
+func DefaultRdnsConfig() *RdnsConfig {
+	return &RdnsConfig{
+		MaxPacketSize:      4096,
+		DownCutSize:        700,
+		MaxId:              100000,
+		BufferSize:         1024 * 1024,
+		MaxWin:             200,
+		ResendTimems:       400,
+		Compress:           0,
+		Stat:               0,
+		ConnectTimeoutMs:   10000,
+		CloseTimeoutMs:     5000,
+		CloseWaitTimeoutMs: 5000,
+		AcceptChanLen:      128,
+		Congestion:         "bb",
+		Domain:             "t.example.com",
+		Resolver:           "",
+		QueryType:          "TXT",
+		PollIntervalMs:     50,
+		MaxInflight:        16,
+		QueryTimeoutMs:     2000,
+		SendQueueLen:       1024,
+	}
+}
+
+type RdnsConn struct {
+	info          string
+	config        *RdnsConfig
+	dialer        *rdnsConnDialer
+	listenersonny *rdnsConnListenerSonny
+	listener      *rdnsConnListener
+	cancel        context.CancelFunc
+	isclose       bool
+	closelock     sync.Mutex
+	deadline      connDeadline
+	stat          connCounter
+}
+
+type rdnsConnDialer struct {
+	conn        *net.UDPConn
+	fm          *frame.FrameMgr
+	wg          *group.Group
+	id          uint32
+	nonce       uint32
+	more        int32
+	lastpoll    time.Time
+	pendinglock sync.Mutex
+	pending     map[uint16]time.Time
+}
+
+type rdnsConnListenerSonny struct {
+	dstaddr    *net.UDPAddr
+	dstlock    sync.Mutex
+	fatherconn *net.UDPConn
+	fm         *frame.FrameMgr
+	wg         *group.Group
+	id         uint32
+	queue      *rdnsQueue
+}
+
+type rdnsConnListener struct {
+	listenerconn *net.UDPConn
+	wg           *group.Group
+	sonny        sync.Map
+	accept       *common.Channel
+}
+
+// rdnsQueue holds the frames of a sonny until queries come to take them, the oldest is dropped when full and FrameMgr resends it
+type rdnsQueue struct {
+	lock sync.Mutex
+	list [][]byte
+	max  int
+}
+
+func (q *rdnsQueue) push(b []byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.list = append(q.list, b)
+	if len(q.list) > q.max {
+		q.list = q.list[1:]
+	}
+}
+
+// pop takes the frames that fit in size, at least one, so small acks ride along with the data
+func (q *rdnsQueue) pop(size int) [][]byte {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var ret [][]byte
+	for len(q.list) > 0 && (len(ret) == 0 || len(q.list[0]) <= size) {
+		size -= len(q.list[0])
+		ret = append(ret, q.list[0])
+		q.list = q.list[1:]
+	}
+	return ret
+}
+
+func (s *rdnsConnListenerSonny) remote() *net.UDPAddr {
+	s.dstlock.Lock()
+	defer s.dstlock.Unlock()
+	return s.dstaddr
+}
+
+func (s *rdnsConnListenerSonny) setRemote(addr *net.UDPAddr) {
+	s.dstlock.Lock()
+	defer s.dstlock.Unlock()
+	s.dstaddr = addr
+}
+
+func (c *RdnsConn) Name() string {
+	return "rdns"
+}
+
+func (c *RdnsConn) Read(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.isclose {
+		return 0, errors.New("read closed conn")
+	}
+
+	if len(p) <= 0 {
+		return 0, errors.New("read empty buffer")
+	}
+
+	var fm *frame.FrameMgr
+	var wg *group.Group
+	if c.dialer != nil {
+		fm = c.dialer.fm
+		wg = c.dialer.wg
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	} else if c.listenersonny != nil {
+		fm = c.listenersonny.fm
+		wg = c.listenersonny.wg
+	} else {
+		return 0, errors.New("empty conn")
+	}
+
+	for !c.isclose {
+		if c.deadline.readExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if fm.GetRecvBufferSize() <= 0 {
+			if wg != nil && wg.IsExit() {
+				return 0, errors.New("closed conn")
+			}
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+
+		size := copy(p, fm.GetRecvReadLineBuffer())
+		fm.SkipRecvBuffer(size)
+		return size, nil
+	}
+
+	return 0, errors.New("read closed conn")
+}
+
+func (c *RdnsConn) Write(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.isclose {
+		return 0, errors.New("write closed conn")
+	}
+
+	if len(p) <= 0 {
+		return 0, errors.New("write empty data")
+	}
+
+	var fm *frame.FrameMgr
+	var wg *group.Group
+	if c.dialer != nil {
+		fm = c.dialer.fm
+		wg = c.dialer.wg
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	} else if c.listenersonny != nil {
+		fm = c.listenersonny.fm
+		wg = c.listenersonny.wg
+	} else {
+		return 0, errors.New("empty conn")
+	}
+
+	totalsize := len(p)
+	cur := 0
+
+	for !c.isclose {
+		if c.deadline.writeExpired() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
+		size := totalsize - cur
+		svleft := fm.GetSendBufferLeft()
+		if size > svleft {
+			size = svleft
+		}
+
+		if size <= 0 {
+			if wg != nil && wg.IsExit() {
+				return 0, errors.New("closed conn")
+			}
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+
+		fm.WriteSendBuffer(p[cur : cur+size])
+		cur += size
+
+		if cur >= totalsize {
+			return totalsize, nil
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return 0, errors.New("write closed conn")
+}
+
+func (c *RdnsConn) Close() error {
+	c.checkConfig()
+
+	if c.isclose {
+		return nil
+	}
+
+	c.closelock.Lock()
+	defer c.closelock.Unlock()
+
+	//loggo.Debug("start Close %s", c.Info())
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.dialer != nil {
+		if c.dialer.wg != nil {
+			//loggo.Debug("start Close dialer %s", c.Info())
+			c.dialer.wg.Stop()
+			c.dialer.wg.Wait()
+		}
+		if c.dialer.conn != nil {
+			c.dialer.conn.Close()
+		}
+	} else if c.listener != nil {
+		if c.listener.wg != nil {
+			//loggo.Debug("start Close listener %s", c.Info())
+			c.listener.wg.Stop()
+			c.listener.sonny.Range(func(key, value interface{}) bool {
+				u := value.(*RdnsConn)
+				u.Close()
+				return true
+			})
+			c.listener.wg.Wait()
+		}
+		if c.listener.listenerconn != nil {
+			c.listener.listenerconn.Close()
+		}
+	} else if c.listenersonny != nil {
+		if c.listenersonny.wg != nil {
+			//loggo.Debug("start Close listenersonny %s", c.Info())
+			c.listenersonny.wg.Stop()
+			c.listenersonny.wg.Wait()
+		}
+	}
+	c.isclose = true
+
+	//loggo.Debug("Close ok %s", c.Info())
+
+	return nil
+}
+
+func (c *RdnsConn) Info() string {
+	c.checkConfig()
+
+	if c.info != "" {
+		return c.info
+	}
+	if c.dialer != nil {
+		c.info = c.dialer.conn.LocalAddr().String() + "<--rdns-->" + c.dialer.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = "rdns--" + c.listener.listenerconn.LocalAddr().String()
+	} else if c.listenersonny != nil {
+		c.info = c.listenersonny.fatherconn.LocalAddr().String() + "<--rdns-->" + strconv.FormatUint(uint64(c.listenersonny.id), 16)
+	} else {
+		c.info = "empty rdns conn"
+	}
+	return c.info
+}
+
+func (c *RdnsConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *RdnsConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.RemoteAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.remote()
+	}
+	return nil
+}
+
+func (c *RdnsConn) SetDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setDeadline(t)
+	return nil
+}
+
+func (c *RdnsConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setReadDeadline(t)
+	return nil
+}
+
+func (c *RdnsConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setWriteDeadline(t)
+	return nil
+}
+
+func (c *RdnsConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *RdnsConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	cutsize := rdnsUpCutSize(c.config.Domain)
+	if cutsize <= 0 {
+		return nil, errors.New("domain too long " + c.config.Domain)
+	}
+
+	server := dst
+	if c.config.Resolver != "" {
+		server = c.config.Resolver
+	}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	dialctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	var d net.Dialer
+	if gControlOnConnSetup != nil {
+		d = net.Dialer{Control: gControlOnConnSetup}
+	}
+	conn, err := d.DialContext(dialctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	c.cancel = nil
+
+	id := common.Guid()
+	fm := frame.NewFrameMgr(cutsize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
+	fm.SetDebugid(id)
+	if c.config.Congestion == "bb" {
+		fm.SetCongestion(&congestion.BBCongestion{})
+	}
+
+	dialer := &rdnsConnDialer{conn: conn.(*net.UDPConn), fm: fm, id: uint32(common.RandUint64()), pending: make(map[uint16]time.Time)}
+
+	u := &RdnsConn{config: c.config, dialer: dialer}
+
+	//loggo.Debug("start connect remote rdns %s %s", u.Info(), id)
+
+	u.dialer.fm.Connect()
+
+	startConnectTime := time.Now()
+	buf := make([]byte, c.config.MaxPacketSize)
+	for {
+		if u.dialer.fm.IsConnected() {
+			break
+		}
+
+		u.dialer.fm.Update()
+
+		// send dns query
+		sendlist := u.dialer.fm.GetSendList()
+		for e := sendlist.Front(); e != nil; e = e.Next() {
+			f := e.Value.(*frame.Frame)
+			mb, _ := u.dialer.fm.MarshalFrame(f)
+			u.send(mb)
+		}
+		u.poll()
+
+		// recv dns response
+		u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, _ := u.dialer.conn.Read(buf)
+		if n > 0 {
+			u.onResponse(buf[0:n])
+		}
+
+		if c.isclose {
+			//loggo.Debug("can not connect remote rdns %s", u.Info())
+			break
+		}
+
+		if ctx.Err() != nil {
+			//loggo.Debug("cancel connect remote rdns %s", u.Info())
+			break
+		}
+
+		// timeout
+		now := time.Now()
+		diffclose := now.Sub(startConnectTime)
+		if diffclose > time.Millisecond*time.Duration(c.config.ConnectTimeoutMs) {
+			//loggo.Debug("can not connect remote rdns %s", u.Info())
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if c.isclose {
+		u.Close()
+		return nil, errors.New("closed conn")
+	}
+
+	if u.isclose {
+		return nil, errors.New("closed conn")
+	}
+
+	if !u.dialer.fm.IsConnected() {
+		u.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("connect timeout")
+	}
+
+	//loggo.Debug("connect remote ok rdns %s", u.Info())
+
+	wg := group.NewGroup("RdnsConn Dialer"+" "+u.Info(), nil, nil)
+
+	u.dialer.wg = wg
+
+	wg.Go("RdnsConn updateDialerSonny"+" "+u.Info(), func() error {
+		return u.updateDialerSonny()
+	})
+
+	return u, nil
+}
+
+func (c *RdnsConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *RdnsConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	listenerconn, err := listenUDP(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := common.NewChannel(c.config.AcceptChanLen)
+
+	wg := group.NewGroup("RdnsConn Listen"+" "+dst, nil, nil)
+
+	listener := &rdnsConnListener{
+		listenerconn: listenerconn,
+		wg:           wg,
+		accept:       ch,
+	}
+
+	u := &RdnsConn{config: c.config, listener: listener}
+	wg.Go("RdnsConn loopListenerRecv"+" "+dst, func() error {
+		return u.loopListenerRecv()
+	})
+
+	return u, nil
+}
+
+func (c *RdnsConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *RdnsConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil || c.listener.wg == nil {
+		return nil, errors.New("not listen")
+	}
+	for !c.listener.wg.IsExit() {
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s == nil {
+			break
+		}
+		sonny := s.(*RdnsConn)
+		_, ok := c.listener.sonny.Load(sonny.listenersonny.id)
+		if !ok {
+			continue
+		}
+		if sonny.isclose {
+			continue
+		}
+		return sonny, nil
+	}
+	return nil, errors.New("listener close")
+}
+
+func (c *RdnsConn) Stats() ConnStats {
+	if c.dialer != nil {
+		return c.stat.frameStats(c.dialer.fm)
+	} else if c.listenersonny != nil {
+		return c.stat.frameStats(c.listenersonny.fm)
+	}
+	return c.stat.stats()
+}
+
+func (c *RdnsConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultRdnsConfig()
+	}
+}
+
+func (c *RdnsConn) SetConfig(config *RdnsConfig) {
+	c.config = config
+}
+
+func (c *RdnsConn) GetConfig() *RdnsConfig {
+	c.checkConfig()
+	return c.config
+}
+
+// send puts a frame in a query for the dialer, the sonny can only answer so its frames wait in the queue
+func (c *RdnsConn) send(mb []byte) {
+	if c.listenersonny != nil {
+		c.listenersonny.queue.push(mb)
+		return
+	}
+	c.sendQuery(mb)
+}
+
+func (c *RdnsConn) sendQuery(data []byte) {
+	nonce := uint16(atomic.AddUint32(&c.dialer.nonce, 1))
+	name, err := rdnsEncodeName(c.config.Domain, c.dialer.id, nonce, data)
+	if err != nil {
+		// FrameMgr keeps its frames within the cut size and rdnsFrameOverhead, one that still does not fit is counted, not lost silently
+		c.stat.drop()
+		loggo.Error("rdns frame too big for the query name %s %d %s", c.Info(), len(data), err)
+		return
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: nonce, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: rdnsQueryType(c.config.QueryType), Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var rh dnsmessage.ResourceHeader
+	rh.SetEDNS0(c.config.MaxPacketSize, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(rh, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		//loggo.Error("dns query Finish fail %s %s", c.Info(), err)
+		return
+	}
+
+	c.dialer.pendinglock.Lock()
+	c.dialer.pending[nonce] = time.Now()
+	c.dialer.pendinglock.Unlock()
+
+	c.stat.out(len(msg))
+	c.dialer.conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	c.dialer.conn.Write(msg)
+}
+
+// poll keeps queries in flight so the server has something to answer with,
+// a response with data asks for two more so the pipe fills up when there is a lot to receive
+func (c *RdnsConn) poll() {
+	now := time.Now()
+
+	c.dialer.pendinglock.Lock()
+	for id, t := range c.dialer.pending {
+		if now.Sub(t) > time.Millisecond*time.Duration(c.config.QueryTimeoutMs) {
+			delete(c.dialer.pending, id)
+		}
+	}
+	inflight := len(c.dialer.pending)
+	c.dialer.pendinglock.Unlock()
+
+	for inflight < c.config.MaxInflight {
+		if atomic.LoadInt32(&c.dialer.more) > 0 {
+			atomic.AddInt32(&c.dialer.more, -1)
+		} else if now.Sub(c.dialer.lastpoll) < time.Millisecond*time.Duration(c.config.PollIntervalMs) {
+			break
+		}
+		c.sendQuery(nil)
+		c.dialer.lastpoll = now
+		inflight++
+	}
+	if inflight >= c.config.MaxInflight {
+		atomic.StoreInt32(&c.dialer.more, 0)
+	}
+}
+
+func (c *RdnsConn) onResponse(b []byte) {
+	c.stat.in(len(b))
+
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil || !h.Response {
+		return
+	}
+
+	c.dialer.pendinglock.Lock()
+	delete(c.dialer.pending, h.ID)
+	c.dialer.pendinglock.Unlock()
+
+	if p.SkipAllQuestions() != nil {
+		return
+	}
+	frames := rdnsAnswerData(&p)
+	if len(frames) <= 0 {
+		return
+	}
+	atomic.AddInt32(&c.dialer.more, 2)
+
+	for _, data := range frames {
+		f := &frame.Frame{}
+		err = proto.Unmarshal(data, f)
+		if err == nil {
+			c.dialer.fm.OnRecvFrame(f)
+			//loggo.Debug("%s recv frame %d", c.Info(), f.Id)
+		} else {
+			//loggo.Error("Unmarshal fail from %s %s", c.Info(), err)
+		}
+	}
+}
+
+func (c *RdnsConn) loopListenerRecv() error {
+	c.checkConfig()
+
+	buf := make([]byte, c.config.MaxPacketSize)
+	for !c.listener.wg.IsExit() {
+		c.listener.listenerconn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, srcaddr, err := c.listener.listenerconn.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+
+		c.onQuery(buf[0:n], srcaddr)
+
+		c.listener.sonny.Range(func(key, value interface{}) bool {
+			u := value.(*RdnsConn)
+			if u.isclose {
+				c.listener.sonny.Delete(key)
+				//loggo.Debug("delete sonny from map %s", u.Info())
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+// onQuery answers every query, names that are not ours get an empty answer so a resolver doing qname minimisation goes on
+func (c *RdnsConn) onQuery(b []byte, srcaddr *net.UDPAddr) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil || h.Response {
+		return
+	}
+	q, err := p.Question()
+	if err != nil {
+		return
+	}
+
+	id, data, ok := rdnsDecodeName(c.config.Domain, q.Name.String())
+	if !ok || (q.Type != dnsmessage.TypeTXT && q.Type != rdnsTypeNULL) {
+		c.writeResponse(nil, h, q, nil, false, srcaddr)
+		return
+	}
+
+	var u *RdnsConn
+	v, ok := c.listener.sonny.Load(id)
+	if ok {
+		u = v.(*RdnsConn)
+		u.listenersonny.setRemote(srcaddr)
+	} else if len(data) > 0 {
+		fm := frame.NewFrameMgr(c.config.DownCutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
+		fm.SetDebugid(common.Guid())
+		if c.config.Congestion == "bb" {
+			fm.SetCongestion(&congestion.BBCongestion{})
+		}
+
+		sonny := &rdnsConnListenerSonny{
+			dstaddr:    srcaddr,
+			fatherconn: c.listener.listenerconn,
+			fm:         fm,
+			id:         id,
+			queue:      &rdnsQueue{max: c.config.SendQueueLen},
+		}
+
+		u = &RdnsConn{config: c.config, listenersonny: sonny}
+		c.listener.sonny.Store(id, u)
+
+		c.listener.wg.Go("RdnsConn accept"+" "+u.Info(), func() error {
+			return c.accept(u)
+		})
+
+		//loggo.Debug("start accept remote rdns %s", u.Info())
+	}
+
+	if u == nil {
+		c.writeResponse(nil, h, q, nil, true, srcaddr)
+		return
+	}
+
+	u.stat.in(len(b))
+	if len(data) > 0 {
+		f := &frame.Frame{}
+		err := proto.Unmarshal(data, f)
+		if err == nil {
+			u.listenersonny.fm.OnRecvFrame(f)
+			//loggo.Debug("%s recv frame %d", u.Info(), f.Id)
+		} else {
+			//loggo.Error("%s %s Unmarshal fail %s", c.Info(), u.Info(), err)
+		}
+	}
+
+	c.writeResponse(u, h, q, u.listenersonny.queue.pop(c.config.DownCutSize+rdnsFrameOverhead), true, srcaddr)
+}
+
+// writeResponse puts each frame in an answer record, an answer with empty data tells the client there is nothing now
+func (c *RdnsConn) writeResponse(u *RdnsConn, h dnsmessage.Header, q dnsmessage.Question, frames [][]byte, answer bool, srcaddr *net.UDPAddr) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RecursionDesired: h.RecursionDesired})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if answer {
+		if len(frames) <= 0 {
+			frames = [][]byte{nil}
+		}
+		for _, data := range frames {
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 0}
+			if q.Type == dnsmessage.TypeTXT {
+				txt := []string{""}
+				if len(data) > 0 {
+					txt = nil
+					for i := 0; i < len(data); i += 255 {
+						txt = append(txt, string(data[i:common.MinOfInt(i+255, len(data))]))
+					}
+				}
+				b.TXTResource(rh, dnsmessage.TXTResource{TXT: txt})
+			} else {
+				b.UnknownResource(rh, dnsmessage.UnknownResource{Type: rdnsTypeNULL, Data: data})
+			}
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		//loggo.Error("dns response Finish fail %s %s", c.Info(), err)
+		return
+	}
+
+	if u != nil {
+		u.stat.out(len(msg))
+	}
+	c.listener.listenerconn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	c.listener.listenerconn.WriteToUDP(msg, srcaddr)
+}
+
+func (c *RdnsConn) accept(u *RdnsConn) error {
+
+	//loggo.Debug("server begin accept rdns %s", u.Info())
+
+	startConnectTime := time.Now()
+	done := false
+	for !c.listener.wg.IsExit() {
+
+		if u.listenersonny.fm.IsConnected() {
+			done = true
+			break
+		}
+
+		u.listenersonny.fm.Update()
+
+		// queue for the next query
+		sendlist := u.listenersonny.fm.GetSendList()
+		for e := sendlist.Front(); e != nil; e = e.Next() {
+			f := e.Value.(*frame.Frame)
+			mb, err := u.listenersonny.fm.MarshalFrame(f)
+			if err != nil {
+				//loggo.Error("MarshalFrame fail %s", err)
+				break
+			}
+			u.send(mb)
+		}
+
+		now := time.Now()
+		diffclose := now.Sub(startConnectTime)
+		if diffclose > time.Millisecond*time.Duration(c.config.ConnectTimeoutMs) {
+			//loggo.Debug("can not connect by remote rdns %s", u.Info())
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if !done {
+		u.Close()
+		return nil
+	}
+
+	if c.listener.wg.IsExit() {
+		u.Close()
+		return nil
+	}
+
+	//loggo.Debug("server accept rdns ok %s", u.Info())
+
+	c.listener.accept.Write(u)
+
+	wg := group.NewGroup("RdnsConn ListenerSonny"+" "+u.Info(), c.listener.wg, nil)
+
+	u.listenersonny.wg = wg
+
+	wg.Go("RdnsConn updateListenerSonny"+" "+u.Info(), func() error {
+		return u.updateListenerSonny()
+	})
+
+	//loggo.Debug("accept rdns finish %s", u.Info())
+
+	return nil
+}
+
+func (c *RdnsConn) updateListenerSonny() error {
+	return c.update_rdns(c.listenersonny.wg, c.listenersonny.fm, false)
+}
+
+func (c *RdnsConn) updateDialerSonny() error {
+	return c.update_rdns(c.dialer.wg, c.dialer.fm, true)
+}
+
+func (c *RdnsConn) update_rdns(wg *group.Group, fm *frame.FrameMgr, readconn bool) error {
+
+	//loggo.Debug("start rdns conn %s", c.Info())
+
+	stage := "open"
+
+	if readconn {
+		wg.Go("RdnsConn update_rdns recv"+" "+c.Info(), func() error {
+			bytes := make([]byte, c.config.MaxPacketSize)
+			for !wg.IsExit() && stage != "closewait" {
+				// recv dns response
+				c.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+				n, _ := c.dialer.conn.Read(bytes)
+				if n > 0 {
+					c.onResponse(bytes[0:n])
+				}
+			}
+
+			return nil
+		})
+	}
+
+	reason := ""
+
+	for !wg.IsExit() {
+
+		avctive := fm.Update()
+
+		// send frames
+		sendlist := fm.GetSendList()
+		for e := sendlist.Front(); e != nil; e = e.Next() {
+			f := e.Value.(*frame.Frame)
+			mb, err := fm.MarshalFrame(f)
+			if err != nil {
+				//loggo.Error("MarshalFrame fail %s", err)
+				return err
+			}
+			c.send(mb)
+			//loggo.Debug("%s send frame %d", c.Info(), f.Id)
+		}
+		if readconn {
+			c.poll()
+		}
+
+		// timeout
+		if fm.IsHBTimeout() {
+			reason = "HBTimeout"
+			//loggo.Debug("close inactive conn %s", c.Info())
+			break
+		}
+
+		if fm.IsRemoteClosed() {
+			reason = "RemoteClose"
+			//loggo.Debug("closed by remote conn %s", c.Info())
+			break
+		}
+
+		if !avctive && sendlist.Len() <= 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	stage = "close"
+	fm.Close()
+	//loggo.Debug("close rdns conn fm %s", c.Info())
+
+	startCloseTime := time.Now()
+	for !wg.IsExit() {
+		now := time.Now()
+
+		fm.Update()
+
+		// send frames
+		sendlist := fm.GetSendList()
+		for e := sendlist.Front(); e != nil; e = e.Next() {
+			f := e.Value.(*frame.Frame)
+			mb, err := fm.MarshalFrame(f)
+			if err != nil {
+				//loggo.Error("MarshalFrame fail %s", err)
+				return err
+			}
+			c.send(mb)
+			//loggo.Debug("%s send frame %d", c.Info(), f.Id)
+		}
+		if readconn {
+			c.poll()
+		}
+
+		diffclose := now.Sub(startCloseTime)
+		if diffclose > time.Millisecond*time.Duration(c.config.CloseTimeoutMs) {
+			//loggo.Debug("close conn had timeout %s", c.Info())
+			break
+		}
+
+		remoteclosed := fm.IsRemoteClosed()
+		if remoteclosed {
+			//loggo.Debug("remote conn had closed %s", c.Info())
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	stage = "closewait"
+	//loggo.Debug("close rdns conn update %s", c.Info())
+
+	startEndTime := time.Now()
+	for !wg.IsExit() {
+		now := time.Now()
+
+		diffclose := now.Sub(startEndTime)
+		if diffclose > time.Millisecond*time.Duration(c.config.CloseWaitTimeoutMs) {
+			//loggo.Debug("close wait conn had timeout %s", c.Info())
+			break
+		}
+
+		if fm.GetRecvBufferSize() <= 0 {
+			//loggo.Debug("conn had no data %s", c.Info())
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	//loggo.Debug("close rdns conn %s", c.Info())
+
+	return errors.New("closed " + reason)
+}
+
+// there is no constant for the NULL type in dnsmessage
+const rdnsTypeNULL = dnsmessage.Type(10)
+
+// the query payload is id(4) nonce(2) frame, the nonce keeps resolvers from answering out of cache
+const rdnsHeadLen = 6
+
+// rdnsFrameOverhead is what a marshalled frame adds to its data
+const rdnsFrameOverhead = 48
+
+var rdnsEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func rdnsQueryType(t string) dnsmessage.Type {
+	if strings.ToUpper(t) == "NULL" {
+		return rdnsTypeNULL
+	}
+	return dnsmessage.TypeTXT
+}
+
+// rdnsUpCutSize is the biggest frame data that still fits a 253 chars name under domain
+func rdnsUpCutSize(domain string) int {
+	chars := 0
+	for l := 1; l+(l+62)/63+1+len(domain) <= 253; l++ {
+		chars = l
+	}
+	return chars*5/8 - rdnsHeadLen - rdnsFrameOverhead
+}
+
+func rdnsEncodeName(domain string, id uint32, nonce uint16, data []byte) (dnsmessage.Name, error) {
+	raw := make([]byte, rdnsHeadLen+len(data))
+	binary.BigEndian.PutUint32(raw, id)
+	binary.BigEndian.PutUint16(raw[4:], nonce)
+	copy(raw[rdnsHeadLen:], data)
+
+	s := strings.ToLower(rdnsEncoding.EncodeToString(raw))
+	var labels []string
+	for len(s) > 63 {
+		labels = append(labels, s[0:63])
+		s = s[63:]
+	}
+	labels = append(labels, s)
+	return dnsmessage.NewName(strings.Join(labels, ".") + "." + domain + ".")
+}
+
+// rdnsDecodeName does not mind the case, resolvers may randomise it
+func rdnsDecodeName(domain string, name string) (uint32, []byte, bool) {
+	name = strings.ToUpper(name)
+	suffix := "." + strings.ToUpper(domain) + "."
+	if !strings.HasSuffix(name, suffix) {
+		return 0, nil, false
+	}
+	name = strings.ReplaceAll(strings.TrimSuffix(name, suffix), ".", "")
+	raw, err := rdnsEncoding.DecodeString(name)
+	if err != nil || len(raw) < rdnsHeadLen {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(raw), raw[rdnsHeadLen:], true
+}
+
+// rdnsAnswerData returns the frames in the answer records, empty records are left out
+func rdnsAnswerData(p *dnsmessage.Parser) [][]byte {
+	var ret [][]byte
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			return ret
+		}
+		var data []byte
+		if rh.Type == dnsmessage.TypeTXT {
+			r, err := p.TXTResource()
+			if err != nil {
+				return ret
+			}
+			for _, s := range r.TXT {
+				data = append(data, s...)
+			}
+		} else if rh.Type == rdnsTypeNULL {
+			r, err := p.UnknownResource()
+			if err != nil {
+				return ret
+			}
+			data = r.Data
+		} else if p.SkipAnswer() != nil {
+			return ret
+		}
+		if len(data) > 0 {
+			ret = append(ret, data)
+		}
+	}
+}
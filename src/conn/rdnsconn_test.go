@@ -0,0 +1,182 @@
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRdnsEcho(t *testing.T, config *RdnsConfig, size int) {
+	c, _ := NewConn("rdns")
+	c.(*RdnsConn).SetConfig(config)
+
+	cc, err := c.Listen("127.0.0.1:58108")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done " + sonny.Info())
+		io.Copy(sonny, sonny)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58108")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	src := make([]byte, size)
+	for i := range src {
+		src[i] = byte(i * 3)
+	}
+	go ccc.Write(src)
+
+	begin := time.Now()
+	dst := make([]byte, size)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 60))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+	s, _ := GetStats(ccc)
+	fmt.Printf("%s echo %d bytes in %v %+v\n", config.QueryType, size, time.Now().Sub(begin), s)
+	if s.Dropped != 0 {
+		t.Error("frames dropped", s.Dropped)
+	}
+}
+
+func Test0001RDNS(t *testing.T) {
+	testRdnsEcho(t, DefaultRdnsConfig(), 128*1024)
+
+	config := DefaultRdnsConfig()
+	config.QueryType = "NULL"
+	config.Domain = "tunnel.some.long.domain.example.org"
+	testRdnsEcho(t, config, 32*1024)
+}
+
+func Test0002RDNS(t *testing.T) {
+	domain := "t.example.com"
+	data := make([]byte, rdnsUpCutSize(domain)+rdnsFrameOverhead)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	name, err := rdnsEncodeName(domain, 0x12345678, 7, data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println(len(name.String()), name.String())
+
+	// resolvers may randomise the case of the name
+	mixed := []byte(name.String())
+	for i := range mixed {
+		if i%2 == 0 {
+			mixed[i] = strings.ToUpper(string(mixed[i]))[0]
+		}
+	}
+	id, got, ok := rdnsDecodeName("T.Example.com", string(mixed))
+	if !ok || id != 0x12345678 || !bytes.Equal(got, data) {
+		t.Error("decode name fail")
+	}
+
+	_, _, ok = rdnsDecodeName(domain, "www.example.com.")
+	if ok {
+		t.Error("other name should not decode")
+	}
+
+	if rdnsUpCutSize(strings.Repeat("a.", 100)+"com") > 0 {
+		t.Error("too long domain should have no room")
+	}
+}
+
+func Test0003RDNS(t *testing.T) {
+	c, _ := NewConn("rdns")
+	cc, err := c.Listen("127.0.0.1:58108")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	conn, err := net.Dial("udp", "127.0.0.1:58108")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	msg, _ := b.Finish()
+	conn.Write(msg)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(buf[0:n])
+	if err != nil || h.ID != 1234 || !h.Response || h.RCode != dnsmessage.RCodeSuccess {
+		t.Error("other query should get an empty answer", h, err)
+	}
+	p.SkipAllQuestions()
+	answers, _ := p.AllAnswers()
+	if len(answers) != 0 {
+		t.Error("other query should have no answer")
+	}
+}
+
+func Test0004RDNS(t *testing.T) {
+	c, _ := NewConn("rdns")
+	cc, err := c.Listen("127.0.0.1:58133")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(sonny, sonny)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58133")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+
+	// a frame that does not fit the name is counted instead of vanishing
+	ccc.(*RdnsConn).sendQuery(make([]byte, rdnsUpCutSize(DefaultRdnsConfig().Domain)*2))
+	s, _ := GetStats(ccc)
+	fmt.Printf("%+v\n", s)
+	if s.Dropped != 1 {
+		t.Error("drop not counted", s.Dropped)
+	}
+}
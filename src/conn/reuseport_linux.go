@@ -0,0 +1,19 @@
+package conn
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var opterr error
+	err := c.Control(func(fd uintptr) {
+		opterr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opterr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import (
+	"errors"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reuseport not supported")
+}
@@ -3,43 +3,72 @@ package conn
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"github.com/3t2ugg1e/go-engine/src/common"
 	"github.com/3t2ugg1e/go-engine/src/group"
 	"github.com/3t2ugg1e/go-engine/src/rbuffergo"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+func init() {
+	Register("rhttp", func() Conn {
+		return &RhttpConn{}
+	}, true)
+}
+
 type HttpConfig struct {
-	MaxPacketSize       int
-	RecvChanLen         int
-	AcceptChanLen       int
-	RecvChanPushTimeout int
-	BufferSize          int
-	MaxRetryNum         int
-	CloseWaitTimeoutMs  int
-	HBTimeoutMs         int
-	MaxMsgIndex         int
+	MaxPacketSize        int
+	RecvChanLen          int
+	AcceptChanLen        int
+	RecvChanPushTimeout  int
+	BufferSize           int
+	MaxRetryNum          int
+	CloseWaitTimeoutMs   int
+	HBTimeoutMs          int
+	MaxMsgIndex          int
+	Mode                 string            // poll为每批数据一个POST轮询，stream为一个chunked GET下行加一个流式POST上行，stream不通时回退poll
+	StreamProbeTimeoutMs int               // stream模式等待下行首个chunk的超时，超时认为中间设备缓存了chunked响应
+	Path                 string            // 隧道请求的URL路径前缀，如/api/v1
+	Headers              map[string]string // 客户端请求附加的头，Host会设置为请求的Host
+	RspHeaders           map[string]string // 服务端响应附加的头，诱饵站点的响应也会带上
+	FieldMode            string            // 隧道字段的位置，query为type/index查询参数，path为放在路径中，header为放在FieldHeader头中
+	FieldHeader          string            // FieldMode为header时使用的头
+	Https                bool              // 使用https，dst以https://开头时也会使用
+	CertFile             string            // 服务端证书，为空时自动生成自签名证书
+	KeyFile              string            // 服务端证书私钥
+	CAFile               string            // 客户端校验服务端证书的CA，为空时用系统根证书
+	ServerName           string            // 客户端校验的服务端名字，为空时取dst的host
+	Insecure             bool              // 客户端不校验服务端证书
+	DecoyDir             string            // 非隧道请求用此目录作为静态站点响应，为空时返回404
+	Message              string            // 消息模式，每次Write对端一次Read完整读到，空为字节流，http本身可靠有序，各模式都按reliable处理
 }
 
 func DefaultHttpConfig() *HttpConfig {
 	return &HttpConfig{
-		MaxPacketSize:       1024 * 100,
-		RecvChanLen:         128,
-		AcceptChanLen:       128,
-		RecvChanPushTimeout: 100,
-		BufferSize:          1024 * 1024,
-		MaxRetryNum:         10,
-		CloseWaitTimeoutMs:  5000,
-		HBTimeoutMs:         10000,
-		MaxMsgIndex:         100,
+		MaxPacketSize:        1024 * 100,
+		RecvChanLen:          128,
+		AcceptChanLen:        128,
+		RecvChanPushTimeout:  100,
+		BufferSize:           1024 * 1024,
+		MaxRetryNum:          10,
+		CloseWaitTimeoutMs:   5000,
+		HBTimeoutMs:          10000,
+		MaxMsgIndex:          100,
+		Mode:                 "poll",
+		StreamProbeTimeoutMs: 3000,
+		FieldMode:            "query",
+		FieldHeader:          "X-Request-Id",
 	}
 }
 
@@ -47,6 +76,8 @@ const (
 	ProtoConnnect = "connect"
 	ProtoData     = "data"
 	ProtoClose    = "close"
+	ProtoDown     = "down"
+	ProtoUp       = "up"
 
 	ProtoCodeOK   = 200
 	ProtoCodeFull = 403
@@ -55,7 +86,7 @@ const (
 
 type RhttpConn struct {
 	id            string
-	isclose       bool
+	isclose       int32
 	info          string
 	config        *HttpConfig
 	dialer        *httpConnDialer
@@ -65,28 +96,41 @@ type RhttpConn struct {
 	sendb         *rbuffergo.RBuffergo
 	recvb         *rbuffergo.RBuffergo
 	closelock     sync.Mutex
+	deadline      connDeadline
+	stat          connCounter
+	writedown     func(w io.Writer, b []byte) error // 写下行数据记录，nil为writeHttpRecord，测试用来打断下行
+	recvmsglen    int
 }
 
 type httpConnDialer struct {
-	wg    *group.Group
-	addr  string
-	url   string
-	index int
-	retry int
+	wg        *group.Group
+	tlsconfig *tls.Config
+	addr      string
+	url       string
+	index     int
+	retry     int
+	stream    bool
+	lastRecv  int64
 }
 
 type httpConnListenerSonny struct {
 	fwg          *group.Group
 	addr         string
+	remoteaddr   string
 	expectIndex  int
-	lastRecvTime time.Time
+	lastRecvTime int64
 	lastSend     []byte
+	stream       int32
+	poll         int32
+	downlock     sync.Mutex
+	downsent     int64
 }
 
 type httpConnListener struct {
 	wg           *group.Group
 	addr         string
 	listenerconn *net.TCPListener
+	serveconn    net.Listener
 	sonny        sync.Map
 	accept       *common.Channel
 }
@@ -98,7 +142,7 @@ func (c *RhttpConn) Name() string {
 func (c *RhttpConn) Read(p []byte) (n int, err error) {
 	c.checkConfig()
 
-	if c.isclose {
+	if atomic.LoadInt32(&c.isclose) != 0 {
 		return 0, errors.New("read closed conn")
 	}
 
@@ -117,27 +161,61 @@ func (c *RhttpConn) Read(p []byte) (n int, err error) {
 		return 0, errors.New("empty conn")
 	}
 
-	for !c.isclose {
-		if c.recvb.Size() <= 0 {
-			if wg != nil && wg.IsExit() {
-				return 0, errors.New("closed conn")
+	for atomic.LoadInt32(&c.isclose) == 0 {
+		if c.deadline.readExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if c.config.Message != "" {
+			n, err := c.readMessage(p)
+			if n > 0 {
+				return n, err
 			}
-			time.Sleep(time.Millisecond * 100)
-			continue
+		} else if c.recvb.Size() > 0 {
+			size := copy(p, c.recvb.GetReadLineBuffer())
+			c.recvb.SkipRead(size)
+			return size, nil
 		}
 
-		size := copy(p, c.recvb.GetReadLineBuffer())
-		c.recvb.SkipRead(size)
-		return size, nil
+		if wg != nil && wg.IsExit() {
+			return 0, errors.New("closed conn")
+		}
+		time.Sleep(time.Millisecond * 100)
 	}
 
 	return 0, errors.New("read closed conn")
 }
 
+// readMessage reads len(4) | data written by writeMessage, it returns 0 until the whole message is in, a message longer than p is cut
+func (c *RhttpConn) readMessage(p []byte) (int, error) {
+	if c.recvmsglen <= 0 {
+		if c.recvb.Size() < 4 {
+			return 0, nil
+		}
+		head := make([]byte, 4)
+		c.recvb.Read(head)
+		c.recvmsglen = int(binary.BigEndian.Uint32(head))
+	}
+
+	if c.recvb.Size() < c.recvmsglen {
+		return 0, nil
+	}
+
+	n := c.recvmsglen
+	c.recvmsglen = 0
+	if n <= len(p) {
+		c.recvb.Read(p[0:n])
+		return n, nil
+	}
+	c.recvb.Read(p)
+	c.recvb.SkipRead(n - len(p))
+	return len(p), io.ErrShortBuffer
+}
+
 func (c *RhttpConn) Write(p []byte) (n int, err error) {
 	c.checkConfig()
 
-	if c.isclose {
+	if atomic.LoadInt32(&c.isclose) != 0 {
 		return 0, errors.New("write closed conn")
 	}
 
@@ -156,10 +234,18 @@ func (c *RhttpConn) Write(p []byte) (n int, err error) {
 		return 0, errors.New("empty conn")
 	}
 
+	if c.config.Message != "" {
+		return c.writeMessage(wg, p)
+	}
+
 	totalsize := len(p)
 	cur := 0
 
-	for !c.isclose {
+	for atomic.LoadInt32(&c.isclose) == 0 {
+		if c.deadline.writeExpired() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
 		size := totalsize - cur
 		svleft := c.sendb.Capacity() - c.sendb.Size()
 		if size > svleft {
@@ -187,10 +273,38 @@ func (c *RhttpConn) Write(p []byte) (n int, err error) {
 	return 0, errors.New("write closed conn")
 }
 
+// writeMessage puts len(4) | p in the send buffer at once, so the peer gets it back in one Read
+func (c *RhttpConn) writeMessage(wg *group.Group, p []byte) (n int, err error) {
+	if len(p)+4 > common.MinOfInt(c.sendb.Capacity(), c.recvb.Capacity()) {
+		return 0, errors.New("message too big")
+	}
+
+	msg := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(msg, uint32(len(p)))
+	copy(msg[4:], p)
+
+	for atomic.LoadInt32(&c.isclose) == 0 {
+		if c.deadline.writeExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if c.sendb.Write(msg) {
+			return len(p), nil
+		}
+
+		if wg != nil && wg.IsExit() {
+			return 0, errors.New("closed conn")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return 0, errors.New("write closed conn")
+}
+
 func (c *RhttpConn) Close() error {
 	c.checkConfig()
 
-	if c.isclose {
+	if atomic.LoadInt32(&c.isclose) != 0 {
 		return nil
 	}
 
@@ -225,7 +339,7 @@ func (c *RhttpConn) Close() error {
 	} else if c.listenersonny != nil {
 		//loggo.Debug("start Close listenersonny %s", c.Info())
 	}
-	c.isclose = true
+	atomic.StoreInt32(&c.isclose, 1)
 
 	//loggo.Debug("Close ok %s", c.Info())
 
@@ -250,28 +364,109 @@ func (c *RhttpConn) Info() string {
 	return c.info
 }
 
-func (c *RhttpConn) postData(url string, d []byte) (int, []byte, error) {
+func (c *RhttpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return &connAddr{network: "rhttp", addr: c.id}
+	} else if c.listener != nil {
+		return c.listener.listenerconn.Addr()
+	} else if c.listenersonny != nil {
+		return &connAddr{network: "rhttp", addr: c.listenersonny.addr}
+	}
+	return nil
+}
 
-	data := bytes.NewReader(d)
-	req, err := http.NewRequest("POST", url, data)
-	if err != nil {
-		return 0, nil, err
+func (c *RhttpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return &connAddr{network: "rhttp", addr: c.dialer.addr}
+	} else if c.listenersonny != nil {
+		return &connAddr{network: "rhttp", addr: c.listenersonny.remoteaddr}
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Close = true
+	return nil
+}
+
+func (c *RhttpConn) SetDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setDeadline(t)
+	return nil
+}
 
+func (c *RhttpConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setReadDeadline(t)
+	return nil
+}
+
+func (c *RhttpConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setWriteDeadline(t)
+	return nil
+}
+
+func (c *RhttpConn) httpClient() *http.Client {
 	tp := http.Transport{}
-	tp.Dial = func(network, addr string) (net.Conn, error) {
+	tp.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		var d net.Dialer
 		if gControlOnConnSetup != nil {
 			d = net.Dialer{Control: gControlOnConnSetup}
 		}
-		return d.Dial(network, addr)
+		return d.DialContext(ctx, network, addr)
 	}
 
+	tp.TLSClientConfig = c.dialer.tlsconfig
+
 	client := &http.Client{}
 	client.Transport = &tp
-	resp, err := client.Do(req)
+	return client
+}
+
+// newRequest puts the tunnel fields where FieldMode says, so no fixed query key shows up unless asked
+func (c *RhttpConn) newRequest(ctx context.Context, method string, ty string, index int, body io.Reader) (*http.Request, error) {
+	url := c.dialer.url
+	if c.config.FieldMode == "path" {
+		url += "/" + ty + "/" + strconv.Itoa(index)
+	} else if c.config.FieldMode != "header" {
+		url += "?type=" + ty + "&index=" + strconv.Itoa(index)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if c.config.FieldMode == "header" {
+		req.Header.Set(c.config.FieldHeader, ty+"."+strconv.Itoa(index))
+	}
+	for k, v := range c.config.Headers {
+		if k == "Host" {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Close = true
+	return req, nil
+}
+
+func (c *RhttpConn) postData(ctx context.Context, ty string, index int, d []byte) (int, []byte, error) {
+	return c.postStream(ctx, ty, index, bytes.NewReader(d))
+}
+
+func (c *RhttpConn) postStream(ctx context.Context, ty string, index int, data io.Reader) (int, []byte, error) {
+
+	req, err := c.newRequest(ctx, "POST", ty, index, data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -285,18 +480,68 @@ func (c *RhttpConn) postData(url string, d []byte) (int, []byte, error) {
 	return resp.StatusCode, body, nil
 }
 
+// the stream mode sends len(4) | data records, an empty record is a keepalive
+func writeHttpRecord(w io.Writer, b []byte) error {
+	head := make([]byte, 4)
+	binary.BigEndian.PutUint32(head, uint32(len(b)))
+	_, err := w.Write(append(head, b...))
+	return err
+}
+
+func readHttpRecord(r io.Reader, buf []byte) (int, error) {
+	head := make([]byte, 4)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint32(head))
+	if n > len(buf) {
+		return 0, errors.New("record too big " + strconv.Itoa(n))
+	}
+	_, err = io.ReadFull(r, buf[0:n])
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (c *RhttpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *RhttpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
 	id := common.UniqueId()
 
-	url := dst + "/" + id
+	host := dst
+	https := c.config.Https
+	if strings.HasPrefix(host, "https://") {
+		host = strings.TrimPrefix(host, "https://")
+		https = true
+	} else {
+		host = strings.TrimPrefix(host, "http://")
+	}
 
-	if !strings.HasPrefix(url, "http://") {
-		url = "http://" + url
+	url := "http://" + host + c.config.Path + "/" + id
+	var tlsconfig *tls.Config
+	if https {
+		url = "https://" + host + c.config.Path + "/" + id
+		cf, err := c.clientTlsConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		tlsconfig = cf
 	}
 
-	code, ret, err := c.postData(url+"?type="+ProtoConnnect, []byte{})
+	sendb := rbuffergo.New(c.config.BufferSize, true)
+	recvb := rbuffergo.New(c.config.BufferSize, true)
+
+	dialer := &httpConnDialer{url: url, index: 0, retry: 0, addr: dst, tlsconfig: tlsconfig}
+
+	u := &RhttpConn{id: id, config: c.config, dialer: dialer, sendb: sendb, recvb: recvb}
+
+	code, ret, err := u.postData(ctx, ProtoConnnect, 0, []byte{})
 	if err != nil {
 		return nil, err
 	}
@@ -307,12 +552,19 @@ func (c *RhttpConn) Dial(dst string) (Conn, error) {
 
 	wg := group.NewGroup("RhttpConn Dialer"+" "+id, nil, nil)
 
-	sendb := rbuffergo.New(c.config.BufferSize, true)
-	recvb := rbuffergo.New(c.config.BufferSize, true)
-
-	dialer := &httpConnDialer{wg: wg, url: url, index: 0, retry: 0, addr: dst}
+	u.dialer.wg = wg
 
-	u := &RhttpConn{id: id, config: c.config, dialer: dialer, sendb: sendb, recvb: recvb}
+	if c.config.Mode == "stream" {
+		down := u.openDown(0)
+		if down != nil {
+			u.dialer.stream = true
+			wg.Go("RhttpConn updateDialerStream"+" "+u.Info(), func() error {
+				return u.updateDialerStream(down)
+			})
+			return u, nil
+		}
+		//loggo.Debug("http stream not pass, fall back to poll %s", u.Info())
+	}
 
 	wg.Go("RhttpConn updateDialerSonny"+" "+u.Info(), func() error {
 		return u.updateDialerSonny()
@@ -321,6 +573,158 @@ func (c *RhttpConn) Dial(dst string) (Conn, error) {
 	return u, nil
 }
 
+// openDown opens the downstream GET, the server sends a keepalive record at once,
+// so if it does not come in time something between buffers the chunked response and we poll instead
+// index is the bytes got from the downstreams before, the server goes on from there
+func (c *RhttpConn) openDown(index int) io.ReadCloser {
+	ctx, cancel := context.WithCancel(c.dialer.wg.Context())
+	timer := time.AfterFunc(time.Millisecond*time.Duration(c.config.StreamProbeTimeoutMs), cancel)
+
+	req, err := c.newRequest(ctx, "GET", ProtoDown, index, nil)
+	if err != nil {
+		cancel()
+		return nil
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		cancel()
+		return nil
+	}
+
+	_, err = readHttpRecord(resp.Body, nil)
+	if err != nil || resp.StatusCode != ProtoCodeOK || !timer.Stop() {
+		resp.Body.Close()
+		cancel()
+		return nil
+	}
+	return resp.Body
+}
+
+func (c *RhttpConn) updateDialerStream(down io.ReadCloser) error {
+
+	//loggo.Debug("start http stream conn %s", c.Info())
+
+	wg := c.dialer.wg
+	atomic.StoreInt64(&c.dialer.lastRecv, time.Now().UnixNano())
+
+	pr, pw := io.Pipe()
+	wg.Go("RhttpConn stream up"+" "+c.Info(), func() error {
+		code, ret, err := c.postStream(wg.Context(), ProtoUp, 0, pr)
+		if err == nil && code != ProtoCodeOK {
+			err = errors.New("stream up fail " + string(ret))
+		}
+		if err == nil {
+			err = errors.New("stream up closed")
+		}
+		pr.CloseWithError(err)
+		return err
+	})
+
+	wg.Go("RhttpConn stream down"+" "+c.Info(), func() error {
+		defer func() {
+			if down != nil {
+				down.Close()
+			}
+		}()
+		buf := make([]byte, c.config.MaxPacketSize)
+		downrecv := 0
+		retry := 0
+		for !wg.IsExit() {
+			n, err := readHttpRecord(down, buf)
+			if err != nil {
+				//loggo.Debug("stream down fail %s %s", c.Info(), err)
+				down.Close()
+				down = nil
+				for down == nil && retry < c.config.MaxRetryNum && !wg.IsExit() {
+					retry++
+					down = c.openDown(downrecv)
+					if down == nil {
+						time.Sleep(time.Millisecond * 100)
+					}
+				}
+				if down == nil {
+					return err
+				}
+				continue
+			}
+			retry = 0
+			downrecv += n
+			atomic.StoreInt64(&c.dialer.lastRecv, time.Now().UnixNano())
+			if n <= 0 {
+				continue
+			}
+			for !c.recvb.Write(buf[0:n]) {
+				if wg.IsExit() {
+					return nil
+				}
+				time.Sleep(time.Microsecond * 100)
+			}
+			c.stat.in(n)
+		}
+		return nil
+	})
+
+	buf := make([]byte, c.config.MaxPacketSize)
+	lastsend := time.Now()
+	for !wg.IsExit() {
+		now := time.Now()
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&c.dialer.lastRecv))) > time.Millisecond*time.Duration(c.config.HBTimeoutMs) {
+			//loggo.Debug("stream down timeout %s", c.Info())
+			break
+		}
+
+		sendn := common.MinOfInt(c.sendb.Size(), len(buf))
+		if sendn <= 0 {
+			if now.Sub(lastsend) > time.Second {
+				if writeHttpRecord(pw, nil) != nil {
+					break
+				}
+				lastsend = now
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		if !c.sendb.Read(buf[0:sendn]) {
+			//loggo.Error("sendb Read fail")
+			return errors.New("sendb Read fail")
+		}
+		if writeHttpRecord(pw, buf[0:sendn]) != nil {
+			//loggo.Debug("stream up fail %s", c.Info())
+			break
+		}
+		c.stat.out(sendn)
+		lastsend = now
+	}
+
+	pw.Close()
+
+	//loggo.Debug("close http stream conn update %s", c.Info())
+
+	startEndTime := time.Now()
+	for !wg.IsExit() {
+		now := time.Now()
+
+		diffclose := now.Sub(startEndTime)
+		if diffclose > time.Millisecond*time.Duration(c.config.CloseWaitTimeoutMs) {
+			break
+		}
+
+		if c.recvb.Size() <= 0 {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	//loggo.Debug("close http stream conn %s", c.Info())
+
+	c.postData(context.Background(), ProtoClose, 0, []byte{})
+
+	return errors.New("closed")
+}
+
 func (c *RhttpConn) updateDialerSonny() error {
 
 	//loggo.Debug("start http conn %s", c.Info())
@@ -356,9 +760,11 @@ func (c *RhttpConn) updateDialerSonny() error {
 		} else {
 			send = lastsend
 			active = true
+			c.stat.retransmit()
 		}
 
-		code, ret, err := c.postData(c.dialer.url+"?type="+ProtoData+"&index="+strconv.Itoa(c.dialer.index), send)
+		begin := time.Now()
+		code, ret, err := c.postData(c.dialer.wg.Context(), ProtoData, c.dialer.index, send)
 		if err != nil || code != ProtoCodeOK {
 			if code != ProtoCodeFull {
 				c.dialer.retry++
@@ -372,6 +778,9 @@ func (c *RhttpConn) updateDialerSonny() error {
 			continue
 		}
 		lastsend = nil
+		c.stat.out(len(send))
+		c.stat.in(len(ret))
+		c.stat.setRtt(time.Now().Sub(begin))
 
 		//loggo.Debug("dailer send ok %s %d %d %d", c.Info(), c.dialer.index, len(send), len(ret))
 
@@ -413,22 +822,38 @@ func (c *RhttpConn) updateDialerSonny() error {
 
 	//loggo.Debug("close http conn %s", c.Info())
 
-	c.postData(c.dialer.url+"?type="+ProtoClose, []byte{})
+	c.postData(context.Background(), ProtoClose, 0, []byte{})
 
 	return errors.New("closed")
 }
 
 func (c *RhttpConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *RhttpConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
 	addr, err := net.ResolveTCPAddr("tcp", dst)
 	if err != nil {
 		return nil, err
 	}
-	listenerconn, err := net.ListenTCP("tcp", addr)
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
+	listenerconn := l.(*net.TCPListener)
+
+	var serveconn net.Listener = listenerconn
+	if c.config.Https {
+		tlsconfig, err := c.serverTlsConfig()
+		if err != nil {
+			listenerconn.Close()
+			return nil, err
+		}
+		serveconn = tls.NewListener(listenerconn, tlsconfig)
+	}
 
 	ch := common.NewChannel(c.config.AcceptChanLen)
 
@@ -440,11 +865,12 @@ func (c *RhttpConn) Listen(dst string) (Conn, error) {
 	listener := &httpConnListener{
 		addr:         dst,
 		listenerconn: listenerconn,
+		serveconn:    serveconn,
 		wg:           wg,
 		accept:       ch,
 	}
 
-	u := &RhttpConn{id: common.UniqueId(), config: c.config, listener: listener}
+	u := &RhttpConn{id: common.UniqueId(), config: c.config, listener: listener, writedown: c.writedown}
 	wg.Go("RhttpConn Listen loopRecv"+" "+dst, func() error {
 		return u.loopRecv()
 	})
@@ -456,13 +882,22 @@ func (c *RhttpConn) Listen(dst string) (Conn, error) {
 }
 
 func (c *RhttpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *RhttpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
@@ -471,7 +906,7 @@ func (c *RhttpConn) Accept() (Conn, error) {
 		if !ok {
 			continue
 		}
-		if sonny.isclose {
+		if atomic.LoadInt32(&sonny.isclose) != 0 {
 			continue
 		}
 		return sonny, nil
@@ -482,35 +917,26 @@ func (c *RhttpConn) Accept() (Conn, error) {
 func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//loggo.Debug("ServeHTTP %v %v", r.Method, r.RequestURI)
 
-	u, err := url.Parse(r.RequestURI)
-	if err != nil {
-		//loggo.Error("Parse fail %v", r.RequestURI)
-		w.WriteHeader(ProtoCodeFail)
-		w.Write([]byte("url Parse fail"))
-		return
+	for k, v := range c.config.RspHeaders {
+		w.Header().Set(k, v)
 	}
 
-	id := u.Path
-	param := u.Query()
-	types, ok := param["type"]
-	if !ok || len(types) == 0 {
-		//loggo.Error("no params type %v", r.RequestURI)
-		w.WriteHeader(ProtoCodeFail)
-		w.Write([]byte("no params type"))
+	id, ty, index, ok := c.parseTunnel(r)
+	if !ok {
+		//loggo.Debug("not tunnel request %v", r.RequestURI)
+		c.decoy(w, r)
 		return
 	}
-	ty := types[0]
 
 	v, ok := c.listener.sonny.Load(id)
 	if !ok {
 		if ty != ProtoConnnect {
-			//loggo.Error("no sonny id %v", id)
-			w.WriteHeader(ProtoCodeFail)
-			w.Write([]byte("no sonny id"))
+			//loggo.Debug("no sonny id %v", id)
+			c.decoy(w, r)
 			return
 		}
 
-		sonny := &httpConnListenerSonny{fwg: c.listener.wg, expectIndex: 0, lastRecvTime: time.Now(), addr: c.listener.addr}
+		sonny := &httpConnListenerSonny{fwg: c.listener.wg, expectIndex: 0, lastRecvTime: time.Now().UnixNano(), addr: c.listener.addr, remoteaddr: r.RemoteAddr}
 
 		sendb := rbuffergo.New(c.config.BufferSize, true)
 		recvb := rbuffergo.New(c.config.BufferSize, true)
@@ -525,9 +951,9 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	} else {
 		u := v.(*RhttpConn)
-		u.listenersonny.lastRecvTime = time.Now()
+		atomic.StoreInt64(&u.listenersonny.lastRecvTime, time.Now().UnixNano())
 
-		if ty != ProtoData && ty != ProtoClose {
+		if ty == ProtoConnnect {
 			//loggo.Error("wrong type %v %v", id, ty)
 			w.WriteHeader(ProtoCodeFail)
 			w.Write([]byte("wrong type " + ty))
@@ -540,21 +966,18 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		indexs, ok := param["index"]
-		if !ok || len(indexs) == 0 {
-			//loggo.Error("no index type %v", r.RequestURI)
-			w.WriteHeader(ProtoCodeFail)
-			w.Write([]byte("no params index"))
+		if ty == ProtoDown {
+			c.serveDown(u, w, r, index)
 			return
 		}
-		index, err := strconv.Atoi(indexs[0])
-		if err != nil {
-			//loggo.Error("index fail %v", r.RequestURI)
-			w.WriteHeader(ProtoCodeFail)
-			w.Write([]byte("index fail"))
+
+		if ty == ProtoUp {
+			c.serveUp(u, w, r)
 			return
 		}
 
+		atomic.StoreInt32(&u.listenersonny.poll, 1)
+
 		newrecv := true
 		if index != u.listenersonny.expectIndex {
 			nextindex := index + 1
@@ -580,6 +1003,7 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			u.stat.in(len(body))
 			if !u.recvb.Write(body) {
 				//loggo.Debug("body write fail %v %v", r.RequestURI, len(body))
 				w.WriteHeader(ProtoCodeFull)
@@ -598,18 +1022,209 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			w.WriteHeader(ProtoCodeOK)
 			w.Write(buff)
+			u.stat.out(len(buff))
 
 			u.listenersonny.lastSend = buff
 		} else {
 			w.WriteHeader(ProtoCodeOK)
 			w.Write(u.listenersonny.lastSend)
+			u.stat.out(len(u.listenersonny.lastSend))
+			u.stat.retransmit()
 		}
 	}
 }
 
+// parseTunnel finds the tunnel fields of r, anything else is not ours and goes to the decoy
+func (c *RhttpConn) parseTunnel(r *http.Request) (string, string, int, bool) {
+	prefix := c.config.Path + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return "", "", 0, false
+	}
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+
+	var ty, index string
+	if c.config.FieldMode == "path" {
+		parts := strings.Split(id, "/")
+		if len(parts) != 3 {
+			return "", "", 0, false
+		}
+		id, ty, index = parts[0], parts[1], parts[2]
+	} else if c.config.FieldMode == "header" {
+		field := r.Header.Get(c.config.FieldHeader)
+		dot := strings.LastIndex(field, ".")
+		if dot < 0 {
+			return "", "", 0, false
+		}
+		ty, index = field[0:dot], field[dot+1:]
+	} else {
+		param := r.URL.Query()
+		ty, index = param.Get("type"), param.Get("index")
+	}
+
+	if id == "" || strings.Contains(id, "/") {
+		return "", "", 0, false
+	}
+	if ty != ProtoConnnect && ty != ProtoData && ty != ProtoClose && ty != ProtoDown && ty != ProtoUp {
+		return "", "", 0, false
+	}
+	n := 0
+	if index != "" {
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return "", "", 0, false
+		}
+		n = i
+	} else if ty == ProtoData {
+		return "", "", 0, false
+	}
+	return id, ty, n, true
+}
+
+// decoy answers like a plain static site
+func (c *RhttpConn) decoy(w http.ResponseWriter, r *http.Request) {
+	if c.config.DecoyDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	http.FileServer(http.Dir(c.config.DecoyDir)).ServeHTTP(w, r)
+}
+
+func (c *RhttpConn) clientTlsConfig(host string) (*tls.Config, error) {
+	return clientTls(host, c.config.ServerName, c.config.CAFile, "", c.config.Insecure)
+}
+
+func (c *RhttpConn) serverTlsConfig() (*tls.Config, error) {
+	if c.config.CertFile == "" {
+		return common.GenerateTLSConfig("http/1.1")
+	}
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}, nil
+}
+
+func (c *RhttpConn) sonnyAlive(u *RhttpConn) bool {
+	if atomic.LoadInt32(&u.isclose) != 0 || c.listener.wg.IsExit() {
+		return false
+	}
+	_, ok := c.listener.sonny.Load(u.id)
+	return ok
+}
+
+// serveDown streams the send buffer of the sonny as records, it starts moving data only after the up stream comes,
+// a client that got no keepalive polls instead, index is how many bytes the client got from the downstreams before,
+// the data only leaves sendb once written, so the client can poll or open the downstream again after a failure
+func (c *RhttpConn) serveDown(u *RhttpConn, w http.ResponseWriter, r *http.Request, index int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(ProtoCodeFail)
+		w.Write([]byte("stream not support"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(ProtoCodeOK)
+	if writeHttpRecord(w, nil) != nil {
+		return
+	}
+	flusher.Flush()
+
+	for atomic.LoadInt32(&u.listenersonny.stream) == 0 {
+		if r.Context().Err() != nil || atomic.LoadInt32(&u.listenersonny.poll) != 0 || !c.sonnyAlive(u) {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// a reopened downstream waits for the broken one to give up
+	u.listenersonny.downlock.Lock()
+	defer u.listenersonny.downlock.Unlock()
+
+	if int64(index) != u.listenersonny.downsent {
+		// a written record did not reach the client, the stream can not go on
+		//loggo.Debug("http stream down lost %s %d %d", u.Info(), index, u.listenersonny.downsent)
+		u.Close()
+		return
+	}
+
+	//loggo.Debug("start http stream down %s", u.Info())
+
+	buf := make([]byte, u.config.MaxPacketSize)
+	lastsend := time.Now()
+	for r.Context().Err() == nil && c.sonnyAlive(u) {
+		now := time.Now()
+		sendn := common.MinOfInt(u.sendb.Size(), len(buf))
+		if sendn <= 0 {
+			if now.Sub(lastsend) > time.Second {
+				if writeHttpRecord(w, nil) != nil {
+					break
+				}
+				flusher.Flush()
+				lastsend = now
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		u.sendb.Peek(buf[0:sendn])
+		writedown := writeHttpRecord
+		if c.writedown != nil {
+			writedown = c.writedown
+		}
+		if writedown(w, buf[0:sendn]) != nil {
+			// the data is still in sendb, the client opens the downstream again
+			break
+		}
+		flusher.Flush()
+		u.sendb.SkipRead(sendn)
+		u.listenersonny.downsent += int64(sendn)
+		u.stat.out(sendn)
+		lastsend = now
+	}
+
+	//loggo.Debug("end http stream down %s", u.Info())
+}
+
+func (c *RhttpConn) serveUp(u *RhttpConn, w http.ResponseWriter, r *http.Request) {
+	atomic.StoreInt32(&u.listenersonny.stream, 1)
+
+	//loggo.Debug("start http stream up %s", u.Info())
+
+	buf := make([]byte, u.config.MaxPacketSize)
+	for c.sonnyAlive(u) {
+		n, err := readHttpRecord(r.Body, buf)
+		if err != nil {
+			if err != io.EOF {
+				//loggo.Debug("http stream up fail %s %s", u.Info(), err)
+				u.Close()
+			}
+			break
+		}
+		atomic.StoreInt64(&u.listenersonny.lastRecvTime, time.Now().UnixNano())
+		if n <= 0 {
+			continue
+		}
+		for !u.recvb.Write(buf[0:n]) {
+			if !c.sonnyAlive(u) {
+				return
+			}
+			time.Sleep(time.Microsecond * 100)
+		}
+		u.stat.in(n)
+	}
+
+	w.WriteHeader(ProtoCodeOK)
+
+	//loggo.Debug("end http stream up %s", u.Info())
+}
+
 func (c *RhttpConn) loopRecv() error {
 	c.checkConfig()
-	http.Serve(c.listener.listenerconn, c)
+	http.Serve(c.listener.serveconn, c)
 	return nil
 }
 
@@ -618,7 +1233,7 @@ func (c *RhttpConn) checkSonnyClose() error {
 	for !c.listener.wg.IsExit() {
 		c.listener.sonny.Range(func(key, value interface{}) bool {
 			u := value.(*RhttpConn)
-			if u.isclose || time.Now().Sub(u.listenersonny.lastRecvTime) > time.Second*time.Duration(c.config.HBTimeoutMs) {
+			if atomic.LoadInt32(&u.isclose) != 0 || time.Now().UnixNano()-atomic.LoadInt64(&u.listenersonny.lastRecvTime) > int64(time.Second)*int64(c.config.HBTimeoutMs) {
 				c.listener.sonny.Delete(key)
 			}
 			return true
@@ -628,6 +1243,11 @@ func (c *RhttpConn) checkSonnyClose() error {
 	return nil
 }
 
+// Stats counts http requests as packets, the dialer rtt is the time of the last request
+func (c *RhttpConn) Stats() ConnStats {
+	return c.stat.stats()
+}
+
 func (c *RhttpConn) checkConfig() {
 	if c.config == nil {
 		c.config = DefaultHttpConfig()
@@ -1,9 +1,20 @@
 package conn
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/3t2ugg1e/go-engine/src/frame"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -540,3 +551,232 @@ func Test0009RHTTP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func testRhttpStream(t *testing.T, listen string, dial string, writedown func(w io.Writer, b []byte) error) bool {
+	config := DefaultHttpConfig()
+	config.Mode = "stream"
+	config.StreamProbeTimeoutMs = 1000
+
+	c, _ := NewConn("rhttp")
+	c.(*RhttpConn).SetConfig(config)
+	c.(*RhttpConn).writedown = writedown
+	cc, err := c.Listen(listen)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		io.Copy(sonny, sonny)
+	}()
+
+	ccc, err := c.Dial(dial)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	defer ccc.Close()
+	stream := ccc.(*RhttpConn).dialer.stream
+	fmt.Println("dial done", stream, ccc.Info())
+
+	src := make([]byte, 512*1024)
+	for i := range src {
+		src[i] = byte(i * 5)
+	}
+	go ccc.Write(src)
+
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return stream
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+	return stream
+}
+
+func Test0010RHTTP(t *testing.T) {
+	if !testRhttpStream(t, "127.0.0.1:58105", "127.0.0.1:58105", nil) {
+		t.Error("should use stream")
+	}
+}
+
+func Test0011RHTTP(t *testing.T) {
+	// a middlebox that only forwards whole responses
+	server := &http.Server{Addr: "127.0.0.1:58106", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://127.0.0.1:58105"+r.RequestURI, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+	})}
+	go server.ListenAndServe()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	if testRhttpStream(t, "127.0.0.1:58105", "127.0.0.1:58106", nil) {
+		t.Error("should fall back to poll")
+	}
+}
+
+func testRhttpEcho(t *testing.T, config *HttpConfig, listen string, dial string) {
+	c, _ := NewConn("rhttp")
+	c.(*RhttpConn).SetConfig(config)
+	cc, err := c.Listen(listen)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		io.Copy(sonny, sonny)
+	}()
+
+	if config.Https && config.Insecure {
+		// the listener uses a generated self-signed cert, it is refused unless Insecure
+		strict := *config
+		strict.Insecure = false
+		d, _ := NewConn("rhttp")
+		d.(*RhttpConn).SetConfig(&strict)
+		_, err := d.Dial(dial)
+		fmt.Println("verify", err)
+		if err == nil {
+			t.Error("self-signed cert should fail by default")
+		}
+	}
+
+	ccc, err := c.Dial(dial)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done", ccc.(*RhttpConn).dialer.url)
+
+	src := make([]byte, 256*1024)
+	for i := range src {
+		src[i] = byte(i * 7)
+	}
+	go ccc.Write(src)
+
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	scheme := "http://"
+	if config.Https {
+		scheme = "https://"
+	}
+	for _, path := range []string{"/", config.Path + "/" + ccc.(*RhttpConn).id + "?type=data&index=abc", "/index.html?type=connect"} {
+		resp, err := client.Get(scheme + listen + path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Println("decoy", path, resp.StatusCode, resp.Header.Get("Server"), string(body))
+		if resp.Header.Get("Server") != config.RspHeaders["Server"] {
+			t.Error("response header not set")
+		}
+		if strings.Contains(string(body), "params") || strings.Contains(string(body), "sonny") || strings.Contains(string(body), "fail") {
+			t.Error("tunnel error leaked", path)
+		}
+		if config.DecoyDir != "" && path == "/" && !strings.Contains(string(body), "welcome") {
+			t.Error("decoy not served", path)
+		}
+	}
+}
+
+func Test0012RHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decoy")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>welcome</html>"), 0644)
+
+	config := DefaultHttpConfig()
+	config.Https = true
+	config.Insecure = true
+	config.Path = "/static/js"
+	config.FieldMode = "path"
+	config.Headers = map[string]string{"User-Agent": "Mozilla/5.0", "Host": "www.example.com"}
+	config.RspHeaders = map[string]string{"Server": "nginx"}
+	config.DecoyDir = dir
+	testRhttpEcho(t, config, "127.0.0.1:58107", "127.0.0.1:58107")
+}
+
+func Test0013RHTTP(t *testing.T) {
+	config := DefaultHttpConfig()
+	config.Mode = "stream"
+	config.Https = true
+	config.Insecure = true
+	config.FieldMode = "header"
+	config.RspHeaders = map[string]string{"Server": "nginx"}
+	testRhttpEcho(t, config, "127.0.0.1:58107", "https://127.0.0.1:58107")
+}
+
+func Test0014RHTTP(t *testing.T) {
+	config := DefaultHttpConfig()
+	config.Message = frame.MessageReliable
+	c, _ := NewConn("rhttp")
+	c.(*RhttpConn).SetConfig(config)
+	testMessageEcho(t, c, "127.0.0.1:58118", true)
+}
+
+func Test0015RHTTP(t *testing.T) {
+	// every 5th downstream record breaks half way, the client opens the downstream again and nothing is lost
+	var num int32
+	writedown := func(w io.Writer, b []byte) error {
+		if len(b) > 0 && atomic.AddInt32(&num, 1)%5 == 0 {
+			w.Write(b[0 : len(b)/2])
+			return errors.New("test break")
+		}
+		return writeHttpRecord(w, b)
+	}
+
+	if !testRhttpStream(t, "127.0.0.1:58132", "127.0.0.1:58132", writedown) {
+		t.Error("should use stream")
+	}
+	fmt.Println("down records", atomic.LoadInt32(&num))
+	if atomic.LoadInt32(&num) < 5 {
+		t.Error("downstream not broken")
+	}
+}
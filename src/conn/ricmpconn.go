@@ -1,22 +1,32 @@
 package conn
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"github.com/3t2ugg1e/go-engine/src/common"
 	"github.com/3t2ugg1e/go-engine/src/congestion"
 	"github.com/3t2ugg1e/go-engine/src/frame"
 	"github.com/3t2ugg1e/go-engine/src/group"
+	"github.com/3t2ugg1e/go-engine/src/icmputil"
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 	"math"
 	"math/rand"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+func init() {
+	Register("ricmp", func() Conn {
+		return &RicmpConn{id: common.UniqueId()}
+	}, true)
+}
+
 type RicmpConfig struct {
 	MaxPacketSize      int
 	CutSize            int
@@ -31,6 +41,12 @@ type RicmpConfig struct {
 	CloseWaitTimeoutMs int
 	AcceptChanLen      int
 	Congestion         string
+	Obfs               *ObfsConfig // 包混淆，nil为不混淆
+	FecData            int         // FEC每组的数据帧数，0为不开启，两端协商取小
+	FecParity          int         // FEC每组的校验帧数，一组内丢失不超过这个数可不重传恢复
+	StreamBuffer       int         // OpenStream时每个流的接收窗口，流之间互不阻塞
+	Message            string      // 消息模式，每次Write对端一次Read完整读到，空为字节流，reliable/unordered/unreliable，两端需一致
+	MessageTtlMs       int         // unreliable模式下消息超过这个时间还没送达就不再重传
 }
 
 func DefaultRicmpConfig() *RicmpConfig {
@@ -48,6 +64,8 @@ func DefaultRicmpConfig() *RicmpConfig {
 		CloseWaitTimeoutMs: 5000,
 		AcceptChanLen:      128,
 		Congestion:         "bb",
+		StreamBuffer:       256 * 1024,
+		MessageTtlMs:       1000,
 	}
 }
 
@@ -60,6 +78,12 @@ type RicmpConn struct {
 	listener      *ricmpConnListener
 	isclose       bool
 	closelock     sync.Mutex
+	deadline      connDeadline
+	lossy         *LossyConfig
+	impair        *impairer
+	obfs          *obfuscator
+	stat          connCounter
+	mux           streamMux
 }
 
 type ricmpConnDialer struct {
@@ -75,6 +99,7 @@ type ricmpConnDialer struct {
 
 type ricmpConnListenerSonny struct {
 	dstaddr    net.Addr
+	dstlock    sync.Mutex
 	fatherconn *icmp.PacketConn
 	fm         *frame.FrameMgr
 	wg         *group.Group
@@ -82,6 +107,22 @@ type ricmpConnListenerSonny struct {
 	icmpSeq    int
 	icmpProto  int
 	icmpFlag   IcmpMsg_TYPE
+
+	challenge     int64
+	challengeaddr string
+	challengetime int64
+}
+
+func (s *ricmpConnListenerSonny) remote() (net.Addr, int) {
+	s.dstlock.Lock()
+	defer s.dstlock.Unlock()
+	return s.dstaddr, s.icmpId
+}
+
+func (s *ricmpConnListenerSonny) isRemote(addr net.Addr, icmpId int) bool {
+	s.dstlock.Lock()
+	defer s.dstlock.Unlock()
+	return s.icmpId == icmpId && s.dstaddr.String() == addr.String()
 }
 
 type ricmpConnListener struct {
@@ -121,6 +162,10 @@ func (c *RicmpConn) Read(p []byte) (n int, err error) {
 	}
 
 	for !c.isclose {
+		if c.deadline.readExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
 		if fm.GetRecvBufferSize() <= 0 {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
@@ -129,6 +174,10 @@ func (c *RicmpConn) Read(p []byte) (n int, err error) {
 			continue
 		}
 
+		if c.config.Message != "" {
+			return fm.ReadMessage(p)
+		}
+
 		size := copy(p, fm.GetRecvReadLineBuffer())
 		fm.SkipRecvBuffer(size)
 		return size, nil
@@ -162,10 +211,18 @@ func (c *RicmpConn) Write(p []byte) (n int, err error) {
 		return 0, errors.New("empty conn")
 	}
 
+	if c.config.Message != "" {
+		return c.writeMessage(fm, wg, p)
+	}
+
 	totalsize := len(p)
 	cur := 0
 
 	for !c.isclose {
+		if c.deadline.writeExpired() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
 		size := totalsize - cur
 		svleft := fm.GetSendBufferLeft()
 		if size > svleft {
@@ -193,6 +250,30 @@ func (c *RicmpConn) Write(p []byte) (n int, err error) {
 	return 0, errors.New("write closed conn")
 }
 
+// writeMessage queues p as one message once the send buffer has room for all of it
+func (c *RicmpConn) writeMessage(fm *frame.FrameMgr, wg *group.Group, p []byte) (n int, err error) {
+	if len(p) > fm.MaxMessageSize() {
+		return 0, errors.New("message too big")
+	}
+
+	for !c.isclose {
+		if c.deadline.writeExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if fm.WriteMessage(p) {
+			return len(p), nil
+		}
+
+		if wg != nil && wg.IsExit() {
+			return 0, errors.New("closed conn")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return 0, errors.New("write closed conn")
+}
+
 func (c *RicmpConn) Close() error {
 	c.checkConfig()
 
@@ -200,6 +281,8 @@ func (c *RicmpConn) Close() error {
 		return nil
 	}
 
+	c.mux.close()
+
 	c.closelock.Lock()
 	defer c.closelock.Unlock()
 
@@ -253,22 +336,79 @@ func (c *RicmpConn) Info() string {
 	} else if c.listener != nil {
 		c.info = "ricmp listener " + c.id + "--" + c.listener.listenerconn.LocalAddr().String()
 	} else if c.listenersonny != nil {
-		c.info = c.listenersonny.fatherconn.LocalAddr().String() + "<--ricmp listenersonny " + c.id + "-->" + c.listenersonny.dstaddr.String()
+		c.info = c.listenersonny.fatherconn.LocalAddr().String() + "<--ricmp listenersonny " + c.id + "-->" + c.remoteAddr().String()
 	} else {
 		c.info = "empty ricmp conn"
 	}
 	return c.info
 }
 
+func (c *RicmpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *RicmpConn) remoteAddr() net.Addr {
+	dstaddr, _ := c.listenersonny.remote()
+	return dstaddr
+}
+
+func (c *RicmpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.serveraddr
+	} else if c.listenersonny != nil {
+		return c.remoteAddr()
+	}
+	return nil
+}
+
+func (c *RicmpConn) SetDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setDeadline(t)
+	return nil
+}
+
+func (c *RicmpConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setReadDeadline(t)
+	return nil
+}
+
+func (c *RicmpConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setWriteDeadline(t)
+	return nil
+}
+
 func (c *RicmpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *RicmpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
+	if err := checkObfs(c.config.Obfs); err != nil {
+		return nil, err
+	}
+
 	addr, err := net.ResolveIPAddr("ip", dst)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := icmp.ListenPacket("ip4:icmp", "")
+	conn, err := icmputil.Listen(addr.IP)
 	if err != nil {
 		return nil, err
 	}
@@ -279,11 +419,22 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 	if c.config.Congestion == "bb" {
 		fm.SetCongestion(&congestion.BBCongestion{})
 	}
+	if c.config.Obfs != nil {
+		fm.SetObfs(c.config.Obfs.Scheme)
+	}
+	fm.SetFec(c.config.FecData, c.config.FecParity)
+	fm.SetMessage(c.config.Message, c.config.MessageTtlMs)
+
+	icmpId := rand.Intn(math.MaxInt16)
+	if udpaddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && udpaddr.Port != 0 {
+		// the kernel puts the local port in as echo id
+		icmpId = udpaddr.Port
+	}
 
 	dialer := &ricmpConnDialer{serveraddr: addr, conn: conn, fm: fm,
-		icmpId: rand.Intn(math.MaxInt16), icmpSeq: 0, icmpProto: int(IcmpMsg_PING_PROTO), icmpFlag: IcmpMsg_CLIENT_SEND_FLAG}
+		icmpId: icmpId, icmpSeq: 0, icmpProto: int(IcmpMsg_PING_PROTO), icmpFlag: IcmpMsg_CLIENT_SEND_FLAG}
 
-	u := &RicmpConn{id: id, config: c.config, dialer: dialer}
+	u := &RicmpConn{id: id, config: c.config, dialer: dialer, impair: newImpairer(c.lossy), obfs: c.newObfuscator()}
 
 	//loggo.Debug("start connect remote ricmp %s %s", u.Info(), id)
 
@@ -304,7 +455,7 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 			f := e.Value.(*frame.Frame)
 			mb, _ := u.dialer.fm.MarshalFrame(f)
 			u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-			u.send_icmp(u.dialer.conn, mb, u.dialer.serveraddr,
+			u.send_icmp(u.dialer.conn, f, mb, u.dialer.serveraddr,
 				u.id, u.dialer.icmpId, u.dialer.icmpSeq, u.dialer.icmpProto, u.dialer.icmpFlag)
 			u.dialer.icmpSeq++
 		}
@@ -312,9 +463,10 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 		// recv icmp
 		u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		n, _, _, id, echoId, _, echoFlag := u.recv_icmp(u.dialer.conn, buf)
-		if n > 0 && id == u.id && echoId == u.dialer.icmpId && echoFlag == int(IcmpMsg_SERVER_SEND_FLAG) {
+		if n > 0 && id == u.id && icmpIdMatch(u.dialer.conn, echoId, u.dialer.icmpId) && echoFlag == int(IcmpMsg_SERVER_SEND_FLAG) {
+			u.stat.in(n)
 			f := &frame.Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
+			err := u.obfs.unmarshal(u.dialer.fm, buf[0:n], f)
 			if err == nil {
 				u.dialer.fm.OnRecvFrame(f)
 			} else {
@@ -328,6 +480,11 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 			break
 		}
 
+		if ctx.Err() != nil {
+			//loggo.Debug("cancel connect remote ricmp %s", u.Info())
+			break
+		}
+
 		// timeout
 		now := time.Now()
 		diffclose := now.Sub(startConnectTime)
@@ -349,6 +506,10 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 	}
 
 	if !u.dialer.fm.IsConnected() {
+		u.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, errors.New("connect timeout")
 	}
 
@@ -362,13 +523,31 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 		return u.updateDialerSonny()
 	})
 
+	if u.obfs != nil {
+		wg.Go("RicmpConn loopJitter"+" "+u.Info(), func() error {
+			return u.obfs.loopJitter(wg)
+		})
+	}
+
 	return u, nil
 }
 
 func (c *RicmpConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *RicmpConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
-	conn, err := icmp.ListenPacket("ip4:icmp", dst)
+	if err := checkObfs(c.config.Obfs); err != nil {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	conn, err := icmp.ListenPacket(icmpListenNetwork(dst), dst)
 	if err != nil {
 		return nil, err
 	}
@@ -383,22 +562,36 @@ func (c *RicmpConn) Listen(dst string) (Conn, error) {
 		accept:       ch,
 	}
 
-	u := &RicmpConn{id: common.UniqueId(), config: c.config, listener: listener}
+	u := &RicmpConn{id: common.UniqueId(), config: c.config, listener: listener, impair: newImpairer(c.lossy), obfs: c.newObfuscator()}
 	wg.Go("RicmpConn loopListenerRecv"+" "+dst, func() error {
 		return u.loopListenerRecv()
 	})
+	if u.obfs != nil {
+		wg.Go("RicmpConn loopJitter"+" "+dst, func() error {
+			return u.obfs.loopJitter(wg)
+		})
+	}
 
 	return u, nil
 }
 
 func (c *RicmpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *RicmpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
@@ -415,6 +608,40 @@ func (c *RicmpConn) Accept() (Conn, error) {
 	return nil, errors.New("listener close")
 }
 
+func (c *RicmpConn) setLossy(config *LossyConfig) {
+	c.lossy = config
+}
+
+func (c *RicmpConn) Stats() ConnStats {
+	if c.dialer != nil {
+		return c.stat.frameStats(c.dialer.fm)
+	} else if c.listenersonny != nil {
+		return c.stat.frameStats(c.listenersonny.fm)
+	}
+	return c.stat.stats()
+}
+
+// OpenStream opens a stream in the session carried by this conn, the peer gets it from AcceptStream
+func (c *RicmpConn) OpenStream() (Conn, error) {
+	c.checkConfig()
+	if c.dialer == nil && c.listenersonny == nil {
+		return nil, errors.New("not a connected conn")
+	}
+	return c.mux.open(c, c.dialer != nil, c.config.StreamBuffer)
+}
+
+func (c *RicmpConn) AcceptStream() (Conn, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *RicmpConn) AcceptStreamContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+	if c.dialer == nil && c.listenersonny == nil {
+		return nil, errors.New("not a connected conn")
+	}
+	return c.mux.accept(ctx, c, c.dialer != nil, c.config.StreamBuffer)
+}
+
 func (c *RicmpConn) checkConfig() {
 	if c.config == nil {
 		c.config = DefaultRicmpConfig()
@@ -448,11 +675,17 @@ func (c *RicmpConn) loopListenerRecv() error {
 			if c.config.Congestion == "bb" {
 				fm.SetCongestion(&congestion.BBCongestion{})
 			}
+			if c.config.Obfs != nil {
+				fm.SetObfs(c.config.Obfs.Scheme)
+			}
+			fm.SetFec(c.config.FecData, c.config.FecParity)
+			fm.SetMessage(c.config.Message, c.config.MessageTtlMs)
 
 			sonny := &ricmpConnListenerSonny{dstaddr: srcaddr, fatherconn: c.listener.listenerconn, fm: fm,
 				icmpId: echoId, icmpSeq: echoSeq, icmpProto: int(IcmpMsg_PONG_PROTO), icmpFlag: IcmpMsg_SERVER_SEND_FLAG}
 
-			u := &RicmpConn{id: cid, config: c.config, listenersonny: sonny}
+			u := &RicmpConn{id: cid, config: c.config, listenersonny: sonny, impair: c.impair, obfs: c.obfs}
+			u.stat.in(n)
 			c.listener.sonny.Store(cid, u)
 
 			c.listener.wg.Go("RicmpConn accept"+" "+u.Info(), func() error {
@@ -462,15 +695,19 @@ func (c *RicmpConn) loopListenerRecv() error {
 			//loggo.Debug("start accept remote ricmp %s %s", u.Info(), cid)
 		} else {
 			u := v.(*RicmpConn)
-			u.listenersonny.icmpSeq = echoSeq
+			u.stat.in(n)
 
 			f := &frame.Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
-			if err == nil {
+			err := c.obfs.unmarshal(u.listenersonny.fm, buf[0:n], f)
+			if err != nil {
+				//loggo.Error("%s %s Unmarshal fail %s", c.Info(), u.Info(), err)
+			} else if !u.listenersonny.isRemote(srcaddr, echoId) {
+				// the sonny is found by conn id, nat may give the client a new address or echo id
+				c.migrate(u, srcaddr, echoId, echoSeq, f)
+			} else {
+				u.listenersonny.icmpSeq = echoSeq
 				u.listenersonny.fm.OnRecvFrame(f)
 				//loggo.Debug("%s recv frame %d %v", u.Info(), f.Id, f.String())
-			} else {
-				//loggo.Error("%s %s Unmarshal fail %s", c.Info(), u.Info(), err)
 			}
 		}
 
@@ -486,6 +723,46 @@ func (c *RicmpConn) loopListenerRecv() error {
 	return nil
 }
 
+// migrate handles a frame of a known conn id from a new address or echo id, the frame is only used as a trigger,
+// the sonny moves after the new path echoes a challenge, so a guessed conn id can not take the downstream
+func (c *RicmpConn) migrate(u *RicmpConn, srcaddr net.Addr, echoId int, echoSeq int, f *frame.Frame) {
+	s := u.listenersonny
+	path := srcaddr.String() + "#" + strconv.Itoa(echoId)
+	now := time.Now().UnixNano()
+
+	s.dstlock.Lock()
+	if f.Type == int32(frame.Frame_PONG) && s.challenge != 0 && f.Sendtime == s.challenge && s.challengeaddr == path {
+		s.challenge = 0
+		s.dstaddr = srcaddr
+		s.icmpId = echoId
+		s.dstlock.Unlock()
+		s.icmpSeq = echoSeq
+		//loggo.Debug("ricmp sonny migrate %s", path)
+		return
+	}
+	if s.challenge != 0 && s.challengeaddr == path && now-s.challengetime < int64(time.Millisecond)*int64(c.config.ResendTimems) {
+		s.dstlock.Unlock()
+		return
+	}
+	if s.challenge == 0 || s.challengeaddr != path {
+		s.challenge = int64(common.RandUint64()>>1 | 1)
+		s.challengeaddr = path
+	}
+	s.challengetime = now
+	challenge := s.challenge
+	s.dstlock.Unlock()
+
+	// the client answers the ping with a pong carrying the same sendtime, only the real owner of the new path sees it
+	pf := &frame.Frame{Type: int32(frame.Frame_PING), Sendtime: challenge}
+	mb, err := s.fm.MarshalFrame(pf)
+	if err != nil {
+		return
+	}
+	s.fatherconn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	u.send_icmp(s.fatherconn, pf, mb, srcaddr, u.id, echoId, echoSeq, s.icmpProto, s.icmpFlag)
+	//loggo.Debug("ricmp sonny challenge %s %d", path, challenge)
+}
+
 func (c *RicmpConn) accept(u *RicmpConn) error {
 
 	//loggo.Debug("server begin accept ricmp %s", u.Info())
@@ -511,8 +788,9 @@ func (c *RicmpConn) accept(u *RicmpConn) error {
 				break
 			}
 			u.listenersonny.fatherconn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-			u.send_icmp(u.listenersonny.fatherconn, mb, u.listenersonny.dstaddr,
-				u.id, u.listenersonny.icmpId, u.listenersonny.icmpSeq, u.listenersonny.icmpProto, u.listenersonny.icmpFlag)
+			dstaddr, icmpId := u.listenersonny.remote()
+			u.send_icmp(u.listenersonny.fatherconn, f, mb, dstaddr,
+				u.id, icmpId, u.listenersonny.icmpSeq, u.listenersonny.icmpProto, u.listenersonny.icmpFlag)
 		}
 
 		now := time.Now()
@@ -553,21 +831,23 @@ func (c *RicmpConn) accept(u *RicmpConn) error {
 }
 
 func (c *RicmpConn) updateListenerSonny() error {
-	return c.update_ricmp(c.listenersonny.wg, c.listenersonny.fm, c.listenersonny.fatherconn, c.listenersonny.dstaddr, false,
+	return c.update_ricmp(c.listenersonny.wg, c.listenersonny.fm, c.listenersonny.fatherconn, c.listenersonny.remote, false,
 		0, 0,
-		c.id, c.listenersonny.icmpId, &c.listenersonny.icmpSeq, c.listenersonny.icmpProto, c.listenersonny.icmpFlag,
+		c.id, &c.listenersonny.icmpSeq, c.listenersonny.icmpProto, c.listenersonny.icmpFlag,
 		false)
 }
 
 func (c *RicmpConn) updateDialerSonny() error {
-	return c.update_ricmp(c.dialer.wg, c.dialer.fm, c.dialer.conn, c.dialer.serveraddr, true,
+	return c.update_ricmp(c.dialer.wg, c.dialer.fm, c.dialer.conn, func() (net.Addr, int) {
+		return c.dialer.serveraddr, c.dialer.icmpId
+	}, true,
 		c.dialer.icmpId, int(IcmpMsg_SERVER_SEND_FLAG),
-		c.id, c.dialer.icmpId, &c.dialer.icmpSeq, c.dialer.icmpProto, c.dialer.icmpFlag,
+		c.id, &c.dialer.icmpSeq, c.dialer.icmpProto, c.dialer.icmpFlag,
 		true)
 }
 
-func (c *RicmpConn) update_ricmp(wg *group.Group, fm *frame.FrameMgr, conn *icmp.PacketConn, dstaddr net.Addr, readconn bool,
-	recvCheckEchoId int, recvCheckEchoFlag int, id string, icmpId int, icmpSeq *int, icmpProto int, icmpFlag IcmpMsg_TYPE, addIcmpSeq bool) error {
+func (c *RicmpConn) update_ricmp(wg *group.Group, fm *frame.FrameMgr, conn *icmp.PacketConn, target func() (net.Addr, int), readconn bool,
+	recvCheckEchoId int, recvCheckEchoFlag int, id string, icmpSeq *int, icmpProto int, icmpFlag IcmpMsg_TYPE, addIcmpSeq bool) error {
 
 	//loggo.Debug("start ricmp conn %s", c.Info())
 
@@ -580,9 +860,10 @@ func (c *RicmpConn) update_ricmp(wg *group.Group, fm *frame.FrameMgr, conn *icmp
 				// recv icmp
 				conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 				n, _, _, id, echoId, _, echoFlag := c.recv_icmp(conn, bytes)
-				if n > 0 && id == c.id && echoId == recvCheckEchoId && echoFlag == recvCheckEchoFlag {
+				if n > 0 && id == c.id && icmpIdMatch(conn, echoId, recvCheckEchoId) && echoFlag == recvCheckEchoFlag {
+					c.stat.in(n)
 					f := &frame.Frame{}
-					err := proto.Unmarshal(bytes[0:n], f)
+					err := c.obfs.unmarshal(fm, bytes[0:n], f)
 					if err == nil {
 						fm.OnRecvFrame(f)
 						//loggo.Debug("%s recv frame %d %v", c.Info(), f.Id, f.String())
@@ -612,7 +893,8 @@ func (c *RicmpConn) update_ricmp(wg *group.Group, fm *frame.FrameMgr, conn *icmp
 				return err
 			}
 			conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-			c.send_icmp(conn, mb, dstaddr, id, icmpId, *icmpSeq, icmpProto, icmpFlag)
+			dstaddr, icmpId := target()
+			c.send_icmp(conn, f, mb, dstaddr, id, icmpId, *icmpSeq, icmpProto, icmpFlag)
 			if addIcmpSeq {
 				*icmpSeq++
 			}
@@ -657,7 +939,8 @@ func (c *RicmpConn) update_ricmp(wg *group.Group, fm *frame.FrameMgr, conn *icmp
 				return err
 			}
 			conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-			c.send_icmp(conn, mb, dstaddr, id, icmpId, *icmpSeq, icmpProto, icmpFlag)
+			dstaddr, icmpId := target()
+			c.send_icmp(conn, f, mb, dstaddr, id, icmpId, *icmpSeq, icmpProto, icmpFlag)
 			if addIcmpSeq {
 				*icmpSeq++
 			}
@@ -705,7 +988,10 @@ func (c *RicmpConn) update_ricmp(wg *group.Group, fm *frame.FrameMgr, conn *icmp
 	return errors.New("closed " + reason)
 }
 
-func (c *RicmpConn) send_icmp(conn *icmp.PacketConn, data []byte, dst net.Addr, id string, icmpId int, icmpSeq int, icmpProto int, icmpFlag IcmpMsg_TYPE) {
+func (c *RicmpConn) send_icmp(conn *icmp.PacketConn, f *frame.Frame, data []byte, dst net.Addr, id string, icmpId int, icmpSeq int, icmpProto int, icmpFlag IcmpMsg_TYPE) {
+	scheme := obfsScheme(c.frameMgr(), f)
+	data = c.obfs.encode(scheme, data)
+	c.stat.out(len(data))
 
 	m := &IcmpMsg{
 		Id:    id,
@@ -727,18 +1013,44 @@ func (c *RicmpConn) send_icmp(conn *icmp.PacketConn, data []byte, dst net.Addr,
 	}
 
 	msg := &icmp.Message{
-		Type: (ipv4.ICMPType)(icmpProto),
+		Type: icmputil.Type(conn, icmpProto),
 		Code: 0,
 		Body: body,
 	}
 
+	// the icmpv6 checksum needs the pseudo header, the kernel fills it in when it is left zero
 	bytes, err := msg.Marshal(nil)
 	if err != nil {
 		//loggo.Error("sendICMP Marshal error %s %s", c.Info(), err)
 		return
 	}
 
-	conn.WriteTo(bytes, dst)
+	if ipaddr, ok := dst.(*net.IPAddr); ok && icmputil.IsDatagram(conn) {
+		dst = &net.UDPAddr{IP: ipaddr.IP, Zone: ipaddr.Zone}
+	}
+
+	err = c.obfs.send(scheme, bytes, conn, func(b []byte) error {
+		return c.impair.send(b, func(b []byte) error {
+			_, err := conn.WriteTo(b, dst)
+			return err
+		})
+	})
+	if err != nil {
+		c.stat.drop()
+		//loggo.Debug("sendICMP error %s %s", c.Info(), err)
+	}
+}
+
+func (c *RicmpConn) frameMgr() *frame.FrameMgr {
+	if c.dialer != nil {
+		return c.dialer.fm
+	}
+	return c.listenersonny.fm
+}
+
+// newObfuscator leaves room for the icmp and IcmpMsg headers around the padded frame
+func (c *RicmpConn) newObfuscator() *obfuscator {
+	return newObfuscator(c.config.Obfs, c.config.MaxPacketSize-128)
 }
 
 func (c *RicmpConn) recv_icmp(conn *icmp.PacketConn, bytes []byte) (int, net.Addr, error, string, int, int, int) {
@@ -769,3 +1081,17 @@ func (c *RicmpConn) recv_icmp(conn *icmp.PacketConn, bytes []byte) (int, net.Add
 
 	return len(my.Data), srcaddr, nil, my.Id, echoId, echoSeq, int(my.Flag)
 }
+
+// icmpListenNetwork listens on ipv6-icmp when dst is an ipv6 address, the server side always needs a raw socket to see echo requests
+func icmpListenNetwork(dst string) string {
+	ip := net.ParseIP(strings.Trim(dst, "[]"))
+	if ip != nil && ip.To4() == nil {
+		return "ip6:ipv6-icmp"
+	}
+	return "ip4:icmp"
+}
+
+// icmpIdMatch skips the echo id check on datagram sockets, the kernel rewrites the id and only hands over our own replies
+func icmpIdMatch(conn *icmp.PacketConn, echoId int, want int) bool {
+	return icmputil.IsDatagram(conn) || echoId == want
+}
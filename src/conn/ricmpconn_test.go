@@ -2,7 +2,13 @@ package conn
 
 import (
 	"fmt"
+	"github.com/3t2ugg1e/go-engine/src/frame"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"math"
+	"net"
 	"strconv"
 	"testing"
 	"time"
@@ -540,3 +546,151 @@ func Test0009RICMP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func Test0010RICMP(t *testing.T) {
+	c, _ := NewConn("ricmp")
+	cc, err := c.Listen("::")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done " + sonny.Info())
+		buf := make([]byte, 1024)
+		for {
+			n, err := sonny.Read(buf)
+			if err != nil {
+				return
+			}
+			sonny.Write(buf[0:n])
+		}
+	}()
+
+	ccc, err := c.Dial("::1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	ccc.Write([]byte("hello icmpv6"))
+	buf := make([]byte, 1024)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, err := ccc.Read(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(buf[0:n]) != "hello icmpv6" {
+		t.Error("icmpv6 data not match", string(buf[0:n]))
+	}
+}
+
+func Test0011RICMP(t *testing.T) {
+	c, _ := NewConn("ricmp")
+	cc, err := c.Listen("0.0.0.0")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer cc.Close()
+
+	sonnych := make(chan *RicmpConn, 1)
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sonnych <- sonny.(*RicmpConn)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	sonny := <-sonnych
+	fmt.Println("dial done " + ccc.Info())
+	_, before := sonny.listenersonny.remote()
+
+	spoof, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer spoof.Close()
+	spoofId := (before + 1) % math.MaxInt16
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	send := func(data []byte) {
+		mb, _ := proto.Marshal(&IcmpMsg{Id: sonny.id, Data: data, Magic: IcmpMsg_MAGIC, Flag: IcmpMsg_CLIENT_SEND_FLAG})
+		msg := &icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: spoofId, Seq: 1, Data: mb}}
+		b, _ := msg.Marshal(nil)
+		spoof.WriteTo(b, dst)
+	}
+	sendFrame := func(f *frame.Frame) {
+		mb, _ := proto.Marshal(f)
+		send(mb)
+	}
+
+	// garbage with the conn id does not decode, so nothing moves
+	send([]byte{1, 2, 3, 4, 5})
+	time.Sleep(time.Millisecond * 200)
+	if _, id := sonny.listenersonny.remote(); id != before {
+		t.Error("sonny migrate on garbage")
+	}
+
+	// a frame from another echo id only gets a challenge
+	sendFrame(&frame.Frame{Type: int32(frame.Frame_PING), Sendtime: 1})
+	spoof.SetReadDeadline(time.Now().Add(time.Second * 5))
+	ping := &frame.Frame{}
+	buf := make([]byte, 2048)
+	for ping.Type != int32(frame.Frame_PING) {
+		n, _, err := spoof.ReadFrom(buf)
+		if err != nil {
+			t.Error("no challenge", err)
+			return
+		}
+		msg, err := icmp.ParseMessage(1, buf[0:n])
+		if err != nil {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.ID != spoofId {
+			continue
+		}
+		my := &IcmpMsg{}
+		if proto.Unmarshal(echo.Data, my) != nil || my.Flag != IcmpMsg_SERVER_SEND_FLAG || my.Id != sonny.id {
+			continue
+		}
+		proto.Unmarshal(my.Data, ping)
+	}
+	if _, id := sonny.listenersonny.remote(); id != before {
+		t.Error("sonny migrate without challenge")
+	}
+
+	sendFrame(&frame.Frame{Type: int32(frame.Frame_PONG), Sendtime: ping.Sendtime + 1})
+	time.Sleep(time.Millisecond * 200)
+	if _, id := sonny.listenersonny.remote(); id != before {
+		t.Error("sonny migrate with wrong echo")
+	}
+
+	// the real client would take the sonny back with its next ping, cut it off first
+	ccc.(*RicmpConn).dialer.conn.Close()
+	sendFrame(&frame.Frame{Type: int32(frame.Frame_PONG), Sendtime: ping.Sendtime})
+	time.Sleep(time.Millisecond * 200)
+	_, after := sonny.listenersonny.remote()
+	fmt.Println("remote", before, "->", after)
+	if after != spoofId {
+		t.Error("sonny not migrate after echo")
+	}
+}
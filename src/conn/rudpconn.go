@@ -9,10 +9,19 @@ import (
 	"github.com/3t2ugg1e/go-engine/src/group"
 	"github.com/golang/protobuf/proto"
 	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+func init() {
+	Register("rudp", func() Conn {
+		return &RudpConn{}
+	}, true)
+}
+
 type RudpConfig struct {
 	MaxPacketSize      int
 	CutSize            int
@@ -27,6 +36,13 @@ type RudpConfig struct {
 	CloseWaitTimeoutMs int
 	AcceptChanLen      int
 	Congestion         string
+	Obfs               *ObfsConfig // 包混淆，nil为不混淆
+	FecData            int         // FEC每组的数据帧数，0为不开启，两端协商取小
+	FecParity          int         // FEC每组的校验帧数，一组内丢失不超过这个数可不重传恢复
+	StreamBuffer       int         // OpenStream时每个流的接收窗口，流之间互不阻塞
+	Message            string      // 消息模式，每次Write对端一次Read完整读到，空为字节流，reliable/unordered/unreliable，两端需一致
+	MessageTtlMs       int         // unreliable模式下消息超过这个时间还没送达就不再重传
+	ReusePort          int         // 监听时用SO_REUSEPORT开多少个socket，每个一个读协程分担收包，0或1为单个socket
 }
 
 func DefaultRudpConfig() *RudpConfig {
@@ -44,6 +60,8 @@ func DefaultRudpConfig() *RudpConfig {
 		CloseWaitTimeoutMs: 5000,
 		AcceptChanLen:      128,
 		Congestion:         "bb",
+		StreamBuffer:       256 * 1024,
+		MessageTtlMs:       1000,
 	}
 }
 
@@ -56,6 +74,12 @@ type RudpConn struct {
 	cancel        context.CancelFunc
 	isclose       bool
 	closelock     sync.Mutex
+	deadline      connDeadline
+	lossy         *LossyConfig
+	impair        *impairer
+	obfs          *obfuscator
+	stat          connCounter
+	mux           streamMux
 }
 
 type rudpConnDialer struct {
@@ -66,18 +90,54 @@ type rudpConnDialer struct {
 
 type rudpConnListenerSonny struct {
 	dstaddr    *net.UDPAddr
+	dstlock    sync.Mutex
+	shard      *rudpConnShard
 	fatherconn *net.UDPConn
 	fm         *frame.FrameMgr
 	wg         *group.Group
+	session    uint64
+
+	challenge     int64
+	challengeaddr string
+	challengetime int64
 }
 
 type rudpConnListener struct {
 	listenerconn *net.UDPConn
+	shards       []*rudpConnShard
 	wg           *group.Group
-	sonny        sync.Map
+	session      sync.Map
 	accept       *common.Channel
 }
 
+// rudpConnShard is one of the SO_REUSEPORT sockets, the kernel keeps a remote on the same socket,
+// so a sonny lives in the shard whose socket reads its packets
+type rudpConnShard struct {
+	conn    *net.UDPConn
+	sonny   sync.Map
+	recvnum int64
+}
+
+func (s *rudpConnListenerSonny) remote() *net.UDPAddr {
+	s.dstlock.Lock()
+	defer s.dstlock.Unlock()
+	return s.dstaddr
+}
+
+// where returns the remote and the shard it is kept in, both change when the client migrates
+func (s *rudpConnListenerSonny) where() (*net.UDPAddr, *rudpConnShard) {
+	s.dstlock.Lock()
+	defer s.dstlock.Unlock()
+	return s.dstaddr, s.shard
+}
+
+func (s *rudpConnListenerSonny) setRemote(addr *net.UDPAddr, shard *rudpConnShard) {
+	s.dstlock.Lock()
+	defer s.dstlock.Unlock()
+	s.dstaddr = addr
+	s.shard = shard
+}
+
 func (c *RudpConn) Name() string {
 	return "rudp"
 }
@@ -108,6 +168,10 @@ func (c *RudpConn) Read(p []byte) (n int, err error) {
 	}
 
 	for !c.isclose {
+		if c.deadline.readExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
 		if fm.GetRecvBufferSize() <= 0 {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
@@ -116,6 +180,10 @@ func (c *RudpConn) Read(p []byte) (n int, err error) {
 			continue
 		}
 
+		if c.config.Message != "" {
+			return fm.ReadMessage(p)
+		}
+
 		size := copy(p, fm.GetRecvReadLineBuffer())
 		fm.SkipRecvBuffer(size)
 		return size, nil
@@ -149,10 +217,18 @@ func (c *RudpConn) Write(p []byte) (n int, err error) {
 		return 0, errors.New("empty conn")
 	}
 
+	if c.config.Message != "" {
+		return c.writeMessage(fm, wg, p)
+	}
+
 	totalsize := len(p)
 	cur := 0
 
 	for !c.isclose {
+		if c.deadline.writeExpired() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
 		size := totalsize - cur
 		svleft := fm.GetSendBufferLeft()
 		if size > svleft {
@@ -180,6 +256,30 @@ func (c *RudpConn) Write(p []byte) (n int, err error) {
 	return 0, errors.New("write closed conn")
 }
 
+// writeMessage queues p as one message once the send buffer has room for all of it
+func (c *RudpConn) writeMessage(fm *frame.FrameMgr, wg *group.Group, p []byte) (n int, err error) {
+	if len(p) > fm.MaxMessageSize() {
+		return 0, errors.New("message too big")
+	}
+
+	for !c.isclose {
+		if c.deadline.writeExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if fm.WriteMessage(p) {
+			return len(p), nil
+		}
+
+		if wg != nil && wg.IsExit() {
+			return 0, errors.New("closed conn")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return 0, errors.New("write closed conn")
+}
+
 func (c *RudpConn) Close() error {
 	c.checkConfig()
 
@@ -187,6 +287,8 @@ func (c *RudpConn) Close() error {
 		return nil
 	}
 
+	c.mux.close()
+
 	c.closelock.Lock()
 	defer c.closelock.Unlock()
 
@@ -208,15 +310,17 @@ func (c *RudpConn) Close() error {
 		if c.listener.wg != nil {
 			//loggo.Debug("start Close listener %s", c.Info())
 			c.listener.wg.Stop()
-			c.listener.sonny.Range(func(key, value interface{}) bool {
-				u := value.(*RudpConn)
-				u.Close()
-				return true
-			})
+			for _, shard := range c.listener.shards {
+				shard.sonny.Range(func(key, value interface{}) bool {
+					u := value.(*RudpConn)
+					u.Close()
+					return true
+				})
+			}
 			c.listener.wg.Wait()
 		}
-		if c.listener.listenerconn != nil {
-			c.listener.listenerconn.Close()
+		for _, shard := range c.listener.shards {
+			shard.conn.Close()
 		}
 	} else if c.listenersonny != nil {
 		if c.listenersonny.wg != nil {
@@ -243,27 +347,79 @@ func (c *RudpConn) Info() string {
 	} else if c.listener != nil {
 		c.info = "rudp--" + c.listener.listenerconn.LocalAddr().String()
 	} else if c.listenersonny != nil {
-		c.info = c.listenersonny.fatherconn.LocalAddr().String() + "<--rudp-->" + c.listenersonny.dstaddr.String()
+		c.info = c.listenersonny.fatherconn.LocalAddr().String() + "<--rudp-->" + c.listenersonny.remote().String()
 	} else {
 		c.info = "empty rudp conn"
 	}
 	return c.info
 }
 
+func (c *RudpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *RudpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.RemoteAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.remote()
+	}
+	return nil
+}
+
+func (c *RudpConn) SetDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setDeadline(t)
+	return nil
+}
+
+func (c *RudpConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setReadDeadline(t)
+	return nil
+}
+
+func (c *RudpConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	c.deadline.setWriteDeadline(t)
+	return nil
+}
+
 func (c *RudpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *RudpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
+	if err := checkObfs(c.config.Obfs); err != nil {
+		return nil, err
+	}
+
 	addr, err := net.ResolveUDPAddr("udp", dst)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	dialctx, cancel := context.WithCancel(ctx)
 	c.cancel = cancel
 	var d net.Dialer
 	if gControlOnConnSetup != nil {
 		d = net.Dialer{Control: gControlOnConnSetup}
 	}
-	conn, err := d.DialContext(ctx, "udp", addr.String())
+	conn, err := d.DialContext(dialctx, "udp", addr.String())
 	if err != nil {
 		return nil, err
 	}
@@ -272,13 +428,19 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 	id := common.Guid()
 	fm := frame.NewFrameMgr(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
 	fm.SetDebugid(id)
+	fm.SetSession(common.RandUint64())
 	if c.config.Congestion == "bb" {
 		fm.SetCongestion(&congestion.BBCongestion{})
 	}
+	if c.config.Obfs != nil {
+		fm.SetObfs(c.config.Obfs.Scheme)
+	}
+	fm.SetFec(c.config.FecData, c.config.FecParity)
+	fm.SetMessage(c.config.Message, c.config.MessageTtlMs)
 
 	dialer := &rudpConnDialer{conn: conn.(*net.UDPConn), fm: fm}
 
-	u := &RudpConn{config: c.config, dialer: dialer}
+	u := &RudpConn{config: c.config, dialer: dialer, impair: newImpairer(c.lossy), obfs: newObfuscator(c.config.Obfs, c.config.MaxPacketSize)}
 
 	//loggo.Debug("start connect remote rudp %s %s", u.Info(), id)
 
@@ -299,15 +461,16 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 			f := e.Value.(*frame.Frame)
 			mb, _ := u.dialer.fm.MarshalFrame(f)
 			u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-			u.dialer.conn.Write(mb)
+			u.writeUDP(u.dialer.conn, f, mb)
 		}
 
 		// recv udp
 		u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		n, _ := u.dialer.conn.Read(buf)
 		if n > 0 {
+			u.stat.in(n)
 			f := &frame.Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
+			err := u.obfs.unmarshal(u.dialer.fm, buf[0:n], f)
 			if err == nil {
 				u.dialer.fm.OnRecvFrame(f)
 			} else {
@@ -321,6 +484,11 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 			break
 		}
 
+		if ctx.Err() != nil {
+			//loggo.Debug("cancel connect remote rudp %s", u.Info())
+			break
+		}
+
 		// timeout
 		now := time.Now()
 		diffclose := now.Sub(startConnectTime)
@@ -342,6 +510,10 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 	}
 
 	if !u.dialer.fm.IsConnected() {
+		u.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, errors.New("connect timeout")
 	}
 
@@ -355,18 +527,27 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 		return u.updateDialerSonny()
 	})
 
+	if u.obfs != nil {
+		wg.Go("RudpConn loopJitter"+" "+u.Info(), func() error {
+			return u.obfs.loopJitter(wg)
+		})
+	}
+
 	return u, nil
 }
 
 func (c *RudpConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *RudpConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
-	ipaddr, err := net.ResolveUDPAddr("udp", dst)
-	if err != nil {
+	if err := checkObfs(c.config.Obfs); err != nil {
 		return nil, err
 	}
 
-	listenerconn, err := net.ListenUDP("udp", ipaddr)
+	conns, err := listenUDPShards(ctx, dst, c.config.ReusePort)
 	if err != nil {
 		return nil, err
 	}
@@ -376,32 +557,53 @@ func (c *RudpConn) Listen(dst string) (Conn, error) {
 	wg := group.NewGroup("RudpConn Listen"+" "+dst, nil, nil)
 
 	listener := &rudpConnListener{
-		listenerconn: listenerconn,
+		listenerconn: conns[0],
 		wg:           wg,
 		accept:       ch,
 	}
+	for _, conn := range conns {
+		listener.shards = append(listener.shards, &rudpConnShard{conn: conn})
+	}
 
-	u := &RudpConn{config: c.config, listener: listener}
-	wg.Go("RudpConn loopListenerRecv"+" "+dst, func() error {
-		return u.loopListenerRecv()
-	})
+	u := &RudpConn{config: c.config, listener: listener, impair: newImpairer(c.lossy), obfs: newObfuscator(c.config.Obfs, c.config.MaxPacketSize)}
+	for i, shard := range listener.shards {
+		shard := shard
+		wg.Go("RudpConn loopListenerRecv"+" "+dst+" "+strconv.Itoa(i), func() error {
+			return u.loopListenerRecv(shard)
+		})
+	}
+	if u.obfs != nil {
+		wg.Go("RudpConn loopJitter"+" "+dst, func() error {
+			return u.obfs.loopJitter(wg)
+		})
+	}
 
 	return u, nil
 }
 
 func (c *RudpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *RudpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
 		sonny := s.(*RudpConn)
-		_, ok := c.listener.sonny.Load(sonny.listenersonny.dstaddr.String())
+		remote, shard := sonny.listenersonny.where()
+		_, ok := shard.sonny.Load(remote.String())
 		if !ok {
 			continue
 		}
@@ -413,6 +615,68 @@ func (c *RudpConn) Accept() (Conn, error) {
 	return nil, errors.New("listener close")
 }
 
+func (c *RudpConn) setLossy(config *LossyConfig) {
+	c.lossy = config
+}
+
+// writeUDP sends to the current remote of a listener sonny, it may change when the client migrates
+func (c *RudpConn) writeUDP(conn *net.UDPConn, f *frame.Frame, b []byte) {
+	scheme := obfsScheme(c.frameMgr(), f)
+	b = c.obfs.encode(scheme, b)
+	c.stat.out(len(b))
+	err := c.obfs.send(scheme, b, conn, func(b []byte) error {
+		return c.impair.send(b, func(b []byte) error {
+			if c.listenersonny != nil {
+				_, err := conn.WriteToUDP(b, c.listenersonny.remote())
+				return err
+			}
+			_, err := conn.Write(b)
+			return err
+		})
+	})
+	if err != nil {
+		c.stat.drop()
+		//loggo.Debug("writeUDP error %s %s", c.Info(), err)
+	}
+}
+
+func (c *RudpConn) frameMgr() *frame.FrameMgr {
+	if c.dialer != nil {
+		return c.dialer.fm
+	}
+	return c.listenersonny.fm
+}
+
+func (c *RudpConn) Stats() ConnStats {
+	if c.dialer != nil {
+		return c.stat.frameStats(c.dialer.fm)
+	} else if c.listenersonny != nil {
+		return c.stat.frameStats(c.listenersonny.fm)
+	}
+	return c.stat.stats()
+}
+
+// OpenStream opens a stream in the session carried by this conn, the peer gets it from AcceptStream
+func (c *RudpConn) OpenStream() (Conn, error) {
+	c.checkConfig()
+	if c.dialer == nil && c.listenersonny == nil {
+		return nil, errors.New("not a connected conn")
+	}
+	return c.mux.open(c, c.dialer != nil, c.config.StreamBuffer)
+}
+
+func (c *RudpConn) AcceptStream() (Conn, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *RudpConn) AcceptStreamContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+	if c.dialer == nil && c.listenersonny == nil {
+		return nil, errors.New("not a connected conn")
+	}
+	return c.mux.accept(ctx, c, c.dialer != nil, c.config.StreamBuffer)
+}
+
 func (c *RudpConn) checkConfig() {
 	if c.config == nil {
 		c.config = DefaultRudpConfig()
@@ -428,36 +692,63 @@ func (c *RudpConn) GetConfig() *RudpConfig {
 	return c.config
 }
 
-func (c *RudpConn) loopListenerRecv() error {
+func (c *RudpConn) loopListenerRecv(shard *rudpConnShard) error {
 	c.checkConfig()
 
 	buf := make([]byte, c.config.MaxPacketSize)
 	for !c.listener.wg.IsExit() {
-		c.listener.listenerconn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-		n, srcaddr, err := c.listener.listenerconn.ReadFromUDP(buf)
+		shard.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, srcaddr, err := shard.conn.ReadFromUDP(buf)
 		if err != nil {
 			continue
 		}
+		atomic.AddInt64(&shard.recvnum, 1)
 
 		srcaddrstr := srcaddr.String()
 
-		v, ok := c.listener.sonny.Load(srcaddrstr)
+		v, ok := shard.sonny.Load(srcaddrstr)
 		if !ok {
+			data, masked := c.obfs.decode(buf[0:n])
+			f := &frame.Frame{}
+			err := proto.Unmarshal(data, f)
+			if err != nil {
+				//loggo.Error("%s Unmarshal fail %s", c.Info(), err)
+				continue
+			}
+
+			if f.Session != 0 {
+				if u := c.migrate(f.Session, shard, srcaddr, f, masked); u != nil {
+					u.stat.in(n)
+					continue
+				}
+			}
+
 			id := common.Guid()
 			fm := frame.NewFrameMgr(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
 			fm.SetDebugid(id)
 			if c.config.Congestion == "bb" {
 				fm.SetCongestion(&congestion.BBCongestion{})
 			}
+			if c.config.Obfs != nil {
+				fm.SetObfs(c.config.Obfs.Scheme)
+			}
+			fm.SetFec(c.config.FecData, c.config.FecParity)
+			fm.SetMessage(c.config.Message, c.config.MessageTtlMs)
 
 			sonny := &rudpConnListenerSonny{
 				dstaddr:    srcaddr,
-				fatherconn: c.listener.listenerconn,
+				shard:      shard,
+				fatherconn: shard.conn,
 				fm:         fm,
+				session:    f.Session,
 			}
 
-			u := &RudpConn{config: c.config, listenersonny: sonny}
-			c.listener.sonny.Store(srcaddrstr, u)
+			u := &RudpConn{config: c.config, listenersonny: sonny, impair: c.impair, obfs: c.obfs}
+			u.stat.in(n)
+			shard.sonny.Store(srcaddrstr, u)
+			if f.Session != 0 {
+				c.listener.session.Store(f.Session, u)
+			}
 
 			c.listener.wg.Go("RudpConn accept"+" "+u.Info(), func() error {
 				return c.accept(u)
@@ -466,9 +757,10 @@ func (c *RudpConn) loopListenerRecv() error {
 			//loggo.Debug("start accept remote rudp %s %s", u.Info(), id)
 		} else {
 			u := v.(*RudpConn)
+			u.stat.in(n)
 
 			f := &frame.Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
+			err := c.obfs.unmarshal(u.listenersonny.fm, buf[0:n], f)
 			if err == nil {
 				u.listenersonny.fm.OnRecvFrame(f)
 				//loggo.Debug("%s recv frame %d", u.Info(), f.Id)
@@ -477,18 +769,83 @@ func (c *RudpConn) loopListenerRecv() error {
 			}
 		}
 
-		c.listener.sonny.Range(func(key, value interface{}) bool {
+		shard.sonny.Range(func(key, value interface{}) bool {
 			u := value.(*RudpConn)
 			if u.isclose {
-				c.listener.sonny.Delete(key)
+				shard.sonny.Delete(key)
 				//loggo.Debug("delete sonny from map %s", u.Info())
 			}
 			return true
 		})
+		c.listener.session.Range(func(key, value interface{}) bool {
+			u := value.(*RudpConn)
+			if u.isclose {
+				c.listener.session.Delete(key)
+			}
+			return true
+		})
 	}
 	return nil
 }
 
+// migrate handles a packet of a known session from a new address, it returns nil when there is no such session,
+// the sonny only moves to the shard that read it after the new address echoes a challenge, the client keeps its FrameMgr state after a nat rebinding
+func (c *RudpConn) migrate(session uint64, shard *rudpConnShard, srcaddr *net.UDPAddr, f *frame.Frame, masked bool) *RudpConn {
+	v, ok := c.listener.session.Load(session)
+	if !ok {
+		return nil
+	}
+	u := v.(*RudpConn)
+	if u.isclose {
+		return nil
+	}
+	// a plain packet can not move a sonny that has negotiated a scheme
+	if !masked && u.listenersonny.fm.GetObfs() != "" {
+		return u
+	}
+
+	s := u.listenersonny
+	srcaddrstr := srcaddr.String()
+	now := time.Now().UnixNano()
+
+	s.dstlock.Lock()
+	if f.Type == int32(frame.Frame_PONG) && s.challenge != 0 && f.Sendtime == s.challenge && s.challengeaddr == srcaddrstr {
+		s.challenge = 0
+		s.dstlock.Unlock()
+
+		old, oldshard := s.where()
+		oldshard.sonny.Delete(old.String())
+		s.setRemote(srcaddr, shard)
+		shard.sonny.Store(srcaddrstr, u)
+		//loggo.Debug("rudp sonny migrate %s -> %s", old.String(), srcaddrstr)
+		return u
+	}
+	if s.challenge != 0 && s.challengeaddr == srcaddrstr && now-s.challengetime < int64(time.Millisecond)*int64(c.config.ResendTimems) {
+		s.dstlock.Unlock()
+		return u
+	}
+	if s.challenge == 0 || s.challengeaddr != srcaddrstr {
+		s.challenge = int64(common.RandUint64()>>1 | 1)
+		s.challengeaddr = srcaddrstr
+	}
+	s.challengetime = now
+	challenge := s.challenge
+	s.dstlock.Unlock()
+
+	// the client answers the ping with a pong carrying the same sendtime, only the real owner of the new address sees it
+	pf := &frame.Frame{Type: int32(frame.Frame_PING), Sendtime: challenge}
+	mb, err := s.fm.MarshalFrame(pf)
+	if err != nil {
+		return u
+	}
+	b := u.obfs.encode(obfsScheme(s.fm, pf), mb)
+	u.stat.out(len(b))
+	shard.conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	shard.conn.WriteToUDP(b, srcaddr)
+	//loggo.Debug("rudp sonny challenge %s %d", srcaddrstr, challenge)
+	return u
+}
+
 func (c *RudpConn) accept(u *RudpConn) error {
 
 	//loggo.Debug("server begin accept rudp %s", u.Info())
@@ -514,7 +871,7 @@ func (c *RudpConn) accept(u *RudpConn) error {
 				break
 			}
 			u.listenersonny.fatherconn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-			u.listenersonny.fatherconn.WriteToUDP(mb, u.listenersonny.dstaddr)
+			u.writeUDP(u.listenersonny.fatherconn, f, mb)
 		}
 
 		now := time.Now()
@@ -555,14 +912,14 @@ func (c *RudpConn) accept(u *RudpConn) error {
 }
 
 func (c *RudpConn) updateListenerSonny() error {
-	return c.update_rudp(c.listenersonny.wg, c.listenersonny.fm, c.listenersonny.fatherconn, c.listenersonny.dstaddr, false)
+	return c.update_rudp(c.listenersonny.wg, c.listenersonny.fm, c.listenersonny.fatherconn, false)
 }
 
 func (c *RudpConn) updateDialerSonny() error {
-	return c.update_rudp(c.dialer.wg, c.dialer.fm, c.dialer.conn, nil, true)
+	return c.update_rudp(c.dialer.wg, c.dialer.fm, c.dialer.conn, true)
 }
 
-func (c *RudpConn) update_rudp(wg *group.Group, fm *frame.FrameMgr, conn *net.UDPConn, dstaddr *net.UDPAddr, readconn bool) error {
+func (c *RudpConn) update_rudp(wg *group.Group, fm *frame.FrameMgr, conn *net.UDPConn, readconn bool) error {
 
 	//loggo.Debug("start rudp conn %s", c.Info())
 
@@ -576,8 +933,9 @@ func (c *RudpConn) update_rudp(wg *group.Group, fm *frame.FrameMgr, conn *net.UD
 				conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 				n, _ := conn.Read(bytes)
 				if n > 0 {
+					c.stat.in(n)
 					f := &frame.Frame{}
-					err := proto.Unmarshal(bytes[0:n], f)
+					err := c.obfs.unmarshal(fm, bytes[0:n], f)
 					if err == nil {
 						fm.OnRecvFrame(f)
 						//loggo.Debug("%s recv frame %d", c.Info(), f.Id)
@@ -607,13 +965,8 @@ func (c *RudpConn) update_rudp(wg *group.Group, fm *frame.FrameMgr, conn *net.UD
 				return err
 			}
 			conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-			if dstaddr != nil {
-				conn.WriteToUDP(mb, dstaddr)
-				//loggo.Debug("%s send frame to %s %d", c.Info(), dstaddr, f.Id)
-			} else {
-				conn.Write(mb)
-				//loggo.Debug("%s send frame %d", c.Info(), f.Id)
-			}
+			c.writeUDP(conn, f, mb)
+			//loggo.Debug("%s send frame %d", c.Info(), f.Id)
 		}
 
 		// timeout
@@ -654,13 +1007,8 @@ func (c *RudpConn) update_rudp(wg *group.Group, fm *frame.FrameMgr, conn *net.UD
 				return err
 			}
 			conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-			if dstaddr != nil {
-				conn.WriteToUDP(mb, dstaddr)
-				//loggo.Debug("%s send frame to %s %d", c.Info(), dstaddr, f.Id)
-			} else {
-				conn.Write(mb)
-				//loggo.Debug("%s send frame %d", c.Info(), f.Id)
-			}
+			c.writeUDP(conn, f, mb)
+			//loggo.Debug("%s send frame %d", c.Info(), f.Id)
 		}
 
 		diffclose := now.Sub(startCloseTime)
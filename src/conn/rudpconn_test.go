@@ -1,9 +1,21 @@
 package conn
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/3t2ugg1e/go-engine/src/frame"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -455,3 +467,660 @@ func Test0008RUDP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func Test0009RUDP(t *testing.T) {
+	c, err := NewConn("rudp")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58084")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer cc.Close()
+
+	ccc, err := c.Dial(":58084")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer ccc.Close()
+
+	fmt.Println(ccc.LocalAddr(), ccc.RemoteAddr())
+
+	ccc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	_, err = ccc.Read(buf)
+	fmt.Println(err)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Error("read deadline not work")
+	}
+}
+
+func Test0010RUDP(t *testing.T) {
+	c, err := NewConn("rudp")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58084")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := AsListener(cc)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.RemoteAddr))
+	}))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cn, _ := NewConn("rudp")
+			return cn.DialContext(ctx, addr)
+		},
+	}}
+
+	resp, err := client.Get("http://127.0.0.1:58084/")
+	if err != nil {
+		t.Error(err)
+		l.Close()
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	fmt.Println(string(body))
+	if !strings.HasPrefix(string(body), "hello") {
+		t.Error("http over rudp fail")
+	}
+
+	client.CloseIdleConnections()
+	l.Close()
+}
+
+// natRelay forwards udp like a nat, rebind switches to a new outbound socket so the server sees a new source address
+type natRelay struct {
+	in     *net.UDPConn
+	dst    *net.UDPAddr
+	lock   sync.Mutex
+	out    *net.UDPConn
+	client *net.UDPAddr
+}
+
+func (r *natRelay) rebind() error {
+	out, err := net.DialUDP("udp", nil, r.dst)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	old := r.out
+	r.out = out
+	r.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := out.Read(buf)
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			client := r.client
+			r.lock.Unlock()
+			if client != nil {
+				r.in.WriteToUDP(buf[0:n], client)
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *natRelay) run() {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := r.in.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		r.lock.Lock()
+		r.client = src
+		out := r.out
+		r.lock.Unlock()
+		out.Write(buf[0:n])
+	}
+}
+
+func (r *natRelay) close() {
+	r.in.Close()
+	r.lock.Lock()
+	r.out.Close()
+	r.lock.Unlock()
+}
+
+func Test0011RUDP(t *testing.T) {
+	c, err := NewConn("rudp")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cc, err := c.Listen("127.0.0.1:58099")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	in, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 58098})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	relay := &natRelay{in: in, dst: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 58099}}
+	err = relay.rebind()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go relay.run()
+	defer relay.close()
+
+	sonnych := make(chan Conn, 1)
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done " + sonny.Info())
+		sonnych <- sonny
+		buf := make([]byte, 10240)
+		for {
+			n, err := sonny.Read(buf)
+			if err != nil {
+				return
+			}
+			sonny.Write(buf[0:n])
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58098")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	sonny := <-sonnych
+	before := sonny.RemoteAddr().String()
+
+	src := make([]byte, 512*1024)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	go ccc.Write(src)
+
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(ccc, dst[0:len(dst)/2])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = relay.rebind()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = io.ReadFull(ccc, dst[len(dst)/2:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+
+	after := sonny.RemoteAddr().String()
+	fmt.Println("remote", before, "->", after)
+	if before == after {
+		t.Error("sonny not migrate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err = cc.(*RudpConn).AcceptContext(ctx)
+	if err == nil {
+		t.Error("migrate should not accept new conn")
+	}
+
+	// a packet with the session from another address only gets a challenge
+	spoof, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 58099})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer spoof.Close()
+	session := ccc.(*RudpConn).dialer.fm.GetSession()
+	mb, _ := proto.Marshal(&frame.Frame{Type: int32(frame.Frame_PING), Sendtime: 1, Session: session})
+	spoof.Write(mb)
+
+	spoof.SetReadDeadline(time.Now().Add(time.Second * 5))
+	ping := &frame.Frame{}
+	buf := make([]byte, 2048)
+	for ping.Type != int32(frame.Frame_PING) {
+		n, err := spoof.Read(buf)
+		if err != nil {
+			t.Error("no challenge", err)
+			return
+		}
+		proto.Unmarshal(buf[0:n], ping)
+	}
+	if sonny.RemoteAddr().String() != after {
+		t.Error("sonny migrate without challenge")
+	}
+
+	mb, _ = proto.Marshal(&frame.Frame{Type: int32(frame.Frame_PONG), Sendtime: ping.Sendtime + 1, Session: session})
+	spoof.Write(mb)
+	time.Sleep(time.Millisecond * 200)
+	if sonny.RemoteAddr().String() != after {
+		t.Error("sonny migrate with wrong echo")
+	}
+
+	// the real client would take the sonny back with its next ping, cut it off first
+	relay.close()
+	mb, _ = proto.Marshal(&frame.Frame{Type: int32(frame.Frame_PONG), Sendtime: ping.Sendtime, Session: session})
+	spoof.Write(mb)
+	time.Sleep(time.Millisecond * 200)
+	fmt.Println("remote", after, "->", sonny.RemoteAddr().String())
+	if sonny.RemoteAddr().String() != spoof.LocalAddr().String() {
+		t.Error("sonny not migrate after echo")
+	}
+}
+
+func testRudpObfs(t *testing.T, server *ObfsConfig, client *ObfsConfig) (string, string) {
+	c, _ := NewConn("rudp")
+	config := DefaultRudpConfig()
+	config.Obfs = server
+	c.(*RudpConn).SetConfig(config)
+
+	cc, err := c.Listen("127.0.0.1:58104")
+	if err != nil {
+		t.Error(err)
+		return "", ""
+	}
+	defer cc.Close()
+
+	sonnych := make(chan Conn, 1)
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sonnych <- sonny
+		io.Copy(sonny, sonny)
+	}()
+
+	d, _ := NewConn("rudp")
+	config = DefaultRudpConfig()
+	config.Obfs = client
+	d.(*RudpConn).SetConfig(config)
+	ccc, err := d.Dial("127.0.0.1:58104")
+	if err != nil {
+		t.Error(err)
+		return "", ""
+	}
+	defer ccc.Close()
+
+	src := make([]byte, 256*1024)
+	for i := range src {
+		src[i] = byte(i * 3)
+	}
+	go ccc.Write(src)
+
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return "", ""
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+
+	sonny := <-sonnych
+	ds := ccc.(*RudpConn).dialer.fm.GetObfs()
+	ls := sonny.(*RudpConn).listenersonny.fm.GetObfs()
+	fmt.Println("obfs", ds, ls)
+	return ds, ls
+}
+
+func Test0012RUDP(t *testing.T) {
+	server := DefaultObfsConfig()
+	server.Scheme = "mask"
+	server.Key = "123456"
+	client := DefaultObfsConfig()
+	client.Key = "123456"
+	client.JitterMs = 5
+	ds, ls := testRudpObfs(t, server, client)
+	if ds != "mask" || ls != "mask" {
+		t.Error("obfs should negotiate mask")
+	}
+
+	server.Scheme = "pad,mask"
+	client.Scheme = "pad"
+	client.Sizes = []int{600, 800, 1000}
+	ds, ls = testRudpObfs(t, server, client)
+	if ds != "pad" || ls != "pad" {
+		t.Error("obfs should negotiate pad")
+	}
+
+	// the handshake is still masked with the key, only the data after it is plain
+	server.Scheme = "mask"
+	ds, ls = testRudpObfs(t, server, client)
+	if ds != "" || ls != "" {
+		t.Error("obfs should fall back to plain")
+	}
+
+	d, _ := NewConn("rudp")
+	config := DefaultRudpConfig()
+	config.Obfs = DefaultObfsConfig()
+	d.(*RudpConn).SetConfig(config)
+	_, err := d.Dial("127.0.0.1:58104")
+	fmt.Println(err)
+	if err == nil {
+		t.Error("obfs without key should fail")
+	}
+}
+
+func testRudpFec(t *testing.T, fecdata int, fecparity int) ConnStats {
+	c, _ := NewConn("lossy+rudp")
+	c.(*LossyConn).SetConfig(&LossyConfig{Loss: 0.03, DelayMs: 10, Seed: 1})
+	config := DefaultRudpConfig()
+	config.FecData = fecdata
+	config.FecParity = fecparity
+	c.(*LossyConn).Inner().(*RudpConn).SetConfig(config)
+
+	cc, err := c.Listen("127.0.0.1:58110")
+	if err != nil {
+		t.Error(err)
+		return ConnStats{}
+	}
+	defer cc.Close()
+
+	src := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(src)
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sonny.Write(src)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58110")
+	if err != nil {
+		t.Error(err)
+		return ConnStats{}
+	}
+	defer ccc.Close()
+
+	begin := time.Now()
+	dst := make([]byte, len(src))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 60))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return ConnStats{}
+	}
+	if !bytes.Equal(src, dst) {
+		t.Error("data not match")
+	}
+	stat, _ := GetStats(ccc)
+	fmt.Println("fec", fecdata, fecparity, "cost", time.Now().Sub(begin), "recovered", stat.Recovered)
+	return stat
+}
+
+func Test0013RUDP(t *testing.T) {
+	stat := testRudpFec(t, 8, 2)
+	if stat.Recovered <= 0 {
+		t.Error("fec should recover lost frames")
+	}
+
+	stat = testRudpFec(t, 0, 0)
+	if stat.Recovered != 0 {
+		t.Error("fec should be off")
+	}
+}
+
+func Test0014RUDP(t *testing.T) {
+	c, _ := NewConn("rudp")
+	cc, err := c.Listen("127.0.0.1:58111")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for {
+			s, err := sonny.(StreamOpener).AcceptStream()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			go func() {
+				defer s.Close()
+				buf := make([]byte, 5)
+				_, err := io.ReadFull(s, buf)
+				if err != nil || string(buf) == "block" {
+					// never read again, the writer should only stall this stream
+					time.Sleep(time.Second * 5)
+					return
+				}
+				s.Write(buf)
+				io.Copy(s, s)
+			}()
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58111")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+
+	blocked, err := ccc.(StreamOpener).OpenStream()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println("open done " + blocked.Info())
+	blocked.Write([]byte("block"))
+	go blocked.Write(make([]byte, 4*1024*1024))
+	time.Sleep(time.Millisecond * 500)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := ccc.(StreamOpener).OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer s.Close()
+			src := []byte(fmt.Sprintf("hello%v", strings.Repeat("x", 64*1024*i)))
+			s.Write(src)
+			dst := make([]byte, len(src))
+			s.SetReadDeadline(time.Now().Add(time.Second * 3))
+			_, err = io.ReadFull(s, dst)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(src, dst) {
+				t.Error("stream data not match", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stat, ok := GetStats(blocked)
+	fmt.Println("blocked stream out", stat.BytesOut, ok)
+	if !ok || stat.BytesOut >= 4*1024*1024 {
+		t.Error("blocked stream should stall")
+	}
+}
+
+func testMessageEcho(t *testing.T, c Conn, addr string, ordered bool) {
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := sonny.Read(buf)
+			if err != nil {
+				return
+			}
+			sonny.Write(buf[0:n])
+		}
+	}()
+
+	ccc, err := c.Dial(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+
+	r := rand.New(rand.NewSource(1))
+	var msgs [][]byte
+	for i := 0; i < 100; i++ {
+		msg := make([]byte, r.Intn(4000)+1)
+		r.Read(msg)
+		msg[0] = byte(i)
+		msgs = append(msgs, msg)
+	}
+	go func() {
+		for _, msg := range msgs {
+			ccc.Write(msg)
+		}
+	}()
+
+	got := make(map[int]bool)
+	buf := make([]byte, 64*1024)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	for i := range msgs {
+		n, err := ccc.Read(buf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		index := int(buf[0])
+		if ordered && index != i {
+			t.Error("message order diff", i, index)
+			return
+		}
+		if index >= len(msgs) || got[index] || !bytes.Equal(buf[0:n], msgs[index]) {
+			t.Error("message not match", i, index, n)
+			return
+		}
+		got[index] = true
+	}
+	fmt.Println("message echo done", len(got))
+}
+
+func Test0015RUDP(t *testing.T) {
+	c, _ := NewConn("lossy+rudp")
+	c.(*LossyConn).SetConfig(&LossyConfig{Loss: 0.05, Reorder: 0.05, ReorderMs: 20, DelayMs: 5, Seed: 1})
+	config := DefaultRudpConfig()
+	config.Message = frame.MessageReliable
+	c.(*LossyConn).Inner().(*RudpConn).SetConfig(config)
+	testMessageEcho(t, c, "127.0.0.1:58117", true)
+
+	c, _ = NewConn("lossy+rudp")
+	c.(*LossyConn).SetConfig(&LossyConfig{Loss: 0.05, Reorder: 0.05, ReorderMs: 20, DelayMs: 5, Seed: 1})
+	config = DefaultRudpConfig()
+	config.Message = frame.MessageUnordered
+	c.(*LossyConn).Inner().(*RudpConn).SetConfig(config)
+	testMessageEcho(t, c, "127.0.0.1:58117", false)
+}
+
+func Test0016RUDP(t *testing.T) {
+	c, _ := NewConn("rudp")
+	config := DefaultRudpConfig()
+	config.ReusePort = 4
+	c.(*RudpConn).SetConfig(config)
+	cc, clients := testReusePortEcho(t, c, "127.0.0.1:58120", 16)
+	if cc == nil {
+		return
+	}
+	defer testReusePortClose(cc, clients)
+
+	listener := cc.(*RudpConn).listener
+	used := 0
+	remotes := make(map[string]int)
+	for i, shard := range listener.shards {
+		num := 0
+		shard.sonny.Range(func(key, value interface{}) bool {
+			if _, s := value.(*RudpConn).listenersonny.where(); s != shard {
+				t.Error("sonny in wrong shard", key)
+			}
+			remotes[key.(string)]++
+			num++
+			return true
+		})
+		recvnum := atomic.LoadInt64(&shard.recvnum)
+		fmt.Println("shard", i, shard.conn.LocalAddr(), num, recvnum)
+		// the socket that read the packets is the one keeping their sonnies
+		if (num > 0) != (recvnum > 0) {
+			t.Error("shard recv not match sonny", i, num, recvnum)
+		}
+		if num > 0 {
+			used++
+		}
+	}
+	// a remote read by two sockets would have a sonny in both
+	if len(remotes) != 16 {
+		t.Error("remote not in one shard", len(remotes))
+	}
+	for k, v := range remotes {
+		if v != 1 {
+			t.Error("remote in many shards", k, v)
+		}
+	}
+	if len(listener.shards) != 4 || used < 2 {
+		t.Error("reuseport shards not used", len(listener.shards), used)
+	}
+}
@@ -0,0 +1,101 @@
+package conn
+
+import (
+	"github.com/3t2ugg1e/go-engine/src/frame"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats 连接统计，transport不支持的项为0
+type ConnStats struct {
+	BytesIn     int64         // 收到的字节数
+	BytesOut    int64         // 发出的字节数
+	PacketsIn   int64         // 收到的包数
+	PacketsOut  int64         // 发出的包数
+	Retransmits int64         // 重传的包数
+	Rtt         time.Duration // 往返时间
+	Cwnd        int           // 拥塞窗口，字节
+	RecvOld     int64         // 收到的已确认过的旧包
+	RecvOutWin  int64         // 收到的窗口外的包
+	Recovered   int64         // FEC恢复的包
+	Dropped     int64         // 超出传输限制发不出去而丢弃的包
+}
+
+// StatsProvider is implemented by conns that can report their health, it is safe to poll from any goroutine
+type StatsProvider interface {
+	Stats() ConnStats
+}
+
+// GetStats returns the stats of c or of the conn it wraps
+func GetStats(c Conn) (ConnStats, bool) {
+	for {
+		if s, ok := c.(StatsProvider); ok {
+			return s.Stats(), true
+		}
+		w, ok := c.(WrapConn)
+		if !ok {
+			return ConnStats{}, false
+		}
+		c = w.Inner()
+	}
+}
+
+type connCounter struct {
+	bytesIn     int64
+	bytesOut    int64
+	packetsIn   int64
+	packetsOut  int64
+	retransmits int64
+	rttns       int64
+	dropped     int64
+}
+
+func (cc *connCounter) in(n int) {
+	atomic.AddInt64(&cc.bytesIn, int64(n))
+	atomic.AddInt64(&cc.packetsIn, 1)
+}
+
+func (cc *connCounter) out(n int) {
+	atomic.AddInt64(&cc.bytesOut, int64(n))
+	atomic.AddInt64(&cc.packetsOut, 1)
+}
+
+func (cc *connCounter) drop() {
+	atomic.AddInt64(&cc.dropped, 1)
+}
+
+func (cc *connCounter) retransmit() {
+	atomic.AddInt64(&cc.retransmits, 1)
+}
+
+func (cc *connCounter) setRtt(rtt time.Duration) {
+	atomic.StoreInt64(&cc.rttns, int64(rtt))
+}
+
+func (cc *connCounter) stats() ConnStats {
+	return ConnStats{
+		BytesIn:     atomic.LoadInt64(&cc.bytesIn),
+		BytesOut:    atomic.LoadInt64(&cc.bytesOut),
+		PacketsIn:   atomic.LoadInt64(&cc.packetsIn),
+		PacketsOut:  atomic.LoadInt64(&cc.packetsOut),
+		Retransmits: atomic.LoadInt64(&cc.retransmits),
+		Rtt:         time.Duration(atomic.LoadInt64(&cc.rttns)),
+		Dropped:     atomic.LoadInt64(&cc.dropped),
+	}
+}
+
+// frameStats merges the counters kept by FrameMgr, fm is nil before the conn is set up
+func (cc *connCounter) frameStats(fm *frame.FrameMgr) ConnStats {
+	ret := cc.stats()
+	if fm == nil {
+		return ret
+	}
+	fs := fm.GetStat()
+	ret.Retransmits = fs.Resend
+	ret.Rtt = fs.Rtt
+	ret.Cwnd = fs.Cwnd
+	ret.RecvOld = fs.RecvOld
+	ret.RecvOutWin = fs.RecvOutWin
+	ret.Recovered = fs.Recovered
+	return ret
+}
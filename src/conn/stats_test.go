@@ -0,0 +1,100 @@
+package conn
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func testStatsEcho(t *testing.T, proto string, addr string, size int) (ConnStats, ConnStats) {
+	c, err := NewConn(proto)
+	if err != nil {
+		t.Error(err)
+		return ConnStats{}, ConnStats{}
+	}
+	if tc, ok := c.(*TlsConn); ok {
+		// the listener uses a generated self-signed cert
+		tc.GetConfig().Insecure = true
+	}
+
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Error(err)
+		return ConnStats{}, ConnStats{}
+	}
+	defer cc.Close()
+
+	sonnych := make(chan Conn, 1)
+	go func() {
+		sonny, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sonnych <- sonny
+		io.Copy(sonny, sonny)
+	}()
+
+	ccc, err := c.Dial(addr)
+	if err != nil {
+		t.Error(err)
+		return ConnStats{}, ConnStats{}
+	}
+	defer ccc.Close()
+
+	src := make([]byte, size)
+	go ccc.Write(src)
+	dst := make([]byte, size)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(ccc, dst)
+	if err != nil {
+		t.Error(err)
+		return ConnStats{}, ConnStats{}
+	}
+	// wait for the pong of the heartbeat
+	time.Sleep(time.Second * 2)
+
+	ds, ok := GetStats(ccc)
+	if !ok {
+		t.Error(proto + " dialer has no stats")
+	}
+	ls, ok := GetStats(<-sonnych)
+	if !ok {
+		t.Error(proto + " sonny has no stats")
+	}
+	fmt.Printf("%s dialer %+v\n", proto, ds)
+	fmt.Printf("%s sonny %+v\n", proto, ls)
+	return ds, ls
+}
+
+func Test0001STATS(t *testing.T) {
+	c, _ := NewConn("tcp")
+	_, ok := GetStats(c)
+	if ok {
+		t.Error("tcp should have no stats")
+	}
+
+	size := 256 * 1024
+	ds, ls := testStatsEcho(t, "tls+rudp", "127.0.0.1:58100", size)
+	if ds.BytesOut < int64(size) || ds.BytesIn < int64(size) || ds.PacketsOut <= 0 || ds.PacketsIn <= 0 {
+		t.Error("rudp dialer bytes not count", ds)
+	}
+	if ls.BytesOut < int64(size) || ls.BytesIn < int64(size) {
+		t.Error("rudp sonny bytes not count", ls)
+	}
+	if ds.Rtt <= 0 || ds.Cwnd <= 0 {
+		t.Error("rudp rtt or cwnd not set", ds)
+	}
+}
+
+func Test0002STATS(t *testing.T) {
+	size := 64 * 1024
+	ds, ls := testStatsEcho(t, "rhttp", "127.0.0.1:58101", size)
+	if ds.BytesOut != int64(size) || ds.BytesIn != int64(size) || ds.PacketsOut <= 0 || ds.Rtt <= 0 {
+		t.Error("rhttp dialer stats wrong", ds)
+	}
+	if ls.BytesIn != int64(size) || ls.BytesOut != int64(size) {
+		t.Error("rhttp sonny stats wrong", ls)
+	}
+}
@@ -0,0 +1,220 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"github.com/xtaci/smux"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StreamOpener is implemented by conns that can carry many streams in one session, both sides must use streams instead of Read/Write then
+type StreamOpener interface {
+	OpenStream() (Conn, error)
+	AcceptStream() (Conn, error)
+	AcceptStreamContext(ctx context.Context) (Conn, error)
+}
+
+// streamMux runs smux v2 over a reliable conn, each stream has its own window so a slow one does not stall the others
+type streamMux struct {
+	lock    sync.Mutex
+	session *smux.Session
+}
+
+// streamMuxConn keeps smux from closing the conn, the conn closes the session instead
+type streamMuxConn struct {
+	io.ReadWriter
+}
+
+func (c *streamMuxConn) Close() error {
+	return nil
+}
+
+// get starts the session on first use, the dialer side is the smux client
+func (m *streamMux) get(c Conn, client bool, buffer int) (*smux.Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.session != nil {
+		return m.session, nil
+	}
+
+	config := smux.DefaultConfig()
+	config.Version = 2
+	if buffer > 0 {
+		config.MaxStreamBuffer = buffer
+		if config.MaxReceiveBuffer < buffer {
+			config.MaxReceiveBuffer = buffer
+		}
+	}
+
+	var session *smux.Session
+	var err error
+	if client {
+		session, err = smux.Client(&streamMuxConn{c}, config)
+	} else {
+		session, err = smux.Server(&streamMuxConn{c}, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.session = session
+	return session, nil
+}
+
+func (m *streamMux) open(c Conn, client bool, buffer int) (Conn, error) {
+	session, err := m.get(c, client, buffer)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &StreamConn{parent: c, stream: stream, id: int64(stream.ID())}, nil
+}
+
+func (m *streamMux) accept(ctx context.Context, c Conn, client bool, buffer int) (Conn, error) {
+	session, err := m.get(c, client, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, func() {
+		session.SetDeadline(time.Now())
+	})
+	stream, err := session.AcceptStream()
+	stop()
+	if ctx.Err() != nil {
+		session.SetDeadline(time.Time{})
+		if stream != nil {
+			stream.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &StreamConn{parent: c, stream: stream, id: int64(stream.ID())}, nil
+}
+
+func (m *streamMux) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.session != nil {
+		m.session.Close()
+	}
+}
+
+// streamIO is a smux stream or a native quic stream
+type streamIO interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// StreamConn is one stream opened by OpenStream or AcceptStream, closing it leaves the session and the other streams alone
+type StreamConn struct {
+	parent Conn
+	stream streamIO
+	id     int64
+	info   string
+	stat   connCounter
+}
+
+func (c *StreamConn) Name() string {
+	return "stream+" + c.parent.Name()
+}
+
+func (c *StreamConn) Read(p []byte) (n int, err error) {
+	n, err = c.stream.Read(p)
+	if n > 0 {
+		c.stat.in(n)
+	}
+	return n, err
+}
+
+func (c *StreamConn) Write(p []byte) (n int, err error) {
+	n, err = c.stream.Write(p)
+	if n > 0 {
+		c.stat.out(n)
+	}
+	return n, err
+}
+
+func (c *StreamConn) Close() error {
+	return c.stream.Close()
+}
+
+func (c *StreamConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	c.info = "stream " + strconv.FormatInt(c.id, 10) + " " + c.parent.Info()
+	return c.info
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.parent.LocalAddr()
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.parent.RemoteAddr()
+}
+
+// Stats counts the bytes of this stream, the rest comes from the session
+func (c *StreamConn) Stats() ConnStats {
+	ret := c.stat.stats()
+	if ps, ok := GetStats(c.parent); ok {
+		ret.PacketsIn = ps.PacketsIn
+		ret.PacketsOut = ps.PacketsOut
+		ret.Retransmits = ps.Retransmits
+		ret.Rtt = ps.Rtt
+		ret.Cwnd = ps.Cwnd
+		ret.RecvOld = ps.RecvOld
+		ret.RecvOutWin = ps.RecvOutWin
+		ret.Recovered = ps.Recovered
+		ret.Dropped = ps.Dropped
+	}
+	return ret
+}
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+func (c *StreamConn) Dial(dst string) (Conn, error) {
+	return nil, errors.New("stream conn can not dial, use OpenStream")
+}
+
+func (c *StreamConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	return c.Dial(dst)
+}
+
+func (c *StreamConn) Listen(dst string) (Conn, error) {
+	return nil, errors.New("stream conn can not listen, use AcceptStream")
+}
+
+func (c *StreamConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	return c.Listen(dst)
+}
+
+func (c *StreamConn) Accept() (Conn, error) {
+	return nil, errors.New("stream conn can not accept, use AcceptStream")
+}
+
+func (c *StreamConn) AcceptContext(ctx context.Context) (Conn, error) {
+	return c.Accept()
+}
@@ -4,8 +4,15 @@ import (
 	"context"
 	"errors"
 	"net"
+	"time"
 )
 
+func init() {
+	Register("tcp", func() Conn {
+		return &TcpConn{}
+	}, true)
+}
+
 type TcpConn struct {
 	conn     *net.TCPConn
 	listener *net.TCPListener
@@ -57,12 +64,53 @@ func (c *TcpConn) Info() string {
 	return c.info
 }
 
+func (c *TcpConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *TcpConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *TcpConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TcpConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TcpConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
 func (c *TcpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *TcpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	addr, err := net.ResolveTCPAddr("tcp", dst)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	c.cancel = cancel
 	var d net.Dialer
 	if gControlOnConnSetup != nil {
@@ -77,19 +125,42 @@ func (c *TcpConn) Dial(dst string) (Conn, error) {
 }
 
 func (c *TcpConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *TcpConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
 	addr, err := net.ResolveTCPAddr("tcp", dst)
 	if err != nil {
 		return nil, err
 	}
-	listener, err := net.ListenTCP("tcp", addr)
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
-	return &TcpConn{listener: listener}, nil
+	return &TcpConn{listener: listener.(*net.TCPListener)}, nil
 }
 
 func (c *TcpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *TcpConn) AcceptContext(ctx context.Context) (Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	stop := watchContext(ctx, func() {
+		c.listener.SetDeadline(time.Now())
+	})
 	conn, err := c.listener.Accept()
+	stop()
+	if ctx.Err() != nil {
+		c.listener.SetDeadline(time.Time{})
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,343 @@
+package conn
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterWrapper("tls", func(inner Conn) Conn {
+		return &TlsConn{inner: inner}
+	}, true)
+}
+
+type TlsConfig struct {
+	CertFile           string // 证书，服务端为空时自动生成自签名证书，客户端用于双向认证
+	KeyFile            string // 证书私钥
+	CAFile             string // CA证书，用于校验对端证书，客户端为空时用系统根证书
+	ServerName         string // 客户端校验的服务端名字，为空时取dst的host
+	ClientAuth         bool   // 服务端是否要求客户端证书，需要CAFile
+	PinSha256          string // 客户端固定服务端证书的sha256指纹，没有CAFile时代替证书链校验
+	Insecure           bool   // 客户端不校验服务端证书
+	NextProto          string
+	HandshakeTimeoutMs int
+}
+
+func DefaultTlsConfig() *TlsConfig {
+	return &TlsConfig{
+		NextProto:          "TlsConn",
+		HandshakeTimeoutMs: 10000,
+	}
+}
+
+type TlsConn struct {
+	info      string
+	config    *TlsConfig
+	inner     Conn
+	conn      *tls.Conn
+	listener  Conn
+	tlsconfig *tls.Config
+}
+
+func (c *TlsConn) Name() string {
+	return "tls+" + c.inner.Name()
+}
+
+func (c *TlsConn) Inner() Conn {
+	return c.inner
+}
+
+func (c *TlsConn) Read(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Read(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *TlsConn) Write(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Write(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *TlsConn) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	} else if c.listener != nil {
+		return c.listener.Close()
+	}
+	return c.inner.Close()
+}
+
+func (c *TlsConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		c.info = c.conn.LocalAddr().String() + "<--" + c.Name() + "-->" + c.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = c.Name() + "--" + c.listener.LocalAddr().String()
+	} else {
+		c.info = "empty tls conn"
+	}
+	return c.info
+}
+
+func (c *TlsConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.LocalAddr()
+	}
+	return nil
+}
+
+func (c *TlsConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *TlsConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TlsConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TlsConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TlsConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *TlsConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	config, err := c.clientTlsConfig(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	inner, err := c.inner.DialContext(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.handshake(ctx, tls.Client(inner, config))
+	if err != nil {
+		inner.Close()
+		return nil, err
+	}
+
+	return &TlsConn{config: c.config, inner: inner, conn: conn}, nil
+}
+
+func (c *TlsConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *TlsConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	config, err := c.serverTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := c.inner.ListenContext(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TlsConn{config: c.config, inner: listener, listener: listener, tlsconfig: config}, nil
+}
+
+func (c *TlsConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *TlsConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+
+	inner, err := c.listener.AcceptContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// handshake is done on the first Read/Write like tls.Listener, so a slow client can not block Accept
+	conn := tls.Server(inner, c.tlsconfig)
+
+	return &TlsConn{config: c.config, inner: inner, conn: conn}, nil
+}
+
+func (c *TlsConn) handshake(ctx context.Context, conn *tls.Conn) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(c.config.HandshakeTimeoutMs))
+	defer cancel()
+	err := conn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *TlsConn) clientTlsConfig(dst string) (*tls.Config, error) {
+	config, err := clientTls(dst, c.config.ServerName, c.config.CAFile, c.config.PinSha256, c.config.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	config.NextProtos = []string{c.config.NextProto}
+
+	if c.config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// clientTls verifies the server against cafile, or the system roots when it is empty, and the server name
+// a pin without cafile replaces the chain check, only insecure skips the check at all
+func clientTls(dst string, servername string, cafile string, pin string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: servername,
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(dst)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	if cafile != "" {
+		pool, err := loadCertPool(cafile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if pin != "" {
+		pin = strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+		// VerifyPeerCertificate still runs when the chain check is skipped
+		config.InsecureSkipVerify = cafile == ""
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) <= 0 {
+				return errors.New("no peer certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != pin {
+				return errors.New("peer certificate pin mismatch")
+			}
+			return nil
+		}
+	}
+
+	if insecure {
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+func (c *TlsConn) serverTlsConfig() (*tls.Config, error) {
+	var config *tls.Config
+	if c.config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{c.config.NextProto},
+		}
+	} else {
+		cf, err := common.GenerateTLSConfig(c.config.NextProto)
+		if err != nil {
+			return nil, err
+		}
+		config = cf
+	}
+
+	if c.config.ClientAuth {
+		if c.config.CAFile == "" {
+			return nil, errors.New("tls client auth need CAFile")
+		}
+		pool, err := loadCertPool(c.config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate in " + file)
+	}
+	return pool, nil
+}
+
+func (c *TlsConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultTlsConfig()
+	}
+}
+
+func (c *TlsConn) SetConfig(config *TlsConfig) {
+	c.config = config
+}
+
+func (c *TlsConn) GetConfig() *TlsConfig {
+	c.checkConfig()
+	return c.config
+}
@@ -0,0 +1,203 @@
+package conn
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func genTestCert(dir string, name string, ca *x509.Certificate, cakey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, []byte) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		ca = template
+		cakey = key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, cakey)
+	cert, _ := x509.ParseCertificate(der)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	return cert, key, der
+}
+
+func Test0001TLS(t *testing.T) {
+	c, err := NewConn("tls+tcp")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println(c.Name(), HasReliableProto("tls+rudp"), HasProto("tls+udp"))
+	if HasProto("tls+udp") || !HasReliableProto("tls+kcp") {
+		t.Error("tls wrapper check fail")
+	}
+	// the listener uses a generated self-signed cert
+	c.(*TlsConn).GetConfig().Insecure = true
+
+	cc, err := c.Listen(":58088")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Println("accept done " + sonny.Info())
+			go func() {
+				buf := make([]byte, 100)
+				n, err := sonny.Read(buf)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				sonny.Write(buf[0:n])
+			}()
+		}
+	}()
+
+	// the server cert is checked by default
+	d, _ := NewConn("tls+tcp")
+	_, err = d.Dial("127.0.0.1:58088")
+	fmt.Println("verify", err)
+	if err == nil {
+		t.Error("self-signed cert should fail by default")
+	}
+
+	ccc, err := c.Dial("127.0.0.1:58088")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	ccc.Write([]byte("hello tls"))
+	buf := make([]byte, 100)
+	n, err := ccc.Read(buf)
+	if err != nil || string(buf[0:n]) != "hello tls" {
+		t.Error("echo fail", err)
+	}
+}
+
+func Test0002TLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlsconn")
+	defer os.RemoveAll(dir)
+
+	ca, cakey, _ := genTestCert(dir, "ca", nil, nil)
+	_, _, serverder := genTestCert(dir, "localhost", ca, cakey)
+	genTestCert(dir, "client", ca, cakey)
+
+	c, _ := NewConn("tls+rudp")
+	c.(*TlsConn).SetConfig(&TlsConfig{
+		CertFile:           filepath.Join(dir, "localhost.crt"),
+		KeyFile:            filepath.Join(dir, "localhost.key"),
+		CAFile:             filepath.Join(dir, "ca.crt"),
+		ClientAuth:         true,
+		NextProto:          "TlsConn",
+		HandshakeTimeoutMs: 5000,
+	})
+
+	cc, err := c.Listen(":58088")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				fmt.Println("accept fail", err)
+				if err.Error() == "listener close" {
+					return
+				}
+				continue
+			}
+			go func() {
+				_, err := sonny.Read(make([]byte, 10))
+				fmt.Println("sonny read", err)
+				sonny.Close()
+			}()
+		}
+	}()
+
+	sum := sha256.Sum256(serverder)
+
+	// client auth without a CA authenticates nobody
+	e, _ := NewConn("tls+rudp")
+	e.(*TlsConn).SetConfig(&TlsConfig{ClientAuth: true, NextProto: "TlsConn", HandshakeTimeoutMs: 5000})
+	_, err = e.Listen(":58130")
+	fmt.Println("client auth without ca", err)
+	if err == nil {
+		t.Error("client auth should need CAFile")
+	}
+
+	// the ca without the right server name
+	d, _ := NewConn("tls+rudp")
+	d.(*TlsConn).SetConfig(&TlsConfig{CertFile: filepath.Join(dir, "client.crt"), KeyFile: filepath.Join(dir, "client.key"),
+		CAFile: filepath.Join(dir, "ca.crt"), ServerName: "other", NextProto: "TlsConn", HandshakeTimeoutMs: 5000})
+	_, err = d.Dial("127.0.0.1:58088")
+	fmt.Println("wrong server name", err)
+	if err == nil {
+		t.Error("server name should be checked")
+	}
+
+	// no client cert
+	d.(*TlsConn).SetConfig(&TlsConfig{CAFile: filepath.Join(dir, "ca.crt"), ServerName: "localhost", NextProto: "TlsConn", HandshakeTimeoutMs: 5000})
+	ccc, err := d.Dial("127.0.0.1:58088")
+	if err == nil {
+		_, err = ccc.Read(make([]byte, 10))
+		ccc.Close()
+	}
+	fmt.Println("no client cert", err)
+	if err == nil {
+		t.Error("mutual tls should fail without client cert")
+	}
+
+	// wrong pin
+	d.(*TlsConn).SetConfig(&TlsConfig{CertFile: filepath.Join(dir, "client.crt"), KeyFile: filepath.Join(dir, "client.key"),
+		PinSha256: "00", NextProto: "TlsConn", HandshakeTimeoutMs: 5000})
+	_, err = d.Dial("127.0.0.1:58088")
+	fmt.Println("wrong pin", err)
+	if err == nil {
+		t.Error("pin should fail")
+	}
+
+	// client cert and pin
+	d.(*TlsConn).SetConfig(&TlsConfig{CertFile: filepath.Join(dir, "client.crt"), KeyFile: filepath.Join(dir, "client.key"),
+		PinSha256: hex.EncodeToString(sum[:]), NextProto: "TlsConn", HandshakeTimeoutMs: 5000})
+	ccc, err = d.Dial("127.0.0.1:58088")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println("dial done " + ccc.Info())
+	ccc.Close()
+}
@@ -7,9 +7,19 @@ import (
 	"github.com/3t2ugg1e/go-engine/src/group"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
 	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+func init() {
+	Register("udp", func() Conn {
+		return &UdpConn{}
+	}, false)
+}
+
 type UdpConn struct {
 	info          string
 	config        *UdpConfig
@@ -17,6 +27,9 @@ type UdpConn struct {
 	listenersonny *udpConnListenerSonny
 	listener      *udpConnListener
 	cancel        context.CancelFunc
+	deadline      connDeadline
+	lossy         *LossyConfig
+	impair        *impairer
 }
 
 type udpConnDialer struct {
@@ -26,22 +39,32 @@ type udpConnDialer struct {
 type udpConnListenerSonny struct {
 	dstaddr    *net.UDPAddr
 	fatherconn *net.UDPConn
+	shard      *udpConnShard
 	recvch     *common.Channel
 	isclose    bool
 }
 
 type udpConnListener struct {
 	listenerconn *net.UDPConn
+	shards       []*udpConnShard
 	wg           *group.Group
-	sonny        sync.Map
 	accept       *common.Channel
 }
 
+// udpConnShard is one of the SO_REUSEPORT sockets, the kernel keeps a remote on the same socket,
+// so a sonny lives in the shard whose socket reads its packets
+type udpConnShard struct {
+	conn    *net.UDPConn
+	sonny   sync.Map
+	recvnum int64
+}
+
 type UdpConfig struct {
 	MaxPacketSize       int
 	RecvChanLen         int
 	AcceptChanLen       int
 	RecvChanPushTimeout int
+	ReusePort           int // 监听时用SO_REUSEPORT开多少个socket，每个一个读协程分担收包，0或1为单个socket
 }
 
 func DefaultUdpConfig() *UdpConfig {
@@ -65,12 +88,22 @@ func (c *UdpConn) Read(p []byte) (n int, err error) {
 	} else if c.listener != nil {
 		return 0, errors.New("listener can not be read")
 	} else if c.listenersonny != nil {
-		if c.listenersonny.isclose {
-			return 0, errors.New("read closed conn")
-		}
-		b := <-c.listenersonny.recvch.Ch()
-		if b == nil {
-			return 0, errors.New("read closed conn")
+		var b interface{}
+		for b == nil {
+			if c.listenersonny.isclose {
+				return 0, errors.New("read closed conn")
+			}
+			if c.deadline.readExpired() {
+				return 0, os.ErrDeadlineExceeded
+			}
+			select {
+			case bb, ok := <-c.listenersonny.recvch.Ch():
+				if !ok || bb == nil {
+					return 0, errors.New("read closed conn")
+				}
+				b = bb
+			case <-time.After(time.Millisecond * 100):
+			}
 		}
 		data := b.([]byte)
 		if len(data) > len(p) {
@@ -86,14 +119,17 @@ func (c *UdpConn) Write(p []byte) (n int, err error) {
 	c.checkConfig()
 
 	if c.dialer != nil {
-		return c.dialer.conn.Write(p)
+		return c.writeUDP(c.dialer.conn, p, nil)
 	} else if c.listener != nil {
 		return 0, errors.New("listener can not be write")
 	} else if c.listenersonny != nil {
 		if c.listenersonny.isclose {
 			return 0, errors.New("write closed conn")
 		}
-		return c.listenersonny.fatherconn.WriteToUDP(p, c.listenersonny.dstaddr)
+		if c.deadline.writeExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return c.writeUDP(c.listenersonny.fatherconn, p, c.listenersonny.dstaddr)
 	}
 	return 0, errors.New("empty conn")
 }
@@ -109,11 +145,13 @@ func (c *UdpConn) Close() error {
 	} else if c.listener != nil {
 		c.listener.wg.Stop()
 		c.listener.wg.Wait()
-		c.listener.sonny.Range(func(key, value interface{}) bool {
-			u := value.(*UdpConn)
-			u.Close()
-			return true
-		})
+		for _, shard := range c.listener.shards {
+			shard.sonny.Range(func(key, value interface{}) bool {
+				u := value.(*UdpConn)
+				u.Close()
+				return true
+			})
+		}
 	} else if c.listenersonny != nil {
 		c.listenersonny.recvch.Close()
 		c.listenersonny.isclose = true
@@ -139,14 +177,74 @@ func (c *UdpConn) Info() string {
 	return c.info
 }
 
+func (c *UdpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *UdpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.RemoteAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.dstaddr
+	}
+	return nil
+}
+
+func (c *UdpConn) SetDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	} else if c.listenersonny != nil {
+		c.deadline.setDeadline(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UdpConn) SetReadDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	} else if c.listenersonny != nil {
+		c.deadline.setReadDeadline(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UdpConn) SetWriteDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	} else if c.listenersonny != nil {
+		c.deadline.setWriteDeadline(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
 func (c *UdpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *UdpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
 	addr, err := net.ResolveUDPAddr("udp", dst)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	c.cancel = cancel
 	var d net.Dialer
 	if gControlOnConnSetup != nil {
@@ -158,18 +256,17 @@ func (c *UdpConn) Dial(dst string) (Conn, error) {
 	}
 	c.cancel = nil
 	dialer := &udpConnDialer{conn: conn.(*net.UDPConn)}
-	return &UdpConn{config: c.config, dialer: dialer}, nil
+	return &UdpConn{config: c.config, dialer: dialer, impair: newImpairer(c.lossy)}, nil
 }
 
 func (c *UdpConn) Listen(dst string) (Conn, error) {
-	c.checkConfig()
+	return c.ListenContext(context.Background(), dst)
+}
 
-	ipaddr, err := net.ResolveUDPAddr("udp", dst)
-	if err != nil {
-		return nil, err
-	}
+func (c *UdpConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
 
-	listenerconn, err := net.ListenUDP("udp", ipaddr)
+	conns, err := listenUDPShards(ctx, dst, c.config.ReusePort)
 	if err != nil {
 		return nil, err
 	}
@@ -177,37 +274,54 @@ func (c *UdpConn) Listen(dst string) (Conn, error) {
 	ch := common.NewChannel(c.config.AcceptChanLen)
 
 	wg := group.NewGroup("UdpConn Listen"+" "+dst, nil, func() {
-		listenerconn.Close()
+		for _, conn := range conns {
+			conn.Close()
+		}
 		ch.Close()
 	})
 
 	listener := &udpConnListener{
-		listenerconn: listenerconn,
+		listenerconn: conns[0],
 		wg:           wg,
 		accept:       ch,
 	}
+	for _, conn := range conns {
+		listener.shards = append(listener.shards, &udpConnShard{conn: conn})
+	}
 
-	u := &UdpConn{config: c.config, listener: listener}
-	wg.Go("UdpConn Listen loopRecv"+" "+dst, func() error {
-		return u.loopRecv()
-	})
+	u := &UdpConn{config: c.config, listener: listener, impair: newImpairer(c.lossy)}
+	for i, shard := range listener.shards {
+		shard := shard
+		wg.Go("UdpConn Listen loopRecv"+" "+dst+" "+strconv.Itoa(i), func() error {
+			return u.loopRecv(shard)
+		})
+	}
 
 	return u, nil
 }
 
 func (c *UdpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *UdpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
 		sonny := s.(*UdpConn)
-		_, ok := c.listener.sonny.Load(sonny.listenersonny.dstaddr.String())
+		_, ok := sonny.listenersonny.shard.sonny.Load(sonny.listenersonny.dstaddr.String())
 		if !ok {
 			continue
 		}
@@ -219,33 +333,35 @@ func (c *UdpConn) Accept() (Conn, error) {
 	return nil, errors.New("listener close")
 }
 
-func (c *UdpConn) loopRecv() error {
+func (c *UdpConn) loopRecv(shard *udpConnShard) error {
 	c.checkConfig()
 
 	buf := make([]byte, c.config.MaxPacketSize)
 	for !c.listener.wg.IsExit() {
-		n, srcaddr, err := c.listener.listenerconn.ReadFromUDP(buf)
+		n, srcaddr, err := shard.conn.ReadFromUDP(buf)
 		if err != nil {
 			return err
 		}
+		atomic.AddInt64(&shard.recvnum, 1)
 
 		data := make([]byte, n)
 		copy(data, buf[0:n])
 		srcaddrstr := srcaddr.String()
 
-		v, ok := c.listener.sonny.Load(srcaddrstr)
+		v, ok := shard.sonny.Load(srcaddrstr)
 		if !ok {
 			sonny := &udpConnListenerSonny{
 				dstaddr:    srcaddr,
-				fatherconn: c.listener.listenerconn,
+				fatherconn: shard.conn,
+				shard:      shard,
 				recvch:     common.NewChannel(c.config.RecvChanLen),
 			}
 
-			u := &UdpConn{config: c.config, listenersonny: sonny}
+			u := &UdpConn{config: c.config, listenersonny: sonny, impair: c.impair}
 			if !u.listenersonny.recvch.WriteTimeout(data, c.config.RecvChanPushTimeout) {
 				loggo.Debug("udp conn %s push %d data to %s recv channel timeout", c.Info(), len(data), u.Info())
 			}
-			c.listener.sonny.Store(srcaddrstr, u)
+			shard.sonny.Store(srcaddrstr, u)
 
 			c.listener.accept.Write(u)
 		} else {
@@ -255,10 +371,10 @@ func (c *UdpConn) loopRecv() error {
 			}
 		}
 
-		c.listener.sonny.Range(func(key, value interface{}) bool {
+		shard.sonny.Range(func(key, value interface{}) bool {
 			u := value.(*UdpConn)
 			if u.listenersonny.isclose {
-				c.listener.sonny.Delete(key)
+				shard.sonny.Delete(key)
 			}
 			return true
 		})
@@ -266,6 +382,25 @@ func (c *UdpConn) loopRecv() error {
 	return nil
 }
 
+func (c *UdpConn) setLossy(config *LossyConfig) {
+	c.lossy = config
+}
+
+func (c *UdpConn) writeUDP(conn *net.UDPConn, p []byte, dstaddr *net.UDPAddr) (int, error) {
+	err := c.impair.send(p, func(b []byte) error {
+		if dstaddr != nil {
+			_, err := conn.WriteToUDP(b, dstaddr)
+			return err
+		}
+		_, err := conn.Write(b)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 func (c *UdpConn) checkConfig() {
 	if c.config == nil {
 		c.config = DefaultUdpConfig()
@@ -280,3 +415,54 @@ func (c *UdpConn) GetConfig() *UdpConfig {
 	c.checkConfig()
 	return c.config
 }
+
+func listenUDP(ctx context.Context, dst string) (*net.UDPConn, error) {
+	ipaddr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", ipaddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenUDPShards opens num sockets on dst with SO_REUSEPORT so each can be read by its own goroutine
+func listenUDPShards(ctx context.Context, dst string, num int) ([]*net.UDPConn, error) {
+	if num > 1 && !reusePortSupported {
+		loggo.Warn("reuseport not supported, listen %s with one socket", dst)
+		num = 1
+	}
+	if num <= 1 {
+		conn, err := listenUDP(ctx, dst)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+
+	ipaddr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	addr := ipaddr.String()
+	var conns []*net.UDPConn
+	for i := 0; i < num; i++ {
+		conn, err := lc.ListenPacket(ctx, "udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+		// with port 0 the first one picks the port, the others join it
+		addr = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -361,3 +363,118 @@ func Test0008UDP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func testReusePortEcho(t *testing.T, c Conn, addr string, num int) (Conn, []Conn) {
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 100)
+				for {
+					n, err := sonny.Read(buf)
+					if err != nil {
+						return
+					}
+					sonny.Write(buf[0:n])
+				}
+			}()
+		}
+	}()
+
+	clients := make([]Conn, num)
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ccc, err := c.Dial(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			clients[i] = ccc
+			src := "hello" + strconv.Itoa(i)
+			buf := make([]byte, 100)
+			for j := 0; j < 20; j++ {
+				ccc.Write([]byte(src))
+				ccc.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+				n, err := ccc.Read(buf)
+				if err == nil {
+					if string(buf[0:n]) != src {
+						t.Error("echo not match", src, string(buf[0:n]))
+					}
+					return
+				}
+			}
+			t.Error("no echo", src)
+		}(i)
+	}
+	wg.Wait()
+	return cc, clients
+}
+
+func testReusePortClose(cc Conn, clients []Conn) {
+	for _, ccc := range clients {
+		if ccc != nil {
+			ccc.Close()
+		}
+	}
+	cc.Close()
+}
+
+func Test0009UDP(t *testing.T) {
+	c, _ := NewConn("udp")
+	config := DefaultUdpConfig()
+	config.ReusePort = 4
+	c.(*UdpConn).SetConfig(config)
+	cc, clients := testReusePortEcho(t, c, "127.0.0.1:58119", 32)
+	if cc == nil {
+		return
+	}
+	defer testReusePortClose(cc, clients)
+
+	listener := cc.(*UdpConn).listener
+	used := 0
+	remotes := make(map[string]int)
+	for i, shard := range listener.shards {
+		num := 0
+		shard.sonny.Range(func(key, value interface{}) bool {
+			if value.(*UdpConn).listenersonny.shard != shard {
+				t.Error("sonny in wrong shard", key)
+			}
+			remotes[key.(string)]++
+			num++
+			return true
+		})
+		recvnum := atomic.LoadInt64(&shard.recvnum)
+		fmt.Println("shard", i, shard.conn.LocalAddr(), num, recvnum)
+		// the socket that read the packets is the one keeping their sonnies
+		if (num > 0) != (recvnum > 0) {
+			t.Error("shard recv not match sonny", i, num, recvnum)
+		}
+		if num > 0 {
+			used++
+		}
+	}
+	// a remote read by two sockets would have a sonny in both
+	if len(remotes) != 32 {
+		t.Error("remote not in one shard", len(remotes))
+	}
+	for k, v := range remotes {
+		if v != 1 {
+			t.Error("remote in many shards", k, v)
+		}
+	}
+	if len(listener.shards) != 4 || used < 2 {
+		t.Error("reuseport shards not used", len(listener.shards), used)
+	}
+}
@@ -0,0 +1,238 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("unix", func() Conn {
+		return &UnixConn{}
+	}, true)
+}
+
+type UnixConfig struct {
+	FileMode    os.FileMode // socket文件权限，默认只有属主可用，0为不修改
+	RemoveStale bool        // Listen时删除残留的socket文件，正在使用的不会删除
+}
+
+func DefaultUnixConfig() *UnixConfig {
+	return &UnixConfig{
+		FileMode:    0600,
+		RemoveStale: true,
+	}
+}
+
+type UnixConn struct {
+	config   *UnixConfig
+	conn     *net.UnixConn
+	listener *net.UnixListener
+	cancel   context.CancelFunc
+	info     string
+}
+
+func (c *UnixConn) Name() string {
+	return "unix"
+}
+
+func (c *UnixConn) Read(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Read(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *UnixConn) Write(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Write(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *UnixConn) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.conn != nil {
+		return c.conn.Close()
+	} else if c.listener != nil {
+		return c.listener.Close()
+	}
+	return nil
+}
+
+func (c *UnixConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		c.info = c.conn.LocalAddr().String() + "<--unix-->" + c.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = "unix--" + c.listener.Addr().String()
+	} else {
+		c.info = "empty unix conn"
+	}
+	return c.info
+}
+
+func (c *UnixConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *UnixConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *UnixConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *UnixConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", dst)
+	if err != nil {
+		return nil, err
+	}
+	c.cancel = nil
+	return &UnixConn{config: c.config, conn: conn.(*net.UnixConn)}, nil
+}
+
+func (c *UnixConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *UnixConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	err := prepareUnixSocket("unix", dst, c.config.RemoveStale)
+	if err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "unix", dst)
+	if err != nil {
+		return nil, err
+	}
+	err = chmodUnixSocket(dst, c.config.FileMode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &UnixConn{config: c.config, listener: listener.(*net.UnixListener)}, nil
+}
+
+func (c *UnixConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *UnixConn) AcceptContext(ctx context.Context) (Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	stop := watchContext(ctx, func() {
+		c.listener.SetDeadline(time.Now())
+	})
+	conn, err := c.listener.Accept()
+	stop()
+	if ctx.Err() != nil {
+		c.listener.SetDeadline(time.Time{})
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &UnixConn{config: c.config, conn: conn.(*net.UnixConn)}, nil
+}
+
+func (c *UnixConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultUnixConfig()
+	}
+}
+
+func (c *UnixConn) SetConfig(config *UnixConfig) {
+	c.config = config
+}
+
+func (c *UnixConn) GetConfig() *UnixConfig {
+	c.checkConfig()
+	return c.config
+}
+
+// abstract socket names start with @ and have no file, linux only
+func isAbstractUnix(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// prepareUnixSocket removes the socket file left by a crashed process, a socket still accepting is reported in use
+func prepareUnixSocket(network string, path string, removestale bool) error {
+	if isAbstractUnix(path) {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New("not socket file " + path)
+	}
+	if !removestale {
+		return errors.New("address already in use " + path)
+	}
+	conn, err := net.DialTimeout(network, path, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.New("address already in use " + path)
+	}
+	return os.Remove(path)
+}
+
+func chmodUnixSocket(path string, mode os.FileMode) error {
+	if isAbstractUnix(path) || mode == 0 {
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,131 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test0001UNIX(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "unixconn")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+
+	c, err := NewConn("unix")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c.(*UnixConn).SetConfig(&UnixConfig{FileMode: 0600, RemoveStale: true})
+
+	cc, err := c.Listen(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fi, _ := os.Stat(path)
+	fmt.Println(fi.Mode())
+	if fi.Mode().Perm() != 0600 {
+		t.Error("file mode not set", fi.Mode())
+	}
+
+	_, err = c.Listen(path)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("listen a live socket should fail")
+	}
+
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Println("accept done " + sonny.Info())
+			buf := make([]byte, 100)
+			n, err := sonny.Read(buf)
+			if err != nil {
+				// the probe of the second Listen
+				fmt.Println(err)
+				continue
+			}
+			sonny.Write(buf[0:n])
+			return
+		}
+	}()
+
+	ccc, err := c.Dial(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println("dial done " + ccc.Info())
+
+	ccc.Write([]byte("hello unix"))
+	buf := make([]byte, 100)
+	n, err := ccc.Read(buf)
+	if err != nil || string(buf[0:n]) != "hello unix" {
+		t.Error("echo fail", err)
+	}
+	ccc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	_, err = cc.AcceptContext(ctx)
+	cancel()
+	fmt.Println(err)
+	if err != context.DeadlineExceeded {
+		t.Error("AcceptContext should be canceled")
+	}
+
+	cc.Close()
+}
+
+func Test0002UNIX(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "unixconn")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stale.sock")
+
+	// leave a stale socket file like a crashed process
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	c, _ := NewConn("unix")
+	c.(*UnixConn).SetConfig(&UnixConfig{RemoveStale: false})
+	_, err = c.Listen(path)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("listen stale socket without RemoveStale should fail")
+	}
+
+	c.(*UnixConn).SetConfig(DefaultUnixConfig())
+	cc, err := c.Listen(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cc.Close()
+
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Error("socket file should be removed on close", err)
+	}
+
+	ioutil.WriteFile(path, []byte("not socket"), 0600)
+	_, err = c.Listen(path)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("listen on regular file should fail")
+	}
+}
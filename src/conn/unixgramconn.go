@@ -0,0 +1,402 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/group"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("unixgram", func() Conn {
+		return &UnixgramConn{}
+	}, false)
+}
+
+type UnixgramConn struct {
+	info          string
+	config        *UnixgramConfig
+	dialer        *unixgramConnDialer
+	listenersonny *unixgramConnListenerSonny
+	listener      *unixgramConnListener
+	deadline      connDeadline
+}
+
+type unixgramConnDialer struct {
+	conn *net.UnixConn
+}
+
+type unixgramConnListenerSonny struct {
+	dstaddr    *net.UnixAddr
+	fatherconn *net.UnixConn
+	recvch     *common.Channel
+	isclose    bool
+}
+
+type unixgramConnListener struct {
+	listenerconn *net.UnixConn
+	wg           *group.Group
+	sonny        sync.Map
+	accept       *common.Channel
+}
+
+type UnixgramConfig struct {
+	MaxPacketSize       int
+	RecvChanLen         int
+	AcceptChanLen       int
+	RecvChanPushTimeout int
+	FileMode            os.FileMode // socket文件权限，默认只有属主可用，0为不修改
+	RemoveStale         bool        // Listen时删除残留的socket文件，正在使用的不会删除
+	TempDir             string      // Dial时本端绑定的socket文件目录，为空时用系统临时目录
+}
+
+func DefaultUnixgramConfig() *UnixgramConfig {
+	return &UnixgramConfig{
+		MaxPacketSize:       10240,
+		RecvChanLen:         128,
+		AcceptChanLen:       128,
+		RecvChanPushTimeout: 100,
+		FileMode:            0600,
+		RemoveStale:         true,
+	}
+}
+
+func (c *UnixgramConn) Name() string {
+	return "unixgram"
+}
+
+func (c *UnixgramConn) Read(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.dialer != nil {
+		return c.dialer.conn.Read(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	} else if c.listenersonny != nil {
+		var b interface{}
+		for b == nil {
+			if c.listenersonny.isclose {
+				return 0, errors.New("read closed conn")
+			}
+			if c.deadline.readExpired() {
+				return 0, os.ErrDeadlineExceeded
+			}
+			select {
+			case bb, ok := <-c.listenersonny.recvch.Ch():
+				if !ok || bb == nil {
+					return 0, errors.New("read closed conn")
+				}
+				b = bb
+			case <-time.After(time.Millisecond * 100):
+			}
+		}
+		data := b.([]byte)
+		if len(data) > len(p) {
+			return 0, errors.New("read buffer too small")
+		}
+		copy(p, data)
+		return len(data), nil
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *UnixgramConn) Write(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.dialer != nil {
+		return c.dialer.conn.Write(p)
+	} else if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	} else if c.listenersonny != nil {
+		if c.listenersonny.isclose {
+			return 0, errors.New("write closed conn")
+		}
+		if c.deadline.writeExpired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return c.listenersonny.fatherconn.WriteToUnix(p, c.listenersonny.dstaddr)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *UnixgramConn) Close() error {
+	c.checkConfig()
+
+	if c.dialer != nil {
+		err := c.dialer.conn.Close()
+		removeUnixSocket(c.dialer.conn.LocalAddr().String())
+		return err
+	} else if c.listener != nil {
+		c.listener.wg.Stop()
+		c.listener.wg.Wait()
+		c.listener.sonny.Range(func(key, value interface{}) bool {
+			u := value.(*UnixgramConn)
+			u.Close()
+			return true
+		})
+	} else if c.listenersonny != nil {
+		c.listenersonny.recvch.Close()
+		c.listenersonny.isclose = true
+	}
+	return nil
+}
+
+func (c *UnixgramConn) Info() string {
+	c.checkConfig()
+
+	if c.info != "" {
+		return c.info
+	}
+	if c.dialer != nil {
+		c.info = c.dialer.conn.LocalAddr().String() + "<--unixgram-->" + c.dialer.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = "unixgram--" + c.listener.listenerconn.LocalAddr().String()
+	} else if c.listenersonny != nil {
+		c.info = c.listenersonny.fatherconn.LocalAddr().String() + "<--unixgram-->" + c.listenersonny.dstaddr.String()
+	} else {
+		c.info = "empty unixgram conn"
+	}
+	return c.info
+}
+
+func (c *UnixgramConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *UnixgramConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.RemoteAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.dstaddr
+	}
+	return nil
+}
+
+func (c *UnixgramConn) SetDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	} else if c.listenersonny != nil {
+		c.deadline.setDeadline(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixgramConn) SetReadDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	} else if c.listenersonny != nil {
+		c.deadline.setReadDeadline(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixgramConn) SetWriteDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	} else if c.listenersonny != nil {
+		c.deadline.setWriteDeadline(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixgramConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *UnixgramConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// the listener replies to the address we bind, an unbound unixgram socket can not receive
+	dir := c.config.TempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	laddr := &net.UnixAddr{Name: filepath.Join(dir, "unixgram-"+common.UniqueId()[0:16]+".sock"), Net: "unixgram"}
+	raddr := &net.UnixAddr{Name: dst, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		removeUnixSocket(laddr.Name)
+		return nil, err
+	}
+	dialer := &unixgramConnDialer{conn: conn}
+	return &UnixgramConn{config: c.config, dialer: dialer}, nil
+}
+
+func (c *UnixgramConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *UnixgramConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	err := prepareUnixSocket("unixgram", dst, c.config.RemoveStale)
+	if err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "unixgram", dst)
+	if err != nil {
+		return nil, err
+	}
+	listenerconn := conn.(*net.UnixConn)
+	err = chmodUnixSocket(dst, c.config.FileMode)
+	if err != nil {
+		listenerconn.Close()
+		removeUnixSocket(dst)
+		return nil, err
+	}
+
+	ch := common.NewChannel(c.config.AcceptChanLen)
+
+	wg := group.NewGroup("UnixgramConn Listen"+" "+dst, nil, func() {
+		listenerconn.Close()
+		removeUnixSocket(dst)
+		ch.Close()
+	})
+
+	listener := &unixgramConnListener{
+		listenerconn: listenerconn,
+		wg:           wg,
+		accept:       ch,
+	}
+
+	u := &UnixgramConn{config: c.config, listener: listener}
+	wg.Go("UnixgramConn Listen loopRecv"+" "+dst, func() error {
+		return u.loopRecv()
+	})
+
+	return u, nil
+}
+
+func (c *UnixgramConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *UnixgramConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil || c.listener.wg == nil {
+		return nil, errors.New("not listen")
+	}
+	for !c.listener.wg.IsExit() {
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s == nil {
+			break
+		}
+		sonny := s.(*UnixgramConn)
+		_, ok := c.listener.sonny.Load(sonny.listenersonny.dstaddr.String())
+		if !ok {
+			continue
+		}
+		if sonny.listenersonny.isclose {
+			continue
+		}
+		return sonny, nil
+	}
+	return nil, errors.New("listener close")
+}
+
+func (c *UnixgramConn) loopRecv() error {
+	c.checkConfig()
+
+	buf := make([]byte, c.config.MaxPacketSize)
+	for !c.listener.wg.IsExit() {
+		n, srcaddr, err := c.listener.listenerconn.ReadFromUnix(buf)
+		if err != nil {
+			return err
+		}
+
+		// unbound senders can not be replied
+		if srcaddr == nil || srcaddr.Name == "" {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[0:n])
+		srcaddrstr := srcaddr.String()
+
+		v, ok := c.listener.sonny.Load(srcaddrstr)
+		if !ok {
+			sonny := &unixgramConnListenerSonny{
+				dstaddr:    srcaddr,
+				fatherconn: c.listener.listenerconn,
+				recvch:     common.NewChannel(c.config.RecvChanLen),
+			}
+
+			u := &UnixgramConn{config: c.config, listenersonny: sonny}
+			if !u.listenersonny.recvch.WriteTimeout(data, c.config.RecvChanPushTimeout) {
+				loggo.Debug("unixgram conn %s push %d data to %s recv channel timeout", c.Info(), len(data), u.Info())
+			}
+			c.listener.sonny.Store(srcaddrstr, u)
+
+			c.listener.accept.Write(u)
+		} else {
+			u := v.(*UnixgramConn)
+			if !u.listenersonny.recvch.WriteTimeout(data, c.config.RecvChanPushTimeout) {
+				loggo.Debug("unixgram conn %s push %d data to %s recv channel timeout", c.Info(), len(data), u.Info())
+			}
+		}
+
+		c.listener.sonny.Range(func(key, value interface{}) bool {
+			u := value.(*UnixgramConn)
+			if u.listenersonny.isclose {
+				c.listener.sonny.Delete(key)
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+func (c *UnixgramConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultUnixgramConfig()
+	}
+}
+
+func (c *UnixgramConn) SetConfig(config *UnixgramConfig) {
+	c.config = config
+}
+
+func (c *UnixgramConn) GetConfig() *UnixgramConfig {
+	c.checkConfig()
+	return c.config
+}
+
+func removeUnixSocket(path string) {
+	if path == "" || isAbstractUnix(path) {
+		return
+	}
+	os.Remove(path)
+}
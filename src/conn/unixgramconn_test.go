@@ -0,0 +1,118 @@
+package conn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test0001UNIXGRAM(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "unixgramconn")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+
+	c, err := NewConn("unixgram")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c.(*UnixgramConn).GetConfig().TempDir = dir
+
+	cc, err := c.Listen(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	fi, _ := os.Stat(path)
+	if fi.Mode().Perm() != 0600 {
+		t.Error("default file mode should be owner only", fi.Mode())
+	}
+
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Println("accept done " + sonny.Info())
+			go func() {
+				buf := make([]byte, 100)
+				for {
+					n, err := sonny.Read(buf)
+					if err != nil {
+						return
+					}
+					sonny.Write(buf[0:n])
+				}
+			}()
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		ccc, err := c.Dial(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Println("dial done " + ccc.Info())
+
+		for j := 0; j < 10; j++ {
+			src := "hello unixgram " + strconv.Itoa(i) + " " + strconv.Itoa(j)
+			ccc.Write([]byte(src))
+			ccc.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 100)
+			n, err := ccc.Read(buf)
+			if err != nil || string(buf[0:n]) != src {
+				t.Error("echo fail", err)
+			}
+		}
+
+		local := ccc.LocalAddr().String()
+		ccc.Close()
+		_, err = os.Stat(local)
+		if !os.IsNotExist(err) {
+			t.Error("dialer socket file should be removed on close", err)
+		}
+	}
+}
+
+func Test0002UNIXGRAM(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "unixgramconn")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stale.sock")
+
+	// leave a stale socket file like a crashed process
+	l, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	l.Close()
+
+	c, _ := NewConn("unixgram")
+	cc, err := c.Listen(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = c.Listen(path)
+	fmt.Println(err)
+	if err == nil {
+		t.Error("listen a live socket should fail")
+	}
+
+	cc.Close()
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Error("socket file should be removed on close", err)
+	}
+}
@@ -0,0 +1,645 @@
+package conn
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/group"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	Register("ws", func() Conn {
+		return &WsConn{}
+	}, true)
+}
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+type WsConfig struct {
+	Path               string            // ws路径
+	Host               string            // 握手时的Host头，为空时取dst
+	Headers            map[string]string // 握手时额外的http头
+	MaxFrameSize       int
+	PingInterMs        int
+	PingTimeoutMs      int
+	HandshakeTimeoutMs int
+	AcceptChanLen      int
+}
+
+func DefaultWsConfig() *WsConfig {
+	return &WsConfig{
+		Path:               "/",
+		MaxFrameSize:       1024 * 64,
+		PingInterMs:        10000,
+		PingTimeoutMs:      30000,
+		HandshakeTimeoutMs: 10000,
+		AcceptChanLen:      128,
+	}
+}
+
+type WsConn struct {
+	info      string
+	config    *WsConfig
+	conn      net.Conn
+	br        *bufio.Reader
+	client    bool
+	wg        *group.Group
+	listener  *wsConnListener
+	cancel    context.CancelFunc
+	isclose   bool
+	closelock sync.Mutex
+	readlock  sync.Mutex
+	writelock sync.Mutex
+
+	readleft     int64
+	readmasked   bool
+	readmask     [4]byte
+	readmaskpos  int
+	reading      int32
+	lastRecvTime int64
+}
+
+type wsConnListener struct {
+	listenerconn net.Listener
+	server       *http.Server
+	wg           *group.Group
+	accept       *common.Channel
+}
+
+func (c *WsConn) Name() string {
+	return "ws"
+}
+
+func (c *WsConn) Read(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	} else if c.conn == nil {
+		return 0, errors.New("empty conn")
+	}
+
+	c.readlock.Lock()
+	defer c.readlock.Unlock()
+
+	for c.readleft <= 0 {
+		atomic.StoreInt32(&c.reading, 1)
+		opcode, size, err := c.readFrameHeader()
+		atomic.StoreInt32(&c.reading, 0)
+		if err != nil {
+			return 0, err
+		}
+		atomic.StoreInt64(&c.lastRecvTime, time.Now().UnixNano())
+
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.readleft = size
+		case wsOpPing, wsOpPong, wsOpClose:
+			if size > 125 {
+				return 0, errors.New("ws control frame too big")
+			}
+			payload := make([]byte, size)
+			_, err := io.ReadFull(c.br, payload)
+			if err != nil {
+				return 0, err
+			}
+			c.unmask(payload)
+			if opcode == wsOpPing {
+				c.writeFrame(wsOpPong, payload)
+			} else if opcode == wsOpClose {
+				if len(payload) > 2 {
+					payload = payload[0:2]
+				}
+				c.writeFrame(wsOpClose, payload)
+				return 0, io.EOF
+			}
+		default:
+			return 0, errors.New("ws unknown opcode")
+		}
+	}
+
+	size := len(p)
+	if int64(size) > c.readleft {
+		size = int(c.readleft)
+	}
+	n, err = c.br.Read(p[0:size])
+	c.unmask(p[0:n])
+	c.readleft -= int64(n)
+	return n, err
+}
+
+func (c *WsConn) Write(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	} else if c.conn == nil {
+		return 0, errors.New("empty conn")
+	}
+
+	if c.isclose {
+		return 0, errors.New("write closed conn")
+	}
+
+	totalsize := len(p)
+	cur := 0
+	for cur < totalsize {
+		size := common.MinOfInt(totalsize-cur, c.config.MaxFrameSize)
+		err := c.writeFrame(wsOpBinary, p[cur:cur+size])
+		if err != nil {
+			return cur, err
+		}
+		cur += size
+	}
+	return totalsize, nil
+}
+
+func (c *WsConn) Close() error {
+	c.checkConfig()
+
+	if c.isclose {
+		return nil
+	}
+
+	c.closelock.Lock()
+	defer c.closelock.Unlock()
+
+	if c.isclose {
+		return nil
+	}
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.conn != nil {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsOpClose, []byte{0x03, 0xe8})
+		c.wg.Stop()
+		c.wg.Wait()
+	} else if c.listener != nil {
+		c.listener.wg.Stop()
+		c.listener.wg.Wait()
+	}
+	c.isclose = true
+
+	return nil
+}
+
+func (c *WsConn) Info() string {
+	c.checkConfig()
+
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		c.info = c.conn.LocalAddr().String() + "<--ws-->" + c.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = "ws--" + c.listener.listenerconn.Addr().String()
+	} else {
+		c.info = "empty ws conn"
+	}
+	return c.info
+}
+
+func (c *WsConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.Addr()
+	}
+	return nil
+}
+
+func (c *WsConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *WsConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *WsConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *WsConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errors.New("listener can not set deadline")
+	}
+	return errors.New("empty conn")
+}
+
+func (c *WsConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *WsConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	u, err := wsParseUrl(dst, c.config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(c.config.HandshakeTimeoutMs))
+	defer cancel()
+	c.cancel = cancel
+	var d net.Dialer
+	if gControlOnConnSetup != nil {
+		d = net.Dialer{Control: gControlOnConnSetup}
+	}
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	c.cancel = nil
+
+	stop := watchContext(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	br, err := c.handshake(conn, u)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newWsConn(c.config, conn, br, true, nil), nil
+}
+
+func (c *WsConn) handshake(conn net.Conn, u *url.URL) (*bufio.Reader, error) {
+	keyb := make([]byte, 16)
+	rand.Read(keyb)
+	key := base64.StdEncoding.EncodeToString(keyb)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if c.config.Host != "" {
+		req.Host = c.config.Host
+	}
+	for k, v := range c.config.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("ws handshake fail " + resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("ws handshake bad accept key")
+	}
+	return br, nil
+}
+
+func (c *WsConn) Listen(dst string) (Conn, error) {
+	return c.ListenContext(context.Background(), dst)
+}
+
+func (c *WsConn) ListenContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	addr, err := net.ResolveTCPAddr("tcp", dst)
+	if err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	listenerconn, err := lc.Listen(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	ch := common.NewChannel(c.config.AcceptChanLen)
+
+	server := &http.Server{
+		ReadHeaderTimeout: time.Millisecond * time.Duration(c.config.HandshakeTimeoutMs),
+	}
+
+	wg := group.NewGroup("WsConn Listen"+" "+dst, nil, func() {
+		server.Close()
+		ch.Close()
+	})
+
+	listener := &wsConnListener{
+		listenerconn: listenerconn,
+		server:       server,
+		wg:           wg,
+		accept:       ch,
+	}
+
+	u := &WsConn{config: c.config, listener: listener}
+	server.Handler = u
+	wg.Go("WsConn Listen loopRecv"+" "+dst, func() error {
+		server.Serve(listenerconn)
+		return nil
+	})
+
+	return u, nil
+}
+
+func (c *WsConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *WsConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil || c.listener.wg == nil {
+		return nil, errors.New("not listen")
+	}
+	for !c.listener.wg.IsExit() {
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s == nil {
+			break
+		}
+		sonny := s.(*WsConn)
+		if sonny.isclose || sonny.wg.IsExit() {
+			continue
+		}
+		return sonny, nil
+	}
+	return nil, errors.New("listener close")
+}
+
+func (c *WsConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != c.config.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "not websocket", http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "bad websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "no websocket key", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can not hijack", http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		//loggo.Error("Hijack fail %s", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\n")
+	brw.WriteString("Connection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n")
+	err = brw.Flush()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	u := newWsConn(c.config, conn, brw.Reader, false, c.listener.wg)
+	c.listener.accept.Write(u)
+}
+
+func newWsConn(config *WsConfig, conn net.Conn, br *bufio.Reader, client bool, father *group.Group) *WsConn {
+	u := &WsConn{config: config, conn: conn, br: br, client: client, lastRecvTime: time.Now().UnixNano()}
+
+	u.wg = group.NewGroup("WsConn"+" "+u.Info(), father, func() {
+		conn.Close()
+	})
+
+	u.wg.Go("WsConn keepalive"+" "+u.Info(), func() error {
+		return u.keepalive()
+	})
+
+	return u
+}
+
+func (c *WsConn) keepalive() error {
+	lastPing := time.Now()
+	for !c.wg.IsExit() {
+		now := time.Now()
+
+		if c.config.PingInterMs > 0 && now.Sub(lastPing) > time.Millisecond*time.Duration(c.config.PingInterMs) {
+			lastPing = now
+			err := c.writeFrame(wsOpPing, []byte{})
+			if err != nil {
+				return err
+			}
+		}
+
+		// only check timeout when someone is waiting for data
+		if c.config.PingTimeoutMs > 0 && atomic.LoadInt32(&c.reading) != 0 {
+			last := time.Unix(0, atomic.LoadInt64(&c.lastRecvTime))
+			if now.Sub(last) > time.Millisecond*time.Duration(c.config.PingTimeoutMs) {
+				return errors.New("ping timeout")
+			}
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+	return nil
+}
+
+func (c *WsConn) readFrameHeader() (int, int64, error) {
+	var head [2]byte
+	_, err := io.ReadFull(c.br, head[:])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	opcode := int(head[0] & 0x0f)
+	c.readmasked = head[1]&0x80 != 0
+	size := int64(head[1] & 0x7f)
+
+	switch size {
+	case 126:
+		var ext [2]byte
+		_, err := io.ReadFull(c.br, ext[:])
+		if err != nil {
+			return 0, 0, err
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err := io.ReadFull(c.br, ext[:])
+		if err != nil {
+			return 0, 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+		if size < 0 {
+			return 0, 0, errors.New("ws frame too big")
+		}
+	}
+
+	if c.readmasked {
+		_, err := io.ReadFull(c.br, c.readmask[:])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	c.readmaskpos = 0
+
+	return opcode, size, nil
+}
+
+func (c *WsConn) unmask(p []byte) {
+	if !c.readmasked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.readmask[c.readmaskpos&3]
+		c.readmaskpos++
+	}
+}
+
+func (c *WsConn) writeFrame(opcode int, data []byte) error {
+	c.writelock.Lock()
+	defer c.writelock.Unlock()
+
+	buf := make([]byte, 0, 14+len(data))
+	buf = append(buf, 0x80|byte(opcode))
+
+	var maskbit byte
+	if c.client {
+		maskbit = 0x80
+	}
+
+	size := len(data)
+	if size < 126 {
+		buf = append(buf, maskbit|byte(size))
+	} else if size <= 0xffff {
+		buf = append(buf, maskbit|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(size))
+	} else {
+		buf = append(buf, maskbit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(size))
+	}
+
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, data...)
+		for i := start; i < len(buf); i++ {
+			buf[i] ^= mask[(i-start)&3]
+		}
+	} else {
+		buf = append(buf, data...)
+	}
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func wsParseUrl(dst string, path string) (*url.URL, error) {
+	if !strings.HasPrefix(dst, "ws://") {
+		dst = "ws://" + dst
+	}
+	u, err := url.Parse(dst)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = path
+	}
+	return u, nil
+}
+
+func (c *WsConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultWsConfig()
+	}
+}
+
+func (c *WsConn) SetConfig(config *WsConfig) {
+	c.config = config
+}
+
+func (c *WsConn) GetConfig() *WsConfig {
+	c.checkConfig()
+	return c.config
+}
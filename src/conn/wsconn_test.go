@@ -0,0 +1,607 @@
+package conn
+
+import (
+	"fmt"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test000WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		cc.Accept()
+		fmt.Println("accept done")
+	}()
+
+	time.Sleep(time.Second)
+
+	cc.Close()
+
+	time.Sleep(time.Second)
+}
+
+func Test0002WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		conn, err := c.Dial("9.9.9.9:58089")
+		fmt.Println("Dial return")
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(conn.Info())
+		}
+
+	}()
+
+	time.Sleep(time.Second)
+
+	c.Close()
+	fmt.Println("closed")
+
+	time.Sleep(time.Second)
+}
+
+func Test0003WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		cc.Accept()
+		fmt.Println("accept done")
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		buf := make([]byte, 100)
+		_, err := ccc.Read(buf)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}()
+
+	time.Sleep(time.Second * 5)
+	fmt.Println("start close listener")
+	cc.Close()
+	fmt.Println("close listener ok")
+	fmt.Println("start close client")
+	ccc.Close()
+	fmt.Println("close client ok")
+
+	time.Sleep(time.Second)
+}
+
+func Test0004WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		cc.Accept()
+		fmt.Println("accept done")
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		buf := make([]byte, 1000)
+		for i := 0; i < 10000; i++ {
+			_, err := ccc.Write(buf)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		fmt.Println("write done")
+	}()
+
+	time.Sleep(time.Second)
+
+	cc.Close()
+	ccc.Close()
+
+	time.Sleep(time.Second)
+}
+
+func Test0005WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	exit := false
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer cc.Close()
+		fmt.Println("accept done")
+		buf := make([]byte, 10)
+		for !exit {
+			n, err := cc.Read(buf)
+			if err != nil {
+				fmt.Println(err)
+				fmt.Println("Read done")
+				return
+			}
+			fmt.Println(string(buf[0:n]))
+			time.Sleep(time.Millisecond * 100)
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		for i := 0; i < 10000 && !exit; i++ {
+			_, err := ccc.Write([]byte("hahaha" + strconv.Itoa(i)))
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		fmt.Println("write done")
+	}()
+
+	time.Sleep(time.Second * 10)
+
+	cc.Close()
+	ccc.Close()
+
+	exit = true
+
+	time.Sleep(time.Second)
+}
+
+func Test0005WS1(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	exit := false
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done")
+		for i := 0; i < 10000 && !exit; i++ {
+			_, err := cc.Write([]byte("hahaha" + strconv.Itoa(i)))
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		fmt.Println("write done")
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		buf := make([]byte, 10)
+		for !exit {
+			n, err := ccc.Read(buf)
+			if err != nil {
+				fmt.Println(err)
+				fmt.Println("Read done")
+				return
+			}
+			fmt.Println(string(buf[0:n]))
+			time.Sleep(time.Millisecond * 100)
+		}
+		fmt.Println("write done")
+	}()
+
+	time.Sleep(time.Second * 10)
+
+	cc.Close()
+	ccc.Close()
+
+	exit = true
+
+	time.Sleep(time.Second)
+}
+
+func Test0006WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer cc.Close()
+		fmt.Println("accept done")
+		buf := make([]byte, 10)
+		_, err = cc.Read(buf)
+		if err != nil {
+			fmt.Println("Read " + err.Error())
+			return
+		}
+		fmt.Println("Read done")
+
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		time.Sleep(time.Second)
+		ccc.Close()
+		fmt.Println("client close")
+	}()
+
+	time.Sleep(time.Second * 20)
+
+	fmt.Println("start close")
+	cc.Close()
+	ccc.Close()
+
+	time.Sleep(time.Second)
+}
+
+func Test0007WS(t *testing.T) {
+
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer cc.Close()
+		fmt.Println("accept done")
+		buf := make([]byte, 10)
+		_, err = cc.Read(buf)
+		if err != nil {
+			fmt.Println("Read " + err.Error())
+			return
+		}
+		fmt.Println("Read done")
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	time.Sleep(time.Second * 5)
+
+	fmt.Println("start close")
+	cc.Close()
+	ccc.Close()
+
+	time.Sleep(time.Second)
+}
+
+func Test0008WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	exit := false
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done")
+		data := make([]byte, 1024*1024)
+		start := time.Now()
+		speed := 0
+		for !exit {
+			//fmt.Println("start Write")
+			_, err := cc.Write(data)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			//fmt.Println("end Write")
+			speed += len(data)
+			if time.Now().Sub(start) > time.Second {
+				speed = speed / 1024 / 1024
+				loggo.Info("write speed %v MB per second", float64(speed)/float64(time.Now().Sub(start)/time.Second))
+				speed = 0
+				start = time.Now()
+			}
+		}
+		fmt.Println("write done")
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		fmt.Println("start client")
+		buf := make([]byte, 1024*1024)
+		start := time.Now()
+		speed := 0
+		for !exit {
+			//fmt.Println("start Read")
+			n, err := ccc.Read(buf)
+			//fmt.Println("start Read")
+			if err != nil {
+				fmt.Println(err)
+				fmt.Println("Read done")
+				return
+			}
+			speed += n
+			if time.Now().Sub(start) > time.Second {
+				speed = speed / 1024 / 1024
+				loggo.Info("read speed %v MB per second", float64(speed)/float64(time.Now().Sub(start)/time.Second))
+				speed = 0
+				start = time.Now()
+			}
+		}
+		fmt.Println("write done")
+	}()
+
+	time.Sleep(time.Second * 10)
+
+	cc.Close()
+	ccc.Close()
+
+	exit = true
+
+	time.Sleep(time.Second)
+}
+
+func Test0009WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	exit := false
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done")
+		data := make([]byte, 1024*1024)
+		start := time.Now()
+		speed := 0
+		for !exit {
+			//fmt.Println("start Read")
+			n, err := cc.Read(data)
+			//fmt.Println("start Read")
+			if err != nil {
+				fmt.Println(err)
+				fmt.Println("Read done")
+				return
+			}
+			speed += n
+			if time.Now().Sub(start) > time.Second {
+				speed = speed / 1024 / 1024
+				loggo.Info("read speed %v MB per second", float64(speed)/float64(time.Now().Sub(start)/time.Second))
+				speed = 0
+				start = time.Now()
+			}
+		}
+		fmt.Println("write done")
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	go func() {
+		fmt.Println("start client")
+		buf := make([]byte, 1024*1024)
+		start := time.Now()
+		speed := 0
+		for !exit {
+			//fmt.Println("start Write")
+			_, err := ccc.Write(buf)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			//fmt.Println("end Write")
+			speed += len(buf)
+			if time.Now().Sub(start) > time.Second {
+				speed = speed / 1024 / 1024
+				loggo.Info("write speed %v MB per second", float64(speed)/float64(time.Now().Sub(start)/time.Second))
+				speed = 0
+				start = time.Now()
+			}
+		}
+		fmt.Println("write done")
+	}()
+
+	time.Sleep(time.Second * 10)
+
+	cc.Close()
+	ccc.Close()
+
+	exit = true
+
+	time.Sleep(time.Second)
+}
+
+func Test0010WS(t *testing.T) {
+	c, err := NewConn("ws")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	c.(*WsConn).GetConfig().Path = "/tunnel"
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer cc.Close()
+
+	go func() {
+		cc, err := cc.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("accept done " + cc.Info())
+		buf := make([]byte, 100)
+		n, err := cc.Read(buf)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cc.Write(buf[0:n])
+	}()
+
+	// ws behind a http reverse proxy
+	target, _ := url.Parse("http://127.0.0.1:58089")
+	proxy := &http.Server{Addr: ":58090", Handler: httputil.NewSingleHostReverseProxy(target)}
+	go proxy.ListenAndServe()
+	defer proxy.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	d, _ := NewConn("ws")
+	_, err = d.Dial("127.0.0.1:58090")
+	fmt.Println("wrong path", err)
+	if err == nil {
+		t.Error("wrong path should fail")
+	}
+
+	d.(*WsConn).GetConfig().Headers = map[string]string{"X-Tunnel": "go-engine"}
+	ccc, err := d.Dial("ws://127.0.0.1:58090/tunnel")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ccc.Close()
+	fmt.Println("dial done " + ccc.Info())
+
+	ccc.Write([]byte("hello ws"))
+	buf := make([]byte, 100)
+	n, err := ccc.Read(buf)
+	if err != nil || string(buf[0:n]) != "hello ws" {
+		t.Error("echo fail", err)
+	}
+}
@@ -0,0 +1,347 @@
+package frame
+
+import (
+	"encoding/binary"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/reedsolomon"
+	"sync/atomic"
+	"time"
+)
+
+// a shard is len(2) | marshalled FrameData, zero padded to the longest one in the group
+const fecShardHeadLen = 2
+
+type fecData struct {
+	shard []byte
+	time  int64
+}
+
+// fecParity is a parity frame the congestion window had no room for yet
+type fecParity struct {
+	f    *Frame
+	time int64
+}
+
+type fecGroup struct {
+	ids    []int32
+	parity [][]byte
+	time   int64
+	done   bool
+}
+
+// SetFec must be called before Connect, data and parity are the most the local side wants, 0 turns it off
+func (fm *FrameMgr) SetFec(data int, parity int) {
+	if data <= 0 || parity <= 0 || data+parity > 256 {
+		data, parity = 0, 0
+	}
+	fm.fecdata = data
+	fm.fecparity = parity
+}
+
+// pickFec keeps the smaller group of both sides, FEC is off when one of them does not support it
+func (fm *FrameMgr) pickFec(data int32, parity int32) (int, int) {
+	if fm.fecdata <= 0 || data <= 0 || parity <= 0 {
+		return 0, 0
+	}
+	return common.MinOfInt(fm.fecdata, int(data)), common.MinOfInt(fm.fecparity, int(parity))
+}
+
+func (fm *FrameMgr) fecEncoder(data int, parity int) reedsolomon.Encoder {
+	key := data<<16 | parity
+	enc, ok := fm.fecenc[key]
+	if !ok {
+		var err error
+		enc, err = reedsolomon.New(data, parity)
+		if err != nil {
+			loggo.Error("reedsolomon New fail %v %v %v", data, parity, err)
+			return nil
+		}
+		fm.fecenc[key] = enc
+	}
+	return enc
+}
+
+func (fm *FrameMgr) fecShard(fd *FrameData) []byte {
+	b, err := proto.Marshal(fd)
+	if err != nil || len(b) > 0xFFFF {
+		return nil
+	}
+	ret := make([]byte, fecShardHeadLen+len(b))
+	binary.BigEndian.PutUint16(ret, uint16(len(b)))
+	copy(ret[fecShardHeadLen:], b)
+	return ret
+}
+
+// addFecSend groups the data frames sent for the first time, resends are not protected
+func (fm *FrameMgr) addFecSend(f *Frame, cur int64) {
+	if fm.fecN <= 0 || f.Data == nil {
+		return
+	}
+	if len(fm.fecsend) <= 0 {
+		fm.fecsendtime = f.Sendtime
+	}
+	fm.fecsend = append(fm.fecsend, f)
+	if len(fm.fecsend) >= fm.fecN {
+		fm.flushFec(cur)
+	}
+}
+
+// flushShortFec sends a group that is not full only when nothing more is coming to fill it or it waited half a resend,
+// so the tail is protected without paying the parity of a short group on every Update
+func (fm *FrameMgr) flushShortFec(cur int64, idle bool) {
+	if len(fm.fecsend) <= 0 {
+		return
+	}
+	if idle || cur-fm.fecsendtime > int64(fm.resend_timems)*int64(time.Millisecond)/2 {
+		fm.flushFec(cur)
+	}
+}
+
+// flushFec makes the parity frames of the pending group and sends what the congestion window has room for
+func (fm *FrameMgr) flushFec(cur int64) {
+	if len(fm.fecsend) <= 0 {
+		return
+	}
+	group := fm.fecsend
+	fm.fecsend = nil
+
+	data := len(group)
+	enc := fm.fecEncoder(data, fm.fecM)
+	if enc == nil {
+		return
+	}
+
+	ids := make([]int32, data)
+	shards := make([][]byte, data+fm.fecM)
+	size := 0
+	for i, f := range group {
+		ids[i] = f.Id
+		shards[i] = fm.fecShard(f.Data)
+		if shards[i] == nil {
+			return
+		}
+		if len(shards[i]) > size {
+			size = len(shards[i])
+		}
+	}
+	for i := range shards {
+		if i >= data {
+			shards[i] = make([]byte, size)
+		} else if len(shards[i]) < size {
+			shards[i] = append(shards[i], make([]byte, size-len(shards[i]))...)
+		}
+	}
+
+	err := enc.Encode(shards)
+	if err != nil {
+		loggo.Error("fec Encode fail %v", err)
+		return
+	}
+
+	for i := 0; i < fm.fecM; i++ {
+		f := &Frame{Type: (int32)(Frame_FEC), Resend: false, Sendtime: 0,
+			Id:     int32(i),
+			Dataid: ids,
+			Data:   &FrameData{Data: shards[data+i], Fecdata: int32(data), Fecparity: int32(fm.fecM)}}
+		fm.fecparitysend = append(fm.fecparitysend, &fecParity{f: f, time: cur})
+	}
+	//loggo.Debug("debugid %v send fec %v %v %v", fm.debugid, common.Int32ArrayToString(ids, ","), fm.fecM, size)
+
+	fm.sendFecParity(cur)
+}
+
+// sendFecParity sends the queued parity frames in order, they count against the congestion window like the data
+// under the id of the first frame of their group, what is refused waits for the next tick,
+// a parity frame that waited a resend is dropped, its group is being resent anyway
+func (fm *FrameMgr) sendFecParity(cur int64) {
+	n := 0
+	for _, p := range fm.fecparitysend {
+		if cur-p.time > int64(fm.resend_timems)*int64(time.Millisecond) {
+			atomic.AddInt64(&fm.fecDropNum, 1)
+			if fm.openstat > 0 {
+				fm.fs.fecDropNum++
+			}
+			n++
+			continue
+		}
+		if fm.ct != nil && !fm.ct.CanSend(int(p.f.Dataid[0]), len(p.f.Data.Data)) {
+			break
+		}
+		fm.sendFrame(p.f)
+		if fm.openstat > 0 {
+			fm.fs.sendFecNum++
+		}
+		n++
+	}
+	fm.fecparitysend = fm.fecparitysend[n:]
+	if len(fm.fecparitysend) <= 0 {
+		fm.fecparitysend = nil
+	}
+}
+
+// addFecData keeps what a group may need to rebuild its lost frames, recvlock is held
+func (fm *FrameMgr) addFecData(f *Frame, cur int64) {
+	if fm.fecN <= 0 || f.Data == nil {
+		return
+	}
+	if _, ok := fm.fecrecv[f.Id]; ok {
+		return
+	}
+	shard := fm.fecShard(f.Data)
+	if shard == nil {
+		return
+	}
+	fm.fecrecv[f.Id] = &fecData{shard: shard, time: cur}
+	if gid, ok := fm.fecidgroup[f.Id]; ok {
+		fm.fecdirty[gid] = true
+	}
+}
+
+// addFecParity is called with recvlock held
+func (fm *FrameMgr) addFecParity(f *Frame, cur int64) {
+	if fm.openstat > 0 {
+		fm.fs.recvFecNum++
+	}
+	if fm.fecN <= 0 || f.Data == nil || len(f.Dataid) <= 0 {
+		return
+	}
+	data := len(f.Dataid)
+	parity := int(f.Data.Fecparity)
+	if int(f.Data.Fecdata) != data || parity <= 0 || data+parity > 256 || f.Id < 0 || int(f.Id) >= parity {
+		loggo.Error("recv fec frame error %v %v %v %v", f.Id, data, f.Data.Fecdata, parity)
+		return
+	}
+
+	gid := f.Dataid[0]
+	g, ok := fm.fecgroups[gid]
+	if !ok {
+		g = &fecGroup{ids: f.Dataid, parity: make([][]byte, parity), time: cur}
+		fm.fecgroups[gid] = g
+		for _, id := range f.Dataid {
+			fm.fecidgroup[id] = gid
+		}
+	}
+	if len(g.parity) != parity || len(g.ids) != data {
+		return
+	}
+	g.parity[f.Id] = f.Data.Data
+	fm.fecdirty[gid] = true
+}
+
+// recoverFec rebuilds the lost frames of the groups that got a new shard, they are handled as if they were received
+func (fm *FrameMgr) recoverFec(tmpackto map[int32]*Frame, cur int64) {
+	for gid := range fm.fecdirty {
+		delete(fm.fecdirty, gid)
+		g, ok := fm.fecgroups[gid]
+		if !ok || g.done {
+			continue
+		}
+
+		data := len(g.ids)
+		have := 0
+		for _, id := range g.ids {
+			if _, ok := fm.fecrecv[id]; ok {
+				have++
+			}
+		}
+		if have >= data {
+			g.done = true
+			continue
+		}
+		size := 0
+		for _, p := range g.parity {
+			if p != nil {
+				have++
+				size = len(p)
+			}
+		}
+		if have < data {
+			continue
+		}
+
+		shards := make([][]byte, data+len(g.parity))
+		bad := false
+		for i, id := range g.ids {
+			if d, ok := fm.fecrecv[id]; ok {
+				if len(d.shard) > size {
+					bad = true
+					break
+				}
+				shards[i] = make([]byte, size)
+				copy(shards[i], d.shard)
+			}
+		}
+		for i, p := range g.parity {
+			if p != nil && len(p) == size {
+				shards[data+i] = p
+			}
+		}
+		g.done = true
+		if bad {
+			continue
+		}
+
+		enc := fm.fecEncoder(data, len(g.parity))
+		if enc == nil {
+			continue
+		}
+		err := enc.ReconstructData(shards)
+		if err != nil {
+			loggo.Error("fec ReconstructData fail %v", err)
+			continue
+		}
+
+		for i, id := range g.ids {
+			if _, ok := fm.fecrecv[id]; ok {
+				continue
+			}
+			shard := shards[i]
+			n := int(binary.BigEndian.Uint16(shard))
+			if n > len(shard)-fecShardHeadLen {
+				continue
+			}
+			fd := &FrameData{}
+			err := proto.Unmarshal(shard[fecShardHeadLen:fecShardHeadLen+n], fd)
+			if err != nil {
+				loggo.Error("fec Unmarshal fail %v %v", id, err)
+				continue
+			}
+			fm.fecrecv[id] = &fecData{shard: shard[0 : fecShardHeadLen+n], time: cur}
+			if _, ok := tmpackto[id]; !ok {
+				tmpackto[id] = &Frame{Type: (int32)(Frame_DATA), Id: id, Data: fd}
+			}
+			atomic.AddInt64(&fm.fecRecoverNum, 1)
+			if fm.openstat > 0 {
+				fm.fs.fecRecoverNum++
+			}
+			//loggo.Debug("debugid %v fec recover frame %v %v", fm.debugid, id, n)
+		}
+	}
+}
+
+// cleanFec drops what is too old to beat a resend anyway
+func (fm *FrameMgr) cleanFec(cur int64) {
+	if fm.fecN <= 0 || cur-fm.lastFecClean < int64(fm.resend_timems)*int64(time.Millisecond) {
+		return
+	}
+	fm.lastFecClean = cur
+
+	timeout := int64(fm.resend_timems)*int64(time.Millisecond)*2 + atomic.LoadInt64(&fm.rttns)
+	for id, d := range fm.fecrecv {
+		if cur-d.time > timeout {
+			delete(fm.fecrecv, id)
+		}
+	}
+	for gid, g := range fm.fecgroups {
+		if cur-g.time > timeout {
+			for _, id := range g.ids {
+				if fm.fecidgroup[id] == gid {
+					delete(fm.fecidgroup, id)
+				}
+			}
+			delete(fm.fecgroups, gid)
+		}
+	}
+}
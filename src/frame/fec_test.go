@@ -0,0 +1,268 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func testFecPump(t *testing.T, from *FrameMgr, to *FrameMgr, drop func(f *Frame) bool) {
+	l := from.GetSendList()
+	for e := l.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*Frame)
+		if drop != nil && drop(f) {
+			continue
+		}
+		mb, err := from.MarshalFrame(f)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rf := &Frame{}
+		err = proto.Unmarshal(mb, rf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		to.OnRecvFrame(rf)
+	}
+}
+
+func Test0001FEC(t *testing.T) {
+	a := NewFrameMgr(100, 100000, 1024*1024, 1000, 5000, 0, 0)
+	a.SetFec(4, 2)
+	b := NewFrameMgr(100, 100000, 1024*1024, 1000, 5000, 0, 0)
+	b.SetFec(10, 1)
+
+	a.Connect()
+	for !a.IsConnected() {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, nil)
+		testFecPump(t, b, a, nil)
+		time.Sleep(time.Millisecond)
+	}
+
+	data := make([]byte, 20*1024)
+	rand.Read(data)
+	a.WriteSendBuffer(data)
+
+	sent := make(map[int32]bool)
+	dropped := 0
+	drop := func(f *Frame) bool {
+		if f.Type != (int32)(Frame_DATA) || f.Data.Type != (int32)(FrameData_USER_DATA) || sent[f.Id] {
+			return false
+		}
+		sent[f.Id] = true
+		if f.Id%5 == 3 {
+			dropped++
+			return true
+		}
+		return false
+	}
+
+	var recv []byte
+	begin := time.Now()
+	for len(recv) < len(data) && time.Now().Sub(begin) < 3*time.Second {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, drop)
+		testFecPump(t, b, a, nil)
+		if b.GetRecvBufferSize() > 0 {
+			rb := b.GetRecvReadLineBuffer()
+			recv = append(recv, rb...)
+			b.SkipRecvBuffer(len(rb))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	fmt.Println("fec", a.fecN, a.fecM, b.fecN, b.fecM, dropped, a.GetStat().Resend, b.GetStat().Recovered, time.Now().Sub(begin))
+
+	if a.fecN != 4 || a.fecM != 1 || b.fecN != 4 || b.fecM != 1 {
+		t.Error("fec nego fail")
+	}
+	if !bytes.Equal(recv, data) {
+		t.Error("fec data diff")
+	}
+	if b.GetStat().Recovered != int64(dropped) || a.GetStat().Resend != 0 {
+		t.Error("fec recover fail")
+	}
+}
+
+func Test0002FEC(t *testing.T) {
+	a := NewFrameMgr(100, 100000, 1024*1024, 1000, 200, 0, 0)
+	a.SetFec(4, 2)
+	b := NewFrameMgr(100, 100000, 1024*1024, 1000, 200, 0, 0)
+
+	a.Connect()
+
+	data := make([]byte, 4*1024)
+	rand.Read(data)
+	a.WriteSendBuffer(data)
+
+	var recv []byte
+	begin := time.Now()
+	for len(recv) < len(data) && time.Now().Sub(begin) < 3*time.Second {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, nil)
+		testFecPump(t, b, a, nil)
+		if b.GetRecvBufferSize() > 0 {
+			rb := b.GetRecvReadLineBuffer()
+			recv = append(recv, rb...)
+			b.SkipRecvBuffer(len(rb))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if a.fecN != 0 || b.fecN != 0 {
+		t.Error("fec should be off")
+	}
+	if !bytes.Equal(recv, data) {
+		t.Error("fec off data diff")
+	}
+}
+
+type testFecCongestion struct {
+	calls  int
+	size   int
+	ids    []int
+	refuse bool
+}
+
+func (c *testFecCongestion) Init() {
+}
+
+func (c *testFecCongestion) RecvAck(id int, size int) {
+}
+
+func (c *testFecCongestion) CanSend(id int, size int) bool {
+	c.calls++
+	c.size += size
+	c.ids = append(c.ids, id)
+	return !c.refuse
+}
+
+func (c *testFecCongestion) Update() {
+}
+
+func (c *testFecCongestion) Info() string {
+	return ""
+}
+
+func Test0003FEC(t *testing.T) {
+	// the window holds 3 frames, a group of 4 has to wait for acks to fill up
+	a := NewFrameMgr(100, 100000, 1024*1024, 3, 5000, 0, 0)
+	a.SetFec(4, 2)
+	b := NewFrameMgr(100, 100000, 1024*1024, 1000, 5000, 0, 0)
+	b.SetFec(4, 2)
+
+	a.Connect()
+	for !a.IsConnected() {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, nil)
+		testFecPump(t, b, a, nil)
+		time.Sleep(time.Millisecond)
+	}
+	ct := &testFecCongestion{}
+	a.SetCongestion(ct)
+
+	data := make([]byte, 2*1024)
+	rand.Read(data)
+	a.WriteSendBuffer(data)
+
+	groups := make(map[int32]int)
+	datanum := 0
+	count := func(f *Frame) bool {
+		if f.Type == (int32)(Frame_FEC) {
+			if f.Id == 0 {
+				groups[f.Data.Fecdata]++
+			}
+		} else if f.Type == (int32)(Frame_DATA) && f.Data.Type == (int32)(FrameData_USER_DATA) {
+			datanum++
+		}
+		return false
+	}
+
+	var recv []byte
+	begin := time.Now()
+	for len(recv) < len(data) && time.Now().Sub(begin) < 3*time.Second {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, count)
+		testFecPump(t, b, a, nil)
+		if b.GetRecvBufferSize() > 0 {
+			rb := b.GetRecvReadLineBuffer()
+			recv = append(recv, rb...)
+			b.SkipRecvBuffer(len(rb))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		a.Update()
+		testFecPump(t, a, b, count)
+	}
+
+	fmt.Println("fec groups", groups, datanum, ct.calls)
+	if !bytes.Equal(recv, data) {
+		t.Error("fec data diff")
+	}
+	// 21 frames make 5 full groups and the tail of 1 sent once idle
+	if groups[4] != 5 || groups[1] != 1 || len(groups) != 2 {
+		t.Error("fec short group sent before idle", groups)
+	}
+	if ct.calls != datanum+2*6 {
+		t.Error("fec parity not counted by congestion", ct.calls, datanum)
+	}
+}
+
+func Test0004FEC(t *testing.T) {
+	a := NewFrameMgr(100, 100000, 1024*1024, 1000, 400, 0, 0)
+	a.SetFec(2, 2)
+	a.fecN, a.fecM = 2, 2
+	ct := &testFecCongestion{refuse: true}
+	a.SetCongestion(ct)
+
+	countFec := func() int {
+		n := 0
+		for e := a.GetSendList().Front(); e != nil; e = e.Next() {
+			if e.Value.(*Frame).Type == (int32)(Frame_FEC) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// parity is charged to the first frame of its group, not to its own index
+	cur := time.Now().UnixNano()
+	a.addFecSend(&Frame{Type: (int32)(Frame_DATA), Id: 10, Data: &FrameData{Data: []byte("10")}}, cur)
+	a.addFecSend(&Frame{Type: (int32)(Frame_DATA), Id: 11, Data: &FrameData{Data: []byte("11")}}, cur)
+	if len(ct.ids) != 1 || ct.ids[0] != 10 {
+		t.Error("fec parity charged to wrong id", ct.ids)
+	}
+
+	// what the window refuses is sent on a later tick
+	if countFec() != 0 || len(a.fecparitysend) != 2 {
+		t.Error("refused fec parity not queued", len(a.fecparitysend))
+	}
+	ct.refuse = false
+	a.sendFecParity(cur + int64(time.Millisecond))
+	if countFec() != 2 || len(a.fecparitysend) != 0 {
+		t.Error("queued fec parity not sent")
+	}
+
+	// and dropped once its group is being resent anyway
+	ct.refuse = true
+	a.addFecSend(&Frame{Type: (int32)(Frame_DATA), Id: 12, Data: &FrameData{Data: []byte("12")}}, cur)
+	a.addFecSend(&Frame{Type: (int32)(Frame_DATA), Id: 13, Data: &FrameData{Data: []byte("13")}}, cur)
+	ct.refuse = false
+	a.sendFecParity(cur + int64(time.Second))
+	if countFec() != 0 || len(a.fecparitysend) != 0 || a.GetStat().FecDrop != 2 {
+		t.Error("stale fec parity not dropped", a.GetStat().FecDrop)
+	}
+	fmt.Println("fec ct ids", ct.ids)
+}
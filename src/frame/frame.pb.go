@@ -28,6 +28,7 @@ const (
 	FrameData_CONNRSP   FrameData_TYPE = 2
 	FrameData_CLOSE     FrameData_TYPE = 3
 	FrameData_HB        FrameData_TYPE = 4
+	FrameData_DROP      FrameData_TYPE = 5
 )
 
 var FrameData_TYPE_name = map[int32]string{
@@ -36,6 +37,7 @@ var FrameData_TYPE_name = map[int32]string{
 	2: "CONNRSP",
 	3: "CLOSE",
 	4: "HB",
+	5: "DROP",
 }
 
 var FrameData_TYPE_value = map[string]int32{
@@ -44,6 +46,7 @@ var FrameData_TYPE_value = map[string]int32{
 	"CONNRSP":   2,
 	"CLOSE":     3,
 	"HB":        4,
+	"DROP":      5,
 }
 
 func (x FrameData_TYPE) String() string {
@@ -62,6 +65,7 @@ const (
 	Frame_ACK  Frame_TYPE = 2
 	Frame_PING Frame_TYPE = 3
 	Frame_PONG Frame_TYPE = 4
+	Frame_FEC  Frame_TYPE = 5
 )
 
 var Frame_TYPE_name = map[int32]string{
@@ -70,6 +74,7 @@ var Frame_TYPE_name = map[int32]string{
 	2: "ACK",
 	3: "PING",
 	4: "PONG",
+	5: "FEC",
 }
 
 var Frame_TYPE_value = map[string]int32{
@@ -78,6 +83,7 @@ var Frame_TYPE_value = map[string]int32{
 	"ACK":  2,
 	"PING": 3,
 	"PONG": 4,
+	"FEC":  5,
 }
 
 func (x Frame_TYPE) String() string {
@@ -92,6 +98,10 @@ type FrameData struct {
 	Type                 int32    `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
 	Data                 []byte   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
 	Compress             bool     `protobuf:"varint,3,opt,name=compress,proto3" json:"compress,omitempty"`
+	Fecdata              int32    `protobuf:"varint,4,opt,name=fecdata,proto3" json:"fecdata,omitempty"`
+	Fecparity            int32    `protobuf:"varint,5,opt,name=fecparity,proto3" json:"fecparity,omitempty"`
+	Msgbegin             bool     `protobuf:"varint,6,opt,name=msgbegin,proto3" json:"msgbegin,omitempty"`
+	Msgend               bool     `protobuf:"varint,7,opt,name=msgend,proto3" json:"msgend,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -143,6 +153,34 @@ func (m *FrameData) GetCompress() bool {
 	return false
 }
 
+func (m *FrameData) GetFecdata() int32 {
+	if m != nil {
+		return m.Fecdata
+	}
+	return 0
+}
+
+func (m *FrameData) GetFecparity() int32 {
+	if m != nil {
+		return m.Fecparity
+	}
+	return 0
+}
+
+func (m *FrameData) GetMsgbegin() bool {
+	if m != nil {
+		return m.Msgbegin
+	}
+	return false
+}
+
+func (m *FrameData) GetMsgend() bool {
+	if m != nil {
+		return m.Msgend
+	}
+	return false
+}
+
 type Frame struct {
 	Type                 int32      `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
 	Resend               bool       `protobuf:"varint,2,opt,name=resend,proto3" json:"resend,omitempty"`
@@ -151,6 +189,7 @@ type Frame struct {
 	Data                 *FrameData `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
 	Dataid               []int32    `protobuf:"varint,6,rep,packed,name=dataid,proto3" json:"dataid,omitempty"`
 	Acked                bool       `protobuf:"varint,7,opt,name=acked,proto3" json:"acked,omitempty"`
+	Session              uint64     `protobuf:"fixed64,8,opt,name=session,proto3" json:"session,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
 	XXX_unrecognized     []byte     `json:"-"`
 	XXX_sizecache        int32      `json:"-"`
@@ -230,6 +269,13 @@ func (m *Frame) GetAcked() bool {
 	return false
 }
 
+func (m *Frame) GetSession() uint64 {
+	if m != nil {
+		return m.Session
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterEnum("FrameData_TYPE", FrameData_TYPE_name, FrameData_TYPE_value)
 	proto.RegisterEnum("Frame_TYPE", Frame_TYPE_name, Frame_TYPE_value)
@@ -240,24 +286,28 @@ func init() {
 func init() { proto.RegisterFile("frame.proto", fileDescriptor_5379e2b825e15002) }
 
 var fileDescriptor_5379e2b825e15002 = []byte{
-	// 299 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x91, 0xcd, 0x4a, 0xf4, 0x30,
-	0x14, 0x86, 0xbf, 0xfc, 0xb5, 0x9d, 0x33, 0x9f, 0x12, 0x82, 0x0c, 0xc1, 0x85, 0x94, 0xae, 0xba,
-	0x9a, 0x85, 0x82, 0x5b, 0x99, 0x9f, 0x3a, 0x8a, 0xd2, 0x19, 0x33, 0xe3, 0x42, 0x37, 0x12, 0x27,
-	0x11, 0x8a, 0x8c, 0x2d, 0x6d, 0x37, 0xde, 0x85, 0x37, 0xe9, 0x7d, 0x48, 0x62, 0xe8, 0xca, 0xd5,
-	0x79, 0x9f, 0x16, 0x92, 0xe7, 0xcd, 0x81, 0xf1, 0x5b, 0xab, 0x0f, 0x76, 0xda, 0xb4, 0x75, 0x5f,
-	0x67, 0x5f, 0x08, 0x46, 0xd7, 0x8e, 0x97, 0xba, 0xd7, 0x42, 0x00, 0xed, 0x3f, 0x1b, 0x2b, 0x51,
-	0x8a, 0x72, 0xa6, 0x7c, 0x76, 0xdf, 0x8c, 0xee, 0xb5, 0xc4, 0x29, 0xca, 0xff, 0x2b, 0x9f, 0xc5,
-	0x29, 0x24, 0xfb, 0xfa, 0xd0, 0xb4, 0xb6, 0xeb, 0x24, 0x49, 0x51, 0x9e, 0xa8, 0x81, 0xb3, 0x2b,
-	0xa0, 0xbb, 0xa7, 0x4d, 0x21, 0x8e, 0x60, 0xf4, 0xb8, 0x2d, 0xd4, 0xcb, 0x72, 0xb6, 0x9b, 0xf1,
-	0x7f, 0x22, 0x01, 0xba, 0x58, 0x97, 0x25, 0x47, 0x62, 0x0c, 0xb1, 0x4b, 0x6a, 0xbb, 0xe1, 0x58,
-	0x8c, 0x80, 0x2d, 0xee, 0xd7, 0xdb, 0x82, 0x13, 0x11, 0x01, 0xbe, 0x99, 0x73, 0x9a, 0x7d, 0x23,
-	0x60, 0x5e, 0xe9, 0x4f, 0x9d, 0x09, 0x44, 0xad, 0xed, 0xec, 0x87, 0xf1, 0x42, 0x89, 0x0a, 0xe4,
-	0x94, 0xdc, 0xec, 0xab, 0x83, 0xf5, 0x4a, 0x44, 0x0d, 0x2c, 0x8e, 0x01, 0x57, 0x46, 0x52, 0x7f,
-	0x0a, 0xae, 0x8c, 0x38, 0x0b, 0x95, 0x58, 0x8a, 0xf2, 0xf1, 0x39, 0x4c, 0x87, 0x07, 0x08, 0xf5,
-	0x26, 0x10, 0xb9, 0x59, 0x19, 0x19, 0xa5, 0x24, 0x67, 0x2a, 0x90, 0x38, 0x01, 0xa6, 0xf7, 0xef,
-	0xd6, 0xc8, 0xd8, 0x5f, 0xfd, 0x0b, 0xd9, 0x65, 0x28, 0x9c, 0x00, 0x0d, 0x5d, 0x63, 0x20, 0xaa,
-	0x78, 0xe0, 0xc8, 0x85, 0xd9, 0xe2, 0x8e, 0x63, 0xf7, 0x6f, 0x73, 0x5b, 0xae, 0x38, 0xf1, 0x69,
-	0x5d, 0xae, 0x38, 0x9d, 0xc7, 0xcf, 0xcc, 0x6f, 0xe2, 0x35, 0xf2, 0xab, 0xb8, 0xf8, 0x09, 0x00,
-	0x00, 0xff, 0xff, 0xc6, 0x07, 0xe4, 0x02, 0x99, 0x01, 0x00, 0x00,
+	// 368 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0x41, 0xcf, 0x93, 0x30,
+	0x18, 0xc7, 0xa5, 0xd0, 0x02, 0xcf, 0xd4, 0x34, 0x8d, 0x59, 0x1a, 0x63, 0x0c, 0xe1, 0xc4, 0x69,
+	0x07, 0xfd, 0x00, 0x66, 0x63, 0x6c, 0x2e, 0x1a, 0xc0, 0x6e, 0x1e, 0xf4, 0x62, 0x18, 0x74, 0x0b,
+	0x31, 0x0c, 0x42, 0xb9, 0xec, 0x0b, 0x18, 0x3f, 0xf6, 0x9b, 0x16, 0xd8, 0x7b, 0x79, 0x4f, 0xfd,
+	0xff, 0xfa, 0xc0, 0x93, 0xe7, 0xf9, 0xa5, 0xb0, 0xb8, 0xf4, 0x45, 0x23, 0x57, 0x5d, 0xdf, 0x0e,
+	0x6d, 0xf8, 0x0f, 0x81, 0xbf, 0xd3, 0xbc, 0x2d, 0x86, 0x82, 0x31, 0x70, 0x86, 0x7b, 0x27, 0xb9,
+	0x15, 0x58, 0x11, 0x16, 0x26, 0xeb, 0xbb, 0xaa, 0x18, 0x0a, 0x8e, 0x02, 0x2b, 0x7a, 0x2d, 0x4c,
+	0x66, 0xef, 0xc1, 0x2b, 0xdb, 0xa6, 0xeb, 0xa5, 0x52, 0xdc, 0x0e, 0xac, 0xc8, 0x13, 0x0f, 0x66,
+	0x1c, 0xdc, 0x8b, 0x2c, 0xcd, 0x2f, 0x8e, 0x69, 0x33, 0x23, 0xfb, 0x00, 0xfe, 0x45, 0x96, 0x5d,
+	0xd1, 0xd7, 0xc3, 0x9d, 0x63, 0x53, 0x7b, 0xbe, 0xd0, 0x3d, 0x1b, 0x75, 0x3d, 0xcb, 0x6b, 0x7d,
+	0xe3, 0x64, 0xec, 0x39, 0x33, 0x5b, 0x02, 0x69, 0xd4, 0x55, 0xde, 0x2a, 0xee, 0x9a, 0xca, 0x44,
+	0xe1, 0x01, 0x9c, 0xd3, 0xaf, 0x3c, 0x61, 0x6f, 0xc0, 0xff, 0x79, 0x4c, 0xc4, 0x9f, 0xed, 0xfa,
+	0xb4, 0xa6, 0xaf, 0x98, 0x07, 0x4e, 0x9c, 0xa5, 0x29, 0xb5, 0xd8, 0x02, 0x5c, 0x9d, 0xc4, 0x31,
+	0xa7, 0x88, 0xf9, 0x80, 0xe3, 0xef, 0xd9, 0x31, 0xa1, 0x36, 0x23, 0x80, 0xbe, 0x6e, 0xa8, 0xa3,
+	0xbf, 0xdc, 0x8a, 0x2c, 0xa7, 0x38, 0xfc, 0x8f, 0x00, 0x1b, 0x11, 0x2f, 0x4a, 0x58, 0x02, 0xe9,
+	0xa5, 0xd2, 0x03, 0xa0, 0x71, 0x80, 0x91, 0xf4, 0xd0, 0xfa, 0x1c, 0xea, 0x46, 0x1a, 0x11, 0xb6,
+	0x78, 0x30, 0x7b, 0x0b, 0xa8, 0xae, 0x26, 0x07, 0xa8, 0xae, 0xd8, 0xc7, 0x49, 0xa4, 0xde, 0x7c,
+	0xf1, 0x09, 0x56, 0x0f, 0xed, 0x93, 0xd4, 0x25, 0x10, 0x7d, 0xd6, 0x15, 0x27, 0x81, 0x1d, 0x61,
+	0x31, 0x11, 0x7b, 0x07, 0xb8, 0x28, 0xff, 0xca, 0x79, 0xf7, 0x11, 0xb4, 0x66, 0x25, 0x95, 0xaa,
+	0xdb, 0x1b, 0xf7, 0x02, 0x2b, 0x22, 0x62, 0xc6, 0xf0, 0xcb, 0x24, 0x45, 0xef, 0x36, 0xfa, 0x70,
+	0xc1, 0x16, 0xc9, 0x0f, 0x6a, 0xe9, 0xb0, 0x8e, 0xbf, 0x51, 0xa4, 0x6b, 0xf9, 0x21, 0xdd, 0x53,
+	0xdb, 0xa4, 0x2c, 0xdd, 0x53, 0x47, 0x17, 0x77, 0x49, 0x4c, 0xf1, 0xc6, 0xfd, 0x8d, 0xcd, 0x13,
+	0x39, 0x13, 0xf3, 0x46, 0x3e, 0x3f, 0x0d, 0x00, 0x2e, 0xb5, 0xad, 0xd6, 0x32, 0x02, 0x00, 0x00,
 }
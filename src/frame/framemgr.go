@@ -7,8 +7,11 @@ import (
 	"github.com/3t2ugg1e/go-engine/src/loggo"
 	"github.com/3t2ugg1e/go-engine/src/rbuffergo"
 	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/reedsolomon"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,6 +34,21 @@ type FrameStat struct {
 	recvpong        int
 	recvOldNum      int
 	recvOutWinNum   int
+	sendFecNum      int
+	recvFecNum      int
+	fecRecoverNum   int
+	fecDropNum      int
+}
+
+// Stat is always counted, unlike FrameStat which is only printed when openstat is set
+type Stat struct {
+	Resend     int64         // 重传的数据帧
+	RecvOld    int64         // 收到的已确认过的旧帧
+	RecvOutWin int64         // 收到的窗口外的帧
+	Rtt        time.Duration // 往返时间
+	Cwnd       int           // 拥塞窗口，字节
+	Recovered  int64         // FEC恢复的数据帧
+	FecDrop    int64         // 拥塞窗口一直没空间而丢掉的FEC校验帧
 }
 
 const (
@@ -84,15 +102,99 @@ type FrameMgr struct {
 
 	ct           congestion.Congestion
 	ctLastSendId int32
+
+	session uint64
+
+	resendNum     int64
+	recvOldNum    int64
+	recvOutWinNum int64
+	cwnd          int64
+
+	obfs     string
+	obfsnego atomic.Value
+
+	fecdata       int
+	fecparity     int
+	fecN          int
+	fecM          int
+	fecenc        map[int]reedsolomon.Encoder
+	fecsend       []*Frame
+	fecparitysend []*fecParity
+	fecsendtime   int64
+	fecrecv       map[int32]*fecData
+	fecgroups     map[int32]*fecGroup
+	fecidgroup    map[int32]int32
+	fecdirty      map[int32]bool
+	lastFecClean  int64
+	fecRecoverNum int64
+	fecDropNum    int64
+
+	msgmode            string
+	msgttl             int64
+	sendmsgleft        int
+	sendmsgbegin       bool
+	sendmsgdeadlinecur int64
+	sendmsgtimes       *list.List
+	sendmsgdeadline    map[int32]int64
+	recvmsg            []byte
+	recvmsgdrop        bool
+	recvmsgskip        bool
+	recvmsgearly       map[int32]bool
 }
 
 func (fm *FrameMgr) SetDebugid(debugid string) {
 	fm.debugid = debugid
 }
 
+// SetSession makes every frame carry the session, so the peer can find it after our address changes
+func (fm *FrameMgr) SetSession(session uint64) {
+	fm.session = session
+}
+
+func (fm *FrameMgr) GetSession() uint64 {
+	return fm.session
+}
+
+// SetObfs sets the schemes we support in order of preference, comma separated,
+// the client offers them in CONN and the server picks the first one it also supports in CONNRSP
+func (fm *FrameMgr) SetObfs(obfs string) {
+	fm.obfs = obfs
+}
+
+// GetObfs returns the negotiated scheme, empty before connected or when there is no common one
+func (fm *FrameMgr) GetObfs() string {
+	v, _ := fm.obfsnego.Load().(string)
+	return v
+}
+
+func (fm *FrameMgr) pickObfs(remote string) string {
+	if fm.obfs == "" || remote == "" {
+		return ""
+	}
+	local := strings.Split(fm.obfs, ",")
+	for _, r := range strings.Split(remote, ",") {
+		for _, l := range local {
+			if r == l {
+				return r
+			}
+		}
+	}
+	return ""
+}
+
 func (fm *FrameMgr) SetCongestion(ct congestion.Congestion) {
 	fm.ct = ct
 	fm.ct.Init()
+	fm.storeCwnd()
+}
+
+// storeCwnd publishes the window for GetStat, it runs where the congestion is updated
+func (fm *FrameMgr) storeCwnd() {
+	cwnd := int(fm.windowsize) * fm.frame_max_size
+	if w, ok := fm.ct.(interface{ Window() int }); ok {
+		cwnd = w.Window()
+	}
+	atomic.StoreInt64(&fm.cwnd, int64(cwnd))
 }
 
 func NewFrameMgr(frame_max_size int, frame_max_id int, buffersize int, windowsize int, resend_timems int, compress int, openstat int) *FrameMgr {
@@ -116,11 +218,16 @@ func NewFrameMgr(frame_max_size int, frame_max_id int, buffersize int, windowsiz
 		rttns:     (int64)(resend_timems * 1000),
 		reqmap:    make(map[int32]int64),
 		connected: false, openstat: openstat, lastPrintStat: time.Now().UnixNano(),
+		fecenc:  make(map[int]reedsolomon.Encoder),
+		fecrecv: make(map[int32]*fecData), fecgroups: make(map[int32]*fecGroup),
+		fecidgroup: make(map[int32]int32), fecdirty: make(map[int32]bool),
+		sendmsgtimes: list.New(), sendmsgdeadline: make(map[int32]int64), recvmsgearly: make(map[int32]bool),
 	}
 
 	if openstat > 0 {
 		fm.resetStat()
 	}
+	fm.storeCwnd()
 	return fm
 }
 
@@ -144,6 +251,7 @@ func (fm *FrameMgr) Update() bool {
 	fm.cutSendBufferToWindow(cur)
 
 	tmpreq, tmpack, tmpackto := fm.preProcessRecvList()
+	fm.recoverFec(tmpackto, cur)
 	avtive := len(tmpreq) + len(tmpack) + len(tmpackto)
 	fm.processRecvList(tmpreq, tmpack, tmpackto)
 
@@ -154,6 +262,7 @@ func (fm *FrameMgr) Update() bool {
 	fm.ping()
 	fm.hb()
 
+	fm.cleanFec(cur)
 	fm.second(cur)
 
 	return avtive > 0
@@ -164,13 +273,17 @@ func (fm *FrameMgr) cutSendBufferToWindow(cur int64) {
 	fm.sendblock.Lock()
 	defer fm.sendblock.Unlock()
 
+	if fm.msgmode != "" {
+		fm.cutMessageToWindow(cur)
+	}
+
 	sendall := false
 
 	if fm.sendb.Size() < fm.frame_max_size {
 		sendall = true
 	}
 
-	for fm.sendb.Size() >= fm.frame_max_size && fm.sendwin.Size() < int(fm.windowsize) {
+	for fm.msgmode == "" && fm.sendb.Size() >= fm.frame_max_size && fm.sendwin.Size() < int(fm.windowsize) {
 		fd := &FrameData{Type: (int32)(FrameData_USER_DATA),
 			Data: make([]byte, fm.frame_max_size)}
 		fm.sendb.Read(fd.Data)
@@ -199,7 +312,7 @@ func (fm *FrameMgr) cutSendBufferToWindow(cur int64) {
 		//loggo.Debug("debugid %v cut frame push to send win %v %v %v", fm.debugid, f.Id, fm.frame_max_size, fm.sendwin.Size())
 	}
 
-	if sendall && fm.sendb.Size() > 0 && fm.sendwin.Size() < int(fm.windowsize) {
+	if fm.msgmode == "" && sendall && fm.sendb.Size() > 0 && fm.sendwin.Size() < int(fm.windowsize) {
 		fd := &FrameData{Type: (int32)(FrameData_USER_DATA),
 			Data: make([]byte, fm.sendb.Size())}
 		fm.sendb.Read(fd.Data)
@@ -250,6 +363,11 @@ func (fm *FrameMgr) cutSendBufferToWindow(cur int64) {
 }
 
 func (fm *FrameMgr) calSendList(cur int64) {
+	idle := false
+	defer func() {
+		fm.flushShortFec(cur, idle)
+		fm.sendFecParity(cur)
+	}()
 
 	for e := fm.sendwin.FrontInter(); e != nil; e = e.Next() {
 		f := e.Value.(*Frame)
@@ -258,12 +376,20 @@ func (fm *FrameMgr) calSendList(cur int64) {
 		}
 		if !f.Acked && (f.Resend || cur-f.Sendtime > int64(fm.resend_timems*(int)(time.Millisecond))) &&
 			cur-f.Sendtime > fm.rttns {
+			fm.expireMessage(f, cur)
 			if fm.ct != nil && f.Data != nil && len(f.Data.Data) > 0 && !fm.ct.CanSend(int(f.Id), len(f.Data.Data)) {
 				fm.ctLastSendId = f.Id
 				return
 			}
+			first := f.Sendtime == 0
+			if !first {
+				atomic.AddInt64(&fm.resendNum, 1)
+			}
 			f.Sendtime = cur
 			fm.sendFrame(f)
+			if first {
+				fm.addFecSend(f, cur)
+			}
 			f.Resend = false
 			if fm.openstat > 0 {
 				fm.fs.sendDataNum++
@@ -273,6 +399,11 @@ func (fm *FrameMgr) calSendList(cur int64) {
 		}
 	}
 	fm.ctLastSendId = -1
+
+	// every new frame in the window is sent, idle when the buffer has nothing left to cut either
+	fm.sendblock.Lock()
+	idle = fm.sendb.Size() <= 0
+	fm.sendblock.Unlock()
 }
 
 func (fm *FrameMgr) GetSendList() *list.List {
@@ -306,6 +437,7 @@ func (fm *FrameMgr) preProcessRecvList() (map[int32]int, map[int32]int, map[int3
 	tmpreq := make(map[int32]int)
 	tmpack := make(map[int32]int)
 	tmpackto := make(map[int32]*Frame)
+	cur := time.Now().UnixNano()
 	for e := fm.recvlist.Front(); e != nil; e = e.Next() {
 		f := e.Value.(*Frame)
 		if f.Type == (int32)(Frame_REQ) {
@@ -320,6 +452,7 @@ func (fm *FrameMgr) preProcessRecvList() (map[int32]int, map[int32]int, map[int3
 			}
 		} else if f.Type == (int32)(Frame_DATA) {
 			tmpackto[f.Id] = f
+			fm.addFecData(f, cur)
 			if fm.openstat > 0 {
 				fm.fs.recvDataNum++
 				fm.fs.recvDataNumsMap[f.Id]++
@@ -329,6 +462,8 @@ func (fm *FrameMgr) preProcessRecvList() (map[int32]int, map[int32]int, map[int3
 			fm.processPing(f)
 		} else if f.Type == (int32)(Frame_PONG) {
 			fm.processPong(f)
+		} else if f.Type == (int32)(Frame_FEC) {
+			fm.addFecParity(f, cur)
 		} else {
 			loggo.Error("error frame type %v", f.Type)
 		}
@@ -403,17 +538,19 @@ func (fm *FrameMgr) processRecvList(tmpreq map[int32]int, tmpack map[int32]int,
 				loggo.Error("sendwin PopFront fail ")
 				break
 			}
+			delete(fm.sendmsgdeadline, f.Id)
 		} else {
 			break
 		}
 	}
 
 	if len(tmpackto) > 0 {
-		tmpsize := common.MinOfInt(len(tmpackto), fm.frame_max_size/2/4)
+		tmpsize := common.MinOfInt(len(tmpackto), fm.maxFrameIds())
 		tmp := make([]int32, len(tmpackto))
 		index := 0
 		for id, rf := range tmpackto {
 			if fm.addToRecvWin(rf) {
+				fm.tryEarlyMessage(id)
 				tmp[index] = id
 				index++
 				if fm.openstat > 0 {
@@ -442,16 +579,24 @@ func (fm *FrameMgr) processRecvList(tmpreq map[int32]int, tmpack map[int32]int,
 	}
 }
 
+// maxFrameIds caps the ids of one REQ or ACK, even at 5 bytes a varint they stay under a full data frame,
+// so a transport that cuts its data frames to fit a packet carries them too
+func (fm *FrameMgr) maxFrameIds() int {
+	return common.MaxOfInt(fm.frame_max_size/2/4, 1)
+}
+
 func (fm *FrameMgr) addToRecvWin(rf *Frame) bool {
 
 	if !fm.isIdInRange(rf.Id, fm.frame_max_id) {
 		//loggo.Debug("debugid %v recv frame not in range %v %v", fm.debugid, rf.Id, fm.recvid)
 		if fm.isIdOld(rf.Id, fm.frame_max_id) {
+			atomic.AddInt64(&fm.recvOldNum, 1)
 			if fm.openstat > 0 {
 				fm.fs.recvOldNum++
 			}
 			return true
 		}
+		atomic.AddInt64(&fm.recvOutWinNum, 1)
 		if fm.openstat > 0 {
 			fm.fs.recvOutWinNum++
 		}
@@ -467,7 +612,9 @@ func (fm *FrameMgr) addToRecvWin(rf *Frame) bool {
 }
 
 func (fm *FrameMgr) processRecvFrame(f *Frame) bool {
-	if f.Data.Type == (int32)(FrameData_USER_DATA) {
+	if fm.msgmode != "" && (f.Data.Type == (int32)(FrameData_USER_DATA) || f.Data.Type == (int32)(FrameData_DROP)) {
+		return fm.processRecvMessage(f)
+	} else if f.Data.Type == (int32)(FrameData_USER_DATA) {
 		fm.recvblock.Lock()
 		defer fm.recvblock.Unlock()
 
@@ -499,11 +646,16 @@ func (fm *FrameMgr) processRecvFrame(f *Frame) bool {
 		//loggo.Debug("debugid %v recv remote close frame %v", fm.debugid, f.Id)
 		return true
 	} else if f.Data.Type == (int32)(FrameData_CONN) {
-		fm.sendConnectRsp()
+		obfs := fm.pickObfs(string(f.Data.Data))
+		fm.fecN, fm.fecM = fm.pickFec(f.Data.Fecdata, f.Data.Fecparity)
+		fm.sendConnectRsp(obfs)
+		fm.obfsnego.Store(obfs)
 		fm.connected = true
 		//loggo.Debug("debugid %v recv remote conn frame %v", fm.debugid, f.Id)
 		return true
 	} else if f.Data.Type == (int32)(FrameData_CONNRSP) {
+		fm.obfsnego.Store(fm.pickObfs(string(f.Data.Data)))
+		fm.fecN, fm.fecM = fm.pickFec(f.Data.Fecdata, f.Data.Fecparity)
 		fm.connected = true
 		//loggo.Debug("debugid %v recv remote conn rsp frame %v", fm.debugid, f.Id)
 		return true
@@ -551,7 +703,7 @@ func (fm *FrameMgr) combineWindowToRecvBuffer(cur int64) {
 	reqtmp := make(map[int32]int)
 	e := fm.recvwin.FrontInter()
 	id := fm.recvid
-	for len(reqtmp) < int(fm.windowsize) && len(reqtmp)*4 < fm.frame_max_size/2 && e != nil {
+	for len(reqtmp) < int(fm.windowsize) && len(reqtmp) < fm.maxFrameIds() && e != nil {
 		f := e.Value.(*Frame)
 		//loggo.Debug("debugid %v start add req id %v %v %v", fm.debugid, fm.recvid, f.Id, id)
 		if f.Id != id {
@@ -674,7 +826,7 @@ func (fm *FrameMgr) processPong(f *Frame) {
 	cur := time.Now().UnixNano()
 	if cur > f.Sendtime {
 		rtt := cur - f.Sendtime
-		fm.rttns = (fm.rttns + rtt) / 2
+		atomic.StoreInt64(&fm.rttns, (fm.rttns+rtt)/2)
 		if fm.openstat > 0 {
 			fm.fs.recvpong++
 		}
@@ -718,7 +870,8 @@ func (fm *FrameMgr) IsConnected() bool {
 
 func (fm *FrameMgr) Connect() {
 	if fm.sendwin.Size() < int(fm.windowsize) {
-		fd := &FrameData{Type: (int32)(FrameData_CONN)}
+		fd := &FrameData{Type: (int32)(FrameData_CONN), Data: []byte(fm.obfs),
+			Fecdata: int32(fm.fecdata), Fecparity: int32(fm.fecparity)}
 
 		f := &Frame{Type: (int32)(Frame_DATA),
 			Id:   fm.sendid,
@@ -739,9 +892,10 @@ func (fm *FrameMgr) Connect() {
 	}
 }
 
-func (fm *FrameMgr) sendConnectRsp() {
+func (fm *FrameMgr) sendConnectRsp(obfs string) {
 	if fm.sendwin.Size() < int(fm.windowsize) {
-		fd := &FrameData{Type: (int32)(FrameData_CONNRSP)}
+		fd := &FrameData{Type: (int32)(FrameData_CONNRSP), Data: []byte(obfs),
+			Fecdata: int32(fm.fecN), Fecparity: int32(fm.fecM)}
 
 		f := &Frame{Type: (int32)(Frame_DATA),
 			Id:   fm.sendid,
@@ -762,6 +916,19 @@ func (fm *FrameMgr) sendConnectRsp() {
 	}
 }
 
+// GetStat can be called from any goroutine
+func (fm *FrameMgr) GetStat() Stat {
+	return Stat{
+		Resend:     atomic.LoadInt64(&fm.resendNum),
+		RecvOld:    atomic.LoadInt64(&fm.recvOldNum),
+		RecvOutWin: atomic.LoadInt64(&fm.recvOutWinNum),
+		Rtt:        time.Duration(atomic.LoadInt64(&fm.rttns)),
+		Cwnd:       int(atomic.LoadInt64(&fm.cwnd)),
+		Recovered:  atomic.LoadInt64(&fm.fecRecoverNum),
+		FecDrop:    atomic.LoadInt64(&fm.fecDropNum),
+	}
+}
+
 func (fm *FrameMgr) resetStat() {
 	fm.fs = &FrameStat{}
 	fm.fs.sendDataNumsMap = make(map[int32]int)
@@ -788,6 +955,7 @@ func (fm *FrameMgr) second(cur int64) {
 				"sendping %v\nrecvping %v\nsendpong %v\nrecvpong %v\n"+
 				"sendwin %v\nrecvwin %v\n"+
 				"recvOldNum %v\nrecvOutWinNum %v\n"+
+				"sendFecNum %v\nrecvFecNum %v\nfecRecoverNum %v\nfecDropNum %v\n"+
 				"rtt %v\n"+
 				"ct %v\n",
 				fs.sendDataNum, fs.recvDataNum,
@@ -800,6 +968,7 @@ func (fm *FrameMgr) second(cur int64) {
 				fs.sendpong, fs.recvpong,
 				fm.sendwin.Size(), fm.recvwin.Size(),
 				fs.recvOldNum, fs.recvOutWinNum,
+				fs.sendFecNum, fs.recvFecNum, fs.fecRecoverNum, fs.fecDropNum,
 				time.Duration(fm.rttns).String(),
 				ctinfo)
 			fm.resetStat()
@@ -807,6 +976,7 @@ func (fm *FrameMgr) second(cur int64) {
 
 		if fm.ct != nil {
 			fm.ct.Update()
+			fm.storeCwnd()
 		}
 
 	}
@@ -836,6 +1006,7 @@ func (fm *FrameMgr) printStatMap(m *map[int32]int) string {
 func (fm *FrameMgr) MarshalFrame(f *Frame) ([]byte, error) {
 	resend := f.Resend
 	sendtime := f.Sendtime
+	f.Session = fm.session
 	mb, err := proto.Marshal(f)
 	f.Resend = resend
 	f.Sendtime = sendtime
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"github.com/3t2ugg1e/go-engine/src/common"
 	"github.com/3t2ugg1e/go-engine/src/rbuffergo"
+	"github.com/golang/protobuf/proto"
 	"testing"
+	"time"
 )
 
 func Test0001(t *testing.T) {
@@ -98,3 +100,69 @@ func Test0001(t *testing.T) {
 	fm.recvwin = rbuffergo.NewROBuffer(100, 0, 10000)
 	//fm.printStat(time.Now().UnixNano())
 }
+
+func Test0002(t *testing.T) {
+	fm := NewFrameMgr(100, 10000, 1024, 100, 400, 0, 0)
+	fm.SetSession(0x1234567890abcdef)
+
+	f := &Frame{Type: int32(Frame_DATA), Id: 1, Data: &FrameData{Type: int32(FrameData_USER_DATA), Data: []byte("hello")}}
+	mb, err := fm.MarshalFrame(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rf := &Frame{}
+	err = proto.Unmarshal(mb, rf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Println("session", rf.Session)
+	if rf.Session != fm.GetSession() {
+		t.Error("session not match", rf.Session)
+	}
+}
+
+func Test0003(t *testing.T) {
+	// the recv buffer is too small for any frame, so the front stays and the gaps behind it are asked for
+	fm := NewFrameMgr(64, 1<<30, 1, 1000, 400, 0, 0)
+	fm.SetSession(0x1234567890abcdef)
+	// ids this big take 5 bytes each
+	fm.recvid = 1 << 29
+	fm.recvwin = rbuffergo.NewROBuffer(1000, 1<<29, 1<<30)
+
+	full := &Frame{Type: int32(Frame_DATA), Id: 1<<30 - 1, Sendtime: time.Now().UnixNano(),
+		Data: &FrameData{Type: int32(FrameData_USER_DATA), Data: make([]byte, 64)}}
+	mb, _ := fm.MarshalFrame(full)
+	limit := len(mb)
+
+	// every other frame is lost, so the ACKs and REQs are as long as they can be
+	for i := 0; i < 800; i += 2 {
+		fm.OnRecvFrame(&Frame{Type: int32(Frame_DATA), Id: int32(1<<29 + i),
+			Data: &FrameData{Type: int32(FrameData_USER_DATA), Data: []byte{1, 2}}})
+	}
+	fm.Update()
+
+	reqnum := 0
+	acknum := 0
+	l := fm.GetSendList()
+	for e := l.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*Frame)
+		if f.Type == int32(Frame_REQ) {
+			reqnum++
+		} else if f.Type == int32(Frame_ACK) {
+			acknum++
+		} else {
+			continue
+		}
+		mb, _ := fm.MarshalFrame(f)
+		if len(mb) > limit {
+			t.Error("frame bigger than a full data frame", f.Type, len(f.Dataid), len(mb), limit)
+		}
+	}
+	fmt.Println("req", reqnum, "ack", acknum, "limit", limit)
+	if reqnum <= 0 || acknum <= 0 {
+		t.Error("no req or ack")
+	}
+}
@@ -0,0 +1,273 @@
+package frame
+
+import (
+	"encoding/binary"
+	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"io"
+	"time"
+)
+
+const (
+	MessageReliable   = "reliable"   // 可靠有序
+	MessageUnordered  = "unordered"  // 可靠，但完整的消息不等前面的消息先交付
+	MessageUnreliable = "unreliable" // 同unordered，超过ttl还没送达的消息不再重传
+)
+
+// a message is len(4) | data in sendb and recvb, it is never split by another one
+const messageHeadLen = 4
+
+// SetMessage must be called before any data is written, both sides must use the same mode, ttlms is only for unreliable
+func (fm *FrameMgr) SetMessage(mode string, ttlms int) {
+	switch mode {
+	case "", MessageReliable, MessageUnordered, MessageUnreliable:
+	default:
+		loggo.Error("unknown message mode %v, use byte stream", mode)
+		mode = ""
+	}
+	fm.msgmode = mode
+	fm.msgttl = int64(ttlms) * int64(time.Millisecond)
+}
+
+func (fm *FrameMgr) GetMessage() string {
+	return fm.msgmode
+}
+
+// MaxMessageSize is the biggest message both buffers can hold
+func (fm *FrameMgr) MaxMessageSize() int {
+	return common.MinOfInt(fm.sendb.Capacity(), fm.recvb.Capacity()) - messageHeadLen
+}
+
+// WriteMessage queues data as one message, it returns false when the send buffer has no room for all of it
+func (fm *FrameMgr) WriteMessage(data []byte) bool {
+	fm.sendblock.Lock()
+	defer fm.sendblock.Unlock()
+
+	if fm.sendb.Capacity()-fm.sendb.Size() < messageHeadLen+len(data) {
+		return false
+	}
+	head := make([]byte, messageHeadLen)
+	binary.BigEndian.PutUint32(head, uint32(len(data)))
+	fm.sendb.Write(head)
+	fm.sendb.Write(data)
+	fm.sendmsgtimes.PushBack(time.Now().UnixNano())
+	//loggo.Debug("debugid %v WriteMessage %v %v", fm.debugid, fm.sendb.Size(), len(data))
+	return true
+}
+
+// ReadMessage reads one whole message, it returns 0 when there is none, a message longer than p is cut with io.ErrShortBuffer
+func (fm *FrameMgr) ReadMessage(p []byte) (int, error) {
+	fm.recvblock.Lock()
+	defer fm.recvblock.Unlock()
+
+	if fm.recvb.Size() < messageHeadLen {
+		return 0, nil
+	}
+	head := make([]byte, messageHeadLen)
+	fm.recvb.Read(head)
+	n := int(binary.BigEndian.Uint32(head))
+	if n <= len(p) {
+		fm.recvb.Read(p[0:n])
+		return n, nil
+	}
+	fm.recvb.Read(p)
+	fm.recvb.SkipRead(n - len(p))
+	return len(p), io.ErrShortBuffer
+}
+
+// cutMessageToWindow cuts the messages into frames, the first and the last frame of a message are flagged so the peer can put it together
+func (fm *FrameMgr) cutMessageToWindow(cur int64) {
+	for fm.sendwin.Size() < int(fm.windowsize) {
+		if fm.sendmsgleft <= 0 {
+			if fm.sendb.Size() < messageHeadLen {
+				return
+			}
+			head := make([]byte, messageHeadLen)
+			fm.sendb.Read(head)
+			fm.sendmsgleft = int(binary.BigEndian.Uint32(head))
+			e := fm.sendmsgtimes.Front()
+			fm.sendmsgtimes.Remove(e)
+			if fm.msgmode == MessageUnreliable && fm.msgttl > 0 && cur-e.Value.(int64) > fm.msgttl {
+				// never sent, so the peer does not even need a DROP frame
+				fm.sendb.SkipRead(fm.sendmsgleft)
+				fm.sendmsgleft = 0
+				//loggo.Debug("debugid %v drop expired message before send", fm.debugid)
+				continue
+			}
+			fm.sendmsgbegin = true
+			fm.sendmsgdeadlinecur = e.Value.(int64) + fm.msgttl
+		}
+
+		size := common.MinOfInt(fm.sendmsgleft, fm.frame_max_size)
+		fd := &FrameData{Type: (int32)(FrameData_USER_DATA),
+			Data: make([]byte, size)}
+		fm.sendb.Read(fd.Data)
+		fm.sendmsgleft -= size
+		fd.Msgbegin = fm.sendmsgbegin
+		fd.Msgend = fm.sendmsgleft <= 0
+		fm.sendmsgbegin = false
+
+		if fm.compress > 0 && len(fd.Data) > fm.compress {
+			newb := common.CompressData(fd.Data)
+			if len(newb) < len(fd.Data) {
+				fd.Data = newb
+				fd.Compress = true
+			}
+		}
+
+		f := &Frame{Type: (int32)(Frame_DATA),
+			Id:   fm.sendid,
+			Data: fd}
+
+		fm.sendid++
+		if fm.sendid >= fm.frame_max_id {
+			fm.sendid = 0
+		}
+
+		if fm.msgmode == MessageUnreliable && fm.msgttl > 0 {
+			fm.sendmsgdeadline[f.Id] = fm.sendmsgdeadlinecur
+		}
+
+		err := fm.sendwin.Set(int(f.Id), f)
+		if err != nil {
+			loggo.Error("sendwin Set fail %v", err)
+		}
+		//loggo.Debug("debugid %v cut message frame push to send win %v %v %v %v", fm.debugid, f.Id, size, fd.Msgbegin, fd.Msgend)
+	}
+}
+
+// expireMessage turns an unreliable frame past its ttl into a small DROP frame, only that is sent again
+func (fm *FrameMgr) expireMessage(f *Frame, cur int64) {
+	deadline, ok := fm.sendmsgdeadline[f.Id]
+	if !ok || cur <= deadline {
+		return
+	}
+	delete(fm.sendmsgdeadline, f.Id)
+	if f.Data == nil || f.Data.Type != (int32)(FrameData_USER_DATA) {
+		return
+	}
+	f.Data = &FrameData{Type: (int32)(FrameData_DROP), Msgbegin: f.Data.Msgbegin, Msgend: f.Data.Msgend}
+	//loggo.Debug("debugid %v drop expired message frame %v", fm.debugid, f.Id)
+}
+
+func (fm *FrameMgr) recvWinFrame(id int32) *Frame {
+	err, value := fm.recvwin.Get(int(id))
+	if err != nil || value == nil {
+		return nil
+	}
+	return value.(*Frame)
+}
+
+func (fm *FrameMgr) frameData(f *Frame) ([]byte, error) {
+	if !f.Data.Compress {
+		return f.Data.Data, nil
+	}
+	return common.DeCompressData(f.Data.Data)
+}
+
+// tryEarlyMessage hands out the message holding id as soon as all its frames are in the recv window, the frames stay there until they are in order
+func (fm *FrameMgr) tryEarlyMessage(id int32) {
+	if fm.msgmode != MessageUnordered && fm.msgmode != MessageUnreliable {
+		return
+	}
+
+	begin := id
+	for i := 0; ; i++ {
+		f := fm.recvWinFrame(begin)
+		if f == nil || f.Data == nil || f.Data.Type != (int32)(FrameData_USER_DATA) || i >= int(fm.windowsize) {
+			return
+		}
+		if f.Data.Msgbegin {
+			break
+		}
+		begin--
+		if begin < 0 {
+			begin = fm.frame_max_id - 1
+		}
+	}
+
+	if fm.recvmsgearly[begin] {
+		return
+	}
+
+	var msg []byte
+	end := begin
+	for i := 0; ; i++ {
+		f := fm.recvWinFrame(end)
+		if f == nil || f.Data == nil || f.Data.Type != (int32)(FrameData_USER_DATA) || i >= int(fm.windowsize) {
+			return
+		}
+		data, err := fm.frameData(f)
+		if err != nil {
+			return
+		}
+		msg = append(msg, data...)
+		if f.Data.Msgend {
+			break
+		}
+		end++
+		if end >= fm.frame_max_id {
+			end = 0
+		}
+	}
+
+	if fm.writeRecvMessage(msg) {
+		fm.recvmsgearly[begin] = true
+		//loggo.Debug("debugid %v early message %v %v %v", fm.debugid, begin, end, len(msg))
+	}
+}
+
+func (fm *FrameMgr) writeRecvMessage(msg []byte) bool {
+	fm.recvblock.Lock()
+	defer fm.recvblock.Unlock()
+
+	if fm.recvb.Capacity()-fm.recvb.Size() < messageHeadLen+len(msg) {
+		return false
+	}
+	head := make([]byte, messageHeadLen)
+	binary.BigEndian.PutUint32(head, uint32(len(msg)))
+	fm.recvb.Write(head)
+	fm.recvb.Write(msg)
+	return true
+}
+
+// processRecvMessage puts the in order frames together, a message already handed out early or holding a DROP frame is skipped
+func (fm *FrameMgr) processRecvMessage(f *Frame) bool {
+	fd := f.Data
+	if fd.Msgbegin {
+		fm.recvmsg = fm.recvmsg[:0]
+		fm.recvmsgdrop = false
+		fm.recvmsgskip = fm.recvmsgearly[f.Id]
+		delete(fm.recvmsgearly, f.Id)
+	}
+	if fd.Type == (int32)(FrameData_DROP) {
+		fm.recvmsgdrop = true
+	}
+
+	if !fm.recvmsgdrop && !fm.recvmsgskip {
+		data, err := fm.frameData(f)
+		if err != nil {
+			loggo.Error("recv frame deCompressData error %v", f.Id)
+			return false
+		}
+		if fd.Msgend {
+			if !fm.writeRecvMessage(append(fm.recvmsg, data...)) {
+				return false
+			}
+		} else if len(fm.recvmsg)+len(data) > fm.MaxMessageSize() {
+			loggo.Error("recv message too big %v %v", f.Id, len(fm.recvmsg)+len(data))
+			fm.recvmsgdrop = true
+		} else {
+			fm.recvmsg = append(fm.recvmsg, data...)
+		}
+	}
+
+	if fd.Msgend {
+		fm.recvmsg = fm.recvmsg[:0]
+		fm.recvmsgdrop = false
+		fm.recvmsgskip = false
+	}
+
+	fm.lastRecvDataTime = time.Now().UnixNano()
+	return true
+}
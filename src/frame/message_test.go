@@ -0,0 +1,175 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func testMessageConnect(t *testing.T, mode string, ttlms int, resendms int) (*FrameMgr, *FrameMgr) {
+	a := NewFrameMgr(100, 100000, 1024*1024, 1000, resendms, 0, 0)
+	a.SetMessage(mode, ttlms)
+	b := NewFrameMgr(100, 100000, 1024*1024, 1000, resendms, 0, 0)
+	b.SetMessage(mode, ttlms)
+
+	a.Connect()
+	for !a.IsConnected() {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, nil)
+		testFecPump(t, b, a, nil)
+		time.Sleep(time.Millisecond)
+	}
+	return a, b
+}
+
+func testMessageRecv(t *testing.T, a *FrameMgr, b *FrameMgr, drop func(f *Frame) bool, num int, timeout time.Duration) [][]byte {
+	var recv [][]byte
+	begin := time.Now()
+	for len(recv) < num && time.Now().Sub(begin) < timeout {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, drop)
+		testFecPump(t, b, a, nil)
+		for {
+			p := make([]byte, b.MaxMessageSize())
+			n, err := b.ReadMessage(p)
+			if err != nil {
+				t.Error(err)
+			}
+			if n <= 0 {
+				break
+			}
+			recv = append(recv, p[0:n])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return recv
+}
+
+func Test0001Message(t *testing.T) {
+	a, b := testMessageConnect(t, MessageReliable, 0, 100)
+
+	var msgs [][]byte
+	for i := 0; i < 50; i++ {
+		data := make([]byte, rand.Intn(1000)+1)
+		rand.Read(data)
+		msgs = append(msgs, data)
+		if !a.WriteMessage(data) {
+			t.Error("WriteMessage fail")
+		}
+	}
+
+	sent := make(map[int32]bool)
+	drop := func(f *Frame) bool {
+		if f.Type != (int32)(Frame_DATA) || sent[f.Id] {
+			return false
+		}
+		sent[f.Id] = true
+		return f.Id%7 == 3
+	}
+
+	recv := testMessageRecv(t, a, b, drop, len(msgs), 3*time.Second)
+	fmt.Println("message", len(msgs), len(recv), a.GetStat().Resend)
+
+	if len(recv) != len(msgs) {
+		t.Error("message num diff")
+		return
+	}
+	for i := range msgs {
+		if !bytes.Equal(recv[i], msgs[i]) {
+			t.Error("message diff", i)
+		}
+	}
+
+	a.WriteMessage(make([]byte, 300))
+	for b.GetRecvBufferSize() <= 0 {
+		a.Update()
+		b.Update()
+		testFecPump(t, a, b, nil)
+		testFecPump(t, b, a, nil)
+		time.Sleep(time.Millisecond)
+	}
+	n, err := b.ReadMessage(make([]byte, 10))
+	if n != 10 || err != io.ErrShortBuffer || b.GetRecvBufferSize() != 0 {
+		t.Error("short buffer fail", n, err)
+	}
+}
+
+func Test0002Message(t *testing.T) {
+	a, b := testMessageConnect(t, MessageUnordered, 0, 100)
+
+	first := make([]byte, 50)
+	rand.Read(first)
+	second := make([]byte, 250)
+	rand.Read(second)
+	a.WriteMessage(first)
+	a.WriteMessage(second)
+
+	firstid := int32(-1)
+	drop := func(f *Frame) bool {
+		if f.Type != (int32)(Frame_DATA) || f.Data.Type != (int32)(FrameData_USER_DATA) {
+			return false
+		}
+		if firstid < 0 {
+			firstid = f.Id
+			return true
+		}
+		return false
+	}
+
+	recv := testMessageRecv(t, a, b, drop, 2, 3*time.Second)
+	if len(recv) != 2 {
+		t.Error("unordered message num diff", len(recv))
+		return
+	}
+	if !bytes.Equal(recv[0], second) || !bytes.Equal(recv[1], first) {
+		t.Error("unordered message should come early")
+	}
+}
+
+func Test0003Message(t *testing.T) {
+	a, b := testMessageConnect(t, MessageUnreliable, 50, 20)
+
+	first := make([]byte, 150)
+	rand.Read(first)
+	second := make([]byte, 50)
+	rand.Read(second)
+	a.WriteMessage(first)
+	a.WriteMessage(second)
+
+	begin := time.Now()
+	firstids := make(map[int32]bool)
+	drop := func(f *Frame) bool {
+		if f.Type != (int32)(Frame_DATA) {
+			return false
+		}
+		if f.Data.Msgbegin && len(firstids) <= 0 {
+			firstids[f.Id] = true
+			firstids[f.Id+1] = true
+		}
+		return firstids[f.Id] && time.Now().Sub(begin) < 200*time.Millisecond
+	}
+
+	recv := testMessageRecv(t, a, b, drop, 2, time.Second)
+	if len(recv) != 1 || !bytes.Equal(recv[0], second) {
+		t.Error("unreliable message should drop", len(recv))
+	}
+	for e := a.sendwin.FrontInter(); e != nil; e = e.Next() {
+		f := e.Value.(*Frame)
+		if f.Data.Type == (int32)(FrameData_USER_DATA) || f.Data.Type == (int32)(FrameData_DROP) {
+			t.Error("unreliable message not done", f.Id)
+		}
+	}
+
+	third := make([]byte, 500)
+	rand.Read(third)
+	a.WriteMessage(third)
+	recv = testMessageRecv(t, a, b, nil, 1, time.Second)
+	if len(recv) != 1 || !bytes.Equal(recv[0], third) {
+		t.Error("unreliable message after drop fail", len(recv))
+	}
+}
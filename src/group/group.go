@@ -1,6 +1,7 @@
 package group
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/3t2ugg1e/go-engine/src/common"
@@ -16,12 +17,14 @@ type Group struct {
 	wg       int32
 	errOnce  sync.Once
 	err      error
-	isexit   bool
+	isexit   int32
 	exitfunc func()
 	donech   chan int
 	sonname  map[string]int
 	lock     sync.Mutex
 	name     string
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
 func NewGroup(name string, father *Group, exitfunc func()) *Group {
@@ -37,7 +40,10 @@ func NewGroup(name string, father *Group, exitfunc func()) *Group {
 	g.name = name
 
 	if father != nil {
+		g.ctx, g.cancel = context.WithCancel(father.Context())
 		father.addson(g)
+	} else {
+		g.ctx, g.cancel = context.WithCancel(context.Background())
 	}
 
 	return g
@@ -76,7 +82,7 @@ func (g *Group) done() {
 }
 
 func (g *Group) IsExit() bool {
-	return g.isexit
+	return atomic.LoadInt32(&g.isexit) != 0
 }
 
 func (g *Group) Error() error {
@@ -86,8 +92,9 @@ func (g *Group) Error() error {
 func (g *Group) exit(err error) {
 	g.errOnce.Do(func() {
 		g.err = err
-		g.isexit = true
+		atomic.StoreInt32(&g.isexit, 1)
 		close(g.donech)
+		g.cancel()
 		if g.exitfunc != nil {
 			g.exitfunc()
 		}
@@ -119,10 +126,15 @@ func (g *Group) Done() <-chan int {
 	return g.donech
 }
 
+// Context is canceled when the group exits, so it can be passed to Dial/Accept calls running in the group
+func (g *Group) Context() context.Context {
+	return g.ctx
+}
+
 func (g *Group) Go(name string, f func() error) {
 	g.lock.Lock()
 	defer g.lock.Unlock()
-	if g.isexit {
+	if atomic.LoadInt32(&g.isexit) != 0 {
 		return
 	}
 	g.add()
@@ -149,8 +161,8 @@ func (g *Group) Stop() {
 func (g *Group) Wait() error {
 	last := int64(0)
 	begin := int64(0)
-	for g.wg != 0 {
-		if g.isexit {
+	for atomic.LoadInt32(&g.wg) != 0 {
+		if atomic.LoadInt32(&g.isexit) != 0 {
 			cur := time.Now().Unix()
 			if last == 0 {
 				last = cur
@@ -158,7 +170,7 @@ func (g *Group) Wait() error {
 			} else {
 				if cur-last > 30 {
 					last = cur
-					loggo.Error("Group Wait too long %s %d %s %v", g.name, g.wg,
+					loggo.Error("Group Wait too long %s %d %s %v", g.name, atomic.LoadInt32(&g.wg),
 						time.Duration((cur-begin)*int64(time.Second)).String(), g.runningmap())
 				}
 			}
@@ -220,3 +220,26 @@ func Test008(t *testing.T) {
 	g.Wait()
 
 }
+
+func Test009(t *testing.T) {
+	g := NewGroup("", nil, nil)
+	gg := NewGroup("son", g, nil)
+
+	gg.Go("test", func() error {
+		<-gg.Context().Done()
+		fmt.Println("son ctx done")
+		return nil
+	})
+
+	go func() {
+		time.Sleep(time.Second)
+		g.Stop()
+	}()
+
+	gg.Wait()
+	g.Wait()
+
+	if g.Context().Err() == nil || gg.Context().Err() == nil {
+		t.Error("ctx not canceled")
+	}
+}
@@ -0,0 +1,54 @@
+package icmputil
+
+import (
+	"errors"
+	"github.com/3t2ugg1e/go-engine/src/loggo"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"os"
+)
+
+// gListenPacket is icmp.ListenPacket, tests swap it to act without CAP_NET_RAW
+var gListenPacket = icmp.ListenPacket
+
+// Listen opens a raw echo socket for the family of ip, without CAP_NET_RAW it falls back to an unprivileged udp ping socket
+// that needs net.ipv4.ping_group_range to cover the group, the kernel rewrites the echo id there
+func Listen(ip net.IP) (*icmp.PacketConn, error) {
+	raw, datagram := "ip4:icmp", "udp4"
+	if ip.To4() == nil {
+		raw, datagram = "ip6:ipv6-icmp", "udp6"
+	}
+	conn, err := gListenPacket(raw, "")
+	if err == nil || !errors.Is(err, os.ErrPermission) {
+		return conn, err
+	}
+	udpconn, udperr := gListenPacket(datagram, "")
+	if udperr != nil {
+		loggo.Warn("icmp raw socket fail %s, ping socket %s fail %s", err, datagram, udperr)
+		return nil, err
+	}
+	loggo.Info("icmp raw socket not permitted, use ping socket %s", datagram)
+	return udpconn, nil
+}
+
+// IsDatagram is true for the unprivileged udp sockets, they take a net.UDPAddr and the kernel owns the echo id
+func IsDatagram(conn *icmp.PacketConn) bool {
+	_, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok
+}
+
+// Type maps the ipv4 echo types to icmpv6 ones on ipv6 sockets
+func Type(conn *icmp.PacketConn, proto int) icmp.Type {
+	if conn.IPv6PacketConn() == nil {
+		return ipv4.ICMPType(proto)
+	}
+	switch ipv4.ICMPType(proto) {
+	case ipv4.ICMPTypeEcho:
+		return ipv6.ICMPTypeEchoRequest
+	case ipv4.ICMPTypeEchoReply:
+		return ipv6.ICMPTypeEchoReply
+	}
+	return ipv6.ICMPType(proto)
+}
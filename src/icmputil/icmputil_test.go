@@ -0,0 +1,87 @@
+package icmputil
+
+import (
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test0001(t *testing.T) {
+	old := gListenPacket
+	defer func() {
+		gListenPacket = old
+	}()
+	gListenPacket = func(network, address string) (*icmp.PacketConn, error) {
+		if strings.HasPrefix(network, "ip") {
+			return nil, os.NewSyscallError("socket", syscall.EPERM)
+		}
+		return old(network, address)
+	}
+
+	server, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	conn, err := Listen(server.IP)
+	if err != nil {
+		fmt.Println("ping socket not allowed by net.ipv4.ping_group_range", err)
+		return
+	}
+	defer conn.Close()
+	if !IsDatagram(conn) {
+		t.Error("should fall back to ping socket")
+	}
+	if Type(conn, int(ipv4.ICMPTypeEcho)) != ipv4.ICMPTypeEcho {
+		t.Error("ipv4 type not match")
+	}
+	id := conn.LocalAddr().(*net.UDPAddr).Port
+
+	msg := &icmp.Message{
+		Type: Type(conn, int(ipv4.ICMPTypeEcho)),
+		Body: &icmp.Echo{ID: 1234, Seq: 5, Data: []byte("hello")},
+	}
+	bytes, _ := msg.Marshal(nil)
+	_, err = conn.WriteTo(bytes, &net.UDPAddr{IP: server.IP})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the kernel answers the echo itself, with the id it put in
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	n, src, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Error("ping socket recv fail", err)
+		return
+	}
+	reply, err := icmp.ParseMessage(1, buf[0:n])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	echo, ok := reply.Body.(*icmp.Echo)
+	fmt.Println("recv", src.String(), reply.Type, echo.ID, echo.Seq)
+	if !ok || reply.Type != ipv4.ICMPTypeEchoReply || echo.ID != id || echo.Seq != 5 || string(echo.Data) != "hello" {
+		t.Error("ping socket packet not match")
+	}
+}
+
+func Test0002(t *testing.T) {
+	old := gListenPacket
+	defer func() {
+		gListenPacket = old
+	}()
+	gListenPacket = func(network, address string) (*icmp.PacketConn, error) {
+		return nil, os.NewSyscallError("socket", syscall.EPERM)
+	}
+
+	_, err := Listen(net.ParseIP("::1"))
+	fmt.Println(err)
+	if err == nil || !strings.Contains(err.Error(), "socket") {
+		t.Error("should return the raw socket error")
+	}
+}
@@ -3,6 +3,7 @@ package pingtunnel
 import (
 	"github.com/3t2ugg1e/go-engine/src/common"
 	"github.com/3t2ugg1e/go-engine/src/frame"
+	"github.com/3t2ugg1e/go-engine/src/icmputil"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
 	"github.com/3t2ugg1e/go-engine/src/network"
 	"github.com/golang/protobuf/proto"
@@ -184,12 +185,16 @@ func (p *Client) LocalAddrToConnMapSize() int {
 
 func (p *Client) Run() error {
 
-	conn, err := icmp.ListenPacket("ip4:icmp", "")
+	conn, err := icmputil.Listen(p.ipaddrServer.IP)
 	if err != nil {
 		loggo.Error("Error listening for ICMP packets: %s", err.Error())
 		return err
 	}
 	p.conn = conn
+	if udpaddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && udpaddr.Port != 0 {
+		// the kernel puts the local port in as echo id, the replies carry it too
+		p.id = udpaddr.Port
+	}
 
 	if p.tcpmode > 0 {
 		tcplistenConn, err := net.ListenTCP("tcp", p.tcpaddr)
@@ -824,6 +829,10 @@ func (p *Client) updateServerAddr() {
 	if err != nil {
 		return
 	}
+	if (ipaddrServer.IP.To4() == nil) != (p.ipaddrServer.IP.To4() == nil) {
+		// the icmp socket is opened for one family
+		return
+	}
 	if p.ipaddrServer.String() != ipaddrServer.String() {
 		p.ipaddrServer = ipaddrServer
 	}
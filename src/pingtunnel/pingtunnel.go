@@ -3,16 +3,16 @@ package pingtunnel
 import (
 	"encoding/binary"
 	"github.com/3t2ugg1e/go-engine/src/common"
+	"github.com/3t2ugg1e/go-engine/src/icmputil"
 	"github.com/3t2ugg1e/go-engine/src/loggo"
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 	"net"
 	"sync"
 	"time"
 )
 
-func sendICMP(id int, sequence int, conn icmp.PacketConn, server *net.IPAddr, target string,
+func sendICMP(id int, sequence int, conn icmp.PacketConn, server net.Addr, target string,
 	connId string, msgType uint32, data []byte, sproto int, rproto int, key int,
 	tcpmode int, tcpmode_buffer_size int, tcpmode_maxwin int, tcpmode_resend_time int, tcpmode_compress int, tcpmode_stat int,
 	timeout int) {
@@ -47,20 +47,35 @@ func sendICMP(id int, sequence int, conn icmp.PacketConn, server *net.IPAddr, ta
 	}
 
 	msg := &icmp.Message{
-		Type: (ipv4.ICMPType)(sproto),
+		Type: icmputil.Type(&conn, sproto),
 		Code: 0,
 		Body: body,
 	}
 
+	// the icmpv6 checksum needs the pseudo header, the kernel fills it in when it is left zero
 	bytes, err := msg.Marshal(nil)
 	if err != nil {
 		loggo.Error("sendICMP Marshal error %s %s", server.String(), err)
 		return
 	}
 
+	if ipaddr, ok := server.(*net.IPAddr); ok && icmputil.IsDatagram(&conn) {
+		server = &net.UDPAddr{IP: ipaddr.IP, Zone: ipaddr.Zone}
+	}
+
 	conn.WriteTo(bytes, server)
 }
 
+func isIPv6(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.To4() == nil
+	case *net.UDPAddr:
+		return a.IP.To4() == nil
+	}
+	return false
+}
+
 func recvICMP(workResultLock *sync.WaitGroup, exit *bool, conn icmp.PacketConn, recv chan<- *Packet) {
 
 	defer common.CrashLog()
@@ -101,14 +116,14 @@ func recvICMP(workResultLock *sync.WaitGroup, exit *bool, conn icmp.PacketConn,
 		}
 
 		recv <- &Packet{my: my,
-			src:    srcaddr.(*net.IPAddr),
+			src:    srcaddr,
 			echoId: echoId, echoSeq: echoSeq}
 	}
 }
 
 type Packet struct {
 	my      *MyMsg
-	src     *net.IPAddr
+	src     net.Addr
 	echoId  int
 	echoSeq int
 }
@@ -2,8 +2,12 @@ package pingtunnel
 
 import (
 	"fmt"
+	"github.com/3t2ugg1e/go-engine/src/icmputil"
 	"github.com/golang/protobuf/proto"
+	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test0001(t *testing.T) {
@@ -25,3 +29,38 @@ func Test0001(t *testing.T) {
 	fmt.Println("my1 = ", my1)
 
 }
+
+func Test0002(t *testing.T) {
+	server, _ := net.ResolveIPAddr("ip", "::1")
+	conn, err := icmputil.Listen(server.IP)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	exit := false
+	var workResultLock sync.WaitGroup
+	recv := make(chan *Packet, 100)
+	go recvICMP(&workResultLock, &exit, *conn, recv)
+
+	sendICMP(1234, 5, *conn, server, "target", "id6", (uint32)(MyMsg_PING), []byte("hello"),
+		SEND_PROTO, RECV_PROTO, 0,
+		0, 0, 0, 0, 0, 0,
+		0)
+
+	select {
+	case packet := <-recv:
+		fmt.Println("recv", packet.src.String(), packet.echoId, packet.echoSeq, packet.my.Id)
+		if packet.my.Id != "id6" || string(packet.my.Data) != "hello" || packet.echoSeq != 5 {
+			t.Error("icmpv6 packet not match")
+		}
+		if !icmputil.IsDatagram(conn) && packet.echoId != 1234 {
+			t.Error("icmpv6 echo id not match")
+		}
+	case <-time.After(time.Second * 3):
+		t.Error("icmpv6 recv timeout")
+	}
+	exit = true
+	workResultLock.Wait()
+}
@@ -41,7 +41,8 @@ type Server struct {
 	maxprocessbuffer int
 	connecttmeout    int
 
-	conn *icmp.PacketConn
+	conn  *icmp.PacketConn
+	conn6 *icmp.PacketConn
 
 	localConnMap sync.Map
 	connErrorMap sync.Map
@@ -83,9 +84,19 @@ func (p *Server) Run() error {
 	}
 	p.conn = conn
 
+	conn6, err := icmp.ListenPacket("ip6:ipv6-icmp", "")
+	if err != nil {
+		loggo.Info("Error listening for ICMPv6 packets, ipv6 clients not served: %s", err.Error())
+	} else {
+		p.conn6 = conn6
+	}
+
 	recv := make(chan *Packet, 10000)
 	p.recvcontrol = make(chan int, 1)
 	go recvICMP(&p.workResultLock, &p.exit, *p.conn, recv)
+	if p.conn6 != nil {
+		go recvICMP(&p.workResultLock, &p.exit, *p.conn6, recv)
+	}
 
 	go func() {
 		defer common.CrashLog()
@@ -126,6 +137,9 @@ func (p *Server) Stop() {
 	p.workResultLock.Wait()
 	p.processtp.Stop()
 	p.conn.Close()
+	if p.conn6 != nil {
+		p.conn6.Close()
+	}
 }
 
 func (p *Server) processPacket(packet *Packet) {
@@ -138,7 +152,7 @@ func (p *Server) processPacket(packet *Packet) {
 		t := time.Time{}
 		t.UnmarshalBinary(packet.my.Data)
 		loggo.Info("ping from %s %s %d %d %d", packet.src.String(), t.String(), packet.my.Rproto, packet.echoId, packet.echoSeq)
-		sendICMP(packet.echoId, packet.echoSeq, *p.conn, packet.src, "", "", (uint32)(MyMsg_PING), packet.my.Data,
+		sendICMP(packet.echoId, packet.echoSeq, *p.icmpConn(packet.src), packet.src, "", "", (uint32)(MyMsg_PING), packet.my.Data,
 			(int)(packet.my.Rproto), -1, p.key,
 			0, 0, 0, 0, 0, 0,
 			0)
@@ -276,7 +290,7 @@ func (p *Server) processDataPacket(packet *Packet) {
 	}
 }
 
-func (p *Server) RecvTCP(conn *ServerConn, id string, src *net.IPAddr) {
+func (p *Server) RecvTCP(conn *ServerConn, id string, src net.Addr) {
 
 	defer common.CrashLog()
 
@@ -296,7 +310,7 @@ func (p *Server) RecvTCP(conn *ServerConn, id string, src *net.IPAddr) {
 		for e := sendlist.Front(); e != nil; e = e.Next() {
 			f := e.Value.(*frame.Frame)
 			mb, _ := conn.fm.MarshalFrame(f)
-			sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, "", id, (uint32)(MyMsg_DATA), mb,
+			sendICMP(conn.echoId, conn.echoSeq, *p.icmpConn(src), src, "", id, (uint32)(MyMsg_DATA), mb,
 				conn.rproto, -1, p.key,
 				0, 0, 0, 0, 0, 0,
 				0)
@@ -359,7 +373,7 @@ func (p *Server) RecvTCP(conn *ServerConn, id string, src *net.IPAddr) {
 					loggo.Error("Error tcp Marshal %s %s %s", conn.id, conn.tcpaddrTarget.String(), err)
 					continue
 				}
-				sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, "", id, (uint32)(MyMsg_DATA), mb,
+				sendICMP(conn.echoId, conn.echoSeq, *p.icmpConn(src), src, "", id, (uint32)(MyMsg_DATA), mb,
 					conn.rproto, -1, p.key,
 					0, 0, 0, 0, 0, 0,
 					0)
@@ -421,7 +435,7 @@ func (p *Server) RecvTCP(conn *ServerConn, id string, src *net.IPAddr) {
 		for e := sendlist.Front(); e != nil; e = e.Next() {
 			f := e.Value.(*frame.Frame)
 			mb, _ := conn.fm.MarshalFrame(f)
-			sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, "", id, (uint32)(MyMsg_DATA), mb,
+			sendICMP(conn.echoId, conn.echoSeq, *p.icmpConn(src), src, "", id, (uint32)(MyMsg_DATA), mb,
 				conn.rproto, -1, p.key,
 				0, 0, 0, 0, 0, 0,
 				0)
@@ -461,7 +475,7 @@ func (p *Server) RecvTCP(conn *ServerConn, id string, src *net.IPAddr) {
 	p.close(conn)
 }
 
-func (p *Server) Recv(conn *ServerConn, id string, src *net.IPAddr) {
+func (p *Server) Recv(conn *ServerConn, id string, src net.Addr) {
 
 	defer common.CrashLog()
 
@@ -488,7 +502,7 @@ func (p *Server) Recv(conn *ServerConn, id string, src *net.IPAddr) {
 		now := common.GetNowUpdateInSecond()
 		conn.activeSendTime = now
 
-		sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, "", id, (uint32)(MyMsg_DATA), bytes[:n],
+		sendICMP(conn.echoId, conn.echoSeq, *p.icmpConn(src), src, "", id, (uint32)(MyMsg_DATA), bytes[:n],
 			conn.rproto, -1, p.key,
 			0, 0, 0, 0, 0, 0,
 			0)
@@ -574,8 +588,16 @@ func (p *Server) deleteServerConn(uuid string) {
 	p.localConnMap.Delete(uuid)
 }
 
-func (p *Server) remoteError(echoId int, echoSeq int, uuid string, rprpto int, src *net.IPAddr) {
-	sendICMP(echoId, echoSeq, *p.conn, src, "", uuid, (uint32)(MyMsg_KICK), []byte{},
+// icmpConn answers on the socket of the family the client came from
+func (p *Server) icmpConn(src net.Addr) *icmp.PacketConn {
+	if p.conn6 != nil && isIPv6(src) {
+		return p.conn6
+	}
+	return p.conn
+}
+
+func (p *Server) remoteError(echoId int, echoSeq int, uuid string, rprpto int, src net.Addr) {
+	sendICMP(echoId, echoSeq, *p.icmpConn(src), src, "", uuid, (uint32)(MyMsg_KICK), []byte{},
 		rprpto, -1, p.key,
 		0, 0, 0, 0, 0, 0,
 		0)
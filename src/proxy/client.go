@@ -23,11 +23,13 @@ type Client struct {
 	server     string
 	name       string
 	clienttype CLIENT_TYPE
-	proxyproto []PROXY_PROTO
+	proxyproto []string
 	fromaddr   []string
 	toaddr     []string
 	serverconn []*ServerConn
 	wg         *group.Group
+	raceprotos []string
+	raceaddrs  []string
 }
 
 func NewClient(config *Config, serverproto string, server string, name string, clienttypestr string, proxyprotostr []string, fromaddr []string, toaddr []string) (*Client, error) {
@@ -36,26 +38,44 @@ func NewClient(config *Config, serverproto string, server string, name string, c
 		config = DefaultConfig()
 	}
 
-	cn, err := conn.NewConn(serverproto)
-	if cn == nil {
-		return nil, err
+	// auto races the protos in server, like "tcp://1.2.3.4:8888,rudp://1.2.3.4:8888", and keeps the first one connected
+	var cn conn.Conn
+	var raceprotos []string
+	var raceaddrs []string
+	if strings.ToLower(serverproto) == "auto" {
+		protos, addrs, err := conn.ParseRaceAddr(server)
+		if err != nil {
+			return nil, err
+		}
+		for i := range protos {
+			_, err := conn.NewConn(mainProto(protos[i], config))
+			if err != nil {
+				return nil, err
+			}
+			raceprotos = append(raceprotos, mainProto(protos[i], config))
+		}
+		raceaddrs = addrs
+	} else {
+		var err error
+		cn, err = conn.NewConn(mainProto(serverproto, config))
+		if cn == nil {
+			return nil, err
+		}
+		setServerConn(cn, config)
 	}
 
-	setCongestion(cn, config)
-
 	clienttypestr = strings.ToUpper(clienttypestr)
 	clienttype, ok := CLIENT_TYPE_value[clienttypestr]
 	if !ok {
 		return nil, errors.New("no CLIENT_TYPE " + clienttypestr)
 	}
 
-	var proxyproto []PROXY_PROTO
+	var proxyproto []string
 	for i, _ := range proxyprotostr {
-		p, ok := PROXY_PROTO_value[strings.ToUpper(proxyprotostr[i])]
-		if !ok {
+		if !conn.HasProto(proxyprotostr[i]) {
 			return nil, errors.New("no PROXY_PROTO " + proxyprotostr[i])
 		}
-		proxyproto = append(proxyproto, PROXY_PROTO(p))
+		proxyproto = append(proxyproto, strings.ToLower(proxyprotostr[i]))
 	}
 
 	wg := group.NewGroup("Clent"+" "+clienttypestr, nil, nil)
@@ -70,6 +90,8 @@ func NewClient(config *Config, serverproto string, server string, name string, c
 		toaddr:     toaddr,
 		serverconn: make([]*ServerConn, len(proxyprotostr)),
 		wg:         wg,
+		raceprotos: raceprotos,
+		raceaddrs:  raceaddrs,
 	}
 
 	wg.Go("Client state"+" "+clienttypestr, func() error {
@@ -106,7 +128,7 @@ func (c *Client) connect(index int, conn conn.Conn) error {
 
 	for !c.wg.IsExit() {
 		if c.serverconn[index] == nil {
-			targetconn, err := conn.Dial(c.server)
+			targetconn, err := c.dial(conn)
 			if err != nil {
 				loggo.Error("connect Dial fail: %s %s", c.server, err.Error())
 				time.Sleep(time.Second)
@@ -126,6 +148,25 @@ func (c *Client) connect(index int, conn conn.Conn) error {
 	return nil
 }
 
+func (c *Client) dial(cn conn.Conn) (conn.Conn, error) {
+	if cn != nil {
+		return cn.DialContext(c.wg.Context(), c.server)
+	}
+
+	config := conn.DefaultRaceConfig()
+	config.StaggerMs = c.config.RaceStaggerMs
+	config.TimeoutMs = c.config.ConnectTimeout * 1000
+	config.Prepare = func(cn conn.Conn) {
+		setServerConn(cn, c.config)
+	}
+	targetconn, index, err := conn.RaceDialContext(c.wg.Context(), config, c.raceprotos, c.raceaddrs)
+	if err != nil {
+		return nil, err
+	}
+	loggo.Info("connect race win %s %s", c.raceprotos[index], c.raceaddrs[index])
+	return targetconn, nil
+}
+
 func (c *Client) useServer(index int, serverconn *ServerConn) error {
 
 	loggo.Info("useServer %s", serverconn.conn.Info())
@@ -159,13 +200,13 @@ func (c *Client) useServer(index int, serverconn *ServerConn) error {
 	wg.Go("Client recvFrom"+" "+serverconn.conn.Info(), func() error {
 		atomic.AddInt32(&gStateThreadNum.ThreadNum, 1)
 		defer atomic.AddInt32(&gStateThreadNum.ThreadNum, -1)
-		return recvFrom(wg, recvch, serverconn.conn, c.config.MaxMsgSize, c.config.Encrypt)
+		return recvFrom(wg, recvch, serverconn.conn, c.config.MaxMsgSize, mainEncrypt(c.config))
 	})
 
 	wg.Go("Client sendTo"+" "+serverconn.conn.Info(), func() error {
 		atomic.AddInt32(&gStateThreadNum.ThreadNum, 1)
 		defer atomic.AddInt32(&gStateThreadNum.ThreadNum, -1)
-		return sendTo(wg, sendch, serverconn.conn, c.config.Compress, c.config.MaxMsgSize, c.config.Encrypt, &pingflag, &pongflag, &pongtime)
+		return sendTo(wg, sendch, serverconn.conn, c.config.Compress, c.config.MaxMsgSize, mainEncrypt(c.config), &pingflag, &pongflag, &pongtime)
 	})
 
 	wg.Go("Client checkPingActive"+" "+serverconn.conn.Info(), func() error {
@@ -197,7 +238,10 @@ func (c *Client) login(index int, sendch *common.Channel) {
 	f := &ProxyFrame{}
 	f.Type = FRAME_TYPE_LOGIN
 	f.LoginFrame = &LoginFrame{}
-	f.LoginFrame.Proxyproto = c.proxyproto[index]
+	if p, ok := PROXY_PROTO_value[strings.ToUpper(c.proxyproto[index])]; ok {
+		f.LoginFrame.Proxyproto = PROXY_PROTO(p)
+	}
+	f.LoginFrame.Proxyprotoname = c.proxyproto[index]
 	f.LoginFrame.Clienttype = c.clienttype
 	f.LoginFrame.Fromaddr = c.fromaddr[index]
 	if len(c.toaddr) > 0 {
@@ -270,31 +314,31 @@ func (c *Client) processLoginRsp(wg *group.Group, index int, f *ProxyFrame, send
 func (c *Client) iniService(wg *group.Group, index int, serverConn *ServerConn) error {
 	switch c.clienttype {
 	case CLIENT_TYPE_PROXY:
-		input, err := NewInputer(wg, c.proxyproto[index].String(), c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn, c.toaddr[index])
+		input, err := NewInputer(wg, c.proxyproto[index], c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn, c.toaddr[index])
 		if err != nil {
 			return err
 		}
 		serverConn.input = input
 	case CLIENT_TYPE_REVERSE_PROXY:
-		output, err := NewOutputer(wg, c.proxyproto[index].String(), c.clienttype, c.config, &serverConn.ProxyConn)
+		output, err := NewOutputer(wg, c.proxyproto[index], c.clienttype, c.config, &serverConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		serverConn.output = output
 	case CLIENT_TYPE_SOCKS5:
-		input, err := NewSocks5Inputer(wg, c.proxyproto[index].String(), c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn)
+		input, err := NewSocks5Inputer(wg, c.proxyproto[index], c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		serverConn.input = input
 	case CLIENT_TYPE_REVERSE_SOCKS5:
-		output, err := NewOutputer(wg, c.proxyproto[index].String(), c.clienttype, c.config, &serverConn.ProxyConn)
+		output, err := NewOutputer(wg, c.proxyproto[index], c.clienttype, c.config, &serverConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		serverConn.output = output
 	case CLIENT_TYPE_SS_PROXY:
-		input, err := NewInputer(wg, c.proxyproto[index].String(), c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn, c.toaddr[index])
+		input, err := NewInputer(wg, c.proxyproto[index], c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn, c.toaddr[index])
 		if err != nil {
 			return err
 		}
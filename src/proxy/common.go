@@ -10,29 +10,43 @@ import (
 	"github.com/golang/protobuf/proto"
 	"io"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 type Config struct {
-	MaxMsgSize                int    // 消息最大长度
-	MainBuffer                int    // 主通道buffer最大长度
-	ConnBuffer                int    // 每个conn buffer最大长度
-	EstablishedTimeout        int    // 主通道登录超时
-	PingInter                 int    // 主通道ping间隔
-	PingTimeoutInter          int    // 主通道ping超时间隔
-	ConnTimeout               int    // 每个conn的不活跃超时时间
-	ConnectTimeout            int    // 每个conn的连接超时
-	Key                       string // 连接密码
-	Encrypt                   string // 加密密钥
-	Compress                  int    // 压缩设置
-	ShowPing                  bool   // 是否显示ping
-	Username                  string // 登录用户名
-	Password                  string // 登录密码
-	MaxClient                 int    // 最大客户端数目
-	MaxSonny                  int    // 最大连接数目
-	MainWriteChannelTimeoutMs int    // 主通道转发消息超时
-	Congestion                string // 拥塞算法
+	MaxMsgSize                int             // 消息最大长度
+	MainBuffer                int             // 主通道buffer最大长度
+	ConnBuffer                int             // 每个conn buffer最大长度
+	EstablishedTimeout        int             // 主通道登录超时
+	PingInter                 int             // 主通道ping间隔
+	PingTimeoutInter          int             // 主通道ping超时间隔
+	ConnTimeout               int             // 每个conn的不活跃超时时间
+	ConnectTimeout            int             // 每个conn的连接超时
+	Key                       string          // 连接密码
+	Encrypt                   string          // 加密密钥
+	Compress                  int             // 压缩设置
+	ShowPing                  bool            // 是否显示ping
+	Username                  string          // 登录用户名
+	Password                  string          // 登录密码
+	MaxClient                 int             // 最大客户端数目
+	MaxSonny                  int             // 最大连接数目
+	MainWriteChannelTimeoutMs int             // 主通道转发消息超时
+	Congestion                string          // 拥塞算法
+	TlsCertFile               string          // tls证书，服务端为空时自动生成
+	TlsKeyFile                string          // tls证书私钥
+	TlsCAFile                 string          // tls CA证书，用于校验对端证书
+	TlsServerName             string          // tls客户端校验的服务端名字
+	TlsClientAuth             bool            // tls服务端是否要求客户端证书
+	TlsPinSha256              string          // tls客户端固定服务端证书的sha256指纹
+	TlsInsecure               bool            // tls客户端不校验服务端证书
+	EncryptMode               string          // 主通道加密方式，rc4或aead，aead时Encrypt作为预共享密钥
+	AeadPrivateKey            string          // aead服务端Ed25519私钥，hex
+	AeadPublicKey             string          // aead客户端校验的服务端Ed25519公钥，hex
+	AeadCipher                string          // aead加密算法，chacha20-poly1305或aes-256-gcm
+	Kcp                       *conn.KcpConfig // kcp参数，nil为默认
+	RaceStaggerMs             int             // 服务端协议为auto时，每种协议比前一种晚多久开始拨号
 }
 
 func DefaultConfig() *Config {
@@ -55,6 +69,8 @@ func DefaultConfig() *Config {
 		MaxSonny:                  128,
 		MainWriteChannelTimeoutMs: 1000,
 		Congestion:                "bb",
+		EncryptMode:               "rc4",
+		RaceStaggerMs:             250,
 	}
 }
 
@@ -304,6 +320,14 @@ func sendTo(wg *group.Group, sendch *common.Channel, conn conn.Conn, compress in
 				continue
 			}
 		}
+		// MarshalSrpFrame compresses and encrypts the data in place, so check crc before it
+		if f.Type == FRAME_TYPE_DATA && loggo.IsDebug() {
+			if common.GetCrc32(f.DataFrame.Data) != f.DataFrame.Crc {
+				loggo.Error("sendTo crc error %s %s %s %p", conn.Info(), common.GetCrc32(f.DataFrame.Data), f.DataFrame.Crc, f)
+				return errors.New("conn crc error")
+			}
+		}
+
 		mb, err := MarshalSrpFrame(f, compress, encrypt)
 		if err != nil {
 			loggo.Error("sendTo MarshalSrpFrame fail: %s %s", conn.Info(), err.Error())
@@ -345,12 +369,6 @@ func sendTo(wg *group.Group, sendch *common.Channel, conn conn.Conn, compress in
 
 		if f.Type != FRAME_TYPE_PING && f.Type != FRAME_TYPE_PONG && loggo.IsDebug() {
 			loggo.Debug("sendTo %s %s", conn.Info(), f.Type.String())
-			if f.Type == FRAME_TYPE_DATA {
-				if common.GetCrc32(f.DataFrame.Data) != f.DataFrame.Crc {
-					loggo.Error("sendTo crc error %s %s %s %p", conn.Info(), common.GetCrc32(f.DataFrame.Data), f.DataFrame.Crc, f)
-					return errors.New("conn crc error")
-				}
-			}
 		}
 
 		atomic.AddInt32(&gState.MainSendNum, 1)
@@ -783,7 +801,15 @@ func checkDeadLock(wg *group.Group) error {
 	return nil
 }
 
+func setServerConn(c conn.Conn, config *Config) {
+	setCongestion(c, config)
+	setKcp(c, config)
+	setTls(c, config)
+	setAead(c, config)
+}
+
 func setCongestion(c conn.Conn, config *Config) {
+	c = conn.Unwrap(c)
 	if c.Name() == "rudp" {
 		cf := c.(*conn.RudpConn).GetConfig()
 		cf.Congestion = config.Congestion
@@ -792,5 +818,82 @@ func setCongestion(c conn.Conn, config *Config) {
 		cf := c.(*conn.RicmpConn).GetConfig()
 		cf.Congestion = config.Congestion
 		c.(*conn.RicmpConn).SetConfig(cf)
+	} else if c.Name() == "rdns" {
+		cf := c.(*conn.RdnsConn).GetConfig()
+		cf.Congestion = config.Congestion
+		c.(*conn.RdnsConn).SetConfig(cf)
+	}
+}
+
+func setKcp(c conn.Conn, config *Config) {
+	if config.Kcp == nil {
+		return
+	}
+	c = conn.Unwrap(c)
+	if kc, ok := c.(*conn.KcpConn); ok {
+		kc.SetConfig(config.Kcp)
+	}
+}
+
+func setTls(c conn.Conn, config *Config) {
+	for c != nil {
+		if tc, ok := c.(*conn.TlsConn); ok {
+			cf := tc.GetConfig()
+			cf.CertFile = config.TlsCertFile
+			cf.KeyFile = config.TlsKeyFile
+			cf.CAFile = config.TlsCAFile
+			cf.ServerName = config.TlsServerName
+			cf.ClientAuth = config.TlsClientAuth
+			cf.PinSha256 = config.TlsPinSha256
+			cf.Insecure = config.TlsInsecure
+			tc.SetConfig(cf)
+		}
+		w, ok := c.(conn.WrapConn)
+		if !ok {
+			break
+		}
+		c = w.Inner()
+	}
+}
+
+// mainProto stacks the aead wrapper on the main conn, the data frames are not rc4 encrypted then
+func mainProto(proto string, config *Config) string {
+	if config.EncryptMode == "aead" {
+		return "aead+" + proto
+	}
+	return proto
+}
+
+func mainEncrypt(config *Config) string {
+	if config.EncryptMode == "aead" {
+		return ""
+	}
+	return config.Encrypt
+}
+
+func setAead(c conn.Conn, config *Config) {
+	for c != nil {
+		if ac, ok := c.(*conn.AeadConn); ok {
+			cf := ac.GetConfig()
+			cf.Psk = config.Encrypt
+			cf.PrivateKey = config.AeadPrivateKey
+			cf.PeerPublicKey = config.AeadPublicKey
+			if config.AeadCipher != "" {
+				cf.Cipher = config.AeadCipher
+			}
+			ac.SetConfig(cf)
+		}
+		w, ok := c.(conn.WrapConn)
+		if !ok {
+			break
+		}
+		c = w.Inner()
+	}
+}
+
+func loginProxyProto(f *LoginFrame) string {
+	if f.Proxyprotoname != "" {
+		return f.Proxyprotoname
 	}
+	return strings.ToLower(f.Proxyproto.String())
 }
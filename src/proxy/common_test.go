@@ -2,7 +2,13 @@ package proxy
 
 import (
 	"fmt"
+	"github.com/3t2ugg1e/go-engine/src/conn"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func Test0001(t *testing.T) {
@@ -26,3 +32,172 @@ func Test0001(t *testing.T) {
 	}
 	fmt.Println(string(ff.DataFrame.Data))
 }
+
+func testEcho(t *testing.T, proto string, addr string) conn.Conn {
+	c, _ := conn.NewConn(proto)
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			sonny, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer sonny.Close()
+				buf := make([]byte, 1000)
+				for {
+					n, err := sonny.Read(buf)
+					if err != nil {
+						return
+					}
+					sonny.Write(buf[0:n])
+				}
+			}()
+		}
+	}()
+	return cc
+}
+
+func testProxy(t *testing.T, proto string, clienttype string, server string, from string, to string) {
+	testProxyConfig(t, nil, proto, clienttype, server, from, to)
+}
+
+func testProxyConfig(t *testing.T, config *Config, proto string, clienttype string, server string, from string, to string) {
+	echo := testEcho(t, proto, to)
+	defer echo.Close()
+
+	s, err := NewServer(config, []string{proto}, []string{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cl, err := NewClient(config, proto, server, clienttype, clienttype, []string{proto}, []string{from}, []string{to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	c, _ := conn.NewConn(proto)
+	var cc conn.Conn
+	for i := 0; i < 50; i++ {
+		cc, err = c.Dial(from)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	for i := 0; i < 10; i++ {
+		src := clienttype + strconv.Itoa(i)
+		cc.Write([]byte(src))
+		cc.SetReadDeadline(time.Now().Add(time.Second * 5))
+		buf := make([]byte, 1000)
+		n, err := cc.Read(buf)
+		if err != nil || string(buf[0:n]) != src {
+			t.Fatal("echo fail", err)
+		}
+	}
+	fmt.Println(clienttype, "done", cc.Info())
+}
+
+func Test0002MemProxy(t *testing.T) {
+	t.Parallel()
+	testProxy(t, "mem", "proxy", "mem-server-0002", "mem-from-0002", "mem-to-0002")
+}
+
+func Test0003MemReverseProxy(t *testing.T) {
+	t.Parallel()
+	testProxy(t, "mem", "reverse_proxy", "mem-server-0003", "mem-from-0003", "mem-to-0003")
+}
+
+func Test0004UnixProxy(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "proxy")
+	defer os.RemoveAll(dir)
+	testProxy(t, "unix", "proxy", filepath.Join(dir, "server.sock"), filepath.Join(dir, "from.sock"), filepath.Join(dir, "to.sock"))
+}
+
+func Test0005MultiProxy(t *testing.T) {
+	t.Parallel()
+	testProxy(t, "multi", "proxy", "tcp://127.0.0.1:58095,rudp://127.0.0.1:58095", "tcp://127.0.0.1:58096", "tcp://127.0.0.1:58097")
+}
+
+func Test0006AeadProxy(t *testing.T) {
+	t.Parallel()
+	config := DefaultConfig()
+	config.EncryptMode = "aead"
+	testProxyConfig(t, config, "mem", "proxy", "mem-server-0006", "mem-from-0006", "mem-to-0006")
+}
+
+func Test0007KcpProxy(t *testing.T) {
+	t.Parallel()
+	config := DefaultConfig()
+	config.Kcp = conn.DefaultKcpConfig()
+	config.Kcp.NoDelay = 1
+	config.Kcp.Interval = 20
+	config.Kcp.DataShards = 10
+	config.Kcp.ParityShards = 3
+	config.Kcp.Crypt = "aes"
+	config.Kcp.Key = "kcp-key"
+	config.Kcp.SmuxVersion = 2
+	testProxyConfig(t, config, "kcp", "proxy", "127.0.0.1:58113", "127.0.0.1:58114", "127.0.0.1:58115")
+}
+
+func Test0008AutoProxy(t *testing.T) {
+	t.Parallel()
+	echo := testEcho(t, "tcp", "127.0.0.1:58128")
+	defer echo.Close()
+
+	s, err := NewServer(nil, []string{"tcp", "rudp"}, []string{"127.0.0.1:58126", "127.0.0.1:58126"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// nothing listens on 58129, the race goes on to the next proto
+	server := "tcp://127.0.0.1:58129,rudp://127.0.0.1:58126,tcp://127.0.0.1:58126"
+	cl, err := NewClient(nil, "auto", server, "proxy", "proxy", []string{"tcp"}, []string{"127.0.0.1:58127"}, []string{"127.0.0.1:58128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	_, err = NewClient(nil, "auto", "tcp://127.0.0.1:58126,nosuch://127.0.0.1:58126", "proxy", "proxy", []string{"tcp"}, []string{"127.0.0.1:58127"}, []string{"127.0.0.1:58128"})
+	if err == nil {
+		t.Error("auto should check protos")
+	}
+
+	c, _ := conn.NewConn("tcp")
+	var cc conn.Conn
+	for i := 0; i < 50; i++ {
+		cc, err = c.Dial("127.0.0.1:58127")
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	for i := 0; i < 10; i++ {
+		src := "auto" + strconv.Itoa(i)
+		cc.Write([]byte(src))
+		cc.SetReadDeadline(time.Now().Add(time.Second * 5))
+		buf := make([]byte, 1000)
+		n, err := cc.Read(buf)
+		if err != nil || string(buf[0:n]) != src {
+			t.Fatal("echo fail", err)
+		}
+	}
+	fmt.Println("auto done", cc.Info(), cl.serverconn[0].conn.Info())
+}
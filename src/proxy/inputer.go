@@ -141,7 +141,7 @@ func (i *Inputer) listen(targetAddr string) error {
 	loggo.Info("Inputer start listen %s %s", i.addr, targetAddr)
 
 	for !i.fwg.IsExit() {
-		conn, err := i.listenconn.Accept()
+		conn, err := i.listenconn.AcceptContext(i.fwg.Context())
 		if err != nil {
 			loggo.Info("Inputer listen Accept fail %s", err)
 			continue
@@ -170,7 +170,7 @@ func (i *Inputer) listenSocks5() error {
 	loggo.Info("Inputer start listenSocks5 %s", i.addr)
 
 	for !i.fwg.IsExit() {
-		conn, err := i.listenconn.Accept()
+		conn, err := i.listenconn.AcceptContext(i.fwg.Context())
 		if err != nil {
 			loggo.Info("Inputer listen Accept fail %s", err)
 			continue
@@ -209,7 +209,7 @@ func (i *Inputer) processSocks5Conn(proxyConn *ProxyConn) error {
 		atomic.AddInt32(&gStateThreadNum.ThreadNum, 1)
 		defer atomic.AddInt32(&gStateThreadNum.ThreadNum, -1)
 
-		if proxyConn.conn.Name() != "tcp" {
+		if proxyConn.conn.Name() != "tcp" && proxyConn.conn.Name() != "unix" {
 			loggo.Error("processSocks5Conn no tcp %s %s", proxyConn.conn.Info(), proxyConn.conn.Name())
 			return errors.New("socks5 not tcp")
 		}
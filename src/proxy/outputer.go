@@ -126,7 +126,7 @@ func (o *Outputer) open(proxyconn *ProxyConn, targetAddr string) bool {
 	wg.Go("Outputer Dial"+" "+targetAddr, func() error {
 		atomic.AddInt32(&gStateThreadNum.ThreadNum, 1)
 		defer atomic.AddInt32(&gStateThreadNum.ThreadNum, -1)
-		cc, err := c.Dial(targetAddr)
+		cc, err := c.DialContext(wg.Context(), targetAddr)
 		if err != nil {
 			return err
 		}
@@ -143,6 +143,7 @@ type LoginFrame struct {
 	Toaddr               string      `protobuf:"bytes,4,opt,name=toaddr,proto3" json:"toaddr,omitempty"`
 	Name                 string      `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"`
 	Key                  string      `protobuf:"bytes,6,opt,name=key,proto3" json:"key,omitempty"`
+	Proxyprotoname       string      `protobuf:"bytes,7,opt,name=proxyprotoname,proto3" json:"proxyprotoname,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
 	XXX_unrecognized     []byte      `json:"-"`
 	XXX_sizecache        int32       `json:"-"`
@@ -215,6 +216,13 @@ func (m *LoginFrame) GetKey() string {
 	return ""
 }
 
+func (m *LoginFrame) GetProxyprotoname() string {
+	if m != nil {
+		return m.Proxyprotoname
+	}
+	return ""
+}
+
 type LoginRspFrame struct {
 	Ret                  bool     `protobuf:"varint,1,opt,name=ret,proto3" json:"ret,omitempty"`
 	Msg                  string   `protobuf:"bytes,2,opt,name=msg,proto3" json:"msg,omitempty"`
@@ -673,45 +681,46 @@ func init() {
 func init() { proto.RegisterFile("proxy.proto", fileDescriptor_700b50b08ed8dbaf) }
 
 var fileDescriptor_700b50b08ed8dbaf = []byte{
-	// 634 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0x9b, 0x40,
-	0x10, 0x8d, 0x01, 0x7f, 0x30, 0xd8, 0xd6, 0x66, 0x55, 0x55, 0x56, 0x54, 0x29, 0x91, 0x4f, 0x51,
-	0x1a, 0x71, 0x70, 0x1a, 0xf5, 0xd4, 0x43, 0x4a, 0x48, 0x64, 0xc5, 0x31, 0x68, 0x70, 0xab, 0xa6,
-	0x97, 0x88, 0xc2, 0x36, 0x42, 0xb5, 0x01, 0x61, 0x0e, 0xf1, 0xbf, 0xe9, 0x6f, 0xe9, 0x2f, 0xab,
-	0x76, 0xf8, 0x74, 0x1a, 0xf5, 0xf6, 0x76, 0xdf, 0x9b, 0xdd, 0x79, 0xb3, 0x0f, 0xc0, 0x48, 0xb3,
-	0xe4, 0x79, 0x67, 0xa6, 0x59, 0x92, 0x27, 0xd3, 0x3f, 0x1d, 0x80, 0x45, 0xf2, 0x14, 0xc5, 0x37,
-	0x99, 0xbf, 0x11, 0xfc, 0x1c, 0x80, 0x58, 0x22, 0x27, 0x9d, 0x93, 0xce, 0xe9, 0x78, 0x36, 0x34,
-	0x5d, 0x74, 0xbe, 0x3d, 0x3c, 0xba, 0xe8, 0xac, 0x1c, 0x6c, 0xf1, 0x52, 0x1d, 0xac, 0x23, 0x11,
-	0xe7, 0xf9, 0x2e, 0x15, 0x13, 0xa5, 0x54, 0x5b, 0x8b, 0xb9, 0xbd, 0x5c, 0x3d, 0xae, 0x1e, 0x5c,
-	0x1b, 0x5b, 0x3c, 0x3f, 0x82, 0xc1, 0xcf, 0x2c, 0xd9, 0xf8, 0x61, 0x98, 0x4d, 0xd4, 0x93, 0xce,
-	0xa9, 0x8e, 0xf5, 0x9a, 0xbf, 0x85, 0x5e, 0x9e, 0x10, 0xa3, 0x11, 0x53, 0xae, 0x38, 0x07, 0x2d,
-	0xf6, 0x37, 0x62, 0xd2, 0xa5, 0x5d, 0xc2, 0x9c, 0x81, 0xfa, 0x4b, 0xec, 0x26, 0x3d, 0xda, 0x92,
-	0x70, 0x7a, 0x01, 0x23, 0xf2, 0x80, 0xdb, 0xb4, 0xb0, 0xc1, 0x40, 0xcd, 0x44, 0x4e, 0xfd, 0x0f,
-	0x50, 0x42, 0xb9, 0xb3, 0xd9, 0x3e, 0x51, 0x8f, 0x3a, 0x4a, 0x38, 0x3d, 0x06, 0xdd, 0x8d, 0xe2,
-	0xa7, 0xa2, 0x80, 0x83, 0x96, 0x47, 0x1b, 0x41, 0x15, 0x2a, 0x12, 0x26, 0x41, 0xf2, 0x3f, 0xc1,
-	0x47, 0x18, 0x39, 0xa9, 0x88, 0xad, 0x24, 0x2e, 0xa7, 0x37, 0x06, 0x25, 0x0a, 0x49, 0xa2, 0xa3,
-	0x12, 0x85, 0x2d, 0x57, 0x4a, 0xdb, 0xd5, 0xf4, 0x06, 0x58, 0x55, 0x58, 0xb7, 0xfc, 0xb2, 0xb6,
-	0xb4, 0xa0, 0xfc, 0x63, 0x41, 0x6d, 0x2c, 0xbc, 0x03, 0xb0, 0xd6, 0xc9, 0x56, 0xbc, 0x7a, 0xc2,
-	0x74, 0x0b, 0xfa, 0xb5, 0x9f, 0xfb, 0xaf, 0x1f, 0x7f, 0x04, 0x83, 0x20, 0xd9, 0xa4, 0x99, 0xd8,
-	0x6e, 0xcb, 0x3b, 0xea, 0xb5, 0xbc, 0x28, 0xc8, 0x82, 0xea, 0xa2, 0x20, 0x0b, 0xa4, 0xfb, 0xd0,
-	0xcf, 0x7d, 0x7a, 0x9c, 0x21, 0x12, 0xe6, 0x6f, 0xa0, 0x1b, 0xc5, 0xa1, 0x78, 0xa6, 0xb7, 0xe9,
-	0x62, 0xb1, 0x98, 0xfe, 0x56, 0x01, 0x5c, 0x99, 0x90, 0xe2, 0xda, 0x63, 0xd0, 0x28, 0x1b, 0x45,
-	0x92, 0x0c, 0xf3, 0x06, 0xaf, 0xee, 0xed, 0x22, 0x1a, 0x44, 0xf0, 0xf7, 0x00, 0xeb, 0x3a, 0x7e,
-	0xd4, 0x89, 0x31, 0x33, 0xcc, 0x26, 0x91, 0xd8, 0xa2, 0xf9, 0x07, 0x18, 0xad, 0xdb, 0xef, 0x4c,
-	0x2d, 0x1a, 0xb3, 0xb1, 0xb9, 0xf7, 0xfa, 0xb8, 0x2f, 0xe2, 0xa7, 0xa0, 0x87, 0xd5, 0x1c, 0xc8,
-	0x81, 0x31, 0x03, 0xb3, 0x9e, 0x0c, 0x36, 0xa4, 0x54, 0xa6, 0x55, 0x24, 0xc8, 0x96, 0x54, 0xd6,
-	0x21, 0xc1, 0x86, 0x24, 0x65, 0x95, 0x0d, 0x4a, 0x22, 0x29, 0x93, 0x46, 0x59, 0x07, 0xe7, 0x1c,
-	0xf4, 0x24, 0x15, 0xa5, 0xbf, 0x7e, 0xd9, 0xef, 0x5e, 0x6c, 0xb0, 0x11, 0xf0, 0x4b, 0x18, 0xca,
-	0x45, 0x6d, 0x70, 0x40, 0x05, 0x87, 0xe6, 0xcb, 0xb8, 0xe0, 0x9e, 0x4c, 0x4e, 0x31, 0xa8, 0x83,
-	0x30, 0xd1, 0xcb, 0x29, 0x36, 0xd9, 0xc0, 0x16, 0x7d, 0xf6, 0x09, 0x8c, 0xd6, 0x07, 0xcd, 0xfb,
-	0xa0, 0xae, 0x2c, 0x97, 0x1d, 0x48, 0xf0, 0xe5, 0xda, 0x65, 0x1d, 0x3e, 0x00, 0x0d, 0x25, 0x52,
-	0xb8, 0x0e, 0x5d, 0x9c, 0x5b, 0xf7, 0x2e, 0x53, 0x25, 0x7b, 0x67, 0xb9, 0x4c, 0x3b, 0x7b, 0x00,
-	0xa3, 0xf5, 0x85, 0x4b, 0x09, 0x9d, 0xc6, 0x0e, 0xf8, 0x21, 0x8c, 0xd0, 0xfe, 0x6a, 0xa3, 0x67,
-	0x3f, 0x16, 0x5b, 0x1d, 0x0e, 0xd0, 0xf3, 0x1c, 0xeb, 0xce, 0xbb, 0x64, 0x0a, 0xe7, 0x30, 0xae,
-	0xe8, 0x72, 0x4f, 0xe5, 0x43, 0x18, 0x78, 0x5e, 0xa9, 0xd6, 0xce, 0x04, 0x40, 0x13, 0x10, 0x79,
-	0xf2, 0xc2, 0xb9, 0x9d, 0x2f, 0xd9, 0x81, 0x94, 0x11, 0x44, 0xaf, 0xec, 0xef, 0xfa, 0x6a, 0x75,
-	0xc5, 0x14, 0x89, 0xdc, 0xf9, 0xf2, 0x96, 0xa9, 0x84, 0x9c, 0xe5, 0x2d, 0xd3, 0x24, 0x72, 0x5c,
-	0x7b, 0xc9, 0xba, 0xdc, 0x80, 0xbe, 0x44, 0xb2, 0xa8, 0x27, 0x4f, 0xb3, 0x16, 0x8e, 0x67, 0xb3,
-	0xfe, 0xe7, 0xfe, 0xf7, 0x2e, 0xfd, 0xc4, 0x7e, 0xf4, 0xe8, 0x37, 0x76, 0xf1, 0x37, 0x00, 0x00,
-	0xff, 0xff, 0xd7, 0x9c, 0x13, 0xae, 0x12, 0x05, 0x00, 0x00,
+	// 644 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0xcd, 0x6e, 0x9b, 0x4c,
+	0x14, 0x8d, 0xf9, 0xb1, 0xcd, 0xc5, 0xb6, 0x26, 0xa3, 0x4f, 0x9f, 0x50, 0x54, 0x29, 0x91, 0x17,
+	0x55, 0x94, 0x46, 0x2c, 0x9c, 0x46, 0x5d, 0x75, 0x91, 0x12, 0x12, 0x59, 0x71, 0x0c, 0xba, 0xb8,
+	0x55, 0xd3, 0x4d, 0x44, 0x81, 0x46, 0xa8, 0x36, 0x20, 0xcc, 0x22, 0x79, 0x9b, 0x3e, 0x5f, 0x9f,
+	0xa2, 0x9a, 0xcb, 0xaf, 0xdd, 0xa8, 0xbb, 0x33, 0xf7, 0x9c, 0x3b, 0x73, 0xcf, 0xcc, 0x01, 0xd0,
+	0xb3, 0x3c, 0x7d, 0x7e, 0x31, 0xb3, 0x3c, 0x2d, 0xd2, 0xe9, 0xef, 0x1e, 0xc0, 0x22, 0x7d, 0x8a,
+	0x93, 0x9b, 0xdc, 0xdf, 0x44, 0xfc, 0x1c, 0x80, 0x58, 0x22, 0x8d, 0xde, 0x49, 0xef, 0x74, 0x32,
+	0x1b, 0x99, 0x2e, 0x3a, 0x5f, 0x1f, 0x1e, 0x5d, 0x74, 0x56, 0x0e, 0x76, 0x78, 0xa1, 0x0e, 0xd6,
+	0x71, 0x94, 0x14, 0xc5, 0x4b, 0x16, 0x19, 0x52, 0xa5, 0xb6, 0x16, 0x73, 0x7b, 0xb9, 0x7a, 0x5c,
+	0x3d, 0xb8, 0x36, 0x76, 0x78, 0x7e, 0x04, 0xc3, 0x1f, 0x79, 0xba, 0xf1, 0xc3, 0x30, 0x37, 0xe4,
+	0x93, 0xde, 0xa9, 0x86, 0xcd, 0x9a, 0xff, 0x0f, 0xfd, 0x22, 0x25, 0x46, 0x21, 0xa6, 0x5a, 0x71,
+	0x0e, 0x4a, 0xe2, 0x6f, 0x22, 0x43, 0xa5, 0x2a, 0x61, 0xce, 0x40, 0xfe, 0x19, 0xbd, 0x18, 0x7d,
+	0x2a, 0x09, 0xc8, 0xdf, 0xc2, 0xa4, 0x9d, 0x8a, 0xf4, 0x03, 0x22, 0xf7, 0xaa, 0xd3, 0x0b, 0x18,
+	0x93, 0x57, 0xdc, 0x66, 0xa5, 0x5d, 0x06, 0x72, 0x1e, 0x15, 0xe4, 0x73, 0x88, 0x02, 0x8a, 0xca,
+	0x66, 0xfb, 0x44, 0x5e, 0x34, 0x14, 0x70, 0x7a, 0x0c, 0x9a, 0x1b, 0x27, 0x4f, 0x65, 0x03, 0x07,
+	0xa5, 0x88, 0x37, 0x11, 0x75, 0xc8, 0x48, 0x98, 0x04, 0xe9, 0xbf, 0x04, 0x1f, 0x60, 0xec, 0x64,
+	0x51, 0x62, 0xa5, 0x49, 0x75, 0xcb, 0x13, 0x90, 0xe2, 0x90, 0x24, 0x1a, 0x4a, 0x71, 0xd8, 0x71,
+	0x2f, 0x75, 0xdd, 0x4f, 0x6f, 0x80, 0xd5, 0x8d, 0xcd, 0xc8, 0xfb, 0xbd, 0x95, 0x05, 0xe9, 0x2f,
+	0x0b, 0x72, 0x6b, 0xe1, 0x0d, 0x80, 0xb5, 0x4e, 0xb7, 0xd1, 0xab, 0x3b, 0x4c, 0xb7, 0xa0, 0x5d,
+	0xfb, 0x85, 0xff, 0xfa, 0xf6, 0x47, 0x30, 0x0c, 0xd2, 0x4d, 0x96, 0x47, 0xdb, 0x6d, 0x75, 0x46,
+	0xb3, 0x16, 0x07, 0x05, 0x79, 0x50, 0x1f, 0x14, 0xe4, 0x81, 0x70, 0x1f, 0xfa, 0x85, 0x4f, 0x8f,
+	0x38, 0x42, 0xc2, 0xfc, 0x3f, 0x50, 0xe3, 0x24, 0x8c, 0x9e, 0xe9, 0x0d, 0x55, 0x2c, 0x17, 0xd3,
+	0x5f, 0x32, 0x80, 0x2b, 0x5e, 0xa7, 0x3c, 0xf6, 0x18, 0x14, 0xca, 0x50, 0x99, 0x38, 0xdd, 0xbc,
+	0xc1, 0xab, 0x7b, 0xbb, 0x8c, 0x10, 0x11, 0xfc, 0x1d, 0xc0, 0xba, 0x89, 0x29, 0x4d, 0xa2, 0xcf,
+	0x74, 0xb3, 0x4d, 0x2e, 0x76, 0x68, 0xfe, 0x1e, 0xc6, 0xeb, 0xee, 0x3b, 0xd3, 0x88, 0xfa, 0x6c,
+	0x62, 0xee, 0xbc, 0x3e, 0xee, 0x8a, 0xf8, 0x29, 0x68, 0x61, 0x7d, 0x0f, 0xe4, 0x40, 0x9f, 0x81,
+	0xd9, 0xdc, 0x0c, 0xb6, 0xa4, 0x50, 0x66, 0x75, 0x24, 0x0c, 0xb5, 0x52, 0x36, 0x21, 0xc1, 0x96,
+	0x24, 0x65, 0x9d, 0x0d, 0xa3, 0x5f, 0x2b, 0xd3, 0x56, 0x59, 0x43, 0x7e, 0x0e, 0x5a, 0x9a, 0x45,
+	0x95, 0xbf, 0x41, 0x35, 0xef, 0x4e, 0x6c, 0xb0, 0x15, 0xf0, 0x4b, 0x18, 0x89, 0x45, 0x63, 0x70,
+	0x48, 0x0d, 0x87, 0xe6, 0x7e, 0x5c, 0x70, 0x47, 0x26, 0x6e, 0x31, 0x68, 0x82, 0x60, 0x68, 0xd5,
+	0x2d, 0xb6, 0xd9, 0xc0, 0x0e, 0x7d, 0xf6, 0x11, 0xf4, 0xce, 0x87, 0xcf, 0x07, 0x20, 0xaf, 0x2c,
+	0x97, 0x1d, 0x08, 0xf0, 0xf9, 0xda, 0x65, 0x3d, 0x3e, 0x04, 0x05, 0x05, 0x92, 0xb8, 0x06, 0x2a,
+	0xce, 0xad, 0x7b, 0x97, 0xc9, 0x82, 0xbd, 0xb3, 0x5c, 0xa6, 0x9c, 0x3d, 0x80, 0xde, 0xf9, 0x13,
+	0x08, 0x09, 0xed, 0xc6, 0x0e, 0xf8, 0x21, 0x8c, 0xd1, 0xfe, 0x62, 0xa3, 0x67, 0x3f, 0x96, 0xa5,
+	0x1e, 0x07, 0xe8, 0x7b, 0x8e, 0x75, 0xe7, 0x5d, 0x32, 0x89, 0x73, 0x98, 0xd4, 0x74, 0x55, 0x93,
+	0xf9, 0x08, 0x86, 0x9e, 0x57, 0xa9, 0x95, 0xb3, 0x08, 0xa0, 0x0d, 0x88, 0xd8, 0x79, 0xe1, 0xdc,
+	0xce, 0x97, 0xec, 0x40, 0xc8, 0x08, 0xa2, 0x57, 0xcd, 0x77, 0x7d, 0xb5, 0xba, 0x62, 0x92, 0x40,
+	0xee, 0x7c, 0x79, 0xcb, 0x64, 0x42, 0xce, 0xf2, 0x96, 0x29, 0x02, 0x39, 0xae, 0xbd, 0x64, 0x2a,
+	0xd7, 0x61, 0x20, 0x90, 0x68, 0xea, 0x8b, 0xdd, 0xac, 0x85, 0xe3, 0xd9, 0x6c, 0xf0, 0x69, 0xf0,
+	0x4d, 0xa5, 0x1f, 0xc8, 0xf7, 0x3e, 0xfd, 0x42, 0x2e, 0xfe, 0x0c, 0x00, 0xf6, 0x28, 0xee, 0x63,
+	0x3a, 0x05, 0x00, 0x00,
 }
@@ -14,7 +14,7 @@ import (
 type ClientConn struct {
 	ProxyConn
 
-	proxyproto PROXY_PROTO
+	proxyproto string
 	clienttype CLIENT_TYPE
 	fromaddr   string
 	toaddr     string
@@ -41,12 +41,12 @@ func NewServer(config *Config, proto []string, listenaddrs []string) (*Server, e
 	var listenConns []conn.Conn
 
 	for i, _ := range proto {
-		conn, err := conn.NewConn(proto[i])
+		conn, err := conn.NewConn(mainProto(proto[i], config))
 		if conn == nil {
 			return nil, err
 		}
 
-		setCongestion(conn, config)
+		setServerConn(conn, config)
 
 		listenConn, err := conn.Listen(listenaddrs[i])
 		if err != nil {
@@ -95,7 +95,7 @@ func (s *Server) Close() {
 func (s *Server) listen(index int) error {
 	loggo.Info("listen start %d %s", index, s.listenaddrs[index])
 	for !s.wg.IsExit() {
-		conn, err := s.listenConns[index].Accept()
+		conn, err := s.listenConns[index].AcceptContext(s.wg.Context())
 		if err != nil {
 			loggo.Info("Server listen Accept fail %s", err)
 			continue
@@ -159,13 +159,13 @@ func (s *Server) serveClient(clientconn *ClientConn) error {
 	wg.Go("Server recvFrom"+" "+clientconn.conn.Info(), func() error {
 		atomic.AddInt32(&gStateThreadNum.ThreadNum, 1)
 		defer atomic.AddInt32(&gStateThreadNum.ThreadNum, -1)
-		return recvFrom(wg, recvch, clientconn.conn, s.config.MaxMsgSize, s.config.Encrypt)
+		return recvFrom(wg, recvch, clientconn.conn, s.config.MaxMsgSize, mainEncrypt(s.config))
 	})
 
 	wg.Go("Server sendTo"+" "+clientconn.conn.Info(), func() error {
 		atomic.AddInt32(&gStateThreadNum.ThreadNum, 1)
 		defer atomic.AddInt32(&gStateThreadNum.ThreadNum, -1)
-		return sendTo(wg, sendch, clientconn.conn, s.config.Compress, s.config.MaxMsgSize, s.config.Encrypt, &pingflag, &pongflag, &pongtime)
+		return sendTo(wg, sendch, clientconn.conn, s.config.Compress, s.config.MaxMsgSize, mainEncrypt(s.config), &pingflag, &pongflag, &pongtime)
 	})
 
 	wg.Go("Server checkPingActive"+" "+clientconn.conn.Info(), func() error {
@@ -236,7 +236,7 @@ func (s *Server) process(wg *group.Group, sendch *common.Channel, recvch *common
 func (s *Server) processLogin(wg *group.Group, f *ProxyFrame, sendch *common.Channel, clientconn *ClientConn) {
 	loggo.Info("processLogin from %s %s", clientconn.conn.Info(), f.LoginFrame.String())
 
-	clientconn.proxyproto = f.LoginFrame.Proxyproto
+	clientconn.proxyproto = loginProxyProto(f.LoginFrame)
 	clientconn.clienttype = f.LoginFrame.Clienttype
 	clientconn.fromaddr = f.LoginFrame.Fromaddr
 	clientconn.toaddr = f.LoginFrame.Toaddr
@@ -293,31 +293,31 @@ func (s *Server) processLogin(wg *group.Group, f *ProxyFrame, sendch *common.Cha
 func (s *Server) iniService(wg *group.Group, f *ProxyFrame, clientConn *ClientConn) error {
 	switch f.LoginFrame.Clienttype {
 	case CLIENT_TYPE_PROXY:
-		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		output, err := NewOutputer(wg, clientConn.proxyproto, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		clientConn.output = output
 	case CLIENT_TYPE_REVERSE_PROXY:
-		input, err := NewInputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn, clientConn.toaddr)
+		input, err := NewInputer(wg, clientConn.proxyproto, f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn, clientConn.toaddr)
 		if err != nil {
 			return err
 		}
 		clientConn.input = input
 	case CLIENT_TYPE_SOCKS5:
-		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		output, err := NewOutputer(wg, clientConn.proxyproto, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		clientConn.output = output
 	case CLIENT_TYPE_REVERSE_SOCKS5:
-		input, err := NewSocks5Inputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		input, err := NewSocks5Inputer(wg, clientConn.proxyproto, f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		clientConn.input = input
 	case CLIENT_TYPE_SS_PROXY:
-		output, err := NewSSOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		output, err := NewSSOutputer(wg, clientConn.proxyproto, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
@@ -144,6 +144,37 @@ func (b *RBuffergo) Read(data []byte) bool {
 		defer b.lock.Unlock()
 	}
 
+	if !b.peek(data) {
+		return false
+	}
+
+	b.datasize -= len(data)
+	b.begin += len(data)
+	if b.begin >= len(b.buffer) {
+		b.begin -= len(b.buffer)
+	}
+
+	if b.lock == nil {
+		if b.datasize == 0 {
+			b.begin = 0
+			b.end = 0
+		}
+	}
+
+	return true
+}
+
+// Peek copies the data like Read but leaves it in the buffer, SkipRead drops it later
+func (b *RBuffergo) Peek(data []byte) bool {
+	if b.lock != nil {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+	}
+
+	return b.peek(data)
+}
+
+func (b *RBuffergo) peek(data []byte) bool {
 	if !(b.datasize >= len(data)) {
 		return false
 	}
@@ -161,19 +192,6 @@ func (b *RBuffergo) Read(data []byte) bool {
 		copy(data, b.buffer[b.begin:])
 	}
 
-	b.datasize -= len(data)
-	b.begin += len(data)
-	if b.begin >= len(b.buffer) {
-		b.begin -= len(b.buffer)
-	}
-
-	if b.lock == nil {
-		if b.datasize == 0 {
-			b.begin = 0
-			b.end = 0
-		}
-	}
-
 	return true
 }
 
@@ -46,3 +46,19 @@ func TestRBuffer_Write(t *testing.T) {
 	rb.Read(tmp1[0:])
 	t.Log(tmp1)
 }
+
+func TestRBuffer_Peek(t *testing.T) {
+	rb := New(5, true)
+	rb.Write([]byte{1, 2, 3})
+	var tmp [2]byte
+	rb.Read(tmp[0:])
+	rb.Write([]byte{4, 5, 6})
+	var tmp1 [4]byte
+	if !rb.Peek(tmp1[0:]) || tmp1 != [4]byte{3, 4, 5, 6} || rb.Size() != 4 {
+		t.Error(tmp1, rb.Size())
+	}
+	rb.SkipRead(2)
+	if !rb.Read(tmp[0:]) || tmp != [2]byte{5, 6} || rb.Peek(tmp[0:]) {
+		t.Error(tmp)
+	}
+}